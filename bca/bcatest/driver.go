@@ -0,0 +1,472 @@
+package bcatest
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rotisserie/eris"
+	biConfig "github.com/voxtmault/bank-integration/config"
+	biModels "github.com/voxtmault/bank-integration/models"
+	biUtil "github.com/voxtmault/bank-integration/utils"
+)
+
+// Driver plays BCA against our bank-facing callback endpoints: it requests an access token with an asymmetric
+// signature, then sends signed bill presentment and payment flag requests, the way BCA does during the UAT.
+//
+//	driver := bcatest.NewDriver(server.URL, bCfg, bcaKey) // bcaKey matches the PUBLIC_KEY_PATH of bCfg
+//	report := driver.RunUAT(ctx, fixtures)
+//	fmt.Print(report)
+type Driver struct {
+	// URL is the base url our callback endpoints are served on
+	URL    string
+	Client *http.Client
+
+	endpoints    biConfig.RequestedEndpoints
+	clientID     string // Client id we have given to BCA, sent as X-CLIENT-KEY
+	clientSecret string // Client secret we have given to BCA, key of the symmetric signatures
+	partnerID    string // X-PARTNER-ID
+	channelID    string // CHANNEL-ID
+	key          *rsa.PrivateKey
+
+	token           string
+	sequence        uint
+	lastPaymentFlag *http.Request // Last payment flag sent, see ResendPaymentFlag
+	lastBody        []byte
+
+	sync.Mutex
+}
+
+// NewDriver creates a driver of the callback endpoints configured in bCfg, served on url. bcaKey is the private key
+// of BCA, its public key being the one we verify the access token requests with.
+func NewDriver(url string, bCfg *biConfig.BankConfig, bcaKey *rsa.PrivateKey) *Driver {
+	return &Driver{
+		URL:          strings.TrimSuffix(url, "/"),
+		Client:       &http.Client{Timeout: 30 * time.Second},
+		endpoints:    bCfg.RequestedEndpoints,
+		clientID:     bCfg.BankRequestedCredentials.ClientID,
+		clientSecret: bCfg.BankRequestedCredentials.ClientSecret,
+		partnerID:    bCfg.BankCredential.PartnerID,
+		channelID:    bCfg.BankChannelConfig.VAChannelId,
+		key:          bcaKey,
+	}
+}
+
+// call overrides the headers of a signed request, to send the requests BCA expects us to reject
+type call struct {
+	externalID string // X-EXTERNAL-ID, a new one when empty
+	secret     string // Key of the symmetric signature, the client secret when empty
+}
+
+// AccessToken requests an access token, it is used by the following requests of the driver once granted
+func (d *Driver) AccessToken(ctx context.Context) (*biModels.AccessTokenResponse, error) {
+	timeStamp := time.Now().Format(time.RFC3339)
+
+	hashed := sha256.Sum256([]byte(d.clientID + "|" + timeStamp))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, d.key, crypto.SHA256, hashed[:])
+	if err != nil {
+		return nil, eris.Wrap(err, "signing access token request")
+	}
+
+	body, err := json.Marshal(biModels.GrantType{GrantType: "client_credentials"})
+	if err != nil {
+		return nil, eris.Wrap(err, "marshalling request body")
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL+d.endpoints.AuthURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, eris.Wrap(err, "creating request")
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-TIMESTAMP", timeStamp)
+	request.Header.Set("X-CLIENT-KEY", d.clientID)
+	request.Header.Set("X-SIGNATURE", base64.StdEncoding.EncodeToString(signature))
+
+	response := biModels.AccessTokenResponse{BCAResponse: &biModels.BCAResponse{}}
+	if err := d.do(request, &response, response.BCAResponse); err != nil {
+		return nil, err
+	}
+
+	if response.AccessToken != "" {
+		d.Lock()
+		d.token = response.AccessToken
+		d.Unlock()
+	}
+
+	return &response, nil
+}
+
+// BillPresentment sends a bill presentment (VA inquiry) request
+func (d *Driver) BillPresentment(ctx context.Context, payload *biModels.BCAVARequestPayload) (*biModels.VAResponsePayload, error) {
+	return d.billPresentment(ctx, payload, call{})
+}
+
+// PaymentFlag sends a payment flag request
+func (d *Driver) PaymentFlag(ctx context.Context, payload *biModels.BCAInquiryRequest) (*biModels.BCAInquiryVAResponse, error) {
+	return d.paymentFlag(ctx, payload, call{})
+}
+
+// ResendPaymentFlag sends the last payment flag again as is, with its X-EXTERNAL-ID, X-TIMESTAMP and X-SIGNATURE,
+// the way a retry of BCA reaches us when our answer did not reach them
+func (d *Driver) ResendPaymentFlag(ctx context.Context) (*biModels.BCAInquiryVAResponse, error) {
+	d.Lock()
+	last, body := d.lastPaymentFlag, d.lastBody
+	d.Unlock()
+	if last == nil {
+		return nil, eris.New("no payment flag sent")
+	}
+
+	request := last.Clone(ctx)
+	request.Body = io.NopCloser(bytes.NewReader(body))
+
+	var response biModels.BCAInquiryVAResponse
+	if err := d.do(request, &response, &response.BCAResponse); err != nil {
+		return nil, eris.Wrap(err, "resending payment flag")
+	}
+
+	return &response, nil
+}
+
+func (d *Driver) billPresentment(ctx context.Context, payload *biModels.BCAVARequestPayload, c call) (*biModels.VAResponsePayload, error) {
+	var response biModels.VAResponsePayload
+	if err := d.send(ctx, d.endpoints.BillPresentmentURL, payload, c, &response, &response.BCAResponse); err != nil {
+		return nil, eris.Wrap(err, "sending bill presentment")
+	}
+
+	return &response, nil
+}
+
+func (d *Driver) paymentFlag(ctx context.Context, payload *biModels.BCAInquiryRequest, c call) (*biModels.BCAInquiryVAResponse, error) {
+	var response biModels.BCAInquiryVAResponse
+	if err := d.send(ctx, d.endpoints.PaymentFlagURL, payload, c, &response, &response.BCAResponse); err != nil {
+		return nil, eris.Wrap(err, "sending payment flag")
+	}
+
+	return &response, nil
+}
+
+// send posts a request signed with the access token of the driver to path
+func (d *Driver) send(ctx context.Context, path string, payload any, c call, response any, snap *biModels.BCAResponse) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return eris.Wrap(err, "marshalling request body")
+	}
+
+	d.Lock()
+	token := d.token
+	d.Unlock()
+
+	if c.externalID == "" {
+		c.externalID = d.ExternalID()
+	}
+	if c.secret == "" {
+		c.secret = d.clientSecret
+	}
+	timeStamp := time.Now().Format(time.RFC3339)
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL+path, bytes.NewReader(body))
+	if err != nil {
+		return eris.Wrap(err, "creating request")
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", "Bearer "+token)
+	request.Header.Set("X-TIMESTAMP", timeStamp)
+	request.Header.Set("X-SIGNATURE", symmetricSignature(c.secret, http.MethodPost, path, token, body, timeStamp))
+	request.Header.Set("X-PARTNER-ID", d.partnerID)
+	request.Header.Set("X-EXTERNAL-ID", c.externalID)
+	request.Header.Set("CHANNEL-ID", d.channelID)
+
+	if path == d.endpoints.PaymentFlagURL {
+		d.Lock()
+		d.lastPaymentFlag, d.lastBody = request.Clone(ctx), body
+		d.Unlock()
+	}
+
+	return d.do(request, response, snap)
+}
+
+// do sends request and decodes the answer into response, snap being the SNAP status embedded in response
+func (d *Driver) do(request *http.Request, response any, snap *biModels.BCAResponse) error {
+	resp, err := d.Client.Do(request)
+	if err != nil {
+		return eris.Wrap(err, "sending request")
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return eris.Wrap(err, "reading response body")
+	}
+
+	if err := json.Unmarshal(body, response); err != nil {
+		return eris.Wrapf(err, "decoding response body (http status %d)", resp.StatusCode)
+	}
+	snap.HTTPStatusCode = resp.StatusCode
+
+	return nil
+}
+
+// ExternalID returns a new X-EXTERNAL-ID, unique within the driver
+func (d *Driver) ExternalID() string {
+	d.Lock()
+	defer d.Unlock()
+
+	d.sequence++
+	return fmt.Sprintf("%d%04d", time.Now().UnixNano(), d.sequence%10000)
+}
+
+// RequestID returns a new inquiryRequestId, the paymentRequestId of the payment flag that follows the inquiry
+func (d *Driver) RequestID() string {
+	d.Lock()
+	defer d.Unlock()
+
+	d.sequence++
+	return fmt.Sprintf("%s%08d", time.Now().Format("20060102150405"), d.sequence)
+}
+
+// VA is a virtual account used by the UAT scenarios
+type VA struct {
+	PartnerServiceID string // Left padded with spaces to 8 characters, e.g. "   11111"
+	CustomerNo       string
+	Name             string
+	TotalAmount      biModels.Amount
+}
+
+// VirtualAccountNo returns the virtual account number, as sent by BCA
+func (v VA) VirtualAccountNo() string {
+	return v.PartnerServiceID + v.CustomerNo
+}
+
+// UATFixtures are the virtual accounts the UAT scenarios are run with, they must be in the state described on
+// our side. Payable and WrongAmount are closed VAs waiting for payment, Payable is paid by the run.
+type UATFixtures struct {
+	Payable     VA // Paid with its total amount
+	Expired     VA // Past its expiry date
+	NotFound    VA // Unknown to us
+	WrongAmount VA // Flagged with another amount than its total
+}
+
+// Scenario is a scenario of the BCA UAT list
+type Scenario string
+
+const (
+	ScenarioAccessToken         Scenario = "access token"
+	ScenarioPaid                Scenario = "paid"
+	ScenarioExpired             Scenario = "expired"
+	ScenarioNotFound            Scenario = "not found"
+	ScenarioWrongAmount         Scenario = "wrong amount"
+	ScenarioDuplicateExternalID Scenario = "duplicate external id"
+	ScenarioBadSignature        Scenario = "bad signature"
+)
+
+// Check is a request of a scenario and the answer expected by BCA
+type Check struct {
+	Scenario Scenario
+	Step     string
+	Expected string // Expected response code
+	Got      string // Received response code, empty when no answer could be decoded
+	Err      error  // Reason the answer is not conformant, besides its response code
+}
+
+// Passed reports whether the answer conforms to the UAT
+func (c Check) Passed() bool {
+	return c.Err == nil && c.Got == c.Expected
+}
+
+// Report is the outcome of a UAT run
+type Report struct {
+	Checks []Check
+}
+
+// Passed reports whether every check has passed
+func (r *Report) Passed() bool {
+	for _, check := range r.Checks {
+		if !check.Passed() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Failed returns the checks that have not passed
+func (r *Report) Failed() []Check {
+	var failed []Check
+	for _, check := range r.Checks {
+		if !check.Passed() {
+			failed = append(failed, check)
+		}
+	}
+
+	return failed
+}
+
+func (r *Report) String() string {
+	var sb strings.Builder
+	for _, check := range r.Checks {
+		status := "PASS"
+		if !check.Passed() {
+			status = "FAIL"
+		}
+		fmt.Fprintf(&sb, "%s  %-22s %-28s expected %s, got %s", status, check.Scenario, check.Step, check.Expected, check.Got)
+		if check.Err != nil {
+			fmt.Fprintf(&sb, " (%v)", check.Err)
+		}
+		sb.WriteString("\n")
+	}
+	fmt.Fprintf(&sb, "%d/%d checks passed\n", len(r.Checks)-len(r.Failed()), len(r.Checks))
+
+	return sb.String()
+}
+
+// RunUAT obtains an access token and runs the BCA UAT scenarios against our callback endpoints: a paid bill, an
+// expired bill, an unknown bill, a payment of the wrong amount, a duplicate X-EXTERNAL-ID and a bad signature. The
+// scenarios are run one after another, a failed check does not stop the run unless no access token is granted.
+func (d *Driver) RunUAT(ctx context.Context, fixtures UATFixtures) *Report {
+	report := &Report{}
+
+	token, err := d.AccessToken(ctx)
+	check := Check{Scenario: ScenarioAccessToken, Step: "access token", Expected: "2007300", Err: err}
+	if err == nil {
+		check.Got = token.ResponseCode
+		if token.AccessToken == "" && check.Got == check.Expected {
+			check.Err = eris.New("no access token granted")
+		}
+	}
+	report.Checks = append(report.Checks, check)
+	if !check.Passed() {
+		return report
+	}
+
+	// Paid: the bill is presented, flagged as paid and can no longer be presented
+	requestID := d.RequestID()
+	inquiry, err := d.billPresentment(ctx, inquiryPayload(fixtures.Payable, requestID), call{})
+	report.inquiry(ScenarioPaid, "bill presentment", "2002400", "00", inquiry, err)
+	payment, err := d.paymentFlag(ctx, paymentPayload(fixtures.Payable, requestID, fixtures.Payable.TotalAmount), call{})
+	report.payment(ScenarioPaid, "payment flag", "2002500", "00", payment, err)
+	inquiry, err = d.billPresentment(ctx, inquiryPayload(fixtures.Payable, d.RequestID()), call{})
+	report.inquiry(ScenarioPaid, "bill presentment once paid", "4042414", "01", inquiry, err)
+
+	// Expired
+	inquiry, err = d.billPresentment(ctx, inquiryPayload(fixtures.Expired, d.RequestID()), call{})
+	report.inquiry(ScenarioExpired, "bill presentment", "4042419", "01", inquiry, err)
+	payment, err = d.paymentFlag(ctx, paymentPayload(fixtures.Expired, d.RequestID(), fixtures.Expired.TotalAmount), call{})
+	report.payment(ScenarioExpired, "payment flag", "4042519", "01", payment, err)
+
+	// Not found
+	inquiry, err = d.billPresentment(ctx, inquiryPayload(fixtures.NotFound, d.RequestID()), call{})
+	report.inquiry(ScenarioNotFound, "bill presentment", "4042412", "01", inquiry, err)
+	payment, err = d.paymentFlag(ctx, paymentPayload(fixtures.NotFound, d.RequestID(), fixtures.NotFound.TotalAmount), call{})
+	report.payment(ScenarioNotFound, "payment flag", "4042512", "01", payment, err)
+
+	// Wrong amount: the bill is presented, then paid with more than its total
+	requestID = d.RequestID()
+	inquiry, err = d.billPresentment(ctx, inquiryPayload(fixtures.WrongAmount, requestID), call{})
+	report.inquiry(ScenarioWrongAmount, "bill presentment", "2002400", "00", inquiry, err)
+	wrongAmount, err := otherAmount(fixtures.WrongAmount.TotalAmount)
+	if err == nil {
+		payment, err = d.paymentFlag(ctx, paymentPayload(fixtures.WrongAmount, requestID, wrongAmount), call{})
+	}
+	report.payment(ScenarioWrongAmount, "payment flag", "4042513", "01", payment, err)
+
+	// Duplicate external id: another request sent with the X-EXTERNAL-ID of the previous one
+	externalID := d.ExternalID()
+	inquiry, err = d.billPresentment(ctx, inquiryPayload(fixtures.NotFound, d.RequestID()), call{externalID: externalID})
+	report.inquiry(ScenarioDuplicateExternalID, "bill presentment", "4042412", "01", inquiry, err)
+	inquiry, err = d.billPresentment(ctx, inquiryPayload(fixtures.NotFound, d.RequestID()), call{externalID: externalID})
+	report.inquiry(ScenarioDuplicateExternalID, "same X-EXTERNAL-ID", "4092400", "01", inquiry, err)
+
+	// Bad signature: signed with another client secret
+	badSecret := call{secret: "not-" + d.clientSecret}
+	inquiry, err = d.billPresentment(ctx, inquiryPayload(fixtures.NotFound, d.RequestID()), badSecret)
+	report.inquiry(ScenarioBadSignature, "bill presentment", "4012400", "", inquiry, err)
+	payment, err = d.paymentFlag(ctx, paymentPayload(fixtures.NotFound, d.RequestID(), fixtures.NotFound.TotalAmount), badSecret)
+	report.payment(ScenarioBadSignature, "payment flag", "4012500", "", payment, err)
+
+	return report
+}
+
+// inquiry records the check of a bill presentment answer, inquiryStatus is not checked when empty
+func (r *Report) inquiry(scenario Scenario, step, expected, inquiryStatus string, response *biModels.VAResponsePayload, err error) {
+	check := Check{Scenario: scenario, Step: step, Expected: expected, Err: err}
+	if err == nil {
+		check.Got = response.ResponseCode
+		if inquiryStatus != "" {
+			if response.VirtualAccountData == nil {
+				check.Err = eris.New("virtualAccountData is missing")
+			} else if response.VirtualAccountData.InquiryStatus != inquiryStatus {
+				check.Err = eris.Errorf("inquiryStatus %q, expected %q", response.VirtualAccountData.InquiryStatus, inquiryStatus)
+			}
+		}
+	}
+
+	r.Checks = append(r.Checks, check)
+}
+
+// payment records the check of a payment flag answer, paymentFlagStatus is not checked when empty
+func (r *Report) payment(scenario Scenario, step, expected, paymentFlagStatus string, response *biModels.BCAInquiryVAResponse, err error) {
+	check := Check{Scenario: scenario, Step: step, Expected: expected, Err: err}
+	if err == nil {
+		check.Got = response.ResponseCode
+		if paymentFlagStatus != "" {
+			if response.VirtualAccountData == nil {
+				check.Err = eris.New("virtualAccountData is missing")
+			} else if response.VirtualAccountData.PaymentFlagStatus != paymentFlagStatus {
+				check.Err = eris.Errorf("paymentFlagStatus %q, expected %q", response.VirtualAccountData.PaymentFlagStatus, paymentFlagStatus)
+			}
+		}
+	}
+
+	r.Checks = append(r.Checks, check)
+}
+
+func inquiryPayload(va VA, requestID string) *biModels.BCAVARequestPayload {
+	return &biModels.BCAVARequestPayload{
+		PartnerServiceID: va.PartnerServiceID,
+		CustomerNo:       va.CustomerNo,
+		VirtualAccountNo: va.VirtualAccountNo(),
+		TrxDateInit:      time.Now().Format(time.RFC3339),
+		ChannelCode:      6014,
+		InquiryRequestID: requestID,
+	}
+}
+
+func paymentPayload(va VA, requestID string, paid biModels.Amount) *biModels.BCAInquiryRequest {
+	return &biModels.BCAInquiryRequest{
+		PartnerServiceID:   va.PartnerServiceID,
+		CustomerNo:         va.CustomerNo,
+		VirtualAccountNo:   va.VirtualAccountNo(),
+		VirtualAccountName: va.Name,
+		PaymentRequestID:   requestID,
+		ChannelCode:        6014,
+		SourceBankCode:     "014",
+		PaidAmount:         paid,
+		TotalAmount:        va.TotalAmount,
+		TrxDateTime:        time.Now().Format(time.RFC3339),
+		ReferenceNo:        requestID[len(requestID)-11:],
+		FlagAdvise:         "N",
+		SubCompany:         "00000",
+		AdditionalInfo:     map[string]any{},
+	}
+}
+
+// otherAmount returns an amount different from total, it is not accepted as the payment of a closed VA
+func otherAmount(total biModels.Amount) (biModels.Amount, error) {
+	cents, err := biUtil.ParseAmount(total.Value)
+	if err != nil {
+		return biModels.Amount{}, eris.Wrap(err, "parsing total amount")
+	}
+
+	return biModels.Amount{Value: biUtil.FormatAmount(cents + 100), Currency: total.Currency}, nil
+}
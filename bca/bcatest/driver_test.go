@@ -0,0 +1,393 @@
+package bcatest_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/redis/go-redis/v9"
+	"github.com/voxtmault/bank-integration/bca/bcatest"
+	biConfig "github.com/voxtmault/bank-integration/config"
+	biHandler "github.com/voxtmault/bank-integration/handler"
+	biModels "github.com/voxtmault/bank-integration/models"
+	biUtil "github.com/voxtmault/bank-integration/utils"
+)
+
+var fixtures = bcatest.UATFixtures{
+	Payable:     bcatest.VA{PartnerServiceID: "   11111", CustomerNo: "0001", Name: "Budi", TotalAmount: biModels.Amount{Value: "15000.00", Currency: "IDR"}},
+	Expired:     bcatest.VA{PartnerServiceID: "   11111", CustomerNo: "0002", Name: "Sari", TotalAmount: biModels.Amount{Value: "20000.00", Currency: "IDR"}},
+	NotFound:    bcatest.VA{PartnerServiceID: "   11111", CustomerNo: "0003", Name: "Andi", TotalAmount: biModels.Amount{Value: "10000.00", Currency: "IDR"}},
+	WrongAmount: bcatest.VA{PartnerServiceID: "   11111", CustomerNo: "0004", Name: "Dewi", TotalAmount: biModels.Amount{Value: "25000.00", Currency: "IDR"}},
+}
+
+func TestRunUAT(t *testing.T) {
+	env := setup(t, biConfig.EgressConfig{})
+	ctx := context.Background()
+
+	// The client id we have given to BCA, registered on startup
+	if err := env.rdb.RDB.HSet(ctx, biUtil.ClientCredentialsRedis, env.bCfg.BankRequestedCredentials.ClientID,
+		env.bCfg.BankRequestedCredentials.ClientSecret).Err(); err != nil {
+		t.Fatalf("registering client: %v", err)
+	}
+
+	future := time.Now().Add(time.Hour).Format(time.DateTime)
+	past := time.Now().Add(-time.Hour).Format(time.DateTime)
+
+	// Paid
+	expectInquiry(env, fixtures.Payable, "0.00", future)
+	expectPayment(env, fixtures.Payable, future, true)
+	expectInquiry(env, fixtures.Payable, fixtures.Payable.TotalAmount.Value, future)
+	// Expired
+	expectInquiry(env, fixtures.Expired, "0.00", past)
+	env.sqlMock.ExpectQuery("SELECT paidAmountValue").
+		WillReturnRows(amountRows(fixtures.Expired, past))
+	// Not found
+	env.sqlMock.ExpectBegin()
+	env.sqlMock.ExpectQuery("FROM va_request").WillReturnRows(sqlmock.NewRows(nil))
+	env.sqlMock.ExpectRollback()
+	env.sqlMock.ExpectQuery("SELECT paidAmountValue").WillReturnRows(sqlmock.NewRows(nil))
+	// Wrong amount
+	expectInquiry(env, fixtures.WrongAmount, "0.00", future)
+	expectPayment(env, fixtures.WrongAmount, future, false)
+	// Duplicate external id, the second request is answered before reaching the database
+	env.sqlMock.ExpectBegin()
+	env.sqlMock.ExpectQuery("FROM va_request").WillReturnRows(sqlmock.NewRows(nil))
+	env.sqlMock.ExpectRollback()
+
+	server := httptest.NewServer(biHandler.New(env.service, &env.bCfg.RequestedEndpoints))
+	t.Cleanup(server.Close)
+
+	report := bcatest.NewDriver(server.URL, env.bCfg, env.bcaKey).RunUAT(ctx, fixtures)
+	if !report.Passed() {
+		t.Fatalf("expected every UAT check to pass:\n%s", report)
+	}
+	if got := len(report.Checks); got != 14 {
+		t.Fatalf("expected 14 checks, got %d:\n%s", got, report)
+	}
+	if err := env.sqlMock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet sql expectations: %v", err)
+	}
+}
+
+func TestRunUATNonConformant(t *testing.T) {
+	env := setup(t, biConfig.EgressConfig{})
+	ctx := context.Background()
+
+	// Grants a token and answers every bill presentment as payable, whatever the bill and the signature
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+env.bCfg.RequestedEndpoints.AuthURL, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"responseCode": "2007300", "accessToken": "token"})
+	})
+	mux.HandleFunc("POST "+env.bCfg.RequestedEndpoints.BillPresentmentURL, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"responseCode": "2002400", "virtualAccountData": map[string]string{"inquiryStatus": "00"}})
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	report := bcatest.NewDriver(server.URL, env.bCfg, env.bcaKey).RunUAT(ctx, fixtures)
+	if report.Passed() {
+		t.Fatalf("expected the UAT to fail:\n%s", report)
+	}
+
+	failed := make(map[bcatest.Scenario]int)
+	for _, check := range report.Failed() {
+		failed[check.Scenario]++
+	}
+	if failed[bcatest.ScenarioAccessToken] != 0 || failed[bcatest.ScenarioNotFound] != 2 || failed[bcatest.ScenarioBadSignature] != 2 {
+		t.Fatalf("unexpected failed checks:\n%s", report)
+	}
+}
+
+func TestPaymentFlagReplay(t *testing.T) {
+	env := setup(t, biConfig.EgressConfig{})
+	ctx := context.Background()
+	driver := startDriver(t, env)
+
+	future := time.Now().Add(time.Hour).Format(time.DateTime)
+	expectPayment(env, fixtures.Payable, future, true)
+	env.sqlMock.ExpectQuery("SELECT paidAmountValue").WillReturnRows(sqlmock.NewRows(nil))
+
+	paid := paymentFlag(fixtures.Payable, driver.RequestID(), fixtures.Payable.TotalAmount)
+	notFound := paymentFlag(fixtures.NotFound, driver.RequestID(), fixtures.NotFound.TotalAmount)
+
+	for _, test := range []struct {
+		name     string
+		payload  *biModels.BCAInquiryRequest
+		expected string
+		status   int
+	}{
+		{"paid", paid, "2002500", http.StatusOK},
+		{"not found", notFound, "4042512", http.StatusNotFound},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			first, err := driver.PaymentFlag(ctx, test.payload)
+			if err != nil {
+				t.Fatalf("sending payment flag: %v", err)
+			}
+			if first.ResponseCode != test.expected || first.HTTPStatusCode != test.status {
+				t.Fatalf("expected %s (%d), got %s (%d)", test.expected, test.status, first.ResponseCode, first.HTTPStatusCode)
+			}
+
+			// Resent by BCA when our answer did not reach them, answered without reaching the database
+			resent := *test.payload
+			resent.FlagAdvise = "Y"
+			replayed, err := driver.PaymentFlag(ctx, &resent)
+			if err != nil {
+				t.Fatalf("resending payment flag: %v", err)
+			}
+			if !reflect.DeepEqual(first, replayed) {
+				t.Fatalf("expected the first answer to be replayed\nfirst:    %+v\nreplayed: %+v", first, replayed)
+			}
+
+			key := fmt.Sprintf("%s:%d:%s", biUtil.PaymentFlagRedis, internalBankID, test.payload.PaymentRequestID)
+			if ttl := env.rdb.RDB.TTL(ctx, key).Val(); ttl <= 47*time.Hour {
+				t.Fatalf("expected the answer to be kept for 48 hours, got %v", ttl)
+			}
+		})
+	}
+
+	// Another payment flag sent with the paymentRequestId of the paid one
+	other := *paid
+	other.PaidAmount.Value = "16000.00"
+	inconsistent, err := driver.PaymentFlag(ctx, &other)
+	if err != nil {
+		t.Fatalf("sending payment flag: %v", err)
+	}
+	if inconsistent.ResponseCode != "4042518" {
+		t.Fatalf("expected 4042518, got %s", inconsistent.ResponseCode)
+	}
+
+	if err := env.sqlMock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet sql expectations: %v", err)
+	}
+}
+
+func TestPaymentFlagResentAsIs(t *testing.T) {
+	env := setup(t, biConfig.EgressConfig{})
+	ctx := context.Background()
+	driver := startDriver(t, env)
+
+	// Signatures are remembered for the clock skew accepted from the client
+	if err := env.rdb.RDB.HSet(ctx, biUtil.ClientTimestampSkewRedis, env.bCfg.BankRequestedCredentials.ClientID, 300).Err(); err != nil {
+		t.Fatalf("setting client timestamp skew: %v", err)
+	}
+
+	future := time.Now().Add(time.Hour).Format(time.DateTime)
+	expectPayment(env, fixtures.Payable, future, true)
+	payload := paymentFlag(fixtures.Payable, driver.RequestID(), fixtures.Payable.TotalAmount)
+
+	first, err := driver.PaymentFlag(ctx, payload)
+	if err != nil {
+		t.Fatalf("sending payment flag: %v", err)
+	}
+	if first.ResponseCode != "2002500" {
+		t.Fatalf("expected 2002500, got %s", first.ResponseCode)
+	}
+
+	// Its signature is already used, the first answer is replayed before the signature is rejected
+	replayed, err := driver.ResendPaymentFlag(ctx)
+	if err != nil {
+		t.Fatalf("resending payment flag: %v", err)
+	}
+	if !reflect.DeepEqual(first, replayed) {
+		t.Fatalf("expected the first answer to be replayed\nfirst:    %+v\nreplayed: %+v", first, replayed)
+	}
+
+	// Without an answer to replay the signature is rejected
+	env.rdb.RDB.Del(ctx, fmt.Sprintf("%s:%d:%s", biUtil.PaymentFlagRedis, internalBankID, payload.PaymentRequestID))
+	rejected, err := driver.ResendPaymentFlag(ctx)
+	if err != nil {
+		t.Fatalf("resending payment flag: %v", err)
+	}
+	if rejected.ResponseCode != "4012500" || rejected.HTTPStatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 4012500 (401), got %s (%d)", rejected.ResponseCode, rejected.HTTPStatusCode)
+	}
+
+	if err := env.sqlMock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet sql expectations: %v", err)
+	}
+}
+
+func TestPaymentFlagInProgress(t *testing.T) {
+	env := setup(t, biConfig.EgressConfig{})
+	ctx := context.Background()
+	driver := startDriver(t, env)
+
+	future := time.Now().Add(time.Hour).Format(time.DateTime)
+	env.sqlMock.ExpectQuery("SELECT paidAmountValue").WillDelayFor(500 * time.Millisecond).
+		WillReturnRows(amountRows(fixtures.Payable, future))
+	expectFlag(env, fixtures.Payable, true)
+	payload := paymentFlag(fixtures.Payable, driver.RequestID(), fixtures.Payable.TotalAmount)
+
+	done := make(chan *biModels.BCAInquiryVAResponse)
+	go func() {
+		response, err := driver.PaymentFlag(ctx, payload)
+		if err != nil {
+			t.Errorf("sending payment flag: %v", err)
+		}
+		done <- response
+	}()
+
+	// The same payment flag resent while the first one is processed is not processed twice
+	time.Sleep(100 * time.Millisecond)
+	resent, err := driver.PaymentFlag(ctx, payload)
+	if err != nil {
+		t.Fatalf("resending payment flag: %v", err)
+	}
+	if resent.ResponseCode != "5002500" {
+		t.Fatalf("expected 5002500 while the payment flag is processed, got %s", resent.ResponseCode)
+	}
+
+	first := <-done
+	if first == nil || first.ResponseCode != "2002500" {
+		t.Fatalf("expected the payment flag to be accepted, got %+v", first)
+	}
+	replayed, err := driver.PaymentFlag(ctx, payload)
+	if err != nil {
+		t.Fatalf("resending payment flag: %v", err)
+	}
+	if !reflect.DeepEqual(first, replayed) {
+		t.Fatalf("expected the first answer to be replayed, got %+v", replayed)
+	}
+}
+
+func TestPaymentFlagSaveFailure(t *testing.T) {
+	env := setup(t, biConfig.EgressConfig{})
+	ctx := context.Background()
+	driver := startDriver(t, env)
+	env.rdb.RDB.AddHook(failPaymentFlagSave{})
+
+	future := time.Now().Add(time.Hour).Format(time.DateTime)
+	expectPayment(env, fixtures.Payable, future, true)
+
+	// The payment is flagged, failing to keep its answer does not turn it into an error
+	response, err := driver.PaymentFlag(ctx, paymentFlag(fixtures.Payable, driver.RequestID(), fixtures.Payable.TotalAmount))
+	if err != nil {
+		t.Fatalf("sending payment flag: %v", err)
+	}
+	if response.ResponseCode != "2002500" || response.HTTPStatusCode != http.StatusOK {
+		t.Fatalf("expected 2002500 (200), got %s (%d)", response.ResponseCode, response.HTTPStatusCode)
+	}
+	if err := env.sqlMock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet sql expectations: %v", err)
+	}
+}
+
+// failPaymentFlagSave fails the saving of the payment flag answers, their reservation is let through
+type failPaymentFlagSave struct{}
+
+func (failPaymentFlagSave) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (failPaymentFlagSave) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		args := cmd.Args()
+		if cmd.Name() == "set" && strings.HasPrefix(fmt.Sprint(args[1]), biUtil.PaymentFlagRedis) && args[len(args)-1] != "nx" {
+			cmd.SetErr(fmt.Errorf("connection reset"))
+			return cmd.Err()
+		}
+
+		return next(ctx, cmd)
+	}
+}
+
+func (failPaymentFlagSave) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+// startDriver serves the callback endpoints of env and returns a driver holding an access token
+func startDriver(t *testing.T, env *testEnv) *bcatest.Driver {
+	t.Helper()
+
+	if err := env.rdb.RDB.HSet(context.Background(), biUtil.ClientCredentialsRedis, env.bCfg.BankRequestedCredentials.ClientID,
+		env.bCfg.BankRequestedCredentials.ClientSecret).Err(); err != nil {
+		t.Fatalf("registering client: %v", err)
+	}
+
+	server := httptest.NewServer(biHandler.New(env.service, &env.bCfg.RequestedEndpoints))
+	t.Cleanup(server.Close)
+
+	driver := bcatest.NewDriver(server.URL, env.bCfg, env.bcaKey)
+	if _, err := driver.AccessToken(context.Background()); err != nil {
+		t.Fatalf("requesting access token: %v", err)
+	}
+
+	return driver
+}
+
+// paymentFlag is the payment flag of va paid with paid
+func paymentFlag(va bcatest.VA, requestID string, paid biModels.Amount) *biModels.BCAInquiryRequest {
+	return &biModels.BCAInquiryRequest{
+		PartnerServiceID:   va.PartnerServiceID,
+		CustomerNo:         va.CustomerNo,
+		VirtualAccountNo:   va.VirtualAccountNo(),
+		VirtualAccountName: va.Name,
+		PaymentRequestID:   requestID,
+		ChannelCode:        6014,
+		SourceBankCode:     "014",
+		PaidAmount:         paid,
+		TotalAmount:        va.TotalAmount,
+		TrxDateTime:        time.Now().Format(time.RFC3339),
+		ReferenceNo:        requestID[len(requestID)-11:],
+		FlagAdvise:         "N",
+		SubCompany:         "00000",
+		AdditionalInfo:     map[string]any{},
+	}
+}
+
+// expectInquiry expects the bill presentment of va, paid with paidAmount and expiring at expiry
+func expectInquiry(env *testEnv, va bcatest.VA, paidAmount, expiry string) {
+	env.sqlMock.ExpectBegin()
+	env.sqlMock.ExpectQuery("FROM va_request").WillReturnRows(sqlmock.NewRows([]string{
+		"partnerServiceId", "customerNo", "virtualAccountNo", "virtualAccountName", "totalAmountValue", "totalAmountCurrency",
+		"paidAmountValue", "paidAmountCurrency", "effective_expired_date", "id_va_status", "virtualAccountTrxType",
+		"minAmountValue", "maxAmountValue", "cumulativePaymentAmountValue",
+	}).AddRow(va.PartnerServiceID, va.CustomerNo, va.VirtualAccountNo(), va.Name, va.TotalAmount.Value, va.TotalAmount.Currency,
+		paidAmount, va.TotalAmount.Currency, expiry, biUtil.VAStatusPending, biUtil.VATrxTypeClosed, "0.00", "0.00", "0.00"))
+
+	if paidAmount != "0.00" || expiry < time.Now().Format(time.DateTime) {
+		env.sqlMock.ExpectRollback()
+		return
+	}
+
+	env.sqlMock.ExpectQuery("UPDATE va_request SET inquiryRequestId").WillReturnRows(sqlmock.NewRows(nil))
+	env.sqlMock.ExpectCommit()
+}
+
+// expectPayment expects the payment flag of va, accepted when paid is true
+func expectPayment(env *testEnv, va bcatest.VA, expiry string, paid bool) {
+	env.sqlMock.ExpectQuery("SELECT paidAmountValue").WillReturnRows(amountRows(va, expiry))
+	expectFlag(env, va, paid)
+}
+
+// expectFlag expects the flagging of va once its amounts are read, accepted when paid is true
+func expectFlag(env *testEnv, va bcatest.VA, paid bool) {
+	env.sqlMock.ExpectBegin()
+	env.sqlMock.ExpectQuery("FOR UPDATE").WillReturnRows(sqlmock.NewRows([]string{
+		"virtualAccountTrxType", "totalAmountValue", "minAmountValue", "maxAmountValue", "cumulativePaymentAmountValue",
+	}).AddRow(biUtil.VATrxTypeClosed, va.TotalAmount.Value, "0.00", "0.00", "0.00"))
+
+	if !paid {
+		env.sqlMock.ExpectRollback()
+		return
+	}
+
+	env.sqlMock.ExpectExec("UPDATE va_request SET paidAmountValue").WillReturnResult(sqlmock.NewResult(0, 1))
+	env.sqlMock.ExpectQuery("FROM va_request").WillReturnRows(sqlmock.NewRows([]string{
+		"partnerServiceId", "customerNo", "virtualAccountNo", "virtualAccountName", "totalAmountValue", "totalAmountCurrency",
+		"id", "id_transaction",
+	}).AddRow(va.PartnerServiceID, va.CustomerNo, va.VirtualAccountNo(), va.Name, va.TotalAmount.Value, va.TotalAmount.Currency, 1, 1))
+	env.sqlMock.ExpectExec("INSERT INTO payment_event").WillReturnResult(sqlmock.NewResult(1, 1))
+	env.sqlMock.ExpectCommit()
+}
+
+func amountRows(va bcatest.VA, expiry string) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"paidAmountValue", "paidAmountCurrency", "totalAmountValue", "totalAmountCurrency", "effective_expired_date"}).
+		AddRow("0.00", va.TotalAmount.Currency, va.TotalAmount.Value, va.TotalAmount.Currency, expiry)
+}
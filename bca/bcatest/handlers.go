@@ -0,0 +1,359 @@
+package bcatest
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	biModels "github.com/voxtmault/bank-integration/models"
+)
+
+// answerFunc builds the successful answer of a verified request
+type answerFunc func(r *http.Request, body []byte) any
+
+// rejection is the answer to a request failing the verification
+type rejection struct {
+	status int
+	body   biModels.BCAResponse
+}
+
+func (s *Server) handler(endpoint Endpoint, answer answerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		s.Lock()
+		s.requests = append(s.requests, Request{Endpoint: endpoint, Header: r.Header.Clone(), Body: body})
+		s.Unlock()
+
+		var rejected *rejection
+		if endpoint == AccessToken {
+			rejected = s.verifyAccessTokenRequest(r, body)
+		} else {
+			rejected = s.verifyRequest(endpoint, r, body)
+		}
+		if rejected != nil {
+			writeJSON(w, rejected.status, rejected.body)
+			return
+		}
+
+		response, ok := s.next(endpoint)
+		if !ok {
+			response = Response{Body: answer(r, body)}
+		}
+
+		// The X-EXTERNAL-ID of a processed request can not be used again, rejected ones may be sent again
+		if !response.Drop && (response.Status == 0 || response.Status == http.StatusOK) && endpoint != AccessToken {
+			s.Lock()
+			s.externalIDs[r.Header.Get("X-EXTERNAL-ID")] = true
+			s.Unlock()
+		}
+
+		s.write(w, response)
+	}
+}
+
+// verifyAccessTokenRequest checks the asymmetric signature: SHA256withRSA of X-CLIENT-KEY|X-TIMESTAMP
+func (s *Server) verifyAccessTokenRequest(r *http.Request, body []byte) *rejection {
+	timeStamp := r.Header.Get("X-TIMESTAMP")
+	if _, err := time.Parse(time.RFC3339, timeStamp); err != nil {
+		return &rejection{http.StatusBadRequest, snapError(AccessToken, http.StatusBadRequest, "01", "Invalid Field Format [X-TIMESTAMP]")}
+	}
+
+	if r.Header.Get("X-CLIENT-KEY") != s.credential.ClientID {
+		return &rejection{http.StatusUnauthorized, snapError(AccessToken, http.StatusUnauthorized, "00", "Unauthorized. [Unknown client]")}
+	}
+
+	signature, _ := base64.StdEncoding.DecodeString(r.Header.Get("X-SIGNATURE"))
+	hashed := sha256.Sum256([]byte(s.credential.ClientID + "|" + timeStamp))
+	if err := rsa.VerifyPKCS1v15(s.partnerKey, crypto.SHA256, hashed[:], signature); err != nil {
+		return &rejection{http.StatusUnauthorized, snapError(AccessToken, http.StatusUnauthorized, "00", "Unauthorized. [Signature]")}
+	}
+
+	var payload biModels.GrantType
+	if err := json.Unmarshal(body, &payload); err != nil || payload.GrantType != "client_credentials" {
+		return &rejection{http.StatusBadRequest, snapError(AccessToken, http.StatusBadRequest, "01", "Invalid Field Format [grantType]")}
+	}
+
+	return nil
+}
+
+// verifyRequest checks the access token, the mandatory headers and the symmetric signature: HMAC-SHA512 of
+// METHOD:relativeURL:accessToken:lowercase(hex(sha256(minify(body)))):X-TIMESTAMP with the client secret
+func (s *Server) verifyRequest(endpoint Endpoint, r *http.Request, body []byte) *rejection {
+	accessToken, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	s.Lock()
+	valid := s.tokens[accessToken]
+	s.Unlock()
+
+	if !found || !valid {
+		return &rejection{http.StatusUnauthorized, snapError(endpoint, http.StatusUnauthorized, "01", "Invalid Token (B2B)")}
+	}
+
+	timeStamp := r.Header.Get("X-TIMESTAMP")
+	if _, err := time.Parse(time.RFC3339, timeStamp); err != nil {
+		return &rejection{http.StatusBadRequest, snapError(endpoint, http.StatusBadRequest, "01", "Invalid Field Format [X-TIMESTAMP]")}
+	}
+
+	for _, header := range []string{"X-SIGNATURE", "X-PARTNER-ID", "X-EXTERNAL-ID", "CHANNEL-ID"} {
+		if r.Header.Get(header) == "" {
+			return &rejection{http.StatusBadRequest, snapError(endpoint, http.StatusBadRequest, "02", "Invalid Mandatory Field ["+header+"]")}
+		}
+	}
+
+	if r.Header.Get("X-PARTNER-ID") != s.credential.PartnerID {
+		return &rejection{http.StatusUnauthorized, snapError(endpoint, http.StatusUnauthorized, "00", "Unauthorized. [Unknown partner]")}
+	}
+
+	signature := symmetricSignature(s.credential.ClientSecret, r.Method, relativeURL(r.URL), accessToken, body, timeStamp)
+	if !hmac.Equal([]byte(r.Header.Get("X-SIGNATURE")), []byte(signature)) {
+		return &rejection{http.StatusUnauthorized, snapError(endpoint, http.StatusUnauthorized, "00", "Unauthorized. [Signature]")}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.externalIDs[r.Header.Get("X-EXTERNAL-ID")] {
+		return &rejection{http.StatusConflict, snapError(endpoint, http.StatusConflict, "00", "Conflict")}
+	}
+
+	return nil
+}
+
+func (s *Server) accessToken(r *http.Request, body []byte) any {
+	token := uuid.NewString()
+
+	s.Lock()
+	s.tokens[token] = true
+	s.Unlock()
+
+	return biModels.AccessTokenResponse{
+		BCAResponse: &biModels.BCAResponse{
+			ResponseCode:    successCode(AccessToken),
+			ResponseMessage: "Successful",
+		},
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   strconv.Itoa(int(s.AccessTokenTTL.Seconds())),
+	}
+}
+
+func (s *Server) balanceInquiry(r *http.Request, body []byte) any {
+	var payload biModels.BCABalanceInquiry
+	json.Unmarshal(body, &payload)
+
+	balance := biModels.BCABalance{Value: "1000000.00", Currency: "IDR"}
+
+	return biModels.BCAAccountBalance{
+		BCAResponse:            biModels.BCAResponse{ResponseCode: successCode(BalanceInquiry), ResponseMessage: "Successful"},
+		ReferenceNumber:        s.referenceNo(),
+		PartnerReferenceNumber: payload.PartnerReferenceNumber,
+		AccountNumber:          payload.AccountNumber,
+		AccountName:            "BCA Simulator",
+		AccountInfos: []biModels.BCAAccountInfo{
+			{
+				BalanceType:      "Cash",
+				Amount:           balance,
+				AvailableBalance: balance,
+				LedgerBalance:    balance,
+				Status:           "0001",
+			},
+		},
+	}
+}
+
+func (s *Server) bankStatement(r *http.Request, body []byte) any {
+	var payload biModels.BCABankStatementRequest
+	json.Unmarshal(body, &payload)
+
+	now := time.Now().Format(time.RFC3339)
+	balance := biModels.BCABankStatementBalanceDetails{Value: "1000000.00", Currency: "IDR", DateTime: now}
+
+	return biModels.BCABankStatementResponse{
+		ResponseCode:       successCode(BankStatement),
+		ResponseMessage:    "Successful",
+		ReferenceNo:        s.referenceNo(),
+		PartnerReferenceNo: payload.PartnerReferenceNo,
+		Balance: []*biModels.BCABankStatementBalance{
+			{Amount: balance, StartingBalance: balance, EndingBalance: balance},
+		},
+		TotalCreditEntries: &biModels.BCABankStatementActionDetail{NumberOfEntries: "0", Amount: biModels.Amount{Value: "0.00", Currency: "IDR"}},
+		TotalDebitEntries:  &biModels.BCABankStatementActionDetail{NumberOfEntries: "0", Amount: biModels.Amount{Value: "0.00", Currency: "IDR"}},
+		DetailData:         []*biModels.BCABankStatementDetailData{},
+	}
+}
+
+func (s *Server) transferIntraBank(r *http.Request, body []byte) any {
+	var payload biModels.BCATransferIntraBankReq
+	json.Unmarshal(body, &payload)
+
+	s.SetTransferStatus(payload.PartnerReferenceNumber, "00")
+
+	return biModels.BCAResponseTransferIntraBank{
+		ResponseCode:         successCode(TransferIntraBank),
+		ResponseMessage:      "Successful",
+		ReferenceNo:          s.referenceNo(),
+		PartnerReferenceNo:   payload.PartnerReferenceNumber,
+		Amount:               payload.Amount,
+		BeneficiaryAccountNo: payload.BeneficiaryAccountNo,
+		SourceAccountNo:      payload.SourceAccountNo,
+		TransactionDate:      payload.TransactionDate,
+	}
+}
+
+func (s *Server) transferInterBank(r *http.Request, body []byte) any {
+	var payload biModels.BCATransferInterBankRequest
+	json.Unmarshal(body, &payload)
+
+	s.SetTransferStatus(payload.PartnerReferenceNo, "00")
+
+	return biModels.BCATransferInterBankResponse{
+		BCAResponse:          biModels.BCAResponse{ResponseCode: successCode(TransferInterBank), ResponseMessage: "Successful"},
+		PartnerReferenceNo:   payload.PartnerReferenceNo,
+		ReferenceNo:          s.referenceNo(),
+		Amount:               payload.Amount,
+		BeneficiaryAccountNo: payload.BeneficiaryAccountNo,
+		BeneficiaryBankCode:  payload.BeneficiaryBankCode,
+		SourceAccountNo:      payload.SourceAccountNo,
+	}
+}
+
+func (s *Server) vaStatus(r *http.Request, body []byte) any {
+	var payload biModels.VAPaymentStatusRequest
+	json.Unmarshal(body, &payload)
+
+	return biModels.VAPaymentStatusResponse{
+		BCAResponse: biModels.BCAResponse{ResponseCode: successCode(VAStatus), ResponseMessage: "Successful"},
+		VirtualAccountData: biModels.VirtualAccountData{
+			PartnerServiceID: payload.PartnerServiceId,
+			CustomerNo:       payload.CustomerNo,
+			VirtualAccountNo: payload.VirtualAccountNo,
+			PaymentRequestID: payload.PaymentRequestId,
+			PaidAmount:       biModels.Amount{Value: "0.00", Currency: "IDR"},
+			TotalAmount:      biModels.Amount{Value: "0.00", Currency: "IDR"},
+		},
+		AdditionalInfo: map[string]any{},
+	}
+}
+
+// transactionStatusDescriptions are the descriptions of the latestTransactionStatus codes
+var transactionStatusDescriptions = map[string]string{
+	"00": "Success",
+	"01": "Initiated",
+	"02": "Paying",
+	"03": "Pending",
+	"04": "Refunded",
+	"05": "Canceled",
+	"06": "Failed",
+	"07": "Not Found",
+}
+
+func (s *Server) transferStatus(r *http.Request, body []byte) any {
+	var payload biModels.BCATransactionStatusInquiryRequest
+	json.Unmarshal(body, &payload)
+
+	s.Lock()
+	status, ok := s.transfers[payload.OriginalPartnerReferenceNo]
+	s.Unlock()
+	if !ok {
+		status = "07"
+	}
+
+	return biModels.BCATransactionStatusInquiryResponse{
+		BCAResponse:                biModels.BCAResponse{ResponseCode: successCode(TransferStatus), ResponseMessage: "Successful"},
+		OriginalReferenceNo:        s.referenceNo(),
+		OriginalPartnerReferenceNo: payload.OriginalPartnerReferenceNo,
+		OriginalExternalId:         payload.OriginalExternalId,
+		ServiceCode:                payload.ServiceCode,
+		TransactionDate:            payload.TransactionDate,
+		LatestTransactionStatus:    status,
+		TransactionStatusDesc:      transactionStatusDescriptions[status],
+	}
+}
+
+// write sends a scripted response
+func (s *Server) write(w http.ResponseWriter, response Response) {
+	if response.Delay > 0 {
+		time.Sleep(response.Delay)
+	}
+
+	if response.Drop {
+		if hijacker, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hijacker.Hijack(); err == nil {
+				conn.Close()
+				return
+			}
+		}
+		panic(http.ErrAbortHandler)
+	}
+
+	status := response.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	switch body := response.Body.(type) {
+	case string:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	case []byte:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write(body)
+	default:
+		writeJSON(w, status, body)
+	}
+}
+
+// relativeURL returns the escaped path of the request and its query sorted by name then value
+func relativeURL(u *url.URL) string {
+	query := u.Query()
+	if len(query) == 0 {
+		return u.EscapedPath()
+	}
+
+	var params []string
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, url.QueryEscape(name)+"="+url.QueryEscape(value))
+		}
+	}
+	sort.Strings(params)
+
+	return u.EscapedPath() + "?" + strings.Join(params, "&")
+}
+
+func symmetricSignature(secret, method, relativeURL, accessToken string, body []byte, timeStamp string) string {
+	var minified bytes.Buffer
+	json.Compact(&minified, body)
+	hashedBody := sha256.Sum256(minified.Bytes())
+
+	stringToSign := method + ":" + relativeURL + ":" + accessToken + ":" +
+		strings.ToLower(hex.EncodeToString(hashedBody[:])) + ":" + timeStamp
+
+	h := hmac.New(sha512.New, []byte(secret))
+	h.Write([]byte(stringToSign))
+
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
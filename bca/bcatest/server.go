@@ -0,0 +1,235 @@
+// Package bcatest provides an offline BCA SNAP simulator, so that every egress path of the BCA provider can be
+// exercised without the BCA sandbox, in tests or during local development.
+//
+//	sim := bcatest.New(bCfg, &partnerKey.PublicKey) // bCfg now points at the simulator
+//	defer sim.Close()
+//
+//	sim.Script(bcatest.TransferIntraBank, bcatest.ErrorResponse(bcatest.TransferIntraBank, http.StatusForbidden, "14", "Insufficient Funds"))
+//
+// Our signatures are verified independently from the bca_security package, with the SNAP string to sign rules, so
+// a change in the way we sign is caught instead of being mirrored.
+//
+// The reverse direction is covered by Driver, which plays BCA against our callback endpoints and runs the BCA UAT
+// scenarios against them.
+package bcatest
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	biConfig "github.com/voxtmault/bank-integration/config"
+	biModels "github.com/voxtmault/bank-integration/models"
+)
+
+// Endpoint names a BCA SNAP endpoint served by the simulator
+type Endpoint string
+
+const (
+	AccessToken       Endpoint = "access-token"
+	BalanceInquiry    Endpoint = "balance-inquiry"
+	BankStatement     Endpoint = "bank-statement"
+	TransferIntraBank Endpoint = "transfer-intrabank"
+	TransferInterBank Endpoint = "transfer-interbank"
+	VAStatus          Endpoint = "transfer-va-status"
+	TransferStatus    Endpoint = "transfer-status"
+)
+
+// serviceCodes are the SNAP service codes of the endpoints, the 4th and 5th digits of their response codes
+var serviceCodes = map[Endpoint]string{
+	AccessToken:       "73",
+	BalanceInquiry:    "11",
+	BankStatement:     "14",
+	TransferIntraBank: "17",
+	TransferInterBank: "18",
+	VAStatus:          "26",
+	TransferStatus:    "36",
+}
+
+// DefaultEndpoints are the paths of the BCA SNAP endpoints, used for the endpoints left empty in the bank config
+var DefaultEndpoints = biConfig.BankServiceEndpoints{
+	AccessTokenURL:           "/openapi/v1.0/access-token/b2b",
+	BalanceInquiryURL:        "/openapi/v1.0/balance-inquiry",
+	BankStatementURL:         "/openapi/v1.0/bank-statement",
+	TransferIntraBankURL:     "/openapi/v1.0/transfer-intrabank",
+	TransferInterBankURL:     "/openapi/v1.0/transfer-interbank",
+	PaymentFlagURL:           "/openapi/v1.0/transfer-va/status",
+	TransferStatusInquiryURL: "/openapi/v1.0/transfer/status",
+}
+
+// Response is a scripted answer of the simulator
+type Response struct {
+	Status int           // HTTP status code, 200 when zero
+	Body   any           // Encoded into JSON, a string or a []byte is sent as is
+	Delay  time.Duration // Time to wait before answering, e.g. to trigger the read timeout
+	Drop   bool          // Close the connection without answering, the outcome is unknown to the caller
+}
+
+// ErrorResponse returns a SNAP error answer of endpoint, caseCode being the last two digits of the response code
+// (e.g. ErrorResponse(TransferIntraBank, http.StatusForbidden, "14", "Insufficient Funds") answers 4031714)
+func ErrorResponse(endpoint Endpoint, status int, caseCode, message string) Response {
+	return Response{
+		Status: status,
+		Body:   snapError(endpoint, status, caseCode, message),
+	}
+}
+
+// Request is a request received by the simulator
+type Request struct {
+	Endpoint Endpoint
+	Header   http.Header
+	Body     []byte
+}
+
+// Server is a running BCA SNAP simulator. Requests passing the verification are answered with the scripted
+// responses of their endpoint in order, then with a successful response built from the request.
+type Server struct {
+	URL string
+
+	// AccessTokenTTL is the lifetime of the issued access tokens, sent as expiresIn
+	AccessTokenTTL time.Duration
+
+	server     *httptest.Server
+	credential biConfig.BankCredential
+	partnerKey *rsa.PublicKey
+
+	scripts     map[Endpoint][]Response
+	requests    []Request
+	tokens      map[string]bool   // Issued access tokens, false once revoked
+	externalIDs map[string]bool   // X-EXTERNAL-ID received, they must be unique
+	transfers   map[string]string // partnerReferenceNo -> latestTransactionStatus
+	sequence    uint
+
+	sync.Mutex
+}
+
+// New starts a simulator of the BCA account configured in bCfg, partnerKey being our public key registered at
+// BCA. The base url of bCfg is pointed at the simulator and its empty endpoints are set to DefaultEndpoints.
+func New(bCfg *biConfig.BankConfig, partnerKey *rsa.PublicKey) *Server {
+	endpoints := &bCfg.BankServiceEndpoints
+	for _, field := range []struct {
+		value    *string
+		fallback string
+	}{
+		{&endpoints.AccessTokenURL, DefaultEndpoints.AccessTokenURL},
+		{&endpoints.BalanceInquiryURL, DefaultEndpoints.BalanceInquiryURL},
+		{&endpoints.BankStatementURL, DefaultEndpoints.BankStatementURL},
+		{&endpoints.TransferIntraBankURL, DefaultEndpoints.TransferIntraBankURL},
+		{&endpoints.TransferInterBankURL, DefaultEndpoints.TransferInterBankURL},
+		{&endpoints.PaymentFlagURL, DefaultEndpoints.PaymentFlagURL},
+		{&endpoints.TransferStatusInquiryURL, DefaultEndpoints.TransferStatusInquiryURL},
+	} {
+		if *field.value == "" {
+			*field.value = field.fallback
+		}
+	}
+
+	s := &Server{
+		AccessTokenTTL: 15 * time.Minute,
+		credential:     bCfg.BankCredential,
+		partnerKey:     partnerKey,
+		scripts:        make(map[Endpoint][]Response),
+		tokens:         make(map[string]bool),
+		externalIDs:    make(map[string]bool),
+		transfers:      make(map[string]string),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+endpoints.AccessTokenURL, s.handler(AccessToken, s.accessToken))
+	mux.HandleFunc("POST "+endpoints.BalanceInquiryURL, s.handler(BalanceInquiry, s.balanceInquiry))
+	mux.HandleFunc("POST "+endpoints.BankStatementURL, s.handler(BankStatement, s.bankStatement))
+	mux.HandleFunc("POST "+endpoints.TransferIntraBankURL, s.handler(TransferIntraBank, s.transferIntraBank))
+	mux.HandleFunc("POST "+endpoints.TransferInterBankURL, s.handler(TransferInterBank, s.transferInterBank))
+	mux.HandleFunc("POST "+endpoints.PaymentFlagURL, s.handler(VAStatus, s.vaStatus))
+	mux.HandleFunc("POST "+endpoints.TransferStatusInquiryURL, s.handler(TransferStatus, s.transferStatus))
+
+	s.server = httptest.NewServer(mux)
+	s.URL = s.server.URL
+	endpoints.BaseUrl = s.URL
+
+	return s
+}
+
+// Close stops the simulator
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// Script queues responses of endpoint, they are sent in order to the next requests passing the verification
+func (s *Server) Script(endpoint Endpoint, responses ...Response) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.scripts[endpoint] = append(s.scripts[endpoint], responses...)
+}
+
+// Requests returns the requests received on endpoint, rejected ones included
+func (s *Server) Requests(endpoint Endpoint) []Request {
+	s.Lock()
+	defer s.Unlock()
+
+	var requests []Request
+	for _, request := range s.requests {
+		if request.Endpoint == endpoint {
+			requests = append(requests, request)
+		}
+	}
+
+	return requests
+}
+
+// RevokeTokens invalidates every issued access token, the requests using them are answered with Invalid Token
+func (s *Server) RevokeTokens() {
+	s.Lock()
+	defer s.Unlock()
+
+	for token := range s.tokens {
+		s.tokens[token] = false
+	}
+}
+
+// SetTransferStatus sets the latestTransactionStatus (e.g. "00" success, "06" failed) answered by the transfer status
+// inquiry of partnerReferenceNo. Transfers answered successfully by the simulator are "00", unknown ones "07".
+func (s *Server) SetTransferStatus(partnerReferenceNo, status string) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.transfers[partnerReferenceNo] = status
+}
+
+// next pops the next scripted response of endpoint
+func (s *Server) next(endpoint Endpoint) (Response, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	queue := s.scripts[endpoint]
+	if len(queue) == 0 {
+		return Response{}, false
+	}
+	s.scripts[endpoint] = queue[1:]
+
+	return queue[0], true
+}
+
+// referenceNo returns a new referenceNo, unique within the simulator
+func (s *Server) referenceNo() string {
+	s.Lock()
+	defer s.Unlock()
+
+	s.sequence++
+	return fmt.Sprintf("%s%08d", time.Now().Format("20060102150405"), s.sequence)
+}
+
+func snapError(endpoint Endpoint, status int, caseCode, message string) biModels.BCAResponse {
+	return biModels.BCAResponse{
+		ResponseCode:    fmt.Sprintf("%d%s%s", status, serviceCodes[endpoint], caseCode),
+		ResponseMessage: message,
+	}
+}
+
+func successCode(endpoint Endpoint) string {
+	return fmt.Sprintf("%d%s00", http.StatusOK, serviceCodes[endpoint])
+}
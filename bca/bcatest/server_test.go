@@ -0,0 +1,544 @@
+package bcatest_test
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/rotisserie/eris"
+	"github.com/voxtmault/bank-integration/bca"
+	"github.com/voxtmault/bank-integration/bca/bcatest"
+	bcaRequest "github.com/voxtmault/bank-integration/bca/request"
+	bcaSecurity "github.com/voxtmault/bank-integration/bca/security"
+	bcaService "github.com/voxtmault/bank-integration/bca/service"
+	biConfig "github.com/voxtmault/bank-integration/config"
+	biModels "github.com/voxtmault/bank-integration/models"
+	biStorage "github.com/voxtmault/bank-integration/storage"
+	biUtil "github.com/voxtmault/bank-integration/utils"
+)
+
+const internalBankID = 3
+
+type testEnv struct {
+	bCfg    *biConfig.BankConfig
+	sim     *bcatest.Server
+	sqlMock sqlmock.Sqlmock
+	rdb     *biStorage.RedisInstance
+	service *bcaService.BCAService
+	bcaKey  *rsa.PrivateKey
+}
+
+func setup(t *testing.T, egress biConfig.EgressConfig) *testEnv {
+	t.Helper()
+
+	validate := biUtil.InitValidator()
+	validate.RegisterValidation("bcaPartnerServiceID", biUtil.ValidatePartnerServiceID)
+	validate.RegisterValidation("bcaVA", biUtil.ValidateBCAVirtualAccountNumber)
+
+	dir := t.TempDir()
+	partnerKey := generateKey(t)
+	bcaKey := generateKey(t)
+
+	privateKeyPath := filepath.Join(dir, "private.pem")
+	writePEM(t, privateKeyPath, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(partnerKey))
+
+	publicKey, err := x509.MarshalPKIXPublicKey(&bcaKey.PublicKey)
+	if err != nil {
+		t.Fatalf("marshalling public key: %v", err)
+	}
+	publicKeyPath := filepath.Join(dir, "bca.pem")
+	writePEM(t, publicKeyPath, "PUBLIC KEY", publicKey)
+
+	cfg := &biConfig.InternalConfig{
+		PrivateKeyPath: privateKeyPath,
+		AppHost:        "localhost",
+		TZ:             "Asia/Jakarta",
+		EgressConfig:   egress,
+	}
+	env := &testEnv{
+		bCfg: &biConfig.BankConfig{
+			BankCredential: biConfig.BankCredential{
+				ClientID:      uuid.NewString(),
+				ClientSecret:  uuid.NewString(),
+				VAPrefix:      "11111",
+				PartnerID:     "KBBABCINDO",
+				PublicKeyPath: publicKeyPath,
+				SourceAccount: "0613005827",
+			},
+			BankChannelConfig: biConfig.BankChannelConfig{
+				VAChannelId:       "95231",
+				BusinessChannelId: "95221",
+			},
+			BankRuntimeConfig: biConfig.BankRuntimeConfig{
+				AccessTokenExpirationTime: 900,
+			},
+			BankRequestedCredentials: biConfig.BankRequestedCredentials{
+				ClientID:              uuid.NewString(),
+				ClientSecret:          uuid.NewString(),
+				AccessTokenExpireTime: 900,
+			},
+			RequestedEndpoints: biConfig.RequestedEndpoints{
+				AuthURL:            "/bca/v1.0/access-token/b2b",
+				BillPresentmentURL: "/bca/v1.0/transfer-va/inquiry",
+				PaymentFlagURL:     "/bca/v1.0/transfer-va/payment",
+			},
+			IngressConfig: biConfig.IngressConfig{
+				PaymentFlagTTL: 48 * time.Hour,
+			},
+		},
+		bcaKey: bcaKey,
+	}
+
+	env.sim = bcatest.New(env.bCfg, &partnerKey.PublicKey)
+	t.Cleanup(env.sim.Close)
+
+	db, sqlMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("creating sql mock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	env.sqlMock = sqlMock
+
+	sqlMock.ExpectQuery("SELECT id, bank_name, client_secret FROM authenticated_banks").
+		WithArgs(env.bCfg.BankRequestedCredentials.ClientID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "bank_name", "client_secret"}).
+			AddRow(internalBankID, "BCA", env.bCfg.BankRequestedCredentials.ClientSecret))
+	sqlMock.ExpectQuery("SELECT id_transaction, expired_date FROM va_request").
+		WillReturnRows(sqlmock.NewRows([]string{"id_transaction", "expired_date"}))
+
+	security, err := bcaSecurity.NewBCASecurity(cfg, env.bCfg, nil)
+	if err != nil {
+		t.Fatalf("creating bca security: %v", err)
+	}
+
+	mr := miniredis.RunT(t)
+	env.rdb = &biStorage.RedisInstance{RDB: redis.NewClient(&redis.Options{Addr: mr.Addr()})}
+	env.service, err = bcaService.NewBCAService(
+		bcaRequest.NewBCAEgress(security, env.bCfg, cfg),
+		bcaRequest.NewBCAIngress(security),
+		cfg,
+		env.bCfg,
+		db,
+		env.rdb,
+	)
+	if err != nil {
+		t.Fatalf("creating bca service: %v", err)
+	}
+
+	return env
+}
+
+func TestEgressPaths(t *testing.T) {
+	env := setup(t, biConfig.EgressConfig{})
+	ctx := context.Background()
+
+	balance, err := env.service.BalanceInquiry(ctx)
+	if err != nil {
+		t.Fatalf("balance inquiry: %v", err)
+	}
+	if balance.AccountNumber != env.bCfg.BankCredential.SourceAccount || len(balance.AccountInfos) != 1 {
+		t.Fatalf("unexpected balance response: %+v", balance)
+	}
+
+	if _, err := env.service.BankStatement(ctx, "", ""); err != nil {
+		t.Fatalf("bank statement: %v", err)
+	}
+
+	expectTransfer(env, 1)
+	transfer, err := env.service.TransferIntraBank(ctx, &biModels.BCATransferIntraBankReq{
+		PartnerReferenceNumber: "TRF-1",
+		Amount:                 biModels.Amount{Value: "15000", Currency: "IDR"},
+		BeneficiaryAccountNo:   "8010001575",
+	})
+	if err != nil {
+		t.Fatalf("transfer intra bank: %v", err)
+	}
+	if transfer.ResponseCode != "2001700" || transfer.ReferenceNo == "" {
+		t.Fatalf("unexpected transfer response: %+v", transfer)
+	}
+
+	// The simulator remembers the transfers it has answered
+	externalID := env.sim.Requests(bcatest.TransferIntraBank)[0].Header.Get("X-EXTERNAL-ID")
+	env.sqlMock.ExpectQuery("FROM transfer_ledger").WillReturnRows(ledgerRow(1, "TRF-1", time.Now().Format(time.RFC3339)))
+	status, err := env.service.GetTransactionStatus(ctx, &biModels.BCATransactionStatusInquiryRequest{
+		OriginalPartnerReferenceNo: "TRF-1",
+		OriginalExternalId:         externalID,
+		ServiceCode:                bca.BCAServiceIntrabankTransfer,
+	})
+	if err != nil {
+		t.Fatalf("transaction status: %v", err)
+	}
+	if status.TransactionStatus != biModels.BCATransactionStatusSuccess {
+		t.Fatalf("expected the transfer to be successful, got %s", status.LatestTransactionStatus)
+	}
+
+	expectTransfer(env, 2)
+	interBank, err := env.service.TransferInterBank(ctx, &biModels.BCATransferInterBankRequest{
+		PartnerReferenceNo:     "TRF-2",
+		Amount:                 biModels.Amount{Value: "15000.00", Currency: "IDR"},
+		BeneficiaryAccountName: "Yories Yolanda",
+		BeneficiaryAccountNo:   "888801000157508",
+		BeneficiaryBankCode:    "BRINIDJA",
+	})
+	if err != nil {
+		t.Fatalf("transfer inter bank: %v", err)
+	}
+	if interBank.ResponseCode != "2001800" || interBank.BeneficiaryBankCode != "BRINIDJA" {
+		t.Fatalf("unexpected transfer response: %+v", interBank)
+	}
+
+	// A single access token is used by every request
+	if got := len(env.sim.Requests(bcatest.AccessToken)); got != 1 {
+		t.Fatalf("expected 1 access token request, got %d", got)
+	}
+	if err := env.sqlMock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet sql expectations: %v", err)
+	}
+}
+
+func TestScriptedResponses(t *testing.T) {
+	env := setup(t, biConfig.EgressConfig{MaxRetries: 1, RetryBackoff: time.Millisecond})
+	ctx := context.Background()
+
+	// Transient failures of the read only requests are retried
+	env.sim.Script(bcatest.BalanceInquiry, bcatest.ErrorResponse(bcatest.BalanceInquiry, http.StatusServiceUnavailable, "00", "Service Unavailable"))
+	if _, err := env.service.BalanceInquiry(ctx); err != nil {
+		t.Fatalf("expected the balance inquiry to succeed on the retry, got %v", err)
+	}
+	if got := len(env.sim.Requests(bcatest.BalanceInquiry)); got != 2 {
+		t.Fatalf("expected 2 balance inquiry requests, got %d", got)
+	}
+
+	env.sim.Script(bcatest.BankStatement, bcatest.ErrorResponse(bcatest.BankStatement, http.StatusForbidden, "18", "Inactive Account"))
+	_, err := env.service.BankStatement(ctx, "", "")
+	if err == nil || !strings.Contains(err.Error(), "4031418") {
+		t.Fatalf("expected the scripted error, got %v", err)
+	}
+
+	// A dropped connection leaves the caller without an answer, once the retry is dropped too
+	env.sim.Script(bcatest.BankStatement, bcatest.Response{Drop: true}, bcatest.Response{Drop: true})
+	if _, err := env.service.BankStatement(ctx, "", ""); err == nil {
+		t.Fatal("expected an error on a dropped connection")
+	}
+	if got := len(env.sim.Requests(bcatest.BankStatement)); got != 3 {
+		t.Fatalf("expected 3 bank statement requests, got %d", got)
+	}
+}
+
+func TestRejectedRequests(t *testing.T) {
+	env := setup(t, biConfig.EgressConfig{})
+	ctx := context.Background()
+
+	if _, err := env.service.BalanceInquiry(ctx); err != nil {
+		t.Fatalf("balance inquiry: %v", err)
+	}
+
+	// A revoked token is renewed and the request sent once more
+	env.sim.RevokeTokens()
+	if _, err := env.service.BalanceInquiry(ctx); err != nil {
+		t.Fatalf("expected the balance inquiry to succeed with a renewed token, got %v", err)
+	}
+	if got := len(env.sim.Requests(bcatest.AccessToken)); got != 2 {
+		t.Fatalf("expected 2 access token requests, got %d", got)
+	}
+
+	// Requests signed with another client secret are rejected
+	env.bCfg.BankCredential.ClientSecret = uuid.NewString()
+	_, err := env.service.BalanceInquiry(ctx)
+	if err == nil || !strings.Contains(err.Error(), "Unauthorized. [Signature]") {
+		t.Fatalf("expected the signature to be rejected, got %v", err)
+	}
+}
+
+func TestConcurrentTokenRenewal(t *testing.T) {
+	env := setup(t, biConfig.EgressConfig{})
+	ctx := context.Background()
+
+	if _, err := env.service.BalanceInquiry(ctx); err != nil {
+		t.Fatalf("balance inquiry: %v", err)
+	}
+
+	// Every request gets its token rejected and renews it while the others are being signed
+	env.sim.RevokeTokens()
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := env.service.BalanceInquiry(ctx); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatalf("expected the balance inquiries to succeed with a renewed token, got %v", err)
+	}
+}
+
+func TestGenerateAccessTokenWithClientPublicKey(t *testing.T) {
+	env := setup(t, biConfig.EgressConfig{})
+	ctx := context.Background()
+
+	// A partner app registered with its own key pair next to the bank
+	partnerKey := generateKey(t)
+	der, _ := x509.MarshalPKIXPublicKey(&partnerKey.PublicKey)
+	clientKey, clientSecret := "partner-app", "partner-secret"
+	env.rdb.RDB.HSet(ctx, biUtil.ClientCredentialsRedis, clientKey, clientSecret)
+	env.rdb.RDB.HSet(ctx, biUtil.ClientPublicKeysRedis, clientKey, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})))
+
+	sign := func(key *rsa.PrivateKey, timeStamp string) string {
+		hashed := sha256.Sum256([]byte(clientKey + "|" + timeStamp))
+		raw, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+		if err != nil {
+			t.Fatalf("signing: %v", err)
+		}
+		return base64.StdEncoding.EncodeToString(raw)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		key    *rsa.PrivateKey
+		status int
+	}{
+		{"client key", partnerKey, http.StatusOK},
+		{"bank key", env.bcaKey, http.StatusUnauthorized},
+	} {
+		timeStamp := time.Now().Format(time.RFC3339)
+		request := httptest.NewRequest(http.MethodPost, env.bCfg.RequestedEndpoints.AuthURL, bytes.NewBufferString(`{"grantType":"client_credentials"}`))
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("X-TIMESTAMP", timeStamp)
+		request.Header.Set("X-CLIENT-KEY", clientKey)
+		request.Header.Set("X-SIGNATURE", sign(tc.key, timeStamp))
+
+		response, _ := env.service.GenerateAccessToken(ctx, request)
+		if response.HTTPStatusCode != tc.status {
+			t.Fatalf("%s: expected status %d, got %+v", tc.name, tc.status, response.BCAResponse)
+		}
+	}
+
+	// An unreadable registered key never falls back to the bank key
+	env.rdb.RDB.HSet(ctx, biUtil.ClientPublicKeysRedis, clientKey, "not a public key")
+	timeStamp := time.Now().Format(time.RFC3339)
+	request := httptest.NewRequest(http.MethodPost, env.bCfg.RequestedEndpoints.AuthURL, bytes.NewBufferString(`{"grantType":"client_credentials"}`))
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-TIMESTAMP", timeStamp)
+	request.Header.Set("X-CLIENT-KEY", clientKey)
+	request.Header.Set("X-SIGNATURE", sign(env.bcaKey, timeStamp))
+
+	if response, _ := env.service.GenerateAccessToken(ctx, request); response.HTTPStatusCode == http.StatusOK {
+		t.Fatalf("expected the bank key to be rejected for a client with an invalid key, got %+v", response.BCAResponse)
+	}
+
+	// Nor does a client registered without a key of its own, only the client id given to BCA is verified with it
+	env.rdb.RDB.HDel(ctx, biUtil.ClientPublicKeysRedis, clientKey)
+	timeStamp = time.Now().Add(time.Second).Format(time.RFC3339)
+	request = httptest.NewRequest(http.MethodPost, env.bCfg.RequestedEndpoints.AuthURL, bytes.NewBufferString(`{"grantType":"client_credentials"}`))
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-TIMESTAMP", timeStamp)
+	request.Header.Set("X-CLIENT-KEY", clientKey)
+	request.Header.Set("X-SIGNATURE", sign(env.bcaKey, timeStamp))
+
+	if response, _ := env.service.GenerateAccessToken(ctx, request); response.HTTPStatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected the bank key to be rejected for a client without key, got %+v", response.BCAResponse)
+	}
+}
+
+func TestGenerateAccessTokenSameSecond(t *testing.T) {
+	env := setup(t, biConfig.EgressConfig{})
+	ctx := context.Background()
+
+	partnerKey := generateKey(t)
+	der, _ := x509.MarshalPKIXPublicKey(&partnerKey.PublicKey)
+	clientKey := "partner-app"
+	env.rdb.RDB.HSet(ctx, biUtil.ClientCredentialsRedis, clientKey, "partner-secret")
+	env.rdb.RDB.HSet(ctx, biUtil.ClientPublicKeysRedis, clientKey, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})))
+	env.rdb.RDB.HSet(ctx, biUtil.ClientTimestampSkewRedis, clientKey, "300")
+
+	// PKCS #1 v1.5 signatures are deterministic, both requests carry the same X-SIGNATURE
+	timeStamp := time.Now().Format(time.RFC3339)
+	hashed := sha256.Sum256([]byte(clientKey + "|" + timeStamp))
+	raw, err := rsa.SignPKCS1v15(rand.Reader, partnerKey, crypto.SHA256, hashed[:])
+	if err != nil {
+		t.Fatalf("signing: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		request := httptest.NewRequest(http.MethodPost, env.bCfg.RequestedEndpoints.AuthURL, bytes.NewBufferString(`{"grantType":"client_credentials"}`))
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("X-TIMESTAMP", timeStamp)
+		request.Header.Set("X-CLIENT-KEY", clientKey)
+		request.Header.Set("X-SIGNATURE", base64.StdEncoding.EncodeToString(raw))
+
+		if response, _ := env.service.GenerateAccessToken(ctx, request); response.HTTPStatusCode != http.StatusOK {
+			t.Fatalf("expected token request %d within the same second to be answered, got %+v", i+1, response.BCAResponse)
+		}
+	}
+}
+
+func TestResolveNotFoundTransfers(t *testing.T) {
+	env := setup(t, biConfig.EgressConfig{})
+	ctx := context.Background()
+
+	// Neither transfer is known to the simulator, the recent one may not be registered by BCA yet
+	recent := time.Now().Add(-time.Minute).Format(time.RFC3339)
+	old := time.Now().Add(-2 * time.Hour).Format(time.RFC3339)
+
+	env.sqlMock.ExpectQuery("SELECT partner_reference_no").
+		WillReturnRows(sqlmock.NewRows([]string{"partner_reference_no"}).AddRow("TRF-RECENT").AddRow("TRF-OLD"))
+	env.sqlMock.ExpectQuery("FROM transfer_ledger").WillReturnRows(ledgerRow(1, "TRF-RECENT", recent))
+	env.sqlMock.ExpectQuery("FROM transfer_ledger").WillReturnRows(ledgerRow(2, "TRF-OLD", old))
+	env.sqlMock.ExpectExec("UPDATE transfer_ledger SET id_transfer_status").
+		WithArgs(biUtil.TransferStatusFailed, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), 2,
+			biUtil.TransferStatusSuccess, biUtil.TransferStatusFailed).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := env.service.ResolveUnknownTransfers(ctx); err != nil {
+		t.Fatalf("resolving unknown transfers: %v", err)
+	}
+	if err := env.sqlMock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet sql expectations: %v", err)
+	}
+
+	requests := env.sim.Requests(bcatest.TransferStatus)
+	if len(requests) != 2 || !strings.Contains(string(requests[0].Body), recent) {
+		t.Fatalf("expected the inquiries to carry the ledger transaction date, got %d requests", len(requests))
+	}
+
+	// Without a transfer status inquiry url the transfers are left unknown
+	env.bCfg.BankServiceEndpoints.TransferStatusInquiryURL = ""
+	env.sqlMock.ExpectQuery("SELECT partner_reference_no").
+		WillReturnRows(sqlmock.NewRows([]string{"partner_reference_no"}).AddRow("TRF-RECENT"))
+	if err := env.service.ResolveUnknownTransfers(ctx); !eris.Is(err, bcaService.ErrTransferStatusInquiryDisabled) {
+		t.Fatalf("expected the transfer status inquiry to be disabled, got %v", err)
+	}
+}
+
+func TestTransferSentOnce(t *testing.T) {
+	env := setup(t, biConfig.EgressConfig{})
+	ctx := context.Background()
+	transactionDate := time.Now().Format(time.RFC3339)
+	payload := func(reference string) *biModels.BCATransferIntraBankReq {
+		return &biModels.BCATransferIntraBankReq{
+			PartnerReferenceNumber: reference,
+			Amount:                 biModels.Amount{Value: "15000", Currency: "IDR"},
+			BeneficiaryAccountNo:   "8010001575",
+			TransactionDate:        transactionDate,
+		}
+	}
+
+	// Another caller has claimed the transfer first
+	env.sqlMock.ExpectQuery("FROM transfer_ledger").
+		WillReturnRows(ledgerEntry(1, "TRF-CLAIMED", transactionDate, biUtil.TransferStatusPending, 0))
+	env.sqlMock.ExpectExec("UPDATE transfer_ledger SET attempts").
+		WithArgs(1, biUtil.TransferStatusPending, 0).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	if _, err := env.service.TransferIntraBank(ctx, payload("TRF-CLAIMED")); !eris.Is(err, bcaService.ErrTransferInProgress) {
+		t.Fatalf("expected the transfer to be in progress, got %v", err)
+	}
+
+	// A pending transfer that has already been sent is resolved instead of being sent again
+	env.sim.SetTransferStatus("TRF-STALE", "00")
+	env.sqlMock.ExpectQuery("FROM transfer_ledger").
+		WillReturnRows(ledgerEntry(2, "TRF-STALE", transactionDate, biUtil.TransferStatusPending, 1))
+	env.sqlMock.ExpectExec("UPDATE transfer_ledger SET id_transfer_status").
+		WithArgs(biUtil.TransferStatusSuccess, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), 2,
+			biUtil.TransferStatusSuccess, biUtil.TransferStatusFailed).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if _, err := env.service.TransferIntraBank(ctx, payload("TRF-STALE")); err != nil {
+		t.Fatalf("expected the stale transfer to be resolved as successful, got %v", err)
+	}
+
+	if requests := env.sim.Requests(bcatest.TransferIntraBank); len(requests) != 0 {
+		t.Fatalf("expected no transfer to be sent, got %d", len(requests))
+	}
+
+	// A late duplicate answer does not replace the outcome settled by the resolver in the meantime
+	env.sim.Script(bcatest.TransferIntraBank, bcatest.ErrorResponse(bcatest.TransferIntraBank, http.StatusConflict, "00", "Conflict"))
+	env.sqlMock.ExpectQuery("FROM transfer_ledger").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	env.sqlMock.ExpectExec("INSERT INTO transfer_ledger").WillReturnResult(sqlmock.NewResult(3, 1))
+	env.sqlMock.ExpectExec("UPDATE transfer_ledger SET attempts").
+		WithArgs(3, biUtil.TransferStatusPending, 0).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	env.sqlMock.ExpectExec("UPDATE transfer_ledger SET id_transfer_status").
+		WithArgs(biUtil.TransferStatusUnknown, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), 3,
+			biUtil.TransferStatusSuccess, biUtil.TransferStatusFailed).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	env.sqlMock.ExpectQuery("FROM transfer_ledger").
+		WillReturnRows(ledgerEntry(3, "TRF-LATE", transactionDate, biUtil.TransferStatusSuccess, 1))
+	if _, err := env.service.TransferIntraBank(ctx, payload("TRF-LATE")); err != nil {
+		t.Fatalf("expected the settled outcome to be returned, got %v", err)
+	}
+
+	if err := env.sqlMock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet sql expectations: %v", err)
+	}
+}
+
+// ledgerRow is an unknown transfer entry of the ledger sent on transactionDate
+func ledgerRow(id int64, reference, transactionDate string) *sqlmock.Rows {
+	return ledgerEntry(id, reference, transactionDate, biUtil.TransferStatusUnknown, 1)
+}
+
+// ledgerEntry is a transfer entry of the ledger in status after the given number of attempts
+func ledgerEntry(id int64, reference, transactionDate string, status biUtil.TransferStatus, attempts int) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{
+		"id", "id_bank", "partner_reference_no", "external_id", "service_code", "source_account_no", "beneficiary_account_no",
+		"beneficiary_bank_code", "amount_value", "amount_currency", "transaction_date", "id_transfer_status", "reference_no",
+		"request_body", "response_body", "status_reason", "attempts", "created_at", "updated_at",
+	}).AddRow(id, internalBankID, reference, "1", "17", "0613005827", "8010001575", "", "15000.00", "IDR",
+		transactionDate, status, "", "{}", "{}", "", attempts, transactionDate, transactionDate)
+}
+
+// expectTransfer expects a transfer to be persisted into the ledger as entry id and to succeed
+func expectTransfer(env *testEnv, id int64) {
+	env.sqlMock.ExpectQuery("FROM transfer_ledger").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	env.sqlMock.ExpectExec("INSERT INTO transfer_ledger").WillReturnResult(sqlmock.NewResult(id, 1))
+	env.sqlMock.ExpectExec("UPDATE transfer_ledger SET attempts").
+		WithArgs(id, biUtil.TransferStatusPending, 0).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	env.sqlMock.ExpectExec("UPDATE transfer_ledger SET id_transfer_status").
+		WithArgs(biUtil.TransferStatusSuccess, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), id,
+			biUtil.TransferStatusSuccess, biUtil.TransferStatusFailed).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func generateKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating rsa key: %v", err)
+	}
+
+	return key
+}
+
+func writePEM(t *testing.T, path, blockType string, data []byte) {
+	t.Helper()
+
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: data}), 0600); err != nil {
+		t.Fatalf("writing %s: %v", path, err)
+	}
+}
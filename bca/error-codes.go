@@ -36,6 +36,8 @@ var (
 	BCACommonResponseMessageUnauthorizedStringToSign               = BCACommonResponseMessage("Unauthorized. [Signature]")
 	BCACommonResponseMessageUnauthorizedUnknownClient              = BCACommonResponseMessage("Unauthorized. [Unknown client]")
 	BCACommonResponseMessageUnauthorizedConnectionNotAllowed       = BCACommonResponseMessage("Unauthorized. [Connection not allowed]")
+	BCACommonResponseMessageUnauthorizedTimestamp                  = BCACommonResponseMessage("Unauthorized. [X-TIMESTAMP]")
+	BCACommonResponseMessageUnauthorizedReplay                     = BCACommonResponseMessage("Unauthorized. [Signature already used]")
 	BCACommonResponseMessageMissingMandatoryField                  = BCACommonResponseMessage("Invalid mandatory field")
 	BCACommonResponseMessageInvalidFieldFormat                     = BCACommonResponseMessage("Invalid field format")
 	BCACommonResponseMessageDuplicateExternalID                    = BCACommonResponseMessage("Conflict")
@@ -245,6 +247,16 @@ var (
 		ResponseCode:    "4017300",
 		ResponseMessage: BCACommonResponseMessageUnauthorizedConnectionNotAllowed.ToString(),
 	}
+	BCAAuthUnauthorizedTimestamp = biModels.BCAResponse{
+		HTTPStatusCode:  http.StatusUnauthorized,
+		ResponseCode:    "4017300",
+		ResponseMessage: BCACommonResponseMessageUnauthorizedTimestamp.ToString(),
+	}
+	BCAAuthUnauthorizedReplay = biModels.BCAResponse{
+		HTTPStatusCode:  http.StatusUnauthorized,
+		ResponseCode:    "4017300",
+		ResponseMessage: BCACommonResponseMessageUnauthorizedReplay.ToString(),
+	}
 	BCAAuthTimeout = biModels.BCAResponse{
 		HTTPStatusCode:  http.StatusRequestTimeout,
 		ResponseCode:    "5047300",
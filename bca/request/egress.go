@@ -97,7 +97,11 @@ func (s *BCAEgress) GenerateGeneralRequestHeader(ctx context.Context, request *h
 	request.Header.Set("X-TIMESTAMP", timeStamp)
 	request.Header.Set("X-SIGNATURE", signature)
 	request.Header.Set("ORIGIN", s.internalConfig.AppHost)
-	request.Header.Set("X-EXTERNAL-ID", strconv.Itoa(int(time.Now().Unix())))
+
+	// Callers that need a stable X-EXTERNAL-ID (e.g. retrying a transfer) set it beforehand
+	if request.Header.Get("X-EXTERNAL-ID") == "" {
+		request.Header.Set("X-EXTERNAL-ID", strconv.FormatInt(time.Now().UnixNano(), 10))
+	}
 
 	return nil
 }
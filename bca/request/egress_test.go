@@ -0,0 +1,53 @@
+package bca_request
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+
+	biConfig "github.com/voxtmault/bank-integration/config"
+	biInterfaces "github.com/voxtmault/bank-integration/interfaces"
+	biModels "github.com/voxtmault/bank-integration/models"
+)
+
+type fakeSecurity struct {
+	biInterfaces.Security
+}
+
+func (f *fakeSecurity) CreateSymmetricSignature(ctx context.Context, obj *biModels.SymmetricSignatureRequirement) (string, error) {
+	return "signature", nil
+}
+
+func TestGenerateGeneralRequestHeaderExternalID(t *testing.T) {
+	egress := NewBCAEgress(&fakeSecurity{}, &biConfig.BankConfig{}, &biConfig.InternalConfig{})
+
+	// Requests sent within the same second must not share an X-EXTERNAL-ID, BCA rejects the duplicates
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		request, _ := http.NewRequest(http.MethodPost, "https://bca.example/openapi/v1.0/balance-inquiry", bytes.NewBufferString(`{}`))
+		if err := egress.GenerateGeneralRequestHeader(context.Background(), request, "/openapi/v1.0/balance-inquiry", "token"); err != nil {
+			t.Fatalf("generating request header: %v", err)
+		}
+
+		externalID := request.Header.Get("X-EXTERNAL-ID")
+		if _, err := strconv.ParseUint(externalID, 10, 64); err != nil || len(externalID) > 36 {
+			t.Fatalf("expected a numeric external id of at most 36 digits, got %q", externalID)
+		}
+		if seen[externalID] {
+			t.Fatalf("external id %s generated twice", externalID)
+		}
+		seen[externalID] = true
+	}
+
+	// A caller provided external id is kept
+	request, _ := http.NewRequest(http.MethodPost, "https://bca.example/openapi/v1.0/transfer-intrabank", bytes.NewBufferString(`{}`))
+	request.Header.Set("X-EXTERNAL-ID", "12345")
+	if err := egress.GenerateGeneralRequestHeader(context.Background(), request, "/openapi/v1.0/transfer-intrabank", "token"); err != nil {
+		t.Fatalf("generating request header: %v", err)
+	}
+	if got := request.Header.Get("X-EXTERNAL-ID"); got != "12345" {
+		t.Fatalf("expected the external id to be kept, got %s", got)
+	}
+}
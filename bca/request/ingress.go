@@ -2,17 +2,18 @@ package bca_request
 
 import (
 	"context"
-	"fmt"
 	"log/slog"
 	"net/http"
+	"net/netip"
 	"regexp"
 	"strings"
 	"time"
 
-	"github.com/redis/go-redis/v9"
 	"github.com/rotisserie/eris"
 	"github.com/voxtmault/bank-integration/bca"
+	biIngress "github.com/voxtmault/bank-integration/ingress"
 	biInterfaces "github.com/voxtmault/bank-integration/interfaces"
+	biKeys "github.com/voxtmault/bank-integration/keys"
 	biModels "github.com/voxtmault/bank-integration/models"
 	biStorage "github.com/voxtmault/bank-integration/storage"
 	biUtil "github.com/voxtmault/bank-integration/utils"
@@ -21,10 +22,24 @@ import (
 type BCAIngress struct {
 	// Security is mainly used to generate signatures for request headers
 	Security biInterfaces.Security
+
+	// Secrets decrypts the client secrets, they are stored encrypted when a master key is configured
+	Secrets *biKeys.Envelope
+
+	// TimestampSkew is the accepted clock skew of the X-TIMESTAMP, signatures are rejected once seen within it. Clients
+	// can have their own skew (authenticated_banks.timestamp_skew), 0 disables the check for the other clients.
+	TimestampSkew time.Duration
+
+	// TrustedProxies are the proxies in front of us, the X-Forwarded-For they append is used as the source IP of the
+	// request when it is matched against the allowlist of the client (authenticated_banks.ip_allowlist)
+	TrustedProxies []netip.Prefix
 }
 
 var _ biInterfaces.RequestIngress = &BCAIngress{}
 
+// BCA X-EXTERNAL-ID is numeric
+var externalIDPattern = regexp.MustCompile(`^\d+$`)
+
 func NewBCAIngress(security biInterfaces.Security) *BCAIngress {
 	return &BCAIngress{
 		Security: security,
@@ -39,25 +54,12 @@ func (s *BCAIngress) VerifyAsymmetricSignature(ctx context.Context, request *htt
 	signature := request.Header.Get("X-SIGNATURE")
 
 	// Validate parsed header
-	if clientKey == "" {
-		slog.Debug("clientKey is empty")
-
-		response := bca.BCAAUthInvalidMandatoryField
-		response.ResponseMessage = response.ResponseMessage + " [X-CLIENT-KEY]"
-
-		return false, &response, ""
-	} else if timeStamp == "" {
-		slog.Debug("timeStamp is empty")
+	if header := biIngress.MissingHeader(request, "X-CLIENT-KEY", "X-TIMESTAMP", "X-SIGNATURE"); header != "" {
+		slog.Debug("mandatory header is empty", "header", header)
 
 		response := bca.BCAAUthInvalidMandatoryField
-		response.ResponseMessage = response.ResponseMessage + " [X-TIMESTAMP]"
-
-		return false, &response, ""
-	} else if signature == "" {
-		slog.Debug("signature is empty")
+		response.ResponseMessage = response.ResponseMessage + " [" + header + "]"
 
-		response := bca.BCAAUthInvalidMandatoryField
-		response.ResponseMessage = response.ResponseMessage + " [X-SIGNATURE]"
 		return false, &response, ""
 	}
 
@@ -81,7 +83,18 @@ func (s *BCAIngress) VerifyAsymmetricSignature(ctx context.Context, request *htt
 		return false, &bca.BCAAuthUnauthorizedUnknownClient, ""
 	}
 
-	result, err := s.Security.VerifyAsymmetricSignature(ctx, timeStamp, clientKey, signature)
+	if response := s.verifySourceIP(ctx, redis, request, clientKey); response != nil {
+		return false, response, ""
+	}
+
+	// Every registered client signs with its own key
+	publicKey, err := biIngress.ClientPublicKey(ctx, redis, clientKey)
+	if err != nil {
+		slog.Debug("error getting client public key", "error", err)
+		return false, &bca.BCAAuthGeneralError, ""
+	}
+
+	result, err := s.Security.VerifyAsymmetricSignature(ctx, timeStamp, clientKey, signature, publicKey)
 	if err != nil {
 		slog.Debug("error verifying signature", "error", err)
 
@@ -93,6 +106,13 @@ func (s *BCAIngress) VerifyAsymmetricSignature(ctx context.Context, request *htt
 		return false, &bca.BCAAuthGeneralError, ""
 	}
 
+	// The token signature is the same for every request of a second, it is only held to the clock skew window
+	if result {
+		if response := s.replayResponse(biIngress.VerifyTimestamp(ctx, redis, clientKey, timeStamp, s.TimestampSkew), clientKey, timeStamp); response != nil {
+			return false, response, ""
+		}
+	}
+
 	return result, nil, clientSecret
 }
 
@@ -106,25 +126,11 @@ func (s *BCAIngress) VerifySymmetricSignature(ctx context.Context, request *http
 	signature := request.Header.Get("X-SIGNATURE")
 
 	// Validate parsed header
-	if obj.Timestamp == "" {
-		slog.Debug("timeStamp is empty")
-
-		response := bca.BCAAUthInvalidMandatoryField
-		response.ResponseMessage = response.ResponseMessage + " [X-TIMESTAMP]"
-
-		return false, &response
-	} else if obj.AccessToken == "" {
-		slog.Debug("accessToken is empty")
-
-		response := bca.BCAAUthInvalidMandatoryField
-		response.ResponseMessage = response.ResponseMessage + " [Authorization]"
-
-		return false, &response
-	} else if signature == "" {
-		slog.Debug("signature is empty")
+	if header := biIngress.MissingHeader(request, "X-TIMESTAMP", "Authorization", "X-SIGNATURE"); header != "" {
+		slog.Debug("mandatory header is empty", "header", header)
 
 		response := bca.BCAAUthInvalidMandatoryField
-		response.ResponseMessage = response.ResponseMessage + " [X-SIGNATURE]"
+		response.ResponseMessage = response.ResponseMessage + " [" + header + "]"
 
 		return false, &response
 	}
@@ -149,13 +155,13 @@ func (s *BCAIngress) VerifySymmetricSignature(ctx context.Context, request *http
 	}
 
 	// Retrieve the client secret from redis
-	clientSecret, err := s.ValidateAccessToken(ctx, redis, obj.AccessToken)
+	token, err := s.ValidateAccessToken(ctx, redis, obj.AccessToken)
 	if err != nil {
 		slog.Debug("error getting client secret", "error", err)
 		return false, &bca.BCAAuthGeneralError
 	}
 
-	if clientSecret == "" {
+	if token == nil {
 		slog.Debug("accessToken is not registered")
 		return false, &bca.BCAAuthInvalidToken
 	}
@@ -165,6 +171,17 @@ func (s *BCAIngress) VerifySymmetricSignature(ctx context.Context, request *http
 
 	obj.RequestBody = payload
 
+	if response := s.verifySourceIP(ctx, redis, request, token.ClientID); response != nil {
+		return false, response
+	}
+
+	// The client secret is only decrypted in memory, for the time of the verification
+	clientSecret, err := s.Secrets.Decrypt(ctx, token.ClientSecret, token.ClientID)
+	if err != nil {
+		slog.Debug("error decrypting client secret", "error", err)
+		return false, &bca.BCAAuthGeneralError
+	}
+
 	result, err := s.Security.VerifySymmetricSignature(ctx, &obj, clientSecret, signature)
 	if err != nil {
 		slog.Debug("error verifying signature", "error", err)
@@ -176,61 +193,95 @@ func (s *BCAIngress) VerifySymmetricSignature(ctx context.Context, request *http
 		return false, &bca.BCAAuthGeneralError
 	}
 
+	if result {
+		if response := s.verifyReplay(ctx, redis, token.ClientID, obj.Timestamp, signature); response != nil {
+			return false, response
+		}
+	}
+
 	return result, nil
 }
 
-func (s *BCAIngress) ValidateAccessToken(ctx context.Context, rdb *biStorage.RedisInstance, accessToken string) (string, error) {
-	// Logic
-	// 1. Get the access token from Redis
-	// 2. If redis return nil then return false to the caller
-	// 3. if redis returns a value then return true to the caller
-
-	data, err := rdb.RDB.Get(ctx, fmt.Sprintf("%s:%s", biUtil.AccessTokenRedis, accessToken)).Result()
+func (s *BCAIngress) ValidateAccessToken(ctx context.Context, rdb *biStorage.RedisInstance, accessToken string) (*biModels.AccessToken, error) {
+	token, err := biIngress.AccessToken(ctx, rdb, accessToken)
 	if err != nil {
-		if err == redis.Nil {
-			slog.Debug("token not found in redis, possibly expired or nonexistent")
-			return "", nil
-		} else {
-			slog.Debug("error getting data from redis", "error", err)
-			return "", eris.Wrap(err, "getting data from redis")
-		}
+		slog.Debug("error getting access token", "error", err)
+		return nil, err
 	}
 
-	slog.Debug("token found in redis", "client secret", data)
+	if token == nil {
+		slog.Debug("token not found in redis, possibly expired, nonexistent or issued without client id")
+	}
 
-	return data, nil
+	return token, nil
 }
 
-func (s *BCAIngress) ValidateUniqueExternalID(ctx context.Context, rdb *biStorage.RedisInstance, externalId string) (bool, error) {
-	// Get only the first 36 characters of the externalId
-	if len(externalId) > 36 {
-		externalId = externalId[:36]
+func (s *BCAIngress) ValidateUniqueExternalID(ctx context.Context, rdb *biStorage.RedisInstance, request *http.Request, ttl time.Duration) (bool, []byte, error) {
+	key, err := biIngress.ExternalIDKey(ctx, rdb, request, biUtil.BankCodeBCA, externalIDPattern)
+	if err != nil {
+		slog.Debug("invalid externalId", "error", err)
+		return false, nil, err
 	}
 
-	// Check if the external ID is numeric using regex
-	if isNumeric := regexp.MustCompile(`^\d+$`).MatchString(externalId); !isNumeric {
-		slog.Debug("externalId is not numeric", "externalId", externalId)
-		return false, eris.New("invalid field format")
+	reserved, response, err := biIngress.ReserveExternalID(ctx, rdb, key, ttl)
+	if err != nil {
+		slog.Debug("error reserving externalId", "error", err)
+		return false, nil, err
+	}
+	if !reserved {
+		slog.Debug("externalId already exists", "key", key)
 	}
 
-	data, err := rdb.RDB.SMembers(ctx, fmt.Sprintf("%s:%s", biUtil.UniqueExternalIDRedis, biUtil.BankCodeBCA)).Result()
+	return reserved, response, nil
+}
+
+func (s *BCAIngress) SaveExternalIDResponse(ctx context.Context, rdb *biStorage.RedisInstance, request *http.Request, response []byte) error {
+	key, err := biIngress.ExternalIDKey(ctx, rdb, request, biUtil.BankCodeBCA, externalIDPattern)
 	if err != nil {
-		slog.Debug("error getting data from redis", "error", err)
-		return false, eris.Wrap(err, "getting data from redis")
+		return err
 	}
 
-	for _, item := range data {
-		if externalId == item {
-			slog.Debug("externalId already exists", "externalId", externalId, "cached id", item)
-			return false, nil
-		}
+	return biIngress.SaveExternalIDResponse(ctx, rdb, key, response)
+}
+
+func (s *BCAIngress) VerifyClientSecret(ctx context.Context, clientID, storedSecret, clientSecret string) (bool, error) {
+	return s.Secrets.Equal(ctx, storedSecret, clientSecret, clientID)
+}
+
+// verifyReplay answers the rejection of biIngress.VerifyReplay with the BCA response code
+func (s *BCAIngress) verifyReplay(ctx context.Context, rdb *biStorage.RedisInstance, clientID, timeStamp, signature string) *biModels.BCAResponse {
+	return s.replayResponse(biIngress.VerifyReplay(ctx, rdb, biUtil.BankCodeBCA, clientID, timeStamp, signature, s.TimestampSkew), clientID, timeStamp)
+}
+
+// replayResponse maps the rejection of biIngress.VerifyReplay or biIngress.VerifyTimestamp to the BCA response code
+func (s *BCAIngress) replayResponse(err error, clientID, timeStamp string) *biModels.BCAResponse {
+	switch {
+	case err == nil:
+		return nil
+	case eris.Is(err, biIngress.ErrTimestampOutOfSkew):
+		slog.Debug("timestamp outside of the accepted clock skew", "timestamp", timeStamp)
+		return &bca.BCAAuthUnauthorizedTimestamp
+	case eris.Is(err, biIngress.ErrSignatureReplayed):
+		slog.Debug("signature already used", "client id", clientID)
+		return &bca.BCAAuthUnauthorizedReplay
 	}
 
-	// If it's a new one then add to the hash sets
-	if err = rdb.RDB.SAdd(ctx, fmt.Sprintf("%s:%s", biUtil.UniqueExternalIDRedis, biUtil.BankCodeBCA), externalId).Err(); err != nil {
-		slog.Debug("error saving data to redis cache", "error", err)
-		return false, eris.Wrap(err, "saving data to redis cache")
+	slog.Debug("error verifying replay", "error", err)
+	return &bca.BCAAuthGeneralError
+}
+
+// verifySourceIP answers the rejection of biIngress.VerifySourceIP with the BCA response code
+func (s *BCAIngress) verifySourceIP(ctx context.Context, rdb *biStorage.RedisInstance, request *http.Request, clientID string) *biModels.BCAResponse {
+	err := biIngress.VerifySourceIP(ctx, rdb, request, clientID, s.TrustedProxies)
+	if err == nil {
+		return nil
+	}
+	if eris.Is(err, biIngress.ErrConnectionNotAllowed) {
+		slog.Warn("rejected callback from a source ip outside of the client allowlist", "client id", clientID,
+			"remote addr", request.RemoteAddr, "x-forwarded-for", request.Header.Values("X-Forwarded-For"), "error", err)
+		return &bca.BCAAuthUnauthorizedConnectionNotAllowed
 	}
 
-	return true, nil
+	slog.Debug("error verifying source ip", "error", err)
+	return &bca.BCAAuthGeneralError
 }
@@ -9,21 +9,19 @@ import (
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/sha512"
-	"crypto/x509"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
-	"encoding/pem"
 	"fmt"
 	"log/slog"
 	"net/url"
-	"os"
 	"sort"
 	"strings"
 
 	"github.com/rotisserie/eris"
 	biConfig "github.com/voxtmault/bank-integration/config"
 	biInterfaces "github.com/voxtmault/bank-integration/interfaces"
+	biKeys "github.com/voxtmault/bank-integration/keys"
 	biModels "github.com/voxtmault/bank-integration/models"
 )
 
@@ -33,47 +31,44 @@ type BCASecurity struct {
 
 	// Variables loaded on runtime
 
-	privateKey    *rsa.PrivateKey // privateKey is used to generate and sign signatures that is to be verified by BCA API
-	bankPublicKey *rsa.PublicKey  // bcaPublicKey is used to verify the signature sent by BCA API
+	keys *biKeys.Manager // Holds the signer of our private key and the BCA public key, reloaded on rotation
 }
 
 // BCA Security implements the Security interface
 var _ biInterfaces.Security = &BCASecurity{}
 
-func NewBCASecurity(cfg *biConfig.InternalConfig, bCfg *biConfig.BankConfig) (*BCASecurity, error) {
+// NewBCASecurity signs through the signer of signerProvider, the signer provider selected by
+// PRIVATE_KEY_PROVIDER is used when it is nil
+func NewBCASecurity(cfg *biConfig.InternalConfig, bCfg *biConfig.BankConfig, signerProvider biKeys.SignerProvider) (*BCASecurity, error) {
 	obj := &BCASecurity{
 		bankConfig: bCfg,
 	}
 
 	var err error
-	obj.privateKey, err = loadPrivateKey(cfg.PrivateKeyPath)
+	obj.keys, err = biKeys.NewManager(cfg, bCfg, signerProvider)
 	if err != nil {
-		slog.Error("error loading private key", "error", err)
-		return nil, eris.Wrap(err, "loading private key")
-	}
-
-	obj.bankPublicKey, err = loadPublicKey(bCfg.PublicKeyPath)
-	if err != nil {
-		slog.Error("error loading public key", "error", err)
-		return nil, eris.Wrap(err, "loading public key")
+		slog.Error("error loading keys", "error", err)
+		return nil, eris.Wrap(err, "loading keys")
 	}
 
 	return obj, nil
 }
 
+// Keys returns the key manager holding our private key and the BCA public key
+func (s *BCASecurity) Keys() *biKeys.Manager {
+	return s.keys
+}
+
 func (s *BCASecurity) CreateAsymmetricSignature(ctx context.Context, timeStamp string) (string, error) {
 	var err error
 
-	// Checks if the private key is already loaded
-	if s.privateKey == nil {
-		return "", eris.New("private key not loaded")
-	}
+	signer := s.keys.Signer()
 
 	// Hash the String To Sign
 	hashed := sha256.Sum256([]byte(fmt.Sprintf("%s|%s", s.bankConfig.BankCredential.ClientID, timeStamp)))
 
 	// Sign the hashed string
-	signature, err := rsa.SignPKCS1v15(rand.Reader, s.privateKey, crypto.SHA256, hashed[:])
+	signature, err := signer.Sign(rand.Reader, hashed[:], crypto.SHA256)
 	if err != nil {
 		return "", eris.Wrap(err, "signing string")
 	}
@@ -82,15 +77,7 @@ func (s *BCASecurity) CreateAsymmetricSignature(ctx context.Context, timeStamp s
 	return base64.StdEncoding.EncodeToString(signature), nil
 }
 
-func (s *BCASecurity) VerifyAsymmetricSignature(ctx context.Context, timeStamp, clientKey, signature string) (bool, error) {
-
-	if s.bankPublicKey == nil {
-		var err error
-		s.bankPublicKey, err = loadPublicKey(s.bankConfig.PublicKeyPath)
-		if err != nil {
-			return false, eris.Wrap(err, "loading public key")
-		}
-	}
+func (s *BCASecurity) VerifyAsymmetricSignature(ctx context.Context, timeStamp, clientKey, signature string, publicKey *rsa.PublicKey) (bool, error) {
 
 	// Decode the received signature
 	decodedSignature, err := base64.StdEncoding.DecodeString(signature)
@@ -102,137 +89,72 @@ func (s *BCASecurity) VerifyAsymmetricSignature(ctx context.Context, timeStamp,
 	hash.Write([]byte(fmt.Sprintf("%s|%s", clientKey, timeStamp)))
 	hashed := hash.Sum(nil)
 
+	// Every registered client signs with its own key, the bank public keys are kept for the client id given to the
+	// configured bank. A rotated bank public key is still accepted during its grace period.
+	publicKeys := []*rsa.PublicKey{publicKey}
+	if publicKey == nil {
+		if clientKey != s.bankConfig.BankRequestedCredentials.ClientID {
+			return false, eris.Wrapf(rsa.ErrVerification, "no public key registered for client %s", clientKey)
+		}
+		publicKeys = s.keys.PublicKeys()
+	}
+
 	// Verify the signature
-	if err = rsa.VerifyPKCS1v15(s.bankPublicKey, crypto.SHA256, hashed, decodedSignature); err != nil {
-		return false, eris.Wrap(err, "verifying signature")
-	} else {
-		return true, nil
+	for _, key := range publicKeys {
+		if err = rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed, decodedSignature); err == nil {
+			return true, nil
+		}
 	}
+
+	return false, eris.Wrap(err, "verifying signature")
 }
 
 func (s *BCASecurity) CreateSymmetricSignature(ctx context.Context, obj *biModels.SymmetricSignatureRequirement) (string, error) {
-	// Encode the Relative URL
-	relativeURL, err := s.processRelativeURL(obj.RelativeURL)
-	if err != nil {
-		return "", eris.Wrap(err, "processing relative url")
-	}
+	return SymmetricSignature(s.bankConfig.BankCredential.ClientSecret, obj)
+}
 
-	slog.Debug("received request body", "data", obj.RequestBody)
-	// Generate the hash value of Request Body
-	requestBody, err := s.processRequestBody(obj.RequestBody)
+func (s *BCASecurity) VerifySymmetricSignature(ctx context.Context, obj *biModels.SymmetricSignatureRequirement, clientSecret, signature string) (bool, error) {
+	calculatedSignature, err := SymmetricSignature(clientSecret, obj)
 	if err != nil {
-		return "", eris.Wrap(err, "processing request body")
+		return false, err
 	}
-	stringToSign := obj.HTTPMethod + ":" + relativeURL + ":" + obj.AccessToken + ":" + requestBody + ":" + obj.Timestamp
-
-	fmt.Println("string to sign", "data", stringToSign)
 
-	// Generate Signature using SHA512-HMAC Algorithm
-	slog.Debug("loaded client key", "data", s.bankConfig.BankCredential.ClientSecret)
-	h := hmac.New(sha512.New, []byte(s.bankConfig.BankCredential.ClientSecret))
-	h.Write([]byte(stringToSign))
-	signature := h.Sum(nil)
+	slog.Debug("calculated signature", "data", calculatedSignature)
 
-	return base64.StdEncoding.EncodeToString(signature), nil
+	return hmac.Equal([]byte(signature), []byte(calculatedSignature)), nil
 }
 
-func (s *BCASecurity) VerifySymmetricSignature(ctx context.Context, obj *biModels.SymmetricSignatureRequirement, clientSecret, signature string) (bool, error) {
+// SymmetricSignature returns the base64 encoded SHA512-HMAC signature of obj using secret as the key. The string to
+// sign follows the SNAP format: METHOD:relativeURL:accessToken:lowercase(hex(sha256(minify(body)))):timestamp.
+func SymmetricSignature(secret string, obj *biModels.SymmetricSignatureRequirement) (string, error) {
 	// Encode the Relative URL
-	relativeURL, err := s.processRelativeURL(obj.RelativeURL)
+	relativeURL, err := processRelativeURL(obj.RelativeURL)
 	if err != nil {
-		return false, eris.Wrap(err, "processing relative url")
+		return "", eris.Wrap(err, "processing relative url")
 	}
 
 	// Generate the hash value of Request Body
-	requestBody, err := s.processRequestBody(obj.RequestBody)
+	requestBody, err := processRequestBody(obj.RequestBody)
 	if err != nil {
-		return false, eris.Wrap(err, "processing request body")
+		return "", eris.Wrap(err, "processing request body")
 	}
 	stringToSign := obj.HTTPMethod + ":" + relativeURL + ":" + obj.AccessToken + ":" + requestBody + ":" + obj.Timestamp
 
 	slog.Debug("string to sign", "data", stringToSign)
 
-	h := hmac.New(sha512.New, []byte(clientSecret))
+	// Generate Signature using SHA512-HMAC Algorithm
+	h := hmac.New(sha512.New, []byte(secret))
 	h.Write([]byte(stringToSign))
 
-	calculatedSignature := base64.StdEncoding.EncodeToString(h.Sum(nil))
-
-	slog.Debug("calculated signature", "data", calculatedSignature)
-
-	return hmac.Equal([]byte(signature), []byte(calculatedSignature)), nil
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
 }
 
 // Helper Functions
 
-func loadPrivateKey(path string) (*rsa.PrivateKey, error) {
-	// Read the private key file
-
-	slog.Debug("Loading Private Key", "Path: ", path)
-
-	keyData, err := os.ReadFile(path)
-	if err != nil {
-		slog.Debug("error reading file", "error: ", err)
-		return nil, eris.Wrap(err, "reading file")
-	}
-
-	// Decode the PEM Block
-	block, _ := pem.Decode(keyData)
-	if block == nil {
-		return nil, eris.New("failed to decode PEM block containing private key")
-	}
-
-	// Check the type of the PEM block
-	var privateKey *rsa.PrivateKey
-	if block.Type == "RSA PRIVATE KEY" {
-		privateKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
-		if err != nil {
-			return nil, eris.Wrap(err, "failed to parse PKCS1 private key")
-		}
-	} else if block.Type == "PRIVATE KEY" {
-		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
-		if err != nil {
-			return nil, eris.Wrap(err, "failed to parse PKCS8 private key")
-		}
-		var ok bool
-		privateKey, ok = key.(*rsa.PrivateKey)
-		if !ok {
-			return nil, eris.New("not an RSA private key")
-		}
-	} else {
-		return nil, eris.New("unsupported key type " + block.Type)
-	}
-
-	return privateKey, nil
-}
-
-func loadPublicKey(path string) (*rsa.PublicKey, error) {
-	keyData, err := os.ReadFile(path)
-	if err != nil {
-		return nil, err
-	}
-
-	block, _ := pem.Decode(keyData)
-	if block == nil || block.Type != "PUBLIC KEY" {
-		return nil, fmt.Errorf("failed to decode PEM block containing public key")
-	}
-
-	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
-	if err != nil {
-		return nil, err
-	}
-
-	switch pub := pub.(type) {
-	case *rsa.PublicKey:
-		return pub, nil
-	default:
-		return nil, fmt.Errorf("unexpected type of public key")
-	}
-}
-
 // processRequestBody is a helper function that returns a lowercase hex encoded SHA256 hash of the minified request body
-func (s *BCASecurity) processRequestBody(obj []byte) (string, error) {
+func processRequestBody(obj []byte) (string, error) {
 	// MinifyJSON the Request Body
-	minifiedBody, err := s.customMinifyJSON(obj)
+	minifiedBody, err := customMinifyJSON(obj)
 	if err != nil {
 		return "", eris.Wrap(err, "minifying json")
 	}
@@ -250,7 +172,7 @@ func (s *BCASecurity) processRequestBody(obj []byte) (string, error) {
 }
 
 // Custom function to minify JSON while preserving whitespace within keys and values
-func (s *BCASecurity) customMinifyJSON(input []byte) (string, error) {
+func customMinifyJSON(input []byte) (string, error) {
 	var buf bytes.Buffer
 	if err := json.Compact(&buf, input); err != nil {
 		return "", err
@@ -258,7 +180,7 @@ func (s *BCASecurity) customMinifyJSON(input []byte) (string, error) {
 	return buf.String(), nil
 }
 
-func (s *BCASecurity) processRelativeURL(rawUrl string) (string, error) {
+func processRelativeURL(rawUrl string) (string, error) {
 
 	// Parse the URL
 	parsedURL, err := url.Parse(rawUrl)
@@ -9,10 +9,10 @@ import (
 	"io"
 	"log/slog"
 	"net/http"
-	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-playground/validator/v10"
@@ -21,10 +21,13 @@ import (
 	"github.com/rotisserie/eris"
 	"github.com/voxtmault/bank-integration/bca"
 	biConfig "github.com/voxtmault/bank-integration/config"
+	biHTTPClient "github.com/voxtmault/bank-integration/httpclient"
 	biInterfaces "github.com/voxtmault/bank-integration/interfaces"
 	biLogger "github.com/voxtmault/bank-integration/logger"
 	biModels "github.com/voxtmault/bank-integration/models"
+	biOutbox "github.com/voxtmault/bank-integration/outbox"
 	biStorage "github.com/voxtmault/bank-integration/storage"
+	biTokens "github.com/voxtmault/bank-integration/tokens"
 
 	// timerexpired "github.com/voxtmault/bank-integration/timer_expired"
 	biUtil "github.com/voxtmault/bank-integration/utils"
@@ -38,6 +41,10 @@ type BCAService struct {
 	Ingress         biInterfaces.RequestIngress
 	GeneralSecurity biUtil.GeneralSecurity
 
+	// Security signs and verifies the requests of Egress and Ingress, set by the factory creating the instance so
+	// that its keys can be reloaded or the security swapped while the instance is running
+	Security biInterfaces.Security
+
 	// Adding Watcher here instead of using a centralized Watcher is an intentional design choice
 	Watcher *watcher.TransactionWatcher
 
@@ -45,7 +52,17 @@ type BCAService struct {
 	bankConfig     *biConfig.BankConfig
 	internalConfig *biConfig.InternalConfig
 
-	httpProxy *http.Transport
+	// HTTPClient sends the requests to BCA, shared by every bank service when created through the registry
+	HTTPClient *biHTTPClient.Client
+
+	// tokenRenewer renews the BCA access token, a single replica requests it at a time
+	tokenRenewer *biTokens.Renewer
+	// tokenLock guards the access token of BankRuntimeConfig, it is renewed while other requests are being signed
+	tokenLock sync.RWMutex
+
+	// closers release the resources tied to the instance on Close, see OnClose
+	closers   []func()
+	closeLock sync.Mutex
 
 	// DB Connections
 	DB  *sql.DB
@@ -54,11 +71,11 @@ type BCAService struct {
 
 var _ biInterfaces.SNAP = &BCAService{}
 
-var service *BCAService
-
+// NewBCAService creates a new instance of the BCA service. Every call returns an independent instance, so multiple
+// BCA accounts can be served by the same process as long as each one is given its own BankConfig.
 func NewBCAService(egress biInterfaces.RequestEgress, ingress biInterfaces.RequestIngress, cfg *biConfig.InternalConfig, bCfg *biConfig.BankConfig, db *sql.DB, rdb *biStorage.RedisInstance) (*BCAService, error) {
 
-	service = &BCAService{
+	service := &BCAService{
 		Egress:         egress,
 		Ingress:        ingress,
 		internalConfig: cfg,
@@ -73,38 +90,59 @@ func NewBCAService(egress biInterfaces.RequestEgress, ingress biInterfaces.Reque
 		return nil, err
 	}
 
+	service.tokenRenewer = biTokens.NewRenewer(rdb, service.accessTokenKey(), service.requestAccessToken)
+
+	// Watched transactions are shared through redis when multiple replicas serve the same bank
+	if cfg.TransactionWatcherConfig.Distributed {
+		service.Watcher = watcher.NewDistributedTransactionWatcher(db, rdb.RDB, &cfg.TransactionWatcherConfig,
+			bCfg.BankCredential.InternalBankID, bCfg.BankCredential.InternalBankName)
+		service.Watcher.Start()
+	}
+
 	// Get VA created by the loaded bank id that is still waiting for payment and add it to the watcher
 	if err := service.GetAllVAWaitingPayment(context.Background()); err != nil {
 		slog.Error("error getting all va waiting payment", "error", err)
+		service.Watcher.Stop()
 		return nil, err
 	}
 
 	if cfg.ForwardProxyConfig.ProxyAddress != "" {
 		slog.Debug("using forward proxy", "proxy", cfg.ForwardProxyConfig.ProxyAddress)
-		proxyUrl, err := url.Parse(cfg.ForwardProxyConfig.ProxyAddress)
-		if err != nil {
-			return nil, eris.Wrap(err, "parsing proxy address")
-		}
+	}
 
-		service.httpProxy = &http.Transport{
-			Proxy: http.ProxyURL(proxyUrl),
-		}
+	httpClient, err := biHTTPClient.New(&cfg.EgressConfig, cfg.ForwardProxyConfig.ProxyAddress)
+	if err != nil {
+		service.Watcher.Stop()
+		return nil, eris.Wrap(err, "creating http client")
 	}
+	service.HTTPClient = httpClient
 
 	return service, nil
 }
 
-func GetBCAService() *BCAService {
-	if service != nil {
-		return service
-	}
+func (s *BCAService) GetWatcher() *watcher.TransactionWatcher {
+	return s.Watcher
+}
 
-	return nil
+// OnClose registers f to be run by Close, e.g. to stop the key reloads of the security used by the instance
+func (s *BCAService) OnClose(f func()) {
+	s.closeLock.Lock()
+	defer s.closeLock.Unlock()
+
+	s.closers = append(s.closers, f)
 }
 
-func (s *BCAService) GetWatcher() *watcher.TransactionWatcher {
-	if service != nil {
-		return service.Watcher
+// Close stops the transaction watcher and runs the functions registered through OnClose once, the registry calls it
+// when the instance is removed or rejected
+func (s *BCAService) Close() error {
+	s.closeLock.Lock()
+	closers := s.closers
+	s.closers = nil
+	s.closeLock.Unlock()
+
+	s.Watcher.Stop()
+	for _, f := range closers {
+		f()
 	}
 
 	return nil
@@ -117,31 +155,40 @@ func (s *BCAService) GetAccessToken(ctx context.Context) error {
 
 	// Flow
 	// 1. Check in redis for existing access token (possibly set by other instance)
-	// 2. If exists, then use that token and the ttl for the current session
-	// 3. If not then request a new token to bca api
+	// 2. If it is still valid past the refresh margin, then use that token and the ttl for the current session
+	// 3. If not then request a new token to bca api, only one instance requests it while the others wait for it
+	return s.renewAccessToken(ctx, "")
+}
 
-	// Check in redis for bca api access token
-	accessToken, err := s.RDB.RDB.Get(ctx, biUtil.BCAAccessToken).Result()
-	if err != nil && err != redis.Nil {
-		slog.Debug("error getting access token from redis", "error", err)
-		return eris.Wrap(err, "getting access token from redis")
+// renewAccessToken loads a valid access token into the current instance, rejected is a token refused by BCA that
+// must not be used anymore
+func (s *BCAService) renewAccessToken(ctx context.Context, rejected string) error {
+	accessToken, ttl, err := s.tokenRenewer.Renew(ctx, s.bankConfig.BankRuntimeConfig.AccessTokenRefreshMargin, rejected)
+	if err != nil {
+		slog.Debug("error renewing access token", "error", err)
+		return eris.Wrap(err, "renewing access token")
 	}
 
-	if accessToken != "" {
-		// Get the remaining TTL from redis for the said key
-		ttl, err := s.RDB.RDB.TTL(ctx, biUtil.BCAAccessToken).Result()
-		if err != nil {
-			slog.Debug("error getting access token TTL from redis", "error", err)
-			return eris.Wrap(err, "getting access token TTL from redis")
-		}
+	slog.Debug("loaded bca access token", "expires in", ttl.String())
 
-		slog.Debug("loaded bca access token from redis", "expires in", ttl.String())
+	s.tokenLock.Lock()
+	s.bankConfig.BankRuntimeConfig.AccessToken = accessToken
+	s.bankConfig.BankRuntimeConfig.ExpiresAt = time.Now().Add(ttl).Unix()
+	s.tokenLock.Unlock()
 
-		s.bankConfig.BankRuntimeConfig.AccessToken = accessToken
-		s.bankConfig.BankRuntimeConfig.ExpiresAt = time.Now().Add(ttl).Unix()
-		return nil
-	}
+	return nil
+}
+
+// accessToken returns the access token loaded into the instance and its expiry (unix seconds)
+func (s *BCAService) accessToken() (string, int64) {
+	s.tokenLock.RLock()
+	defer s.tokenLock.RUnlock()
+
+	return s.bankConfig.BankRuntimeConfig.AccessToken, s.bankConfig.BankRuntimeConfig.ExpiresAt
+}
 
+// requestAccessToken requests a new access token to bca api, it is saved into redis by the token renewer
+func (s *BCAService) requestAccessToken(ctx context.Context) (string, time.Duration, error) {
 	baseUrl := s.bankConfig.BankServiceEndpoints.BaseUrl + s.bankConfig.BankServiceEndpoints.AccessTokenURL
 	method := http.MethodPost
 	body := biModels.GrantType{
@@ -151,47 +198,36 @@ func (s *BCAService) GetAccessToken(ctx context.Context) error {
 	jsonBody, err := json.Marshal(body)
 	if err != nil {
 		slog.Debug("error marshalling body", "error", err)
-		return eris.Wrap(err, "marshalling body")
+		return "", 0, eris.Wrap(err, "marshalling body")
 	}
 
 	req, err := http.NewRequestWithContext(ctx, method, baseUrl, bytes.NewBuffer(jsonBody))
 	if err != nil {
-		return eris.Wrap(err, "creating request")
+		return "", 0, eris.Wrap(err, "creating request")
 	}
 
 	if err = s.Egress.GenerateAccessRequestHeader(ctx, req); err != nil {
 		slog.Debug("error generating access token request header", "error", err)
-		return eris.Wrap(err, "access token request header")
+		return "", 0, eris.Wrap(err, "access token request header")
 	}
 
 	response, err := s.RequestHandler(ctx, req)
 	if err != nil {
 		slog.Debug("error sending request", "error", err)
 		if response != "" {
-			return eris.Wrap(eris.New(response), "sending request")
+			return "", 0, eris.Wrap(eris.New(response), "sending request")
 		} else {
-			return eris.Wrap(err, "sending request")
+			return "", 0, eris.Wrap(err, "sending request")
 		}
 	}
 
 	var atObj biModels.AccessTokenResponse
 	if err = json.Unmarshal([]byte(response), &atObj); err != nil {
 		slog.Debug("error unmarshalling response", "error", err)
-		return eris.Wrap(err, "unmarshalling response")
-	}
-
-	ttl := time.Now().Add(time.Second * time.Duration(s.bankConfig.AccessTokenExpirationTime)).Unix()
-
-	// Save to redis so that it can be used by multiple instance of the service
-	if err = s.RDB.RDB.Set(ctx, biUtil.BCAAccessToken, atObj.AccessToken, time.Second*time.Duration(s.bankConfig.AccessTokenExpirationTime)).Err(); err != nil {
-		slog.Debug("error saving access token to redis", "error", err)
-		return eris.Wrap(err, "saving access token to redis")
+		return "", 0, eris.Wrap(err, "unmarshalling response")
 	}
 
-	s.bankConfig.BankRuntimeConfig.AccessToken = atObj.AccessToken
-	s.bankConfig.BankRuntimeConfig.ExpiresAt = ttl
-
-	return nil
+	return atObj.AccessToken, time.Second * time.Duration(s.bankConfig.AccessTokenExpirationTime), nil
 }
 
 func (s *BCAService) BalanceInquiry(ctx context.Context) (*biModels.BCAAccountBalance, error) {
@@ -223,14 +259,15 @@ func (s *BCAService) BalanceInquiry(ctx context.Context) (*biModels.BCAAccountBa
 		return nil, eris.Wrap(err, "creating request")
 	}
 
-	if err = s.Egress.GenerateGeneralRequestHeader(ctx, request, s.bankConfig.BankServiceEndpoints.BalanceInquiryURL, s.bankConfig.BankRuntimeConfig.AccessToken); err != nil {
+	token, _ := s.accessToken()
+	if err = s.Egress.GenerateGeneralRequestHeader(ctx, request, s.bankConfig.BankServiceEndpoints.BalanceInquiryURL, token); err != nil {
 		return nil, eris.Wrap(err, "constructing request header")
 	}
 
 	request.Header.Set("X-PARTNER-ID", s.bankConfig.BankCredential.PartnerID)
 	request.Header.Set("CHANNEL-ID", s.bankConfig.BankChannelConfig.BusinessChannelId)
 
-	response, err := s.RequestHandler(ctx, request)
+	response, err := s.IdempotentRequestHandler(ctx, request)
 	if err != nil {
 		if response != "" {
 			return nil, eris.Wrap(eris.New(response), "sending request")
@@ -318,14 +355,15 @@ func (s *BCAService) BankStatement(ctx context.Context, fromDateTime, toDateTime
 		return nil, eris.Wrap(err, "creating request")
 	}
 
-	if err = s.Egress.GenerateGeneralRequestHeader(ctx, request, s.bankConfig.BankServiceEndpoints.BankStatementURL, s.bankConfig.BankRuntimeConfig.AccessToken); err != nil {
+	token, _ := s.accessToken()
+	if err = s.Egress.GenerateGeneralRequestHeader(ctx, request, s.bankConfig.BankServiceEndpoints.BankStatementURL, token); err != nil {
 		return nil, eris.Wrap(err, "constructing request header")
 	}
 
 	request.Header.Set("X-PARTNER-ID", s.bankConfig.BankCredential.PartnerID)
 	request.Header.Set("CHANNEL-ID", s.bankConfig.BankChannelConfig.BusinessChannelId)
 
-	response, err := s.RequestHandler(ctx, request)
+	response, err := s.IdempotentRequestHandler(ctx, request)
 	if err != nil {
 		if response != "" {
 			return nil, eris.Wrap(eris.New(response), "sending request")
@@ -347,6 +385,9 @@ func (s *BCAService) BankStatement(ctx context.Context, fromDateTime, toDateTime
 	return &obj, nil
 }
 
+// TransferIntraBank sends money from the configured source account to another BCA account. Every transfer is
+// persisted into the transfer ledger before it is sent, calling this function again with the same
+// partnerReferenceNo will reuse the original X-EXTERNAL-ID and request body instead of creating a new transfer.
 func (s *BCAService) TransferIntraBank(ctx context.Context, payload *biModels.BCATransferIntraBankReq) (*biModels.BCAResponseTransferIntraBank, error) {
 
 	// Checks if the access token is empty, if yes then get a new one
@@ -354,7 +395,9 @@ func (s *BCAService) TransferIntraBank(ctx context.Context, payload *biModels.BC
 		return nil, eris.Wrap(err, "checking access token")
 	}
 
-	payload.PartnerReferenceNumber = s.bankConfig.BankCredential.PartnerID
+	if payload.PartnerReferenceNumber == "" {
+		payload.PartnerReferenceNumber = uuid.New().String()
+	}
 	payload.SourceAccountNo = s.bankConfig.BankCredential.SourceAccount
 
 	// Checks if the value ends with .00
@@ -371,26 +414,25 @@ func (s *BCAService) TransferIntraBank(ctx context.Context, payload *biModels.BC
 		return nil, eris.Wrap(err, "validating payload")
 	}
 
-	baseUrl := s.bankConfig.BankServiceEndpoints.BaseUrl + s.bankConfig.BankServiceEndpoints.TransferIntraBankURL
-	method := http.MethodPost
 	body, err := json.Marshal(payload)
 	if err != nil {
 		return nil, eris.Wrap(err, "marshalling payload")
 	}
 
-	request, err := http.NewRequestWithContext(ctx, method, baseUrl, bytes.NewBuffer(body))
+	entry, err := s.prepareTransfer(ctx, &biModels.TransferLedger{
+		PartnerReferenceNo:   payload.PartnerReferenceNumber,
+		ServiceCode:          bca.BCAServiceIntrabankTransfer,
+		SourceAccountNo:      payload.SourceAccountNo,
+		BeneficiaryAccountNo: payload.BeneficiaryAccountNo,
+		Amount:               payload.Amount,
+		TransactionDate:      payload.TransactionDate,
+		RequestBody:          body,
+	})
 	if err != nil {
-		return nil, eris.Wrap(err, "creating request")
+		return nil, eris.Wrap(err, "preparing transfer")
 	}
 
-	if err = s.Egress.GenerateGeneralRequestHeader(ctx, request, s.bankConfig.BankServiceEndpoints.TransferIntraBankURL, s.bankConfig.BankRuntimeConfig.AccessToken); err != nil {
-		return nil, eris.Wrap(err, "constructing request header")
-	}
-
-	request.Header.Set("X-PARTNER-ID", s.bankConfig.BankCredential.PartnerID)
-	request.Header.Set("CHANNEL-ID", s.bankConfig.BankChannelConfig.BusinessChannelId)
-
-	response, err := s.RequestHandler(ctx, request)
+	response, err := s.sendTransfer(ctx, entry, s.bankConfig.BankServiceEndpoints.TransferIntraBankURL, "2001700")
 	if err != nil {
 		if response != "" {
 			return nil, eris.Wrap(eris.New(response), "sending request")
@@ -401,17 +443,14 @@ func (s *BCAService) TransferIntraBank(ctx context.Context, payload *biModels.BC
 
 	var obj biModels.BCAResponseTransferIntraBank
 	if err = json.Unmarshal([]byte(response), &obj); err != nil {
-		return nil, eris.Wrap(err, "unmarshalling balance inquiry response")
-	}
-
-	// Checks for erronous response
-	if obj.ResponseCode != "2001700" {
-		return nil, eris.New(obj.ResponseMessage)
+		return nil, eris.Wrap(err, "unmarshalling transfer intra bank response")
 	}
 
 	return &obj, nil
 }
 
+// TransferInterBank sends money from the configured source account to an account of another bank. Just like
+// TransferIntraBank, every transfer is persisted into the transfer ledger and retries reuse the same X-EXTERNAL-ID.
 func (s *BCAService) TransferInterBank(ctx context.Context, payload *biModels.BCATransferInterBankRequest) (*biModels.BCATransferInterBankResponse, error) {
 	// Checks if the access token is empty, if yes then get a new one
 	if err := s.CheckAccessToken(ctx); err != nil {
@@ -422,6 +461,9 @@ func (s *BCAService) TransferInterBank(ctx context.Context, payload *biModels.BC
 		payload.BeneficiaryBankCode = fmt.Sprintf("%08s", payload.BeneficiaryBankCode)
 	}
 
+	if payload.PartnerReferenceNo == "" {
+		payload.PartnerReferenceNo = uuid.New().String()
+	}
 	payload.SourceAccountNo = s.bankConfig.BankCredential.SourceAccount
 	payload.AdditionalInfo = &biModels.BCATransferInterBankAdditionalInfo{
 		TransferType: bca.BCAInterbankBiFAST,
@@ -442,26 +484,26 @@ func (s *BCAService) TransferInterBank(ctx context.Context, payload *biModels.BC
 		return nil, eris.Wrap(err, "validating payload")
 	}
 
-	baseUrl := s.bankConfig.BankServiceEndpoints.BaseUrl + s.bankConfig.BankServiceEndpoints.TransferInterBankURL
-	method := http.MethodPost
 	body, err := json.Marshal(payload)
 	if err != nil {
 		return nil, eris.Wrap(err, "marshalling payload")
 	}
 
-	request, err := http.NewRequestWithContext(ctx, method, baseUrl, bytes.NewBuffer(body))
+	entry, err := s.prepareTransfer(ctx, &biModels.TransferLedger{
+		PartnerReferenceNo:   payload.PartnerReferenceNo,
+		ServiceCode:          bca.BCAServiceInterbankTransfer,
+		SourceAccountNo:      payload.SourceAccountNo,
+		BeneficiaryAccountNo: payload.BeneficiaryAccountNo,
+		BeneficiaryBankCode:  payload.BeneficiaryBankCode,
+		Amount:               payload.Amount,
+		TransactionDate:      payload.TransactionDate,
+		RequestBody:          body,
+	})
 	if err != nil {
-		return nil, eris.Wrap(err, "creating request")
+		return nil, eris.Wrap(err, "preparing transfer")
 	}
 
-	if err = s.Egress.GenerateGeneralRequestHeader(ctx, request, s.bankConfig.BankServiceEndpoints.TransferInterBankURL, s.bankConfig.BankRuntimeConfig.AccessToken); err != nil {
-		return nil, eris.Wrap(err, "constructing request header")
-	}
-
-	request.Header.Set("X-PARTNER-ID", s.bankConfig.BankCredential.PartnerID)
-	request.Header.Set("CHANNEL-ID", s.bankConfig.BankChannelConfig.BusinessChannelId)
-
-	response, err := s.RequestHandler(ctx, request)
+	response, err := s.sendTransfer(ctx, entry, s.bankConfig.BankServiceEndpoints.TransferInterBankURL, "2001800")
 	if err != nil {
 		if response != "" {
 			return nil, eris.Wrap(eris.New(response), "sending request")
@@ -472,12 +514,7 @@ func (s *BCAService) TransferInterBank(ctx context.Context, payload *biModels.BC
 
 	var obj biModels.BCATransferInterBankResponse
 	if err = json.Unmarshal([]byte(response), &obj); err != nil {
-		return nil, eris.Wrap(err, "unmarshalling balance inquiry response")
-	}
-
-	// Checks for erronous response
-	if obj.ResponseCode != "2001800" {
-		return nil, eris.New(obj.ResponseMessage)
+		return nil, eris.Wrap(err, "unmarshalling transfer inter bank response")
 	}
 
 	return &obj, nil
@@ -536,14 +573,15 @@ func (s *BCAService) GetVAPaymentStatus(ctx context.Context, vaNum string) (*biM
 		return nil, eris.Wrap(err, "creating request")
 	}
 
-	if err = s.Egress.GenerateGeneralRequestHeader(ctx, request, s.bankConfig.BankServiceEndpoints.PaymentFlagURL, s.bankConfig.BankRuntimeConfig.AccessToken); err != nil {
+	token, _ := s.accessToken()
+	if err = s.Egress.GenerateGeneralRequestHeader(ctx, request, s.bankConfig.BankServiceEndpoints.PaymentFlagURL, token); err != nil {
 		return nil, eris.Wrap(err, "constructing request header")
 	}
 
 	request.Header.Set("X-PARTNER-ID", s.bankConfig.BankCredential.PartnerID)
 	request.Header.Set("CHANNEL-ID", s.bankConfig.BankChannelConfig.VAChannelId)
 
-	response, err := s.RequestHandler(ctx, request)
+	response, err := s.IdempotentRequestHandler(ctx, request)
 	if err != nil {
 		if response != "" {
 			return nil, eris.Wrap(eris.New(response), "sending request")
@@ -565,21 +603,95 @@ func (s *BCAService) GetVAPaymentStatus(ctx context.Context, vaNum string) (*biM
 	return &obj, nil
 }
 
+// GetTransactionStatus is used to get the latest status of a transfer that was previously sent to BCA.
+// The payload must refer to the original partnerReferenceNo and X-EXTERNAL-ID used when sending the transfer, an empty
+// transactionDate is taken from the transfer ledger.
 func (s *BCAService) GetTransactionStatus(ctx context.Context, payload *biModels.BCATransactionStatusInquiryRequest) (*biModels.BCATransactionStatusInquiryResponse, error) {
-	return nil, nil
+	if payload == nil {
+		return nil, eris.New("empty payload")
+	}
+	if s.bankConfig.BankServiceEndpoints.TransferStatusInquiryURL == "" {
+		return nil, ErrTransferStatusInquiryDisabled
+	}
+
+	// Checks if the access token is empty, if yes then get a new one
+	if err := s.CheckAccessToken(ctx); err != nil {
+		return nil, eris.Wrap(err, "checking access token")
+	}
+
+	// The inquiry refers to the date the transfer was sent, not the date of the inquiry
+	if payload.TransactionDate == "" {
+		entry, err := s.GetTransferLedger(ctx, payload.OriginalPartnerReferenceNo)
+		if err != nil {
+			return nil, eris.Wrap(err, "getting transfer ledger")
+		}
+		if entry == nil {
+			return nil, eris.Errorf("transactionDate is required, transfer %s is not in the ledger", payload.OriginalPartnerReferenceNo)
+		}
+		payload.TransactionDate = entry.TransactionDate
+	}
+
+	// Validate before sending the request
+	if err := biUtil.ValidateStruct(ctx, payload); err != nil {
+		return nil, eris.Wrap(err, "validating payload")
+	}
+
+	baseUrl := s.bankConfig.BankServiceEndpoints.BaseUrl + s.bankConfig.BankServiceEndpoints.TransferStatusInquiryURL
+	method := http.MethodPost
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, eris.Wrap(err, "marshalling payload")
+	}
+
+	request, err := http.NewRequestWithContext(ctx, method, baseUrl, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, eris.Wrap(err, "creating request")
+	}
+
+	token, _ := s.accessToken()
+	if err = s.Egress.GenerateGeneralRequestHeader(ctx, request, s.bankConfig.BankServiceEndpoints.TransferStatusInquiryURL, token); err != nil {
+		return nil, eris.Wrap(err, "constructing request header")
+	}
+
+	request.Header.Set("X-PARTNER-ID", s.bankConfig.BankCredential.PartnerID)
+	request.Header.Set("CHANNEL-ID", s.bankConfig.BankChannelConfig.BusinessChannelId)
+
+	response, err := s.IdempotentRequestHandler(ctx, request)
+	if err != nil {
+		if response != "" {
+			return nil, eris.Wrap(eris.New(response), "sending request")
+		} else {
+			return nil, eris.Wrap(err, "sending request")
+		}
+	}
+
+	var obj biModels.BCATransactionStatusInquiryResponse
+	if err = json.Unmarshal([]byte(response), &obj); err != nil {
+		return nil, eris.Wrap(err, "unmarshalling transaction status inquiry response")
+	}
+
+	// Checks for erronous response
+	if obj.ResponseCode != "2003600" {
+		return nil, eris.New(obj.ResponseMessage)
+	}
+
+	obj.TransactionStatus = biModels.ParseBCATransactionStatus(obj.LatestTransactionStatus)
+
+	return &obj, nil
 }
 
 // ChecksAccessToken is an exclusive function to renew the access token if it is expired or if it's empty.
 func (s *BCAService) CheckAccessToken(ctx context.Context) error {
-	if s.bankConfig.BankRuntimeConfig.AccessToken == "" {
+	token, expiresAt := s.accessToken()
+	if token == "" {
 		// Access token is empty, get a new one
 		slog.Debug("access Token is empty, getting a new one")
 		if err := s.GetAccessToken(ctx); err != nil {
 			return eris.Wrap(err, "getting access token")
 		}
-	} else if time.Now().Unix() > s.bankConfig.BankRuntimeConfig.ExpiresAt {
-		slog.Debug("access Token is expired, getting a new one")
-		// Access token is expired, get a new one
+	} else if time.Now().Add(s.bankConfig.BankRuntimeConfig.AccessTokenRefreshMargin).Unix() >= expiresAt {
+		slog.Debug("access Token is about to expire, getting a new one")
+		// Access token expires within the refresh margin, renew it before BCA rejects it
 		if err := s.GetAccessToken(ctx); err != nil {
 			return eris.Wrap(err, "renewing access token")
 		}
@@ -664,10 +776,12 @@ func (s *BCAService) CreateVAV2(ctx context.Context, payload *biModels.CreatePay
 	}
 
 	partnerId := s.padPartnerServiceId(s.bankConfig.BankCredential.VAPrefix)
+	rule := payload.AmountRule()
 	query := `
 	INSERT INTO va_request (id_bank, id_wallet, id_transaction, expired_date, partnerServiceId, customerNo,
-							virtualAccountNo, totalAmountValue, virtualAccountName, id_order)
-	VALUES(?,NULLIF(?,0),NULLIF(?,0),?,?,?,?,?,?,NULLIF(?,0))
+							virtualAccountNo, totalAmountValue, virtualAccountName, id_order, virtualAccountTrxType,
+							minAmountValue, maxAmountValue)
+	VALUES(?,NULLIF(?,0),NULLIF(?,0),?,?,?,?,?,?,NULLIF(?,0),?,?,?)
 	`
 	expiredTime := time.Now().Add(time.Hour * time.Duration(s.bankConfig.VirtualAccountConfig.VirtualAccountLife))
 	slog.Info("expired time", "expiredTime", expiredTime.Format(time.DateTime))
@@ -693,7 +807,8 @@ func (s *BCAService) CreateVAV2(ctx context.Context, payload *biModels.CreatePay
 
 	// No active billing for the said VA Number
 	if _, err = tx.ExecContext(ctx, query, payload.IDBank, payload.IDWallet, payload.IDTransaction, expiredTime.Format(time.DateTime),
-		partnerId, payload.CustomerNo, vaNumber, payload.TotalAmount, payload.AccountName, payload.IDOrder); err != nil {
+		partnerId, payload.CustomerNo, vaNumber, payload.TotalAmount, payload.AccountName, payload.IDOrder, rule.TrxType,
+		rule.Min, rule.Max); err != nil {
 		tx.Rollback()
 		return eris.Wrap(err, "inserting into va_request")
 	}
@@ -716,10 +831,69 @@ func (s *BCAService) CreateVAV2(ctx context.Context, payload *biModels.CreatePay
 	return nil
 }
 
+// CancelVA marks the pending VA Payment Request of the transaction as cancelled, records the va.cancelled payment
+// event in the same transaction and stops its watcher.
+func (s *BCAService) CancelVA(ctx context.Context, idTransaction uint) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return eris.Wrap(err, "beginning transaction")
+	}
+	defer tx.Rollback()
+
+	event := biModels.PaymentEvent{
+		IDBank:        s.bankConfig.BankCredential.InternalBankID,
+		EventType:     biUtil.PaymentEventVACancelled,
+		IDTransaction: idTransaction,
+	}
+	statement := `
+	SELECT id, TRIM(virtualAccountNo), COALESCE(inquiryRequestId, ''), paidAmountValue, paidAmountCurrency,
+		   totalAmountValue, totalAmountCurrency
+	FROM va_request
+	WHERE id_transaction = ? AND id_bank = ? AND id_va_status = ?
+	ORDER BY created_at DESC
+	LIMIT 1
+	FOR UPDATE
+	`
+	if err = tx.QueryRowContext(ctx, statement, idTransaction, event.IDBank, biUtil.VAStatusPending).Scan(
+		&event.IDVARequest, &event.VirtualAccountNo, &event.PaymentRequestID, &event.PaidAmount.Value,
+		&event.PaidAmount.Currency, &event.TotalAmount.Value, &event.TotalAmount.Currency,
+	); err != nil {
+		if err == sql.ErrNoRows {
+			return eris.New("no va waiting for payment found")
+		}
+		return eris.Wrap(err, "querying va_request")
+	}
+
+	statement = `
+	UPDATE va_request SET id_va_status = ?
+	WHERE id = ?
+	`
+	if _, err = tx.ExecContext(ctx, statement, biUtil.VAStatusCancelled, event.IDVARequest); err != nil {
+		return eris.Wrap(err, "updating va_request")
+	}
+
+	if err = biOutbox.Record(ctx, tx, &event); err != nil {
+		return eris.Wrap(err, "recording payment event")
+	}
+
+	if err = tx.Commit(); err != nil {
+		return eris.Wrap(err, "committing transaction")
+	}
+
+	// Stops the watcher, notifies the external channel and logs the cancellation
+	s.Watcher.TransactionCancelled(idTransaction)
+
+	return nil
+}
+
 // Ingress
 
 // GenerateAccessTokens is called by the bank to generate access tokens for the client
 func (s *BCAService) GenerateAccessToken(ctx context.Context, request *http.Request) (*biModels.AccessTokenResponse, error) {
+	return biLogger.Ingress(ctx, request, s.generateAccessToken)
+}
+
+func (s *BCAService) generateAccessToken(ctx context.Context, request *http.Request) (*biModels.AccessTokenResponse, error) {
 	// Logic
 	// 1. Parse the request body
 	// 2. Parse the request header
@@ -730,27 +904,11 @@ func (s *BCAService) GenerateAccessToken(ctx context.Context, request *http.Requ
 	// 7. Save the Access Token along with client secret to redis
 	// 8. Return to caller
 
-	logMessage := biModels.BankLog{
-		ClientIP:   request.RemoteAddr,
-		HTTPMethod: request.Method,
-		Protocol:   request.Proto,
-		URI:        request.RequestURI,
-	}
-
-	reqParam, _ := json.Marshal(request.URL.Query())
-	logMessage.RequestParameter = string(reqParam)
-
-	ctx = context.WithValue(ctx, biLogger.BankLogCtxKey, &logMessage)
-
 	bodyBytes, err := io.ReadAll(request.Body)
 	if err != nil {
 		response := biModels.AccessTokenResponse{
 			BCAResponse: &bca.BCAAuthGeneralError,
 		}
-		responseStr, _ := json.Marshal(response)
-		logMessage.ResponseCode = uint(response.BCAResponse.HTTPStatusCode)
-		logMessage.ResponseMessage = response.BCAResponse.ResponseMessage
-		logMessage.ResponseContent = string(responseStr)
 
 		return &response, eris.Wrap(err, "reading request body")
 	}
@@ -759,8 +917,6 @@ func (s *BCAService) GenerateAccessToken(ctx context.Context, request *http.Requ
 	// returns the request body value to be used down the function flow
 	request.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
 
-	logMessage.RequestBody = string(bodyBytes)
-
 	// Parse the request body
 	var body biModels.GrantType
 	if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
@@ -769,11 +925,6 @@ func (s *BCAService) GenerateAccessToken(ctx context.Context, request *http.Requ
 			BCAResponse: &bca.BCAAuthGeneralError,
 		}
 
-		responseStr, _ := json.Marshal(response)
-		logMessage.ResponseCode = uint(response.BCAResponse.HTTPStatusCode)
-		logMessage.ResponseMessage = response.BCAResponse.ResponseMessage
-		logMessage.ResponseContent = string(responseStr)
-
 		return &response, eris.Wrap(err, "decoding request body")
 	}
 
@@ -784,11 +935,6 @@ func (s *BCAService) GenerateAccessToken(ctx context.Context, request *http.Requ
 			BCAResponse: &bca.BCAAuthInvalidFieldFormatClient,
 		}
 
-		responseStr, _ := json.Marshal(response)
-		logMessage.ResponseCode = uint(response.BCAResponse.HTTPStatusCode)
-		logMessage.ResponseMessage = response.BCAResponse.ResponseMessage
-		logMessage.ResponseContent = string(responseStr)
-
 		return &response, nil
 	}
 
@@ -799,11 +945,6 @@ func (s *BCAService) GenerateAccessToken(ctx context.Context, request *http.Requ
 			BCAResponse: response,
 		}
 
-		responseStr, _ := json.Marshal(response)
-		logMessage.ResponseCode = uint(response.BCAResponse.HTTPStatusCode)
-		logMessage.ResponseMessage = response.BCAResponse.ResponseMessage
-		logMessage.ResponseContent = string(responseStr)
-
 		return &response, nil
 	}
 
@@ -812,11 +953,6 @@ func (s *BCAService) GenerateAccessToken(ctx context.Context, request *http.Requ
 			BCAResponse: &bca.BCAAuthUnauthorizedSignature,
 		}
 
-		responseStr, _ := json.Marshal(response)
-		logMessage.ResponseCode = uint(response.BCAResponse.HTTPStatusCode)
-		logMessage.ResponseMessage = response.BCAResponse.ResponseMessage
-		logMessage.ResponseContent = string(responseStr)
-
 		return &response, nil
 	}
 
@@ -830,28 +966,18 @@ func (s *BCAService) GenerateAccessToken(ctx context.Context, request *http.Requ
 			BCAResponse: &bca.BCAAuthGeneralError,
 		}
 
-		responseStr, _ := json.Marshal(response)
-		logMessage.ResponseCode = uint(response.BCAResponse.HTTPStatusCode)
-		logMessage.ResponseMessage = response.BCAResponse.ResponseMessage
-		logMessage.ResponseContent = string(responseStr)
-
 		return &response, eris.Wrap(err, "generating access token")
 	}
 	slog.Debug("generated token", "token", token)
 
-	// Save the access token to redis along with the configured client secret & expiration time
-	key := fmt.Sprintf("%s:%s", biUtil.AccessTokenRedis, token)
-	if err := s.RDB.RDB.Set(ctx, key, clientSecret, time.Second*time.Duration(s.bankConfig.BankRequestedCredentials.AccessTokenExpireTime)).Err(); err != nil {
+	// Save the access token to redis along with the client it is issued to & expiration time
+	if _, err := biTokens.NewStore(s.RDB).Issue(ctx, token, request.Header.Get("X-CLIENT-KEY"), clientSecret, biUtil.AccessTokenScopeVA,
+		time.Second*time.Duration(s.bankConfig.BankRequestedCredentials.AccessTokenExpireTime)); err != nil {
 		slog.Debug("error saving access token to redis", "reason", err)
 		response := biModels.AccessTokenResponse{
 			BCAResponse: &bca.BCAAuthGeneralError,
 		}
 
-		responseStr, _ := json.Marshal(response)
-		logMessage.ResponseCode = uint(response.BCAResponse.HTTPStatusCode)
-		logMessage.ResponseMessage = response.BCAResponse.ResponseMessage
-		logMessage.ResponseContent = string(responseStr)
-
 		return &response, eris.Wrap(err, "saving access token to redis")
 	}
 
@@ -865,15 +991,14 @@ func (s *BCAService) GenerateAccessToken(ctx context.Context, request *http.Requ
 		BCAResponse: &bcaResponse,
 	}
 
-	responseStr, _ := json.Marshal(reqResponse)
-	logMessage.ResponseCode = uint(reqResponse.BCAResponse.HTTPStatusCode)
-	logMessage.ResponseMessage = reqResponse.BCAResponse.ResponseMessage
-	logMessage.ResponseContent = string(responseStr)
-
 	return &reqResponse, nil
 }
 
 func (s *BCAService) BillPresentment(ctx context.Context, request *http.Request) (*biModels.VAResponsePayload, error) {
+	return biLogger.Ingress(ctx, request, s.billPresentment)
+}
+
+func (s *BCAService) billPresentment(ctx context.Context, request *http.Request) (*biModels.VAResponsePayload, error) {
 	var response biModels.VAResponsePayload
 
 	// Validate Channel ID
@@ -987,7 +1112,7 @@ func (s *BCAService) BillPresentment(ctx context.Context, request *http.Request)
 	}
 
 	// Validate unique external id if the request is consistent
-	externalUnique, err := s.Ingress.ValidateUniqueExternalID(ctx, s.RDB, request.Header.Get("X-EXTERNAL-ID"))
+	externalUnique, storedResponse, err := s.Ingress.ValidateUniqueExternalID(ctx, s.RDB, request, s.bankConfig.IngressConfig.ExternalIDTTL)
 	if err != nil {
 		slog.Debug("error validating externalId", "error", err)
 
@@ -1017,24 +1142,32 @@ func (s *BCAService) BillPresentment(ctx context.Context, request *http.Request)
 		AdditionalInfo:        map[string]interface{}{},
 	}
 
-	// Call the core function
-	if err = s.BillPresentmentCore(ctx, &response, &payload); err != nil {
-		slog.Error("error in BillPresentmentCore", "error", err)
-
-		return &response, nil
-	}
-
 	if !externalUnique {
 		slog.Debug("externalId is not unique")
 
+		// The conflict is answered with the data returned to the request that used the external id first
+		var stored biModels.VAResponsePayload
+		if json.Unmarshal(storedResponse, &stored) == nil && stored.VirtualAccountData != nil {
+			response.VirtualAccountData = stored.VirtualAccountData
+		}
+
 		response.BCAResponse = bca.BCABillInquiryResponseDuplicateExternalID
 		response.VirtualAccountData.InquiryReason.English = "Cannot use the same X-EXTERNAL-ID"
 		response.VirtualAccountData.InquiryReason.Indonesia = "Tidak bisa menggunakan X-EXTERNAL-ID yang sama"
 
 		// For conflicting external id, set the inquiry status to failure
 		response.VirtualAccountData.InquiryStatus = "01"
+
+		return &response, nil
 	}
 
+	// Call the core function
+	if err = s.BillPresentmentCore(ctx, &response, &payload); err != nil {
+		slog.Error("error in BillPresentmentCore", "error", err)
+	}
+
+	s.saveExternalIDResponse(ctx, request, &response)
+
 	return &response, nil
 }
 func (s *BCAService) BillPresentmentCore(ctx context.Context, response *biModels.VAResponsePayload, payload *biModels.BCAVARequestPayload) error {
@@ -1051,13 +1184,16 @@ func (s *BCAService) BillPresentmentCore(ctx context.Context, response *biModels
 	}
 	paidAmount := biModels.Amount{}
 	statement := `
-	SELECT partnerServiceId, customerNo, virtualAccountNo, virtualAccountName, totalAmountValue, totalAmountCurrency, paidAmountValue, paidAmountCurrency,COALESCE(expired_date, CURRENT_TIMESTAMP()) AS effective_expired_date
+	SELECT partnerServiceId, customerNo, virtualAccountNo, virtualAccountName, totalAmountValue, totalAmountCurrency, paidAmountValue, paidAmountCurrency,COALESCE(expired_date, CURRENT_TIMESTAMP()) AS effective_expired_date, id_va_status,
+		   virtualAccountTrxType, minAmountValue, maxAmountValue, cumulativePaymentAmountValue
 	FROM va_request 
 	WHERE TRIM(virtualAccountNo) = ?
 	ORDER BY created_at DESC
 	LIMIT 1
 	`
 	expDate := ""
+	var vaStatus biUtil.VAPaymentStatus
+	var rule biUtil.VAAmountRule
 	err = tx.QueryRowContext(ctx, statement, strings.ReplaceAll(payload.VirtualAccountNo, " ", "")).Scan(
 		&response.VirtualAccountData.PartnerServiceID,
 		&response.VirtualAccountData.CustomerNo,
@@ -1066,7 +1202,7 @@ func (s *BCAService) BillPresentmentCore(ctx context.Context, response *biModels
 		&response.VirtualAccountData.TotalAmount.Value,
 		&response.VirtualAccountData.TotalAmount.Currency,
 		&paidAmount.Value,
-		&paidAmount.Currency, &expDate)
+		&paidAmount.Currency, &expDate, &vaStatus, &rule.TrxType, &rule.Min, &rule.Max, &rule.Cumulative)
 	if err == sql.ErrNoRows {
 		slog.Debug("bill presentment core", "error", "va not found")
 		tx.Rollback()
@@ -1096,6 +1232,16 @@ func (s *BCAService) BillPresentmentCore(ctx context.Context, response *biModels
 		response.VirtualAccountData.InquiryStatus = "01"
 		return nil
 	}
+	if vaStatus == biUtil.VAStatusCancelled {
+		slog.Debug("va has been cancelled")
+		tx.Rollback()
+		response.BCAResponse = bca.BCABillInquiryResponseVAExpired
+		response.VirtualAccountData.InquiryReason.English = "Bill Cancelled"
+		response.VirtualAccountData.InquiryReason.Indonesia = "Tagihan telah dibatalkan"
+		response.VirtualAccountData.InquiryStatus = "01"
+
+		return nil
+	}
 	nExpDate, _ := time.Parse(time.DateTime, expDate)
 	if time.Now().After(nExpDate) {
 		slog.Debug("va has been Expired")
@@ -1122,6 +1268,11 @@ func (s *BCAService) BillPresentmentCore(ctx context.Context, response *biModels
 		return eris.Wrap(err, "updating va_request")
 	}
 
+	// Advertise the amount matching the VA type, e.g. the remaining amount of an installment
+	rule.Total = response.VirtualAccountData.TotalAmount.Value
+	response.VirtualAccountData.VirtualAccountTrxType = string(rule.TrxType)
+	response.VirtualAccountData.TotalAmount.Value = rule.AdvertisedAmount()
+
 	response.BCAResponse = bca.BCABillInquiryResponseSuccess
 	response.VirtualAccountData.InquiryStatus = "00"
 	response.VirtualAccountData.InquiryReason.Indonesia = "Sukses"
@@ -1141,6 +1292,10 @@ func (s *BCAService) BillPresentmentCore(ctx context.Context, response *biModels
 }
 
 func (s *BCAService) InquiryVA(ctx context.Context, request *http.Request) (*biModels.BCAInquiryVAResponse, error) {
+	return biLogger.Ingress(ctx, request, s.inquiryVA)
+}
+
+func (s *BCAService) inquiryVA(ctx context.Context, request *http.Request) (*biModels.BCAInquiryVAResponse, error) {
 
 	var response biModels.BCAInquiryVAResponse
 
@@ -1243,6 +1398,13 @@ func (s *BCAService) InquiryVA(ctx context.Context, request *http.Request) (*biM
 
 	// Validate Auth related header
 	result, authResponse := s.Ingress.VerifySymmetricSignature(ctx, request, s.RDB, bodyBytes)
+	if authResponse != nil && *authResponse == bca.BCAAuthUnauthorizedReplay {
+		// A payment flag resent as is by BCA comes with the signature already used by the first one, the answer of
+		// the first one is replayed instead of rejecting it. The signature has been verified before being rejected
+		if replayed := s.replayResentPaymentFlag(ctx, &payload, &response); replayed != nil {
+			return replayed, nil
+		}
+	}
 	if authResponse != nil {
 		slog.Error("verifying symmetric signature failed", "response", authResponse)
 
@@ -1267,48 +1429,51 @@ func (s *BCAService) InquiryVA(ctx context.Context, request *http.Request) (*biM
 		return &response, nil
 	}
 
-	// Validate X-EXTERNAL-ID and paymentRequestID is not already stored in redis
-	key := request.Header.Get("X-EXTERNAL-ID") + ":" + payload.PaymentRequestID
-	val, err := s.RDB.RDB.Get(ctx, key).Result()
-	if err == nil && len(val) > 0 {
-		slog.Warn("X-EXTERNAL-ID and paymentRequestID already stored in redis")
-		// Meaning that a system error has occurred at BCA side causing double flagging request with the same X-EXTERNAL-ID and paymentRequestId
-		uncompressedResponse, err := biUtil.DecompressData([]byte(val))
-		if err != nil {
-			slog.Error("error decompressing response", "error", err)
-			response.BCAResponse = bca.BCAPaymentFlagResponseGeneralError
-			response.VirtualAccountData = biModels.VirtualAccountDataInquiry{}.Default()
-			response.AdditionalInfo = payload.AdditionalInfo
-
-			return &response, nil
-		}
-
-		var storedResponse biModels.BCAInquiryVAResponse
-		if err := json.Unmarshal(uncompressedResponse, &storedResponse); err != nil {
-			slog.Error("error unmarshalling stored response", "error", err)
-
-			response.BCAResponse = bca.BCAPaymentFlagResponseGeneralError
-			response.VirtualAccountData = biModels.VirtualAccountDataInquiry{}.Default()
-			response.AdditionalInfo = payload.AdditionalInfo
+	// A payment flag is answered once per paymentRequestId. BCA resends it (flagAdvise Y) when our answer did not
+	// reach them, the original answer is then replayed as is instead of flagging the payment again
+	digest, err := payload.Digest()
+	if err != nil {
+		slog.Error("error computing payment flag digest", "error", err)
+		response.BCAResponse = bca.BCAPaymentFlagResponseGeneralError
+		response.VirtualAccountData = biModels.VirtualAccountDataInquiry{}.Default()
+		response.AdditionalInfo = payload.AdditionalInfo
 
-			return &response, nil
-		}
+		return &response, nil
+	}
 
-		response.VirtualAccountData = storedResponse.VirtualAccountData
-		response.BCAResponse = bca.BCAPaymentFlagResponseDuplicateExternalIDAndPaymentRequestID
+	key := s.paymentFlagKey(payload.PaymentRequestID)
+	reservation, err := compressPaymentFlagRecord(&paymentFlagRecord{Digest: digest})
+	if err != nil {
+		slog.Error("error compressing payment flag reservation", "error", err)
+		response.BCAResponse = bca.BCAPaymentFlagResponseGeneralError
 
 		return &response, nil
-	} else if err != nil && err != redis.Nil {
-		slog.Error("error checking X-EXTERNAL-ID and paymentRequestID in redis", "error", err)
+	}
+
+	reserved, stored, err := s.RDB.ReserveKeyValue(ctx, key, string(reservation), paymentFlagProcessingTTL)
+	if err != nil {
+		slog.Error("error reserving paymentRequestID in redis", "error", err)
 		response.BCAResponse = bca.BCAPaymentFlagResponseGeneralError
-		response.VirtualAccountData = biModels.VirtualAccountDataInquiry{}.Default()
-		response.AdditionalInfo = payload.AdditionalInfo
 
 		return &response, nil
 	}
+	if !reserved {
+		return replayPaymentFlag(stored, digest, &payload, &response), nil
+	}
+
+	// The reservation is released when the payment flag is not answered, so that it can be sent again
+	answered := false
+	defer func() {
+		if answered {
+			return
+		}
+		if err := s.RDB.RDB.Del(context.WithoutCancel(ctx), key).Err(); err != nil {
+			slog.Error("error releasing paymentRequestID in redis", "error", err)
+		}
+	}()
 
 	// Validate unique external id if the request is consistent
-	externalUnique, err := s.Ingress.ValidateUniqueExternalID(ctx, s.RDB, request.Header.Get("X-EXTERNAL-ID"))
+	externalUnique, storedResponse, err := s.Ingress.ValidateUniqueExternalID(ctx, s.RDB, request, s.bankConfig.IngressConfig.ExternalIDTTL)
 	if err != nil {
 		slog.Debug("error validating externalId", "error", err)
 
@@ -1340,57 +1505,166 @@ func (s *BCAService) InquiryVA(ctx context.Context, request *http.Request) (*biM
 	}
 	response.AdditionalInfo = payload.AdditionalInfo
 
+	if !externalUnique {
+		slog.Debug("externalId is not unique")
+
+		// The conflict is answered with the data returned to the request that used the external id first
+		var stored biModels.BCAInquiryVAResponse
+		if json.Unmarshal(storedResponse, &stored) == nil && stored.VirtualAccountData != nil {
+			response.VirtualAccountData = stored.VirtualAccountData
+			response.AdditionalInfo = stored.AdditionalInfo
+		}
+
+		response.BCAResponse = bca.BCAPaymentFlagResponseDuplicateExternalID
+		response.VirtualAccountData.PaymentFlagStatus = "01"
+		response.VirtualAccountData.PaymentFlagReason.English = "Cannot use the same X-EXTERNAL-ID"
+		response.VirtualAccountData.PaymentFlagReason.Indonesia = "Tidak bisa menggunakan X-EXTERNAL-ID yang sama"
+
+		return &response, nil
+	}
+
 	// Call the core function
 	if err = s.InquiryVACore(ctx, &response, &payload); err != nil {
 		slog.Error("error in InquiryVACore", "error", eris.Cause(err))
 	}
 
-	// Save the response to redis along with the key consisting of X-EXTERNAL-ID and paymentRequestId
-	responseBytes, err := json.Marshal(response)
-	if err != nil {
-		slog.Error("error marshalling response", "error", err)
-		response.BCAResponse = bca.BCAPaymentFlagResponseGeneralError
-		response.VirtualAccountData = biModels.VirtualAccountDataInquiry{}.Default()
-		response.VirtualAccountData.BillDetails = payload.BillDetails
-		response.VirtualAccountData.FreeTexts = payload.FreeTexts
-		response.AdditionalInfo = payload.AdditionalInfo
+	s.saveExternalIDResponse(ctx, request, &response)
 
+	// A general error is not saved so that the payment flag can be retried
+	if response.HTTPStatusCode >= http.StatusInternalServerError {
 		return &response, nil
 	}
+	answered = true
+
+	// The payment is already flagged, failing to save its answer must not turn it into a general error. The
+	// reservation then expires after paymentFlagProcessingTTL.
+	if err := s.savePaymentFlag(ctx, key, digest, &response); err != nil {
+		slog.Error("error saving payment flag response", "paymentRequestID", payload.PaymentRequestID, "error", err)
+	}
+
+	return &response, nil
+}
 
-	compressedResponse, err := biUtil.CompressData(responseBytes)
+// paymentFlagProcessingTTL is the time a payment flag being processed holds its paymentRequestId
+const paymentFlagProcessingTTL = time.Minute
+
+// paymentFlagRecord is kept in redis per paymentRequestId: the digest of the payment flag and, once answered, the
+// answer replayed to the payment flags resent with the same paymentRequestId
+type paymentFlagRecord struct {
+	Digest string          `json:"digest"`
+	Status int             `json:"status,omitempty"` // HTTP status of the answer, 0 while the payment flag is processed
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+func compressPaymentFlagRecord(record *paymentFlagRecord) ([]byte, error) {
+	content, err := json.Marshal(record)
 	if err != nil {
-		slog.Error("error compressing response", "error", err)
+		return nil, eris.Wrap(err, "marshalling payment flag record")
+	}
+
+	return biUtil.CompressData(content)
+}
+
+// savePaymentFlag keeps the answer to a payment flag for PaymentFlagTTL
+func (s *BCAService) savePaymentFlag(ctx context.Context, key, digest string, response *biModels.BCAInquiryVAResponse) error {
+	body, err := json.Marshal(response)
+	if err != nil {
+		return eris.Wrap(err, "marshalling response")
+	}
+
+	record := paymentFlagRecord{Digest: digest, Status: response.HTTPStatusCode, Body: body}
+	if record.Status == 0 {
+		record.Status = http.StatusOK
+	}
+
+	content, err := compressPaymentFlagRecord(&record)
+	if err != nil {
+		return eris.Wrap(err, "compressing payment flag record")
+	}
+
+	return s.RDB.SaveToRedis(context.WithoutCancel(ctx), key, string(content), s.bankConfig.IngressConfig.PaymentFlagTTL)
+}
+
+// paymentFlagKey returns the redis key of the answer to the payment flag of paymentRequestID
+func (s *BCAService) paymentFlagKey(paymentRequestID string) string {
+	return fmt.Sprintf("%s:%d:%s", biUtil.PaymentFlagRedis, s.bankConfig.BankCredential.InternalBankID, paymentRequestID)
+}
+
+// replayResentPaymentFlag returns the answer to the payment flag previously received with the paymentRequestId of
+// payload, nil when there is none
+func (s *BCAService) replayResentPaymentFlag(ctx context.Context, payload *biModels.BCAInquiryRequest, response *biModels.BCAInquiryVAResponse) *biModels.BCAInquiryVAResponse {
+	digest, err := payload.Digest()
+	if err != nil {
+		slog.Error("error computing payment flag digest", "error", err)
+		return nil
+	}
+
+	stored, err := s.RDB.RDB.Get(ctx, s.paymentFlagKey(payload.PaymentRequestID)).Result()
+	if err != nil {
+		if err != redis.Nil {
+			slog.Error("error getting stored payment flag", "error", err)
+		}
+		return nil
+	}
+
+	return replayPaymentFlag(stored, digest, payload, response)
+}
+
+// replayPaymentFlag answers a payment flag whose paymentRequestId has been received before: the first answer is
+// replayed with its status and body when the payment flags are the same
+func replayPaymentFlag(stored, digest string, payload *biModels.BCAInquiryRequest, response *biModels.BCAInquiryVAResponse) *biModels.BCAInquiryVAResponse {
+	var record paymentFlagRecord
+	content, err := biUtil.DecompressData([]byte(stored))
+	if err == nil {
+		err = json.Unmarshal(content, &record)
+	}
+	if err != nil {
+		// The reservation expired in between, the payment flag is sent again
+		slog.Error("error reading stored payment flag", "paymentRequestID", payload.PaymentRequestID, "error", err)
 		response.BCAResponse = bca.BCAPaymentFlagResponseGeneralError
-		response.VirtualAccountData = biModels.VirtualAccountDataInquiry{}.Default()
-		response.VirtualAccountData.BillDetails = payload.BillDetails
-		response.VirtualAccountData.FreeTexts = payload.FreeTexts
-		response.AdditionalInfo = payload.AdditionalInfo
 
-		return &response, nil
+		return response
 	}
 
-	if err := s.RDB.RDB.Set(ctx, key, string(compressedResponse), 0).Err(); err != nil {
-		slog.Error("error saving response to redis", "error", err)
+	if record.Digest != digest {
+		slog.Warn("payment flag differs from the one previously received with the same paymentRequestID",
+			"paymentRequestID", payload.PaymentRequestID)
+
+		response.BCAResponse = bca.BCAPaymentFlagResponseDuplicateExternalIDAndPaymentRequestID
+		response.VirtualAccountData.PartnerServiceID = payload.PartnerServiceID
+		response.VirtualAccountData.CustomerNo = payload.CustomerNo
+		response.VirtualAccountData.VirtualAccountNo = payload.VirtualAccountNo
+		response.VirtualAccountData.PaymentRequestID = payload.PaymentRequestID
+		response.VirtualAccountData.PaymentFlagStatus = "01"
+		response.VirtualAccountData.PaymentFlagReason.English = "Inconsistent Request"
+		response.VirtualAccountData.PaymentFlagReason.Indonesia = "Permintaan Tidak Konsisten"
+
+		return response
+	}
+
+	// The first payment flag is still being processed, a general error has BCA send it again later
+	if record.Status == 0 {
+		slog.Warn("payment flag is still being processed", "paymentRequestID", payload.PaymentRequestID)
 		response.BCAResponse = bca.BCAPaymentFlagResponseGeneralError
-		response.VirtualAccountData = biModels.VirtualAccountDataInquiry{}.Default()
-		response.VirtualAccountData.BillDetails = payload.BillDetails
-		response.VirtualAccountData.FreeTexts = payload.FreeTexts
-		response.AdditionalInfo = payload.AdditionalInfo
 
-		return &response, nil
+		return response
 	}
 
-	if !externalUnique {
-		slog.Debug("externalId is not unique")
+	var replayed biModels.BCAInquiryVAResponse
+	if err := json.Unmarshal(record.Body, &replayed); err != nil {
+		slog.Error("error unmarshalling stored response", "error", err)
+		response.BCAResponse = bca.BCAPaymentFlagResponseGeneralError
 
-		response.BCAResponse = bca.BCAPaymentFlagResponseDuplicateExternalID
-		response.VirtualAccountData.PaymentFlagReason.English = "Cannot use the same X-EXTERNAL-ID"
-		response.VirtualAccountData.PaymentFlagReason.Indonesia = "Tidak bisa menggunakan X-EXTERNAL-ID yang sama"
+		return response
 	}
+	replayed.HTTPStatusCode = record.Status
+	replayed.Replayed = record.Body
 
-	return &response, nil
+	slog.Info("replaying payment flag response", "paymentRequestID", payload.PaymentRequestID, "flagAdvise", payload.FlagAdvise)
+
+	return &replayed
 }
+
 func (s *BCAService) InquiryVACore(ctx context.Context, response *biModels.BCAInquiryVAResponse, payload *biModels.BCAInquiryRequest) error {
 	response.VirtualAccountData.PaidAmount = payload.PaidAmount
 	response.VirtualAccountData.TotalAmount = payload.TotalAmount
@@ -1411,7 +1685,8 @@ func (s *BCAService) InquiryVACore(ctx context.Context, response *biModels.BCAIn
 		return eris.Wrap(err, "get virtual account paid total amount by inquiry request id")
 	}
 
-	if payload.PaidAmount.Value == "" || payload.PaidAmount.Value == "0.00" || payload.TotalAmount.Value == "" || payload.TotalAmount.Value == "0.00" {
+	// The total amount of an open VA is 0, only the paid amount is mandatory
+	if payload.PaidAmount.Value == "" || payload.PaidAmount.Value == "0.00" {
 		slog.Debug("Invalid amount")
 		response.BCAResponse = bca.BCAPaymentFlagResponseInvalidAmount
 		response.VirtualAccountData.PaymentFlagReason.English = "Invalid Amount at Paid Amount or Total Amount"
@@ -1440,15 +1715,6 @@ func (s *BCAService) InquiryVACore(ctx context.Context, response *biModels.BCAIn
 		return eris.Wrap(err, "va is expired")
 	}
 
-	if amountTotal.Value != payload.PaidAmount.Value {
-		slog.Debug("paid amount is not equal to total amount")
-		response.BCAResponse = bca.BCAPaymentFlagResponseInvalidAmount
-		response.VirtualAccountData.PaymentFlagReason.English = "Invalid Amount"
-		response.VirtualAccountData.PaymentFlagReason.Indonesia = "Jumlah yang dibayarkan tidak sesuai"
-		response.VirtualAccountData.PaymentFlagStatus = "01"
-		return nil
-	}
-
 	tx, err := s.DB.BeginTx(ctx, nil)
 	if err != nil {
 		slog.Debug("error beginning transaction", "error", err)
@@ -1459,15 +1725,71 @@ func (s *BCAService) InquiryVACore(ctx context.Context, response *biModels.BCAIn
 		return eris.Wrap(err, "beginning transaction")
 	}
 
+	// Locks the VA so that installments of the same VA are applied one after another. Only a VA still waiting for
+	// payment can be flagged, a cancelled VA is no longer a valid bill
+	var rule biUtil.VAAmountRule
 	statement := `
+	SELECT virtualAccountTrxType, totalAmountValue, minAmountValue, maxAmountValue, cumulativePaymentAmountValue
+	FROM va_request
+	WHERE inquiryRequestId = ? AND id_va_status = ?
+	LIMIT 1
+	FOR UPDATE
+	`
+	if err = tx.QueryRowContext(ctx, statement, payload.PaymentRequestID, biUtil.VAStatusPending).Scan(
+		&rule.TrxType, &rule.Total, &rule.Min, &rule.Max, &rule.Cumulative,
+	); err == sql.ErrNoRows {
+		slog.Debug("va is no longer waiting for payment")
+		tx.Rollback()
+
+		response.BCAResponse = bca.BCAPaymentFlagResponseVAExpired
+		response.VirtualAccountData.PaymentFlagReason.English = "Bill has been cancelled or expired"
+		response.VirtualAccountData.PaymentFlagReason.Indonesia = "Tagihan telah dibatalkan atau kedaluwarsa"
+		response.VirtualAccountData.PaymentFlagStatus = "01"
+
+		return nil
+	} else if err != nil {
+		slog.Error("error querying va_request amount", "error", eris.Cause(err))
+		tx.Rollback()
+
+		response.BCAResponse = bca.BCAPaymentFlagResponseGeneralError
+		response.VirtualAccountData = biModels.VirtualAccountDataInquiry{}.Default()
+		response.AdditionalInfo = map[string]interface{}{}
+
+		return eris.Wrap(err, "querying va_request amount")
+	}
+
+	var reportedCumulative string
+	if payload.CumulativePaymentAmount != nil {
+		reportedCumulative = payload.CumulativePaymentAmount.Value
+	}
+	cumulative, settled, err := rule.Apply(payload.PaidAmount.Value, reportedCumulative)
+	if err != nil {
+		slog.Debug("paid amount is not accepted", "trx type", rule.TrxType, "error", err)
+		tx.Rollback()
+
+		response.BCAResponse = bca.BCAPaymentFlagResponseInvalidAmount
+		response.VirtualAccountData.PaymentFlagReason.English = "Invalid Amount"
+		response.VirtualAccountData.PaymentFlagReason.Indonesia = "Jumlah yang dibayarkan tidak sesuai"
+		response.VirtualAccountData.PaymentFlagStatus = "01"
+
+		return nil
+	}
+
+	// An installment only moves the cumulative amount, the VA keeps waiting for payment until it is settled
+	paidAmount, status, eventType := "0.00", biUtil.VAStatusPending, biUtil.PaymentEventVAInstallment
+	if settled {
+		paidAmount, status, eventType = cumulative, biUtil.VAStatusPaid, biUtil.PaymentEventVAPaid
+	}
+
+	statement = `
 	UPDATE va_request SET paidAmountValue = ?, 
 						  paidAmountCurrency = ?, 
+						  cumulativePaymentAmountValue = ?,
 						  id_va_status = ?   
-	WHERE inquiryRequestId = ?
+	WHERE inquiryRequestId = ? AND id_va_status = ?
 	`
-	_, err = tx.ExecContext(ctx, statement, payload.PaidAmount.Value, payload.PaidAmount.Currency, biUtil.VAStatusPaid,
-		payload.PaymentRequestID)
-	if err != nil {
+	if _, err = tx.ExecContext(ctx, statement, paidAmount, payload.PaidAmount.Currency, cumulative, status,
+		payload.PaymentRequestID, biUtil.VAStatusPending); err != nil {
 		slog.Error("error updating va_request", "error", eris.Cause(err))
 		tx.Rollback()
 
@@ -1518,6 +1840,27 @@ func (s *BCAService) InquiryVACore(ctx context.Context, response *biModels.BCAIn
 		}
 	}
 
+	// Written in the same transaction as the va_request update, delivered by the payment event dispatcher
+	if err = biOutbox.Record(ctx, tx, &biModels.PaymentEvent{
+		IDBank:           s.bankConfig.BankCredential.InternalBankID,
+		EventType:        eventType,
+		IDVARequest:      vaRequestId,
+		IDTransaction:    idTransaction,
+		VirtualAccountNo: strings.ReplaceAll(payload.VirtualAccountNo, " ", ""),
+		PaymentRequestID: payload.PaymentRequestID,
+		PaidAmount:       payload.PaidAmount,
+		TotalAmount:      *amountTotal,
+	}); err != nil {
+		slog.Error("error recording payment event", "error", eris.Cause(err))
+		tx.Rollback()
+
+		response.BCAResponse = bca.BCAPaymentFlagResponseGeneralError
+		response.VirtualAccountData = biModels.VirtualAccountDataInquiry{}.Default()
+		response.AdditionalInfo = map[string]interface{}{}
+
+		return eris.Wrap(err, "recording payment event")
+	}
+
 	response.BCAResponse = bca.BCAPaymentFlagResponseSuccess
 	response.VirtualAccountData.PaymentFlagReason.English = "Success"
 	response.VirtualAccountData.PaymentFlagReason.Indonesia = "Sukses"
@@ -1537,6 +1880,11 @@ func (s *BCAService) InquiryVACore(ctx context.Context, response *biModels.BCAIn
 		return eris.Wrap(err, "committing transaction")
 	}
 
+	if !settled {
+		slog.Info("installment received", "idTransaction", idTransaction, "cumulative", cumulative)
+		return nil
+	}
+
 	// Update the watcher
 	slog.Info("Updating Transaction Watcher", "idTransaction", idTransaction)
 	s.Watcher.TransactionPaid(idTransaction)
@@ -1551,27 +1899,63 @@ func (s *BCAService) GetWatchedTransaction(ctx context.Context) []*biModels.Tran
 
 // Service Utils
 
+// saveExternalIDResponse stores the response returned to the request that reserved its X-EXTERNAL-ID, duplicates
+// of the external id are answered from it
+func (s *BCAService) saveExternalIDResponse(ctx context.Context, request *http.Request, response any) {
+	content, err := json.Marshal(response)
+	if err != nil {
+		slog.Error("error marshalling response", "error", err)
+		return
+	}
+
+	if err := s.Ingress.SaveExternalIDResponse(ctx, s.RDB, request, content); err != nil {
+		slog.Error("error saving external id response", "error", err)
+	}
+}
+
+// RequestHandler sends the request once, it is used for the requests that must not be sent twice (access token,
+// transfers). ErrCircuitOpen of the http client is returned right away while BCA keeps failing.
 func (s *BCAService) RequestHandler(ctx context.Context, request *http.Request) (string, error) {
+	return s.handleRequest(ctx, request, false)
+}
 
-	client := &http.Client{}
+// IdempotentRequestHandler is RequestHandler for the read only requests (balance, statement, status), they are
+// retried on transient failures
+func (s *BCAService) IdempotentRequestHandler(ctx context.Context, request *http.Request) (string, error) {
+	return s.handleRequest(ctx, request, true)
+}
 
-	if s.httpProxy != nil {
-		client.Transport = s.httpProxy
-	}
+func (s *BCAService) handleRequest(ctx context.Context, request *http.Request, idempotent bool) (string, error) {
+	_, body, err := s.sendRequest(ctx, request, idempotent)
+	return body, err
+}
+
+// sendRequest is handleRequest also returning the HTTP status code of the answer, 0 when no answer was received
+func (s *BCAService) sendRequest(ctx context.Context, request *http.Request, idempotent bool) (int, string, error) {
 
 	reqHeader, _ := json.Marshal(request.Header)
 	slog.Debug("request header", "header", string(reqHeader))
 
-	response, err := client.Do(request)
+	// The exchange is logged into bank_egress in the background
+	response, body, err := s.HTTPClient.DoPrepared(request, idempotent, s.resign(ctx))
 	if err != nil {
-		return "", eris.Wrap(err, "sending request")
+		return 0, "", eris.Wrap(err, "sending request")
 	}
 
-	body, err := io.ReadAll(response.Body)
-	if err != nil {
-		return "", eris.Wrap(err, "reading response body")
+	// BCA may reject a token before its expiry (e.g. renewed by another party), it is renewed and the request sent
+	// once more. The rejected request has not been processed, so this also holds for transfers.
+	if isTokenRejected(request, response, body) {
+		slog.Debug("access token rejected, renewing it", "url", request.URL.String())
+
+		if err := s.resignRequest(ctx, request); err != nil {
+			return 0, "", eris.Wrap(err, "renewing rejected access token")
+		}
+
+		response, body, err = s.HTTPClient.DoPrepared(request, idempotent, s.resign(ctx))
+		if err != nil {
+			return 0, "", eris.Wrap(err, "sending request")
+		}
 	}
-	defer response.Body.Close()
 
 	respHeader, _ := json.Marshal(response.Header)
 	slog.Debug("response header", "header", string(respHeader))
@@ -1583,22 +1967,70 @@ func (s *BCAService) RequestHandler(ctx context.Context, request *http.Request)
 		var obj biModels.BCAResponse
 
 		if err := json.Unmarshal(body, &obj); err != nil {
-			return "", eris.Wrap(err, "unmarshalling error response")
+			return response.StatusCode, "", eris.Wrap(err, "unmarshalling error response")
 		}
 
 		obj.HTTPStatusCode = response.StatusCode
 
-		response, err := json.Marshal(obj)
+		content, err := json.Marshal(obj)
+		if err != nil {
+			return response.StatusCode, "", eris.Wrap(err, "marshalling error response")
+		}
+
+		return response.StatusCode, string(content), eris.New("non-200 status code")
+	}
+
+	return response.StatusCode, string(body), nil
+}
+
+// resignRequest renews the access token rejected by BCA and signs the request again with the new one
+func (s *BCAService) resignRequest(ctx context.Context, request *http.Request) error {
+	if err := s.renewAccessToken(ctx, biUtil.BearerToken(request)); err != nil {
+		return err
+	}
+
+	if request.GetBody != nil {
+		body, err := request.GetBody()
 		if err != nil {
-			return "", eris.Wrap(err, "marshalling error response")
+			return eris.Wrap(err, "rewinding request body")
 		}
+		request.Body = body
+	}
+
+	return s.signRequest(ctx, request)
+}
 
-		return string(response), eris.New("non-200 status code")
+// resign signs a retried request again, the bank expects a new X-EXTERNAL-ID and X-TIMESTAMP on every attempt
+func (s *BCAService) resign(ctx context.Context) biHTTPClient.Prepare {
+	return func(request *http.Request) error {
+		request.Header.Del("X-EXTERNAL-ID")
+		return s.signRequest(ctx, request)
 	}
+}
 
-	// TODO Insert to egress log
+// signRequest sets the signed headers of the request with the current access token
+func (s *BCAService) signRequest(ctx context.Context, request *http.Request) error {
+	relativeURL := strings.TrimPrefix(request.URL.String(), s.bankConfig.BankServiceEndpoints.BaseUrl)
+	token, _ := s.accessToken()
+	if err := s.Egress.GenerateGeneralRequestHeader(ctx, request, relativeURL, token); err != nil {
+		return eris.Wrap(err, "constructing request header")
+	}
 
-	return string(body), nil
+	return nil
+}
+
+// isTokenRejected reports whether the response rejects the access token the request was sent with
+func isTokenRejected(request *http.Request, response *http.Response, body []byte) bool {
+	if response.StatusCode != http.StatusUnauthorized || biUtil.BearerToken(request) == "" {
+		return false
+	}
+
+	var obj biModels.BCAResponse
+	if err := json.Unmarshal(body, &obj); err != nil {
+		return false
+	}
+
+	return biUtil.IsInvalidTokenResponse(obj.ResponseCode)
 }
 
 // Deprecated: Virtual Account number will be generated from the caller / library importer
@@ -1779,16 +2211,17 @@ func (s *BCAService) GetAllVAWaitingPayment(ctx context.Context) error {
 }
 
 func (s *BCAService) getInternalBankInfo() error {
+	credentials := s.bankConfig.BankRequestedCredentials
 
 	statement := `
-	SELECT id, bank_name 
+	SELECT id, bank_name, client_secret
 	FROM authenticated_banks
-	WHERE client_id = ? AND client_secret = ? AND deleted_at IS NULL
+	WHERE client_id = ? AND deleted_at IS NULL
 	LIMIT 1
 	`
-	if err := s.DB.QueryRow(statement, s.bankConfig.BankRequestedCredentials.ClientID,
-		s.bankConfig.BankRequestedCredentials.ClientSecret).Scan(
-		&s.bankConfig.BankCredential.InternalBankID, &s.bankConfig.BankCredential.InternalBankName); err != nil {
+	var storedSecret string
+	if err := s.DB.QueryRow(statement, credentials.ClientID).Scan(
+		&s.bankConfig.BankCredential.InternalBankID, &s.bankConfig.BankCredential.InternalBankName, &storedSecret); err != nil {
 		if err == sql.ErrNoRows {
 			slog.Warn("unauthorized bank credentials")
 			return eris.New("unauthorized")
@@ -1797,11 +2230,27 @@ func (s *BCAService) getInternalBankInfo() error {
 		return err
 	}
 
+	// The stored client secret is encrypted once a master key is configured, it can not be matched in the query
+	valid, err := s.Ingress.VerifyClientSecret(context.Background(), credentials.ClientID, storedSecret, credentials.ClientSecret)
+	if err != nil {
+		return eris.Wrap(err, "verifying client secret")
+	}
+	if !valid {
+		slog.Warn("unauthorized bank credentials")
+		return eris.New("unauthorized")
+	}
+
 	slog.Debug("internal bank info", "id", s.bankConfig.BankCredential.InternalBankID, "name", s.bankConfig.BankCredential.InternalBankName)
 
 	return nil
 }
 
+// accessTokenKey returns the redis key of the BCA access token of the current instance. The key is scoped to the
+// internal bank id so that multiple BCA accounts do not overwrite each other's token.
+func (s *BCAService) accessTokenKey() string {
+	return fmt.Sprintf("%s:%d", biUtil.BCAAccessToken, s.bankConfig.BankCredential.InternalBankID)
+}
+
 func (s *BCAService) padPartnerServiceId(id string) string {
 	// For BCA, required partner service id is 8 digits, pad with " " at the front if the length is less than 8
 	for len(id) < 8 {
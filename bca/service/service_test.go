@@ -0,0 +1,92 @@
+package bca_service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	biConfig "github.com/voxtmault/bank-integration/config"
+	biModels "github.com/voxtmault/bank-integration/models"
+	biUtil "github.com/voxtmault/bank-integration/utils"
+	"github.com/voxtmault/bank-integration/watcher"
+)
+
+func TestCancelVAStopsWatcher(t *testing.T) {
+	db, sqlMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("creating sql mock: %v", err)
+	}
+	defer db.Close()
+
+	s := &BCAService{
+		DB:         db,
+		Watcher:    watcher.NewTransactionWatcherWithDB(db),
+		bankConfig: &biConfig.BankConfig{BankCredential: biConfig.BankCredential{InternalBankID: 3}},
+	}
+
+	externalChannel := make(chan uint)
+	s.Watcher.AddWatcher(&biModels.TransactionWatcher{
+		IDTransaction:   42,
+		ExpireAt:        time.Now().Add(time.Hour),
+		ExternalChannel: externalChannel,
+	})
+
+	sqlMock.ExpectBegin()
+	sqlMock.ExpectQuery("FROM va_request").WithArgs(42, 3, biUtil.VAStatusPending).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "virtualAccountNo", "inquiryRequestId", "paidAmountValue",
+			"paidAmountCurrency", "totalAmountValue", "totalAmountCurrency"}).
+			AddRow(9, "   111110001", "", "0.00", "IDR", "15000.00", "IDR"))
+	sqlMock.ExpectExec("UPDATE va_request SET id_va_status").WithArgs(biUtil.VAStatusCancelled, 9).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	sqlMock.ExpectExec("INSERT INTO payment_event").WillReturnResult(sqlmock.NewResult(1, 1))
+	sqlMock.ExpectCommit()
+	sqlMock.ExpectBegin()
+	sqlMock.ExpectExec("INSERT INTO transaction_watcher_log").
+		WithArgs(42, biUtil.WatcherCancelled, "transaction has been cancelled", 0, 0).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	sqlMock.ExpectCommit()
+
+	// The importer reads the external channel after cancelling, the cancellation must not wait for it
+	done := make(chan error)
+	go func() { done <- s.CancelVA(context.Background(), 42) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("cancelling va: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected CancelVA not to wait for the watcher")
+	}
+
+	if status := <-externalChannel; status != uint(biUtil.VAStatusCancelled) {
+		t.Fatalf("expected the importer to be notified of the cancellation, got %d", status)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for len(s.Watcher.GetWatchers()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the watcher to be removed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := sqlMock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet sql expectations: %v", err)
+	}
+}
+
+func TestCloseRunsClosersOnce(t *testing.T) {
+	s := &BCAService{Watcher: watcher.NewTransactionWatcher()}
+
+	closed := 0
+	s.OnClose(func() { closed++ })
+
+	for i := 0; i < 2; i++ {
+		if err := s.Close(); err != nil {
+			t.Fatalf("closing service: %v", err)
+		}
+	}
+	if closed != 1 {
+		t.Fatalf("expected the closers to run once, got %d", closed)
+	}
+}
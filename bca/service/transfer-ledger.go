@@ -0,0 +1,414 @@
+package bca_service
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/rotisserie/eris"
+	biHTTPClient "github.com/voxtmault/bank-integration/httpclient"
+	biModels "github.com/voxtmault/bank-integration/models"
+	biUtil "github.com/voxtmault/bank-integration/utils"
+)
+
+// Pending transfers that has been sent at least once and not updated within this duration are considered
+// to have an unknown outcome (e.g. the process crashed after sending the request)
+const stalePendingTransfer = 5 * time.Minute
+
+// A transfer reported as not found by the transfer status inquiry may not have been registered by the bank yet, it is
+// only considered failed once this duration has passed since its transaction date
+const notFoundTransferWindow = time.Hour
+
+// ErrTransferReferenceReused is returned when a partnerReferenceNo already used by another transfer is sent again
+var ErrTransferReferenceReused = eris.New("partnerReferenceNo is already used by another transfer")
+
+// ErrTransferStatusInquiryDisabled is returned when the transfer status inquiry is needed but
+// TRANSFER_STATUS_INQUIRY_URL is not configured
+var ErrTransferStatusInquiryDisabled = eris.New("transfer status inquiry url is not configured")
+
+// prepareTransfer persists the transfer into the ledger before it is sent to the bank. If a transfer with the same
+// partnerReferenceNo already exists then the stored entry is returned instead, so that retries reuse the same
+// X-EXTERNAL-ID and request body. A reused partnerReferenceNo carrying another transfer is rejected.
+func (s *BCAService) prepareTransfer(ctx context.Context, entry *biModels.TransferLedger) (*biModels.TransferLedger, error) {
+	existing, err := s.GetTransferLedger(ctx, entry.PartnerReferenceNo)
+	if err != nil {
+		return nil, eris.Wrap(err, "getting transfer ledger")
+	}
+	if existing != nil {
+		slog.Debug("transfer already exists in ledger", "partnerReferenceNo", existing.PartnerReferenceNo, "status", existing.Status)
+		if err := sameTransfer(existing, entry); err != nil {
+			return nil, err
+		}
+		return existing, nil
+	}
+
+	entry.IDBank = s.bankConfig.BankCredential.InternalBankID
+	entry.ExternalID = strconv.FormatInt(time.Now().UnixNano(), 10)
+	entry.Status = biUtil.TransferStatusPending
+
+	statement := `
+	INSERT INTO transfer_ledger (id_bank, partner_reference_no, external_id, service_code, source_account_no,
+								 beneficiary_account_no, beneficiary_bank_code, amount_value, amount_currency,
+								 transaction_date, id_transfer_status, request_body)
+	VALUES (?,?,?,?,?,?,?,?,?,?,?,?)
+	`
+	result, err := s.DB.ExecContext(ctx, statement, entry.IDBank, entry.PartnerReferenceNo, entry.ExternalID,
+		entry.ServiceCode, entry.SourceAccountNo, entry.BeneficiaryAccountNo, entry.BeneficiaryBankCode, entry.Amount.Value,
+		entry.Amount.Currency, entry.TransactionDate, entry.Status, string(entry.RequestBody))
+	if err != nil {
+		var mysqlErr *mysql.MySQLError
+		if eris.As(err, &mysqlErr) && mysqlErr.Number == 1062 {
+			// Another caller persisted the same transfer first, use theirs
+			existing, err := s.GetTransferLedger(ctx, entry.PartnerReferenceNo)
+			if err != nil {
+				return nil, eris.Wrap(err, "getting transfer ledger")
+			}
+			if existing != nil {
+				if err := sameTransfer(existing, entry); err != nil {
+					return nil, err
+				}
+				return existing, nil
+			}
+		}
+
+		return nil, eris.Wrap(err, "inserting transfer ledger")
+	}
+
+	id, _ := result.LastInsertId()
+	entry.ID = uint(id)
+
+	return entry, nil
+}
+
+// sameTransfer checks that a transfer sent again with the partnerReferenceNo of a stored one is the same transfer.
+// The transaction date is left out, it defaults to the time the transfer is sent.
+func sameTransfer(stored, entry *biModels.TransferLedger) error {
+	storedAmount, err := biUtil.ParseAmount(stored.Amount.Value)
+	if err != nil {
+		return eris.Wrap(err, "parsing stored transfer amount")
+	}
+	amount, err := biUtil.ParseAmount(entry.Amount.Value)
+	if err != nil {
+		return eris.Wrap(err, "parsing transfer amount")
+	}
+
+	if stored.ServiceCode != entry.ServiceCode || stored.SourceAccountNo != entry.SourceAccountNo ||
+		stored.BeneficiaryAccountNo != entry.BeneficiaryAccountNo || stored.BeneficiaryBankCode != entry.BeneficiaryBankCode ||
+		storedAmount != amount || stored.Amount.Currency != entry.Amount.Currency {
+		return eris.Wrapf(ErrTransferReferenceReused, "partnerReferenceNo %s", entry.PartnerReferenceNo)
+	}
+
+	return nil
+}
+
+// ErrTransferInProgress is returned when the transfer is being sent by another caller
+var ErrTransferInProgress = eris.New("transfer is already being sent")
+
+// sendTransfer sends the persisted transfer to the bank and moves the ledger entry to its next state. Successful
+// transfers are never sent twice, the stored response is returned instead.
+func (s *BCAService) sendTransfer(ctx context.Context, entry *biModels.TransferLedger, relativeURL, successCode string) (string, error) {
+
+	// Settle the previous outcome before deciding whether it is safe to send again, a pending transfer that has
+	// already been sent may have reached the bank just like an unknown one
+	if entry.Status == biUtil.TransferStatusUnknown || (entry.Status == biUtil.TransferStatusPending && entry.Attempts > 0) {
+		if err := s.resolveTransfer(ctx, entry); err != nil {
+			return "", eris.Wrap(err, "resolving transfer with unknown outcome")
+		}
+	}
+
+	if entry.Status != biUtil.TransferStatusPending {
+		return transferOutcome(entry)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, s.bankConfig.BankServiceEndpoints.BaseUrl+relativeURL, bytes.NewBuffer(entry.RequestBody))
+	if err != nil {
+		return "", eris.Wrap(err, "creating request")
+	}
+
+	request.Header.Set("X-EXTERNAL-ID", entry.ExternalID)
+	token, _ := s.accessToken()
+	if err = s.Egress.GenerateGeneralRequestHeader(ctx, request, relativeURL, token); err != nil {
+		return "", eris.Wrap(err, "constructing request header")
+	}
+
+	request.Header.Set("X-PARTNER-ID", s.bankConfig.BankCredential.PartnerID)
+	request.Header.Set("CHANNEL-ID", s.bankConfig.BankChannelConfig.BusinessChannelId)
+
+	// Claim the transfer before sending, only the caller that moves the attempts forward may send it. A crash past
+	// this point leaves a stale pending entry for the resolver.
+	statement := `
+	UPDATE transfer_ledger SET attempts = attempts + 1
+	WHERE id = ? AND id_transfer_status = ? AND attempts = ?
+	`
+	result, err := s.DB.ExecContext(ctx, statement, entry.ID, biUtil.TransferStatusPending, entry.Attempts)
+	if err != nil {
+		return "", eris.Wrap(err, "updating transfer ledger attempts")
+	}
+	if claimed, err := result.RowsAffected(); err != nil {
+		return "", eris.Wrap(err, "updating transfer ledger attempts")
+	} else if claimed == 0 {
+		return "", eris.Wrapf(ErrTransferInProgress, "transfer %s", entry.PartnerReferenceNo)
+	}
+	entry.Attempts++
+
+	// Transfers are never sent twice by the http client
+	httpStatus, response, sendErr := s.sendRequest(ctx, request, false)
+
+	status, reason := classifyTransferResponse(httpStatus, response, sendErr, successCode)
+	entry.Status = status
+	entry.StatusReason = reason
+	entry.ResponseBody = response
+	if status == biUtil.TransferStatusSuccess {
+		var obj struct {
+			ReferenceNo string `json:"referenceNo"`
+		}
+		_ = json.Unmarshal([]byte(response), &obj)
+		entry.ReferenceNo = obj.ReferenceNo
+	}
+
+	// Use a fresh context so that a cancelled caller does not prevent the outcome from being recorded
+	updated, err := s.updateTransferLedger(context.WithoutCancel(ctx), entry)
+	if err != nil {
+		slog.Error("error updating transfer ledger", "partnerReferenceNo", entry.PartnerReferenceNo, "status", status, "error", err)
+	} else if !updated {
+		// The resolver may have settled the transfer in the meantime, its outcome wins over this answer (e.g. a late
+		// 409 for a transfer that has succeeded)
+		stored, err := s.GetTransferLedger(context.WithoutCancel(ctx), entry.PartnerReferenceNo)
+		if err != nil {
+			slog.Error("error getting transfer ledger", "partnerReferenceNo", entry.PartnerReferenceNo, "error", err)
+		} else if stored != nil && stored.Status != status && (stored.Status == biUtil.TransferStatusSuccess || stored.Status == biUtil.TransferStatusFailed) {
+			slog.Debug("transfer already settled", "partnerReferenceNo", entry.PartnerReferenceNo, "status", stored.Status, "answered", status)
+			*entry = *stored
+			return transferOutcome(entry)
+		}
+	}
+
+	if sendErr != nil {
+		return response, sendErr
+	}
+	if status != biUtil.TransferStatusSuccess {
+		return response, eris.New(reason)
+	}
+
+	return response, nil
+}
+
+// transferOutcome returns the stored response of a transfer that is no longer pending
+func transferOutcome(entry *biModels.TransferLedger) (string, error) {
+	switch entry.Status {
+	case biUtil.TransferStatusSuccess:
+		return entry.ResponseBody, nil
+	case biUtil.TransferStatusFailed:
+		return entry.ResponseBody, eris.Errorf("transfer %s has failed: %s", entry.PartnerReferenceNo, entry.StatusReason)
+	default:
+		return "", eris.Errorf("transfer %s outcome is still unknown, retry after it is resolved", entry.PartnerReferenceNo)
+	}
+}
+
+// classifyTransferResponse maps the result of sending a transfer into a ledger status, httpStatus being 0 when no
+// answer was received. Only definitive business rejections (4xx) are treated as failures, anything that may have
+// been processed by the bank (5xx, timeouts, 202 in progress, 409 duplicate) is left unknown for the resolver.
+func classifyTransferResponse(httpStatus int, response string, sendErr error, successCode string) (biUtil.TransferStatus, string) {
+	if eris.Is(sendErr, biHTTPClient.ErrCircuitOpen) {
+		// Rejected by the circuit breaker, the request has never left
+		return biUtil.TransferStatusFailed, sendErr.Error()
+	}
+
+	if httpStatus == 0 {
+		// Timeouts, connection resets, etc. The bank may or may not have received the request
+		reason := "no answer received"
+		if sendErr != nil {
+			reason = sendErr.Error()
+		}
+		return biUtil.TransferStatusUnknown, reason
+	}
+
+	var obj biModels.BCAResponse
+	if err := json.Unmarshal([]byte(response), &obj); err != nil {
+		return biUtil.TransferStatusUnknown, "unable to parse bank response"
+	}
+
+	switch {
+	case httpStatus == http.StatusOK && obj.ResponseCode == successCode:
+		return biUtil.TransferStatusSuccess, obj.ResponseMessage
+	case httpStatus == http.StatusRequestTimeout, httpStatus == http.StatusConflict, httpStatus == http.StatusTooManyRequests:
+		// Timed out on the bank side, duplicate X-EXTERNAL-ID (the bank has received the original request) or
+		// throttled, the outcome of the transfer is left to the transfer status inquiry
+		return biUtil.TransferStatusUnknown, obj.ResponseMessage
+	case httpStatus >= http.StatusBadRequest && httpStatus < http.StatusInternalServerError:
+		return biUtil.TransferStatusFailed, obj.ResponseMessage
+	default:
+		// 5xx, 202 in progress or a 200 without the success code
+		return biUtil.TransferStatusUnknown, obj.ResponseMessage
+	}
+}
+
+// resolveTransfer settles the outcome of a transfer through transfer status inquiry. The entry is left untouched
+// if the bank has not reached a final state yet.
+func (s *BCAService) resolveTransfer(ctx context.Context, entry *biModels.TransferLedger) error {
+	result, err := s.GetTransactionStatus(ctx, &biModels.BCATransactionStatusInquiryRequest{
+		OriginalPartnerReferenceNo: entry.PartnerReferenceNo,
+		OriginalExternalId:         entry.ExternalID,
+		ServiceCode:                entry.ServiceCode,
+		TransactionDate:            entry.TransactionDate,
+	})
+	if err != nil {
+		return eris.Wrap(err, "getting transaction status")
+	}
+
+	switch result.TransactionStatus {
+	case biModels.BCATransactionStatusSuccess:
+		entry.Status = biUtil.TransferStatusSuccess
+		entry.ReferenceNo = result.OriginalReferenceNo
+	case biModels.BCATransactionStatusFailed, biModels.BCATransactionStatusCanceled,
+		biModels.BCATransactionStatusRefunded:
+		entry.Status = biUtil.TransferStatusFailed
+	case biModels.BCATransactionStatusNotFound:
+		if transactionDate, err := time.Parse(time.RFC3339, entry.TransactionDate); err == nil && time.Since(transactionDate) < notFoundTransferWindow {
+			slog.Debug("transfer not found yet", "partnerReferenceNo", entry.PartnerReferenceNo, "transactionDate", entry.TransactionDate)
+			entry.Status = biUtil.TransferStatusUnknown
+			return nil
+		}
+		entry.Status = biUtil.TransferStatusFailed
+	default:
+		slog.Debug("transfer has not reached a final state", "partnerReferenceNo", entry.PartnerReferenceNo, "status", result.TransactionStatus.String())
+		entry.Status = biUtil.TransferStatusUnknown
+		return nil
+	}
+	entry.StatusReason = result.TransactionStatusDesc
+
+	// Keep the original response for successful transfers so that retries can still return it
+	if entry.Status == biUtil.TransferStatusFailed || entry.ResponseBody == "" {
+		response, _ := json.Marshal(result)
+		entry.ResponseBody = string(response)
+	}
+
+	updated, err := s.updateTransferLedger(ctx, entry)
+	if err != nil {
+		return err
+	}
+	if !updated {
+		// Settled by another caller first, keep its outcome
+		stored, err := s.GetTransferLedger(ctx, entry.PartnerReferenceNo)
+		if err != nil {
+			return eris.Wrap(err, "getting transfer ledger")
+		}
+		if stored != nil {
+			*entry = *stored
+		}
+	}
+
+	return nil
+}
+
+// ResolveUnknownTransfers settles every transfer whose outcome is unknown, including pending transfers that were
+// sent but never recorded (e.g. the process crashed after sending). Meant to be called periodically by the importer.
+func (s *BCAService) ResolveUnknownTransfers(ctx context.Context) error {
+	statement := `
+	SELECT partner_reference_no
+	FROM transfer_ledger
+	WHERE id_bank = ? AND (id_transfer_status = ? OR (id_transfer_status = ? AND attempts > 0 AND updated_at < ?))
+	`
+	rows, err := s.DB.QueryContext(ctx, statement, s.bankConfig.BankCredential.InternalBankID, biUtil.TransferStatusUnknown,
+		biUtil.TransferStatusPending, time.Now().Add(-stalePendingTransfer).Format(time.DateTime))
+	if err != nil {
+		return eris.Wrap(err, "querying transfer ledger")
+	}
+
+	var references []string
+	for rows.Next() {
+		var reference string
+		if err := rows.Scan(&reference); err != nil {
+			rows.Close()
+			return eris.Wrap(err, "scanning transfer ledger")
+		}
+		references = append(references, reference)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return eris.Wrap(err, "iterating transfer ledger")
+	}
+
+	if len(references) == 0 {
+		return nil
+	}
+	if s.bankConfig.BankServiceEndpoints.TransferStatusInquiryURL == "" {
+		return eris.Wrapf(ErrTransferStatusInquiryDisabled, "resolving %d transfers", len(references))
+	}
+
+	if err := s.CheckAccessToken(ctx); err != nil {
+		return eris.Wrap(err, "checking access token")
+	}
+
+	for _, reference := range references {
+		entry, err := s.GetTransferLedger(ctx, reference)
+		if err != nil || entry == nil {
+			slog.Error("error getting transfer ledger", "partnerReferenceNo", reference, "error", err)
+			continue
+		}
+
+		if err := s.resolveTransfer(ctx, entry); err != nil {
+			slog.Error("error resolving transfer", "partnerReferenceNo", reference, "error", err)
+			continue
+		}
+
+		slog.Info("transfer resolved", "partnerReferenceNo", reference, "status", entry.Status)
+	}
+
+	return nil
+}
+
+// GetTransferLedger returns the ledger entry of a transfer, nil is returned if the transfer does not exist
+func (s *BCAService) GetTransferLedger(ctx context.Context, partnerReferenceNo string) (*biModels.TransferLedger, error) {
+	var obj biModels.TransferLedger
+	var requestBody string
+	statement := `
+	SELECT id, id_bank, partner_reference_no, external_id, service_code, source_account_no, beneficiary_account_no,
+		   beneficiary_bank_code, amount_value, amount_currency, transaction_date, id_transfer_status, reference_no,
+		   request_body, response_body, status_reason, attempts, created_at, updated_at
+	FROM transfer_ledger
+	WHERE id_bank = ? AND partner_reference_no = ?
+	`
+	if err := s.DB.QueryRowContext(ctx, statement, s.bankConfig.BankCredential.InternalBankID, partnerReferenceNo).Scan(
+		&obj.ID, &obj.IDBank, &obj.PartnerReferenceNo, &obj.ExternalID, &obj.ServiceCode, &obj.SourceAccountNo,
+		&obj.BeneficiaryAccountNo, &obj.BeneficiaryBankCode, &obj.Amount.Value, &obj.Amount.Currency, &obj.TransactionDate,
+		&obj.Status, &obj.ReferenceNo, &requestBody, &obj.ResponseBody, &obj.StatusReason, &obj.Attempts,
+		&obj.CreatedAt, &obj.UpdatedAt,
+	); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, eris.Wrap(err, "querying transfer ledger")
+	}
+	obj.RequestBody = []byte(requestBody)
+
+	return &obj, nil
+}
+
+// updateTransferLedger records the outcome of a transfer. Final outcomes are never overwritten, false is returned
+// if the transfer had already succeeded or failed.
+func (s *BCAService) updateTransferLedger(ctx context.Context, entry *biModels.TransferLedger) (bool, error) {
+	statement := `
+	UPDATE transfer_ledger SET id_transfer_status = ?, reference_no = ?, response_body = ?, status_reason = ?
+	WHERE id = ? AND id_transfer_status NOT IN (?, ?)
+	`
+	result, err := s.DB.ExecContext(ctx, statement, entry.Status, entry.ReferenceNo, entry.ResponseBody,
+		entry.StatusReason, entry.ID, biUtil.TransferStatusSuccess, biUtil.TransferStatusFailed)
+	if err != nil {
+		return false, eris.Wrap(err, "updating transfer ledger")
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return false, eris.Wrap(err, "updating transfer ledger")
+	}
+
+	return updated > 0, nil
+}
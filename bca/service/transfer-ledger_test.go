@@ -0,0 +1,111 @@
+package bca_service
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/rotisserie/eris"
+	biConfig "github.com/voxtmault/bank-integration/config"
+	biHTTPClient "github.com/voxtmault/bank-integration/httpclient"
+	biModels "github.com/voxtmault/bank-integration/models"
+	biUtil "github.com/voxtmault/bank-integration/utils"
+)
+
+func TestClassifyTransferResponse(t *testing.T) {
+	nonOK := errors.New("non-200 status code")
+
+	tests := []struct {
+		name       string
+		httpStatus int
+		response   string
+		sendErr    error
+		expected   biUtil.TransferStatus
+	}{
+		{"success", 200, `{"responseCode":"2001700","responseMessage":"Successful"}`, nil, biUtil.TransferStatusSuccess},
+		{"200 without the success code", 200, `{"responseCode":"2001701","responseMessage":"Request In Progress"}`, nil, biUtil.TransferStatusUnknown},
+		{"202 in progress", 202, `{"responseCode":"2021700","responseMessage":"Request In Progress"}`, nonOK, biUtil.TransferStatusUnknown},
+		{"400 bad request", 400, `{"responseCode":"4001701","responseMessage":"Invalid Field Format"}`, nonOK, biUtil.TransferStatusFailed},
+		{"403 insufficient funds", 403, `{"responseCode":"4031714","responseMessage":"Insufficient Funds"}`, nonOK, biUtil.TransferStatusFailed},
+		{"404 invalid account", 404, `{"responseCode":"4041711","responseMessage":"Invalid Account"}`, nonOK, biUtil.TransferStatusFailed},
+		{"408 timeout", 408, `{"responseCode":"4081700","responseMessage":"Timeout"}`, nonOK, biUtil.TransferStatusUnknown},
+		{"409 duplicate external id", 409, `{"responseCode":"4091700","responseMessage":"Conflict"}`, nonOK, biUtil.TransferStatusUnknown},
+		{"429 too many requests", 429, `{"responseCode":"4291700","responseMessage":"Too Many Requests"}`, nonOK, biUtil.TransferStatusUnknown},
+		{"500 general error", 500, `{"responseCode":"5001700","responseMessage":"General Error"}`, nonOK, biUtil.TransferStatusUnknown},
+		{"504 timeout", 504, `{"responseCode":"5041700","responseMessage":"Timeout"}`, nonOK, biUtil.TransferStatusUnknown},
+		{"unparsable answer", 502, `<html>Bad Gateway</html>`, nonOK, biUtil.TransferStatusUnknown},
+		{"no answer", 0, "", errors.New("read timeout"), biUtil.TransferStatusUnknown},
+		{"circuit open", 0, "", eris.Wrap(biHTTPClient.ErrCircuitOpen, "sending request"), biUtil.TransferStatusFailed},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, _ := classifyTransferResponse(test.httpStatus, test.response, test.sendErr, "2001700")
+			if status != test.expected {
+				t.Fatalf("expected %v, got %v", test.expected, status)
+			}
+		})
+	}
+}
+
+func TestPrepareTransferReusedReference(t *testing.T) {
+	db, sqlMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("creating sql mock: %v", err)
+	}
+	defer db.Close()
+
+	s := &BCAService{DB: db, bankConfig: &biConfig.BankConfig{}}
+
+	stored := &biModels.TransferLedger{
+		PartnerReferenceNo:   "TRF-1",
+		ServiceCode:          "17",
+		SourceAccountNo:      "0613005827",
+		BeneficiaryAccountNo: "8010001575",
+		Amount:               biModels.Amount{Value: "15000.00", Currency: "IDR"},
+	}
+
+	tests := []struct {
+		name   string
+		modify func(entry *biModels.TransferLedger)
+		reused bool
+	}{
+		{"same transfer", func(entry *biModels.TransferLedger) { entry.Amount.Value = "15000" }, false},
+		{"other amount", func(entry *biModels.TransferLedger) { entry.Amount.Value = "16000.00" }, true},
+		{"other beneficiary", func(entry *biModels.TransferLedger) { entry.BeneficiaryAccountNo = "8010001576" }, true},
+		{"other service", func(entry *biModels.TransferLedger) { entry.ServiceCode = "18" }, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sqlMock.ExpectQuery("FROM transfer_ledger").WillReturnRows(ledgerRows(stored))
+
+			entry := *stored
+			entry.TransactionDate = "2026-10-17T10:00:00+07:00"
+			test.modify(&entry)
+
+			_, err := s.prepareTransfer(context.Background(), &entry)
+			if test.reused != eris.Is(err, ErrTransferReferenceReused) {
+				t.Fatalf("expected reused %v, got %v", test.reused, err)
+			}
+			if !test.reused && err != nil {
+				t.Fatalf("preparing transfer: %v", err)
+			}
+		})
+	}
+
+	if err := sqlMock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet sql expectations: %v", err)
+	}
+}
+
+func ledgerRows(entry *biModels.TransferLedger) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{
+		"id", "id_bank", "partner_reference_no", "external_id", "service_code", "source_account_no", "beneficiary_account_no",
+		"beneficiary_bank_code", "amount_value", "amount_currency", "transaction_date", "id_transfer_status", "reference_no",
+		"request_body", "response_body", "status_reason", "attempts", "created_at", "updated_at",
+	}).AddRow(1, 0, entry.PartnerReferenceNo, "1", entry.ServiceCode, entry.SourceAccountNo, entry.BeneficiaryAccountNo,
+		entry.BeneficiaryBankCode, entry.Amount.Value, entry.Amount.Currency, "2026-10-16T10:00:00+07:00",
+		biUtil.TransferStatusPending, "", "{}", "", "", 0, "2026-10-16 10:00:00", "2026-10-16 10:00:00")
+}
@@ -33,7 +33,7 @@ func TestCreateAsymmetricSignature(t *testing.T) {
 	log.Println("Signature: ", signature)
 
 	// Validate the signature
-	result, err := security.VerifyAsymmetricSignature(context.Background(), timestamp, bCfg.BankCredential.ClientID, signature)
+	result, err := security.VerifyAsymmetricSignature(context.Background(), timestamp, bCfg.BankCredential.ClientID, signature, nil)
 	if err != nil {
 		t.Error(err)
 	}
@@ -104,7 +104,7 @@ func TestVerifyAsymmetricSignature(t *testing.T) {
 	timeStamp := "2025-01-25T17:29:24+07:00"
 	clientID := bCfg.BankRequestedCredentials.ClientID
 	signature := "aB54qttjJIXSMyArnHywqjjT/BGULn3Eldi2XmSTHnDXmesZ3Jakk8Gl+matSb1cs3u2ngByzWF2ZCzrbtUPwK5FmVwH0PzQLAQH1Mv/zgEgJstg26T0OXWhI8gh0Pd1tEqtk4NLI/x9gUSOo0YPS4c9lN+bKi+3lHUekqrgB0dEy60a324zTq3WXvyO1LOXl93KHau8m+Z3qvMAldTYxWsns26suOsRRt1CUmhqSzYgI3wtOE1Tsei3L7qCTnAuxFk8OA52LtX+wIWzKBui9kf08GNLOc4D1sP5UybcVjQkcXvARBJJ52AmTbiPOPQlTKIs7wAaNb74khWgfxf0gQ=="
-	result, err := security.VerifyAsymmetricSignature(context.Background(), timeStamp, clientID, signature)
+	result, err := security.VerifyAsymmetricSignature(context.Background(), timeStamp, clientID, signature, nil)
 	if err != nil {
 		t.Error(err)
 	}
@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/voxtmault/bank-integration/bca"
 	request "github.com/voxtmault/bank-integration/bca/request"
 	bca_service "github.com/voxtmault/bank-integration/bca/service"
 	biLogger "github.com/voxtmault/bank-integration/logger"
@@ -653,3 +654,113 @@ func TestTransferInterBank(t *testing.T) {
 
 	slog.Debug("response", "data", res)
 }
+
+func TestGetTransactionStatus(t *testing.T) {
+	security, err := setup()
+	if err != nil {
+		t.Fatalf("error setting up bca security instance: %v", err)
+	}
+
+	s, err := bca_service.NewBCAService(
+		request.NewBCAEgress(security, bCfg, cfg),
+		request.NewBCAIngress(security),
+		cfg,
+		bCfg,
+		biStorage.GetDBConnection(),
+		biStorage.GetRedisInstance(),
+	)
+	if err != nil {
+		t.Errorf("Error creating BCA Service: %v", err)
+	}
+
+	res, err := s.GetTransactionStatus(context.Background(), &biModels.BCATransactionStatusInquiryRequest{
+		OriginalPartnerReferenceNo: "2020102900000000000001",
+		OriginalExternalId:         "30443786930722726463280097920912",
+		ServiceCode:                bca.BCAServiceIntrabankTransfer,
+	})
+	if err != nil {
+		t.Errorf("Error getting transaction status: %v", err)
+	}
+
+	slog.Debug("response", "data", res, "status", res.TransactionStatus.String())
+}
+
+func TestParseBCATransactionStatus(t *testing.T) {
+	cases := map[string]biModels.BCATransactionStatus{
+		"00": biModels.BCATransactionStatusSuccess,
+		"03": biModels.BCATransactionStatusPending,
+		"06": biModels.BCATransactionStatusFailed,
+		"07": biModels.BCATransactionStatusNotFound,
+		"99": biModels.BCATransactionStatusUnknown,
+		"":   biModels.BCATransactionStatusUnknown,
+	}
+
+	for code, expected := range cases {
+		if status := biModels.ParseBCATransactionStatus(code); status != expected {
+			t.Errorf("code %q: expected %s, got %s", code, expected, status)
+		}
+	}
+
+	if biModels.BCATransactionStatusPending.IsFinal() {
+		t.Error("pending status should not be final")
+	}
+	if !biModels.BCATransactionStatusFailed.IsFinal() {
+		t.Error("failed status should be final")
+	}
+}
+
+func TestTransferIntraBankRetry(t *testing.T) {
+	security, err := setup()
+	if err != nil {
+		t.Fatalf("error setting up bca security instance: %v", err)
+	}
+
+	s, err := bca_service.NewBCAService(
+		request.NewBCAEgress(security, bCfg, cfg),
+		request.NewBCAIngress(security),
+		cfg,
+		bCfg,
+		biStorage.GetDBConnection(),
+		biStorage.GetRedisInstance(),
+	)
+	if err != nil {
+		t.Fatalf("Error creating BCA Service: %v", err)
+	}
+
+	payload := biModels.BCATransferIntraBankReq{
+		PartnerReferenceNumber: uuid.New().String(),
+		Amount: biModels.Amount{
+			Value:    "10000.00",
+			Currency: "IDR",
+		},
+		BeneficiaryAccountNo: "0611115813",
+	}
+
+	if _, err := s.TransferIntraBank(context.Background(), &payload); err != nil {
+		t.Errorf("Error transfer intra bank: %v", err)
+	}
+
+	first, err := s.GetTransferLedger(context.Background(), payload.PartnerReferenceNumber)
+	if err != nil || first == nil {
+		t.Fatalf("transfer is not persisted in ledger: %v", err)
+	}
+
+	// Sending the same partnerReferenceNo again must not create a new transfer
+	retry := payload
+	if _, err := s.TransferIntraBank(context.Background(), &retry); err != nil {
+		t.Errorf("Error retrying transfer intra bank: %v", err)
+	}
+
+	second, err := s.GetTransferLedger(context.Background(), payload.PartnerReferenceNumber)
+	if err != nil || second == nil {
+		t.Fatalf("transfer is not persisted in ledger: %v", err)
+	}
+
+	if first.ExternalID != second.ExternalID {
+		t.Errorf("expected retry to reuse external id %s, got %s", first.ExternalID, second.ExternalID)
+	}
+
+	if err := s.ResolveUnknownTransfers(context.Background()); err != nil {
+		t.Errorf("Error resolving unknown transfers: %v", err)
+	}
+}
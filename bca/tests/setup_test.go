@@ -27,7 +27,7 @@ func setup() (*bcaSecurity.BCASecurity, error) {
 	biStorage.InitMariaDB(&cfg.MariaConfig)
 	biStorage.InitRedis(&cfg.RedisConfig)
 
-	security, err := bcaSecurity.NewBCASecurity(cfg, bCfg)
+	security, err := bcaSecurity.NewBCASecurity(cfg, bCfg, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -52,7 +52,7 @@ func bcaMockSetup(bankPath, cfgPath string) (*bcaSecurity.BCASecurity, error) {
 	biStorage.InitMariaDB(&cfg.MariaConfig)
 	biStorage.InitRedis(&cfg.RedisConfig)
 
-	security, err := bcaSecurity.NewBCASecurity(cfg, bCfg)
+	security, err := bcaSecurity.NewBCASecurity(cfg, bCfg, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -26,8 +26,9 @@ type BankChannelConfig struct {
 }
 
 type BankRuntimeConfig struct {
-	AccessToken               string // Access token received from the bank on runtime
-	AccessTokenExpirationTime uint   // Access token expiration time, this can be used to determine when to refresh the token
+	AccessToken               string        // Access token received from the bank on runtime
+	AccessTokenExpirationTime uint          // Access token expiration time, this can be used to determine when to refresh the token
+	AccessTokenRefreshMargin  time.Duration // The access token is renewed once it expires within this margin
 	ExpiresAt                 int64
 }
 
@@ -45,15 +46,23 @@ type RequestedEndpoints struct {
 
 // Used to store the endpoints of the bank's API for each specific operation
 type BankServiceEndpoints struct {
-	BaseUrl                   string `validate:"required,url"` // Base URL to the bank's API
-	AccessTokenURL            string `validate:"required,uri"` // URL to get the access token
-	BalanceInquiryURL         string `validate:"required,uri"` // URL to check / get the balance information of an account
-	PaymentFlagURL            string `validate:"required,uri"` // URL to update / play a billing statement
-	TransferIntraBankURL      string `validate:"required,uri"` // URL to transfer money / withdraw money from the application to the target account (only for intra bank)
-	TransferInterBankURL      string `validate:"required,uri"` // URL to transfer money / withdraw money from the application to the target account (only for inter bank)
-	ExternalAccountInquiryURL string `validate:"required,uri"` // URL to check / get the information of an external (non-bca) account
-	InternalAccountInquiryURL string `validate:"required,uri"` // URL to check / get the information of an internal (bca) account
-	BankStatementURL          string `validate:"required,uri"` // URL to check / get the information of a billing statement
+	BaseUrl                   string `validate:"required,url"`  // Base URL to the bank's API
+	AccessTokenURL            string `validate:"required,uri"`  // URL to get the access token
+	BalanceInquiryURL         string `validate:"required,uri"`  // URL to check / get the balance information of an account
+	PaymentFlagURL            string `validate:"required,uri"`  // URL to update / play a billing statement
+	TransferIntraBankURL      string `validate:"required,uri"`  // URL to transfer money / withdraw money from the application to the target account (only for intra bank)
+	TransferInterBankURL      string `validate:"required,uri"`  // URL to transfer money / withdraw money from the application to the target account (only for inter bank)
+	ExternalAccountInquiryURL string `validate:"required,uri"`  // URL to check / get the information of an external (non-bca) account
+	InternalAccountInquiryURL string `validate:"required,uri"`  // URL to check / get the information of an internal (bca) account
+	BankStatementURL          string `validate:"required,uri"`  // URL to check / get the information of a billing statement
+	TransferStatusInquiryURL  string `validate:"omitempty,uri"` // URL to check / get the latest status of a previously sent transfer, transfers with an unknown outcome are not resolved without it
+}
+
+type IngressConfig struct {
+	ExternalIDTTL  time.Duration // Time an X-EXTERNAL-ID of a bank callback stays reserved
+	PaymentFlagTTL time.Duration // Time the answer to a payment flag is replayed to the payment flags resent by the bank
+	TimestampSkew  time.Duration // Accepted clock skew of the X-TIMESTAMP of a bank callback, 0 disables the check
+	TrustedProxies string        // Comma separated CIDRs of the proxies whose X-Forwarded-For is trusted
 }
 
 type VirtualAccountConfig struct {
@@ -68,55 +77,69 @@ type BankConfig struct {
 	BankRequestedCredentials
 	BankServiceEndpoints
 	RequestedEndpoints
+	IngressConfig
 	VirtualAccountConfig
 }
 
+// NewBankingConfig reads the bank configuration from the given env file. Values are not exported into the process
+// environment, so multiple bank configurations (e.g. two BCA corporate accounts) can be loaded side by side.
+// Variables missing from the file fall back to the process environment.
 func NewBankingConfig(path string) *BankConfig {
-	if err := godotenv.Load(path); err != nil {
+	values, err := godotenv.Read(path)
+	if err != nil {
 		log.Println("Failed to locate .env file, program will proceed with provided env if any is provided")
 	}
+	env := envFile(values)
 
 	return &BankConfig{
 		BankCredential: BankCredential{
-			InternalBankID:   uint(getEnvAsInt("INTERNAL_BANK_ID", 0)),
-			InternalBankName: getEnv("INTERNAL_BANK_NAME", ""),
-			ClientID:         getEnv("CLIENT_ID", ""),
-			ClientSecret:     getEnv("CLIENT_SECRET", ""),
-			VAPrefix:         getEnv("VA_PREFIX", ""),
-			PartnerID:        getEnv("PARTNER_ID", ""),
-			PublicKeyPath:    getEnv("PUBLIC_KEY_PATH", ""),
-			SourceAccount:    getEnv("SOURCE_ACCOUNT", ""),
+			InternalBankID:   uint(env.getEnvAsInt("INTERNAL_BANK_ID", 0)),
+			InternalBankName: env.getEnv("INTERNAL_BANK_NAME", ""),
+			ClientID:         env.getEnv("CLIENT_ID", ""),
+			ClientSecret:     env.getEnv("CLIENT_SECRET", ""),
+			VAPrefix:         env.getEnv("VA_PREFIX", ""),
+			PartnerID:        env.getEnv("PARTNER_ID", ""),
+			PublicKeyPath:    env.getEnv("PUBLIC_KEY_PATH", ""),
+			SourceAccount:    env.getEnv("SOURCE_ACCOUNT", ""),
 		},
 		BankChannelConfig: BankChannelConfig{
-			VAChannelId:       getEnv("VA_CHANNEL_ID", ""),
-			BusinessChannelId: getEnv("BUSINESS_CHANNEL_ID", ""),
+			VAChannelId:       env.getEnv("VA_CHANNEL_ID", ""),
+			BusinessChannelId: env.getEnv("BUSINESS_CHANNEL_ID", ""),
 		},
 		BankRuntimeConfig: BankRuntimeConfig{
-			AccessTokenExpirationTime: uint(getEnvAsInt("ACCESS_TOKEN_EXPIRATION_TIME", 0)),
+			AccessTokenExpirationTime: uint(env.getEnvAsInt("ACCESS_TOKEN_EXPIRATION_TIME", 0)),
+			AccessTokenRefreshMargin:  time.Duration(env.getEnvAsInt("ACCESS_TOKEN_REFRESH_MARGIN", 60)) * time.Second,
 		},
 		BankRequestedCredentials: BankRequestedCredentials{
-			ClientID:              getEnv("REQ_CLIENT_ID", ""),
-			ClientSecret:          getEnv("REQ_CLIENT_SECRET", ""),
-			AccessTokenExpireTime: uint(getEnvAsInt("REQ_ACCESS_TOKEN_EXPIRATION", 0)),
+			ClientID:              env.getEnv("REQ_CLIENT_ID", ""),
+			ClientSecret:          env.getEnv("REQ_CLIENT_SECRET", ""),
+			AccessTokenExpireTime: uint(env.getEnvAsInt("REQ_ACCESS_TOKEN_EXPIRATION", 0)),
 		},
 		BankServiceEndpoints: BankServiceEndpoints{
-			BaseUrl:                   getEnv("BASE_URL", ""),
-			AccessTokenURL:            getEnv("ACCESS_TOKEN_URL", ""),
-			BalanceInquiryURL:         getEnv("BALANCE_INQUIRY_URL", ""),
-			PaymentFlagURL:            getEnv("BANK_PAYMENT_FLAG_URL", ""),
-			TransferIntraBankURL:      getEnv("TRANSFER_INTRABANK_URL", ""),
-			TransferInterBankURL:      getEnv("TRANSFER_INTERBANK_URL", ""),
-			ExternalAccountInquiryURL: getEnv("EXTERNAL_ACCOUNT_INQUIRY_URL", ""),
-			InternalAccountInquiryURL: getEnv("INTERNAL_ACCOUNT_INQUIRY_URL", ""),
-			BankStatementURL:          getEnv("BANK_STATEMENT_URL", ""),
+			BaseUrl:                   env.getEnv("BASE_URL", ""),
+			AccessTokenURL:            env.getEnv("ACCESS_TOKEN_URL", ""),
+			BalanceInquiryURL:         env.getEnv("BALANCE_INQUIRY_URL", ""),
+			PaymentFlagURL:            env.getEnv("BANK_PAYMENT_FLAG_URL", ""),
+			TransferIntraBankURL:      env.getEnv("TRANSFER_INTRABANK_URL", ""),
+			TransferInterBankURL:      env.getEnv("TRANSFER_INTERBANK_URL", ""),
+			ExternalAccountInquiryURL: env.getEnv("EXTERNAL_ACCOUNT_INQUIRY_URL", ""),
+			InternalAccountInquiryURL: env.getEnv("INTERNAL_ACCOUNT_INQUIRY_URL", ""),
+			BankStatementURL:          env.getEnv("BANK_STATEMENT_URL", ""),
+			TransferStatusInquiryURL:  env.getEnv("TRANSFER_STATUS_INQUIRY_URL", ""),
 		},
 		RequestedEndpoints: RequestedEndpoints{
-			AuthURL:            getEnv("OAUTH2_URL", ""),
-			BillPresentmentURL: getEnv("BILL_PRESENTMENT_URL", ""),
-			PaymentFlagURL:     getEnv("PAYMENT_FLAG_URL", ""),
+			AuthURL:            env.getEnv("OAUTH2_URL", ""),
+			BillPresentmentURL: env.getEnv("BILL_PRESENTMENT_URL", ""),
+			PaymentFlagURL:     env.getEnv("PAYMENT_FLAG_URL", ""),
+		},
+		IngressConfig: IngressConfig{
+			ExternalIDTTL:  time.Duration(env.getEnvAsInt("EXTERNAL_ID_TTL", 48)) * time.Hour,
+			PaymentFlagTTL: time.Duration(env.getEnvAsInt("PAYMENT_FLAG_TTL", 48)) * time.Hour,
+			TimestampSkew:  time.Duration(env.getEnvAsInt("TIMESTAMP_SKEW", 300)) * time.Second,
+			TrustedProxies: env.getEnv("TRUSTED_PROXIES", ""),
 		},
 		VirtualAccountConfig: VirtualAccountConfig{
-			VirtualAccountLife: uint(getEnvAsInt("VIRTUAL_ACCOUNT_LIFE", 24)),
+			VirtualAccountLife: uint(env.getEnvAsInt("VIRTUAL_ACCOUNT_LIFE", 24)),
 		},
 	}
 }
@@ -127,6 +150,42 @@ type TransactionWatcherConfig struct {
 	MaxRetry             uint
 	DefaultRetryInterval time.Duration
 	DefaultExpireTime    time.Duration
+
+	// Distributed keeps the watched transactions in redis instead of in memory, required when more than one
+	// replica serves the same bank
+	Distributed   bool
+	LeaseDuration time.Duration // Time a replica has to expire a claimed transaction before it can be claimed again
+	PollInterval  time.Duration // Interval between two claims of the due transactions
+}
+
+type WebhookConfig struct {
+	MaxAttempts    uint          // Attempts before a delivery is moved to the dead-letter state
+	InitialBackoff time.Duration // Delay before the first retry, doubled on every attempt
+	MaxBackoff     time.Duration // Upper bound of the delay between two attempts
+	Timeout        time.Duration // Timeout of a single delivery attempt
+}
+
+type EgressConfig struct {
+	ConnectTimeout      time.Duration // Timeout of establishing the connection (dial and TLS handshake) to a bank
+	ReadTimeout         time.Duration // Timeout of waiting for the response of a bank once the request is sent
+	MaxIdleConnsPerHost uint          // Idle connections kept open to each bank
+	MaxRetries          uint          // Retries of the idempotent requests (balance, statement, status) on transient failures
+	RetryBackoff        time.Duration // Delay before the first retry, doubled on every retry
+	BreakerThreshold    uint          // Consecutive failures of an endpoint opening its circuit breaker, 0 disables it
+	BreakerCooldown     time.Duration // Time an open circuit breaker rejects requests before letting a probe through
+}
+
+type KeyConfig struct {
+	Provider       string        // Signer provider of the private key: pem (default) or pkcs8
+	Passphrase     string        // Passphrase of an encrypted pkcs8 private key
+	GracePeriod    time.Duration // Time a rotated bank public key is still accepted to verify signatures
+	ReloadInterval time.Duration // Interval between two reloads of the key files, 0 only reloads on demand
+}
+
+type SecretConfig struct {
+	MasterKey          string // Base64 encoded AES-256 key encrypting the client secrets at rest, plaintext when empty
+	MasterKeyID        string // Identifies MasterKey in the encrypted values
+	PreviousMasterKeys string // Comma separated id:base64 key pairs still accepted to decrypt
 }
 
 type MariaConfig struct {
@@ -157,6 +216,10 @@ type ForwardProxyConfig struct {
 
 type InternalConfig struct {
 	TransactionWatcherConfig
+	WebhookConfig
+	EgressConfig
+	KeyConfig
+	SecretConfig
 	MariaConfig
 	RedisConfig
 	ForwardProxyConfig
@@ -202,6 +265,35 @@ func New(envPath string) *InternalConfig {
 			MaxRetry:             uint(getEnvAsInt("WATCHER_MAX_RETRY", 10)),
 			DefaultRetryInterval: time.Duration(getEnvAsInt("WATCHER_DEFAULT_RETRY_INTERVAL", 10)) * time.Minute,
 			DefaultExpireTime:    time.Duration(getEnvAsInt("WATCHER_DEFAULT_EXPIRE_TIME", 24)) * time.Hour,
+			Distributed:          getEnvAsBool("WATCHER_DISTRIBUTED", false),
+			LeaseDuration:        time.Duration(getEnvAsInt("WATCHER_LEASE_DURATION", 60)) * time.Second,
+			PollInterval:         time.Duration(getEnvAsInt("WATCHER_POLL_INTERVAL", 1)) * time.Second,
+		},
+		WebhookConfig: WebhookConfig{
+			MaxAttempts:    uint(getEnvAsInt("WEBHOOK_MAX_ATTEMPTS", 10)),
+			InitialBackoff: time.Duration(getEnvAsInt("WEBHOOK_INITIAL_BACKOFF", 30)) * time.Second,
+			MaxBackoff:     time.Duration(getEnvAsInt("WEBHOOK_MAX_BACKOFF", 60)) * time.Minute,
+			Timeout:        time.Duration(getEnvAsInt("WEBHOOK_TIMEOUT", 10)) * time.Second,
+		},
+		EgressConfig: EgressConfig{
+			ConnectTimeout:      time.Duration(getEnvAsInt("EGRESS_CONNECT_TIMEOUT", 5)) * time.Second,
+			ReadTimeout:         time.Duration(getEnvAsInt("EGRESS_READ_TIMEOUT", 30)) * time.Second,
+			MaxIdleConnsPerHost: uint(getEnvAsInt("EGRESS_MAX_IDLE_CONNS_PER_HOST", 10)),
+			MaxRetries:          uint(getEnvAsInt("EGRESS_MAX_RETRIES", 2)),
+			RetryBackoff:        time.Duration(getEnvAsInt("EGRESS_RETRY_BACKOFF", 200)) * time.Millisecond,
+			BreakerThreshold:    uint(getEnvAsInt("EGRESS_BREAKER_THRESHOLD", 5)),
+			BreakerCooldown:     time.Duration(getEnvAsInt("EGRESS_BREAKER_COOLDOWN", 30)) * time.Second,
+		},
+		KeyConfig: KeyConfig{
+			Provider:       getEnv("PRIVATE_KEY_PROVIDER", "pem"),
+			Passphrase:     getEnv("PRIVATE_KEY_PASSPHRASE", ""),
+			GracePeriod:    time.Duration(getEnvAsInt("KEY_GRACE_PERIOD", 24)) * time.Hour,
+			ReloadInterval: time.Duration(getEnvAsInt("KEY_RELOAD_INTERVAL", 0)) * time.Second,
+		},
+		SecretConfig: SecretConfig{
+			MasterKey:          getEnv("SECRET_MASTER_KEY", ""),
+			MasterKeyID:        getEnv("SECRET_MASTER_KEY_ID", "default"),
+			PreviousMasterKeys: getEnv("SECRET_PREVIOUS_MASTER_KEYS", ""),
 		},
 		PrivateKeyPath: getEnv("PRIVATE_KEY_PATH", ""),
 		AppHost:        getEnv("APP_HOST", ""),
@@ -216,6 +308,28 @@ func GetConfig() *InternalConfig {
 	return config
 }
 
+// envFile holds the values of a single env file
+type envFile map[string]string
+
+// Same as getEnv, but the values of the env file take precedence over the process environment.
+func (f envFile) getEnv(key string, defaultVal string) string {
+	if value, exists := f[key]; exists {
+		return value
+	}
+
+	return getEnv(key, defaultVal)
+}
+
+// Same as getEnvAsInt, but the values of the env file take precedence over the process environment.
+func (f envFile) getEnvAsInt(name string, defaultVal int) int {
+	valueStr := f.getEnv(name, "")
+	if value, err := strconv.Atoi(valueStr); err == nil {
+		return value
+	}
+
+	return defaultVal
+}
+
 // Simple helper function to read an environment or return a default value.
 func getEnv(key string, defaultVal string) string {
 	if value, exists := os.LookupEnv(key); exists {
@@ -0,0 +1,7 @@
+--liquibase formatted sql
+
+--changeset Voxtmault:1
+-- Comma separated CIDRs the callbacks of the client may come from, NULL accepts them from anywhere
+ALTER TABLE `authenticated_banks`
+    ADD COLUMN IF NOT EXISTS `ip_allowlist` VARCHAR(1024) NULL DEFAULT NULL AFTER `timestamp_skew`;
+--rollback ALTER TABLE `authenticated_banks` DROP COLUMN `ip_allowlist`;
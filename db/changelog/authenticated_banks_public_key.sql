@@ -0,0 +1,6 @@
+--liquibase formatted sql
+
+--changeset Voxtmault:1
+ALTER TABLE `authenticated_banks`
+    ADD COLUMN IF NOT EXISTS `public_key_path` VARCHAR(255) NULL DEFAULT NULL AFTER `client_secret`;
+--rollback ALTER TABLE `authenticated_banks` DROP COLUMN `public_key_path`;
@@ -0,0 +1,7 @@
+--liquibase formatted sql
+
+--changeset Voxtmault:1
+-- Encrypted client secrets embed their wrapped data key, run ReencryptClientSecrets once SECRET_MASTER_KEY is set
+ALTER TABLE `authenticated_banks`
+    MODIFY COLUMN `client_secret` VARCHAR(512) NOT NULL;
+--rollback ALTER TABLE `authenticated_banks` MODIFY COLUMN `client_secret` VARCHAR(255) NOT NULL;
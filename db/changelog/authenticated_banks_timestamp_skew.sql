@@ -0,0 +1,7 @@
+--liquibase formatted sql
+
+--changeset Voxtmault:1
+-- Accepted X-TIMESTAMP clock skew of the client in seconds, NULL uses the TIMESTAMP_SKEW of the bank configuration
+ALTER TABLE `authenticated_banks`
+    ADD COLUMN IF NOT EXISTS `timestamp_skew` INT UNSIGNED NULL DEFAULT NULL AFTER `public_key_path`;
+--rollback ALTER TABLE `authenticated_banks` DROP COLUMN `timestamp_skew`;
@@ -0,0 +1,15 @@
+--liquibase formatted sql
+
+--changeset Voxtmault:1
+CREATE TABLE IF NOT EXISTS `key_rotation` (
+    `id` BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    `id_bank` INT NOT NULL,
+    `key_type` VARCHAR(16) NOT NULL,
+    `path` VARCHAR(255) NOT NULL DEFAULT '',
+    `previous_fingerprint` VARCHAR(64) NOT NULL DEFAULT '',
+    `fingerprint` VARCHAR(64) NOT NULL,
+    `grace_until` DATETIME NULL DEFAULT NULL,
+    `created_at` DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    KEY `IDX1_KeyRotation_Bank` (`id_bank`)
+)ENGINE = InnoDB;
+--rollback DROP TABLE `key_rotation`;
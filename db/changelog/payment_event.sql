@@ -0,0 +1,36 @@
+--liquibase formatted sql
+
+--changeset Voxtmault:1
+CREATE TABLE IF NOT EXISTS `payment_event` (
+    `id` BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    `id_bank` INT NOT NULL,
+    `event_type` VARCHAR(32) NOT NULL,
+    `id_va_request` INT NOT NULL DEFAULT 0,
+    `id_transaction` INT NOT NULL DEFAULT 0,
+    `virtual_account_no` VARCHAR(28) NOT NULL,
+    `payment_request_id` VARCHAR(128) NOT NULL DEFAULT '',
+    `paid_amount_value` VARCHAR(20) NOT NULL DEFAULT '0.00',
+    `paid_amount_currency` VARCHAR(3) NOT NULL DEFAULT 'IDR',
+    `total_amount_value` VARCHAR(20) NOT NULL DEFAULT '0.00',
+    `total_amount_currency` VARCHAR(3) NOT NULL DEFAULT 'IDR',
+    `created_at` DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    KEY `IDX1_PaymentEvent_Transaction` (`id_transaction`)
+)ENGINE = InnoDB;
+--rollback DROP TABLE `payment_event`;
+
+--changeset Voxtmault:2
+CREATE TABLE IF NOT EXISTS `payment_event_checkpoint` (
+    `subscriber` VARCHAR(64) NOT NULL PRIMARY KEY,
+    `last_contiguous_id` BIGINT UNSIGNED NOT NULL DEFAULT 0,
+    `locked_by` VARCHAR(36) NOT NULL DEFAULT '',
+    `locked_until` DATETIME NULL,
+    `updated_at` DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+)ENGINE = InnoDB;
+CREATE TABLE IF NOT EXISTS `payment_event_delivery` (
+    `subscriber` VARCHAR(64) NOT NULL,
+    `id_payment_event` BIGINT UNSIGNED NOT NULL,
+    `delivered_at` DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (`subscriber`, `id_payment_event`)
+)ENGINE = InnoDB;
+--rollback DROP TABLE `payment_event_delivery`;
+--rollback DROP TABLE `payment_event_checkpoint`;
@@ -0,0 +1,27 @@
+--liquibase formatted sql
+
+--changeset Voxtmault:1
+CREATE TABLE IF NOT EXISTS `transfer_ledger` (
+    `id` INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    `id_bank` INT NOT NULL,
+    `partner_reference_no` VARCHAR(64) NOT NULL,
+    `external_id` VARCHAR(36) NOT NULL,
+    `service_code` VARCHAR(2) NOT NULL,
+    `source_account_no` VARCHAR(34) NOT NULL,
+    `beneficiary_account_no` VARCHAR(34) NOT NULL,
+    `beneficiary_bank_code` VARCHAR(8) NOT NULL DEFAULT '',
+    `amount_value` VARCHAR(20) NOT NULL,
+    `amount_currency` VARCHAR(3) NOT NULL DEFAULT 'IDR',
+    `transaction_date` VARCHAR(25) NOT NULL,
+    `id_transfer_status` TINYINT UNSIGNED NOT NULL DEFAULT 1,
+    `reference_no` VARCHAR(64) NOT NULL DEFAULT '',
+    `request_body` JSON NOT NULL DEFAULT '{}',
+    `response_body` LONGTEXT NOT NULL DEFAULT '',
+    `status_reason` LONGTEXT NOT NULL DEFAULT '',
+    `attempts` INT UNSIGNED NOT NULL DEFAULT 0,
+    `created_at` DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    `updated_at` DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    UNIQUE KEY `UQ1_TransferLedger_PartnerReference` (`id_bank`, `partner_reference_no`),
+    KEY `IDX1_TransferLedger_Status` (`id_transfer_status`, `updated_at`)
+)ENGINE = InnoDB;
+--rollback DROP TABLE `transfer_ledger`;
@@ -0,0 +1,9 @@
+--liquibase formatted sql
+
+--changeset Voxtmault:1
+ALTER TABLE `va_request`
+    ADD COLUMN IF NOT EXISTS `virtualAccountTrxType` CHAR(1) NOT NULL DEFAULT 'C',
+    ADD COLUMN IF NOT EXISTS `minAmountValue` VARCHAR(20) NOT NULL DEFAULT '0.00',
+    ADD COLUMN IF NOT EXISTS `maxAmountValue` VARCHAR(20) NOT NULL DEFAULT '0.00',
+    ADD COLUMN IF NOT EXISTS `cumulativePaymentAmountValue` VARCHAR(20) NOT NULL DEFAULT '0.00';
+--rollback ALTER TABLE `va_request` DROP COLUMN `virtualAccountTrxType`, DROP COLUMN `minAmountValue`, DROP COLUMN `maxAmountValue`, DROP COLUMN `cumulativePaymentAmountValue`;
@@ -0,0 +1,54 @@
+--liquibase formatted sql
+
+--changeset Voxtmault:1
+CREATE TABLE IF NOT EXISTS `webhook_endpoint` (
+    `id` INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    `id_bank` INT NOT NULL DEFAULT 0,
+    `id_transaction` INT NOT NULL DEFAULT 0,
+    `url` VARCHAR(2048) NOT NULL,
+    `secret` VARCHAR(128) NOT NULL,
+    `event_types` VARCHAR(255) NOT NULL DEFAULT '',
+    `active` TINYINT(1) NOT NULL DEFAULT 1,
+    `created_at` DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    `updated_at` DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    KEY `IDX1_WebhookEndpoint_Scope` (`id_bank`, `id_transaction`)
+)ENGINE = InnoDB;
+--rollback DROP TABLE `webhook_endpoint`;
+
+--changeset Voxtmault:2
+CREATE TABLE IF NOT EXISTS `webhook_delivery` (
+    `id` BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    `id_webhook_endpoint` INT NOT NULL,
+    `id_payment_event` BIGINT UNSIGNED NOT NULL,
+    `id_delivery_status` TINYINT UNSIGNED NOT NULL DEFAULT 1,
+    `attempts` INT UNSIGNED NOT NULL DEFAULT 0,
+    `next_attempt_at` DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    `last_response_code` INT NOT NULL DEFAULT 0,
+    `last_error` LONGTEXT NOT NULL DEFAULT '',
+    `created_at` DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    `updated_at` DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    UNIQUE KEY `UQ1_WebhookDelivery_EndpointEvent` (`id_webhook_endpoint`, `id_payment_event`),
+    KEY `IDX1_WebhookDelivery_Status` (`id_delivery_status`, `next_attempt_at`),
+    CONSTRAINT `FK1_WebhookDelivery_WebhookEndpoint` FOREIGN KEY (`id_webhook_endpoint`) REFERENCES webhook_endpoint(`id`),
+    CONSTRAINT `FK2_WebhookDelivery_PaymentEvent` FOREIGN KEY (`id_payment_event`) REFERENCES payment_event(`id`)
+)ENGINE = InnoDB;
+--rollback DROP TABLE `webhook_delivery`;
+
+--changeset Voxtmault:3
+-- Encrypted endpoint secrets embed their wrapped data key
+ALTER TABLE `webhook_endpoint`
+    MODIFY COLUMN `secret` VARCHAR(512) NOT NULL;
+--rollback ALTER TABLE `webhook_endpoint` MODIFY COLUMN `secret` VARCHAR(128) NOT NULL;
+
+--changeset Voxtmault:4
+CREATE TABLE IF NOT EXISTS `webhook_delivery_attempt` (
+    `id` BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    `id_webhook_delivery` BIGINT UNSIGNED NOT NULL,
+    `attempt` INT UNSIGNED NOT NULL,
+    `response_code` INT NOT NULL DEFAULT 0,
+    `error` LONGTEXT NOT NULL DEFAULT '',
+    `created_at` DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    KEY `IDX1_WebhookDeliveryAttempt_Delivery` (`id_webhook_delivery`, `attempt`),
+    CONSTRAINT `FK1_WebhookDeliveryAttempt_WebhookDelivery` FOREIGN KEY (`id_webhook_delivery`) REFERENCES webhook_delivery(`id`)
+)ENGINE = InnoDB;
+--rollback DROP TABLE `webhook_delivery_attempt`;
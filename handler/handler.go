@@ -0,0 +1,183 @@
+package bank_integration_handler
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	biConfig "github.com/voxtmault/bank-integration/config"
+	biInterfaces "github.com/voxtmault/bank-integration/interfaces"
+	biModels "github.com/voxtmault/bank-integration/models"
+)
+
+// Fallback responses written when a service fails without producing a SNAP response of its own
+var (
+	authGeneralError = biModels.BCAResponse{
+		HTTPStatusCode:  http.StatusInternalServerError,
+		ResponseCode:    "5007300",
+		ResponseMessage: "General Error",
+	}
+	billInquiryGeneralError = biModels.BCAResponse{
+		HTTPStatusCode:  http.StatusInternalServerError,
+		ResponseCode:    "5002400",
+		ResponseMessage: "General Error",
+	}
+	paymentFlagGeneralError = biModels.BCAResponse{
+		HTTPStatusCode:  http.StatusInternalServerError,
+		ResponseCode:    "5002500",
+		ResponseMessage: "General Error",
+	}
+)
+
+// Handler serves the bank-facing SNAP endpoints (access token, bill presentment and payment flag) of a single
+// bank service instance. The routes are mounted on the paths configured in RequestedEndpoints, only the path of an
+// endpoint configured as an absolute URL is routed.
+//
+// Handler implements http.Handler so it can be mounted on any router, e.g.
+//
+//	http.Handle("/", h)                 // net/http
+//	e.Any("/*", echo.WrapHandler(h))    // echo
+//	r.Any("/*path", gin.WrapH(h))       // gin
+//	r.Mount("/", h)                     // chi
+//
+// Each endpoint is also exposed on its own through AccessToken, BillPresentment and PaymentFlag for routers
+// that prefer explicit route registration.
+type Handler struct {
+	service   biInterfaces.SNAP
+	endpoints biConfig.RequestedEndpoints
+	mux       *http.ServeMux
+
+	// OnError is called with the error returned by the underlying service, if any. The SNAP response is still
+	// written to the bank afterwards. Defaults to logging the error.
+	OnError func(r *http.Request, err error)
+}
+
+// New creates a new handler for the given service, serving the routes described by endpoints
+func New(service biInterfaces.SNAP, endpoints *biConfig.RequestedEndpoints) *Handler {
+	h := &Handler{
+		service:   service,
+		endpoints: *endpoints,
+		mux:       http.NewServeMux(),
+		OnError: func(r *http.Request, err error) {
+			slog.Error("error handling bank callback", "uri", r.RequestURI, "error", err)
+		},
+	}
+
+	routes := make(map[string]bool)
+	for _, route := range []struct {
+		endpoint string
+		handler  http.Handler
+	}{
+		{h.endpoints.AuthURL, h.AccessToken()},
+		{h.endpoints.BillPresentmentURL, h.BillPresentment()},
+		{h.endpoints.PaymentFlagURL, h.PaymentFlag()},
+	} {
+		routePath, ok := endpointPath(route.endpoint)
+		if !ok || routes[routePath] {
+			// Registered as is, http.ServeMux would panic on it
+			slog.Error("bank callback endpoint not served, it is not a path or is served twice", "endpoint", route.endpoint)
+			continue
+		}
+
+		routes[routePath] = true
+		h.mux.Handle("POST "+routePath, route.handler)
+	}
+
+	return h
+}
+
+// endpointPath returns the path an endpoint is served on, endpoints being configured either as a path or as the
+// absolute URL given to the bank. False is returned when the endpoint has no clean absolute path.
+func endpointPath(endpoint string) (string, bool) {
+	parsed, err := url.Parse(endpoint)
+	if err != nil {
+		return "", false
+	}
+
+	// Escaped, so that the braces of a path are not taken as wildcards
+	escaped := parsed.EscapedPath()
+	cleaned := path.Clean(escaped)
+	if strings.HasSuffix(escaped, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	if !strings.HasPrefix(escaped, "/") || cleaned != escaped {
+		return "", false
+	}
+
+	return escaped, true
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// AccessToken handles the bank requesting an access token, see SNAP.GenerateAccessToken
+func (h *Handler) AccessToken() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response, err := h.service.GenerateAccessToken(r.Context(), r)
+		if err != nil {
+			h.OnError(r, err)
+		}
+
+		if response == nil || response.BCAResponse == nil {
+			writeResponse(w, authGeneralError.HTTPStatusCode, &biModels.AccessTokenResponse{BCAResponse: &authGeneralError})
+			return
+		}
+
+		writeResponse(w, response.HTTPStatusCode, response)
+	})
+}
+
+// BillPresentment handles the bank inquiring a virtual account bill, see SNAP.BillPresentment
+func (h *Handler) BillPresentment() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response, err := h.service.BillPresentment(r.Context(), r)
+		if err != nil {
+			h.OnError(r, err)
+		}
+
+		if response == nil {
+			writeResponse(w, billInquiryGeneralError.HTTPStatusCode, &biModels.VAResponsePayload{BCAResponse: billInquiryGeneralError})
+			return
+		}
+
+		writeResponse(w, response.HTTPStatusCode, response)
+	})
+}
+
+// PaymentFlag handles the bank flagging a virtual account bill as paid, see SNAP.InquiryVA
+func (h *Handler) PaymentFlag() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response, err := h.service.InquiryVA(r.Context(), r)
+		if err != nil {
+			h.OnError(r, err)
+		}
+
+		if response == nil {
+			writeResponse(w, paymentFlagGeneralError.HTTPStatusCode, &biModels.BCAInquiryVAResponse{BCAResponse: paymentFlagGeneralError})
+			return
+		}
+
+		writeResponse(w, response.HTTPStatusCode, response)
+	})
+}
+
+func writeResponse(w http.ResponseWriter, statusCode int, response interface{}) {
+	body, err := json.Marshal(response)
+	if err != nil {
+		slog.Error("error marshalling snap response", "error", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(body)
+}
@@ -0,0 +1,132 @@
+package bank_integration_handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	biConfig "github.com/voxtmault/bank-integration/config"
+	biInterfaces "github.com/voxtmault/bank-integration/interfaces"
+	biModels "github.com/voxtmault/bank-integration/models"
+)
+
+type fakeService struct {
+	biInterfaces.SNAP
+}
+
+func (f *fakeService) GenerateAccessToken(ctx context.Context, request *http.Request) (*biModels.AccessTokenResponse, error) {
+	return &biModels.AccessTokenResponse{
+		BCAResponse: &biModels.BCAResponse{HTTPStatusCode: http.StatusOK, ResponseCode: "2007300", ResponseMessage: "Successful"},
+		AccessToken: "token",
+		TokenType:   "Bearer",
+		ExpiresIn:   "900",
+	}, nil
+}
+
+func (f *fakeService) BillPresentment(ctx context.Context, request *http.Request) (*biModels.VAResponsePayload, error) {
+	return &biModels.VAResponsePayload{
+		BCAResponse: biModels.BCAResponse{HTTPStatusCode: http.StatusUnauthorized, ResponseCode: "4012400", ResponseMessage: "Unauthorized. [Signature]"},
+	}, errors.New("invalid signature")
+}
+
+func (f *fakeService) InquiryVA(ctx context.Context, request *http.Request) (*biModels.BCAInquiryVAResponse, error) {
+	return nil, errors.New("database is down")
+}
+
+func newTestHandler(t *testing.T) (*Handler, *[]error) {
+	t.Helper()
+
+	h := New(&fakeService{}, &biConfig.RequestedEndpoints{
+		AuthURL:            "/bank/v1.0/access-token/b2b",
+		BillPresentmentURL: "/bank/v1.0/transfer-va/inquiry",
+		PaymentFlagURL:     "/bank/v1.0/transfer-va/payment",
+	})
+
+	var errs []error
+	h.OnError = func(r *http.Request, err error) { errs = append(errs, err) }
+
+	return h, &errs
+}
+
+func serve(h http.Handler, method, path string) (*httptest.ResponseRecorder, map[string]interface{}) {
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest(method, path, strings.NewReader("{}")))
+
+	var body map[string]interface{}
+	json.Unmarshal(recorder.Body.Bytes(), &body)
+
+	return recorder, body
+}
+
+func TestHandlerRoutes(t *testing.T) {
+	h, errs := newTestHandler(t)
+
+	recorder, body := serve(h, http.MethodPost, "/bank/v1.0/access-token/b2b")
+	if recorder.Code != http.StatusOK || body["responseCode"] != "2007300" || body["accessToken"] != "token" {
+		t.Fatalf("unexpected access token response %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("unexpected content type %q", recorder.Header().Get("Content-Type"))
+	}
+
+	// The service response is written as is, along with its status code, even when an error is returned
+	recorder, body = serve(h, http.MethodPost, "/bank/v1.0/transfer-va/inquiry")
+	if recorder.Code != http.StatusUnauthorized || body["responseCode"] != "4012400" {
+		t.Fatalf("unexpected bill presentment response %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	// Without a response from the service, a general error is written
+	recorder, body = serve(h, http.MethodPost, "/bank/v1.0/transfer-va/payment")
+	if recorder.Code != http.StatusInternalServerError || body["responseCode"] != "5002500" {
+		t.Fatalf("unexpected payment flag response %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	if len(*errs) != 2 {
+		t.Fatalf("expected 2 reported errors, got %v", *errs)
+	}
+}
+
+func TestHandlerUnknownRoutes(t *testing.T) {
+	h, _ := newTestHandler(t)
+
+	if recorder, _ := serve(h, http.MethodGet, "/bank/v1.0/access-token/b2b"); recorder.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected method not allowed, got %d", recorder.Code)
+	}
+	if recorder, _ := serve(h, http.MethodPost, "/bank/v1.0/unknown"); recorder.Code != http.StatusNotFound {
+		t.Fatalf("expected not found, got %d", recorder.Code)
+	}
+}
+
+func TestHandlerEndpointURLs(t *testing.T) {
+	// Absolute URLs are served on their path, endpoints without a clean path are not served instead of panicking
+	h := New(&fakeService{}, &biConfig.RequestedEndpoints{
+		AuthURL:            "https://partner.example.com/bank/v1.0/access-token/b2b",
+		BillPresentmentURL: "/bank/v1.0/../transfer-va/inquiry",
+		PaymentFlagURL:     "https://partner.example.com/bank/v1.0/access-token/b2b",
+	})
+	h.OnError = func(r *http.Request, err error) {}
+
+	if recorder, body := serve(h, http.MethodPost, "/bank/v1.0/access-token/b2b"); recorder.Code != http.StatusOK || body["responseCode"] != "2007300" {
+		t.Fatalf("unexpected access token response %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder, _ := serve(h, http.MethodPost, "/bank/transfer-va/inquiry"); recorder.Code != http.StatusNotFound {
+		t.Fatalf("expected not found, got %d", recorder.Code)
+	}
+
+	for endpoint, expected := range map[string]string{
+		"/bank/v1.0/transfer-va/payment":                 "/bank/v1.0/transfer-va/payment",
+		"/bank/v1.0/transfer-va/":                        "/bank/v1.0/transfer-va/",
+		"https://partner.example.com/bank/{id}?source=1": "/bank/%7Bid%7D",
+		"https://partner.example.com":                    "",
+		"bank/v1.0/transfer-va/payment":                  "",
+		"":                                               "",
+	} {
+		if got, ok := endpointPath(endpoint); got != expected || ok != (expected != "") {
+			t.Errorf("endpoint %q: expected %q, got %q (%v)", endpoint, expected, got, ok)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package bank_integration_httpclient
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rotisserie/eris"
+)
+
+// ErrCircuitOpen is returned without sending the request while the circuit breaker of the endpoint is open
+var ErrCircuitOpen = eris.New("circuit breaker is open")
+
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"    // Requests are sent
+	BreakerOpen     BreakerState = "open"      // Requests are rejected with ErrCircuitOpen until the cooldown elapses
+	BreakerHalfOpen BreakerState = "half-open" // A single probe is sent, its outcome closes or opens the breaker again
+)
+
+// Breaker is the circuit breaker of a single endpoint. It opens after threshold consecutive failures and lets a
+// probe through once cooldown has elapsed.
+type Breaker struct {
+	threshold uint
+	cooldown  time.Duration
+
+	state    BreakerState
+	failures uint
+	openedAt time.Time
+	probing  bool
+
+	sync.Mutex
+}
+
+// NewBreaker creates a closed circuit breaker, a 0 threshold never opens it
+func NewBreaker(threshold uint, cooldown time.Duration) *Breaker {
+	return &Breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		state:     BreakerClosed,
+	}
+}
+
+// Allow returns ErrCircuitOpen when a request must not be sent. Every allowed request must be followed by Success,
+// Failure or Abort.
+func (b *Breaker) Allow() error {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.cooldown {
+		b.state = BreakerHalfOpen
+	}
+
+	switch b.state {
+	case BreakerOpen:
+		return ErrCircuitOpen
+	case BreakerHalfOpen:
+		// Only one probe at a time, the other requests keep failing fast until it settles
+		if b.probing {
+			return ErrCircuitOpen
+		}
+		b.probing = true
+	}
+
+	return nil
+}
+
+// Success closes the breaker
+func (b *Breaker) Success() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.state = BreakerClosed
+	b.failures = 0
+	b.probing = false
+}
+
+// Failure counts a failed request, the breaker opens once the threshold is reached or when the probe failed
+func (b *Breaker) Failure() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.failures++
+	b.probing = false
+	if b.threshold == 0 {
+		return
+	}
+
+	if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+		b.state = BreakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// Abort settles an allowed request that says nothing about the health of the endpoint, e.g. cancelled by the caller
+func (b *Breaker) Abort() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.probing = false
+}
+
+// State returns the current state of the breaker, an open breaker past its cooldown is reported half-open
+func (b *Breaker) State() BreakerState {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.cooldown {
+		return BreakerHalfOpen
+	}
+
+	return b.state
+}
@@ -0,0 +1,192 @@
+package bank_integration_httpclient
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/rotisserie/eris"
+	biConfig "github.com/voxtmault/bank-integration/config"
+	biLogger "github.com/voxtmault/bank-integration/logger"
+)
+
+// Client sends the requests to the banks over a pooled transport. Every endpoint (host and path) has its own
+// circuit breaker, idempotent requests are retried on transient failures.
+type Client struct {
+	HTTP *http.Client
+	cfg  biConfig.EgressConfig
+
+	breakers sync.Map // endpoint -> *Breaker
+}
+
+// New creates a client shared by the bank services, proxyAddress (PROXY_ADDRESS) is used as forward proxy when set.
+// Zero timeouts wait forever, as the default http client does.
+func New(cfg *biConfig.EgressConfig, proxyAddress string) (*Client, error) {
+	dialer := &net.Dialer{
+		Timeout:   cfg.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   cfg.ConnectTimeout,
+		ResponseHeaderTimeout: cfg.ReadTimeout,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   int(cfg.MaxIdleConnsPerHost),
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: time.Second,
+		ForceAttemptHTTP2:     true,
+	}
+
+	if proxyAddress != "" {
+		proxyUrl, err := url.Parse(proxyAddress)
+		if err != nil {
+			return nil, eris.Wrap(err, "parsing proxy address")
+		}
+		transport.Proxy = http.ProxyURL(proxyUrl)
+	}
+
+	client := &http.Client{Transport: transport}
+
+	// The response header timeout does not cover reading the body
+	if cfg.ConnectTimeout > 0 && cfg.ReadTimeout > 0 {
+		client.Timeout = cfg.ConnectTimeout + cfg.ReadTimeout
+	}
+
+	return &Client{
+		HTTP: client,
+		cfg:  *cfg,
+	}, nil
+}
+
+// Prepare readies a request for another attempt, e.g. signing it again with a new X-EXTERNAL-ID and X-TIMESTAMP
+type Prepare func(request *http.Request) error
+
+// Do sends the request and reads the whole response body, every attempt is logged into bank_egress. Idempotent
+// requests are retried up to MaxRetries times on connection errors, timeouts and 429 / 502 / 503 / 504 responses.
+// Signed requests (carrying an X-SIGNATURE) are not retried, the bank would see their X-EXTERNAL-ID twice, see
+// DoPrepared. ErrCircuitOpen is returned without sending the request while the breaker of the endpoint is open.
+func (c *Client) Do(request *http.Request, idempotent bool) (*http.Response, []byte, error) {
+	return c.DoPrepared(request, idempotent, nil)
+}
+
+// DoPrepared is Do calling prepare before every retry, signed idempotent requests are then retried with the headers
+// set by prepare
+func (c *Client) DoPrepared(request *http.Request, idempotent bool, prepare Prepare) (*http.Response, []byte, error) {
+	endpoint := Endpoint(request)
+	breaker := c.breaker(endpoint)
+
+	var retries uint
+	if idempotent && (request.Body == nil || request.GetBody != nil) && (prepare != nil || request.Header.Get("X-SIGNATURE") == "") {
+		retries = c.cfg.MaxRetries
+	}
+
+	var response *http.Response
+	var body []byte
+	var err error
+
+	backoff := c.cfg.RetryBackoff
+	for attempt := uint(0); ; attempt++ {
+		if attempt > 0 && request.GetBody != nil {
+			reqBody, rewindErr := request.GetBody()
+			if rewindErr != nil {
+				return response, body, err
+			}
+			request.Body = reqBody
+		}
+		if attempt > 0 && prepare != nil {
+			if prepareErr := prepare(request); prepareErr != nil {
+				slog.Error("error preparing retried request", "endpoint", endpoint, "error", prepareErr)
+				return response, body, err
+			}
+		}
+
+		if allowErr := breaker.Allow(); allowErr != nil {
+			// The breaker opened on the previous attempt, its outcome is more telling than the breaker
+			if attempt > 0 {
+				return response, body, err
+			}
+			return nil, nil, eris.Wrapf(allowErr, "sending request to %s", endpoint)
+		}
+
+		response, body, err = biLogger.Do(c.HTTP, request)
+
+		// Only the failures of the bank count, a cancelled caller says nothing about its health
+		switch {
+		case err != nil && request.Context().Err() != nil:
+			breaker.Abort()
+			return response, body, err
+		case err != nil || response.StatusCode >= http.StatusInternalServerError:
+			breaker.Failure()
+		default:
+			breaker.Success()
+		}
+
+		if attempt >= retries || !retryable(response, err) {
+			return response, body, err
+		}
+
+		slog.Debug("retrying request", "endpoint", endpoint, "attempt", attempt+1, "backoff", backoff, "error", err)
+
+		select {
+		case <-request.Context().Done():
+			return response, body, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// BreakerState returns the state of the circuit breaker of endpoint, see Endpoint
+func (c *Client) BreakerState(endpoint string) BreakerState {
+	if breaker, ok := c.breakers.Load(endpoint); ok {
+		return breaker.(*Breaker).State()
+	}
+
+	return BreakerClosed
+}
+
+// BreakerStates returns the state of the circuit breaker of every endpoint a request has been sent to
+func (c *Client) BreakerStates() map[string]BreakerState {
+	states := make(map[string]BreakerState)
+	c.breakers.Range(func(key, value any) bool {
+		states[key.(string)] = value.(*Breaker).State()
+		return true
+	})
+
+	return states
+}
+
+// Endpoint identifies the circuit breaker of the request, its host and path (e.g.
+// sandbox.bca.co.id/openapi/v1.0/balance-inquiry)
+func Endpoint(request *http.Request) string {
+	return request.URL.Host + request.URL.Path
+}
+
+func (c *Client) breaker(endpoint string) *Breaker {
+	if breaker, ok := c.breakers.Load(endpoint); ok {
+		return breaker.(*Breaker)
+	}
+
+	breaker, _ := c.breakers.LoadOrStore(endpoint, NewBreaker(c.cfg.BreakerThreshold, c.cfg.BreakerCooldown))
+	return breaker.(*Breaker)
+}
+
+// retryable reports whether the failure is transient: a connection error, a timeout of the attempt or the bank
+// asking to try again later
+func retryable(response *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+
+	switch response.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
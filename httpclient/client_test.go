@@ -0,0 +1,235 @@
+package bank_integration_httpclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	biConfig "github.com/voxtmault/bank-integration/config"
+)
+
+func newClient(t *testing.T, cfg biConfig.EgressConfig) *Client {
+	t.Helper()
+
+	client, err := New(&cfg, "")
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+
+	return client
+}
+
+// newServer answers with the given status codes in order, the last one is repeated
+func newServer(t *testing.T, statuses ...int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := int(calls.Add(1)) - 1
+
+		// Retried requests must carry the whole body again
+		if body, _ := io.ReadAll(r.Body); string(body) != `{"partnerReferenceNo":"1"}` {
+			t.Errorf("unexpected request body %q", body)
+		}
+
+		w.WriteHeader(statuses[min(call, len(statuses)-1)])
+		w.Write([]byte(`{"responseCode":"5001100","responseMessage":"General Error"}`))
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &calls
+}
+
+func newRequest(t *testing.T, url string) *http.Request {
+	t.Helper()
+
+	request, err := http.NewRequestWithContext(context.Background(), http.MethodPost, url, bytes.NewBufferString(`{"partnerReferenceNo":"1"}`))
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+
+	return request
+}
+
+func TestDoRetriesIdempotentRequests(t *testing.T) {
+	server, calls := newServer(t, http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusOK)
+	client := newClient(t, biConfig.EgressConfig{MaxRetries: 2, RetryBackoff: time.Millisecond})
+
+	response, _, err := client.Do(newRequest(t, server.URL+"/balance-inquiry"), true)
+	if err != nil || response.StatusCode != http.StatusOK {
+		t.Fatalf("expected the request to succeed on the last retry, got %v (%v)", response, err)
+	}
+	if calls.Load() != 3 {
+		t.Fatalf("expected 3 attempts, got %d", calls.Load())
+	}
+
+	// Retries are bounded
+	server, calls = newServer(t, http.StatusServiceUnavailable)
+	response, _, _ = client.Do(newRequest(t, server.URL+"/balance-inquiry"), true)
+	if response.StatusCode != http.StatusServiceUnavailable || calls.Load() != 3 {
+		t.Fatalf("expected the last response after 3 attempts, got %d after %d", response.StatusCode, calls.Load())
+	}
+}
+
+func TestDoDoesNotRetry(t *testing.T) {
+	client := newClient(t, biConfig.EgressConfig{MaxRetries: 2, RetryBackoff: time.Millisecond})
+
+	// Transfers may have reached the bank, they are never sent twice
+	server, calls := newServer(t, http.StatusServiceUnavailable, http.StatusOK)
+	response, _, _ := client.Do(newRequest(t, server.URL+"/transfer-intrabank"), false)
+	if response.StatusCode != http.StatusServiceUnavailable || calls.Load() != 1 {
+		t.Fatalf("expected a single attempt, got %d after %d", response.StatusCode, calls.Load())
+	}
+
+	// Rejections are final
+	server, calls = newServer(t, http.StatusBadRequest, http.StatusOK)
+	response, _, _ = client.Do(newRequest(t, server.URL+"/balance-inquiry"), true)
+	if response.StatusCode != http.StatusBadRequest || calls.Load() != 1 {
+		t.Fatalf("expected a single attempt, got %d after %d", response.StatusCode, calls.Load())
+	}
+}
+
+func TestDoSignedRequests(t *testing.T) {
+	var externalIDs []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		externalIDs = append(externalIDs, r.Header.Get("X-EXTERNAL-ID"))
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(server.Close)
+	client := newClient(t, biConfig.EgressConfig{MaxRetries: 2, RetryBackoff: time.Millisecond})
+
+	signed := func() *http.Request {
+		request := newRequest(t, server.URL+"/balance-inquiry")
+		request.Header.Set("X-EXTERNAL-ID", "1")
+		request.Header.Set("X-SIGNATURE", "signature")
+		return request
+	}
+
+	// Its signature and X-EXTERNAL-ID cannot be sent twice
+	client.Do(signed(), true)
+	if len(externalIDs) != 1 {
+		t.Fatalf("expected a single attempt, got %d", len(externalIDs))
+	}
+
+	// Every retry is signed again
+	externalIDs = nil
+	var attempt int
+	client.DoPrepared(signed(), true, func(request *http.Request) error {
+		attempt++
+		request.Header.Set("X-EXTERNAL-ID", strconv.Itoa(attempt+1))
+		return nil
+	})
+	if !slices.Equal(externalIDs, []string{"1", "2", "3"}) {
+		t.Fatalf("expected a new X-EXTERNAL-ID on every attempt, got %v", externalIDs)
+	}
+
+	// A request that cannot be signed again is not sent
+	externalIDs = nil
+	client.DoPrepared(signed(), true, func(request *http.Request) error {
+		return errors.New("no access token")
+	})
+	if len(externalIDs) != 1 {
+		t.Fatalf("expected a single attempt, got %d", len(externalIDs))
+	}
+}
+
+func TestDoReadTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(300 * time.Millisecond):
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	client := newClient(t, biConfig.EgressConfig{ConnectTimeout: time.Second, ReadTimeout: 50 * time.Millisecond})
+
+	start := time.Now()
+	if _, _, err := client.Do(newRequest(t, server.URL+"/balance-inquiry"), true); err == nil {
+		t.Fatal("expected a timeout")
+	}
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Fatalf("expected the request to time out after the read timeout, took %s", elapsed)
+	}
+}
+
+func TestDoCircuitBreaker(t *testing.T) {
+	server, calls := newServer(t, http.StatusInternalServerError, http.StatusInternalServerError, http.StatusOK)
+	client := newClient(t, biConfig.EgressConfig{BreakerThreshold: 2, BreakerCooldown: 50 * time.Millisecond})
+	endpoint := Endpoint(newRequest(t, server.URL+"/balance-inquiry"))
+
+	for i := 0; i < 2; i++ {
+		client.Do(newRequest(t, server.URL+"/balance-inquiry"), false)
+	}
+	if state := client.BreakerState(endpoint); state != BreakerOpen {
+		t.Fatalf("expected the breaker to be open, got %s", state)
+	}
+
+	// Callers fail fast, the bank is not called
+	_, _, err := client.Do(newRequest(t, server.URL+"/balance-inquiry"), false)
+	if !errors.Is(err, ErrCircuitOpen) || calls.Load() != 2 {
+		t.Fatalf("expected ErrCircuitOpen without calling the bank, got %v after %d calls", err, calls.Load())
+	}
+
+	// Other endpoints have their own breaker
+	if state := client.BreakerState(server.Listener.Addr().String() + "/bank-statement"); state != BreakerClosed {
+		t.Fatalf("expected the breaker of another endpoint to be closed, got %s", state)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if state := client.BreakerStates()[endpoint]; state != BreakerHalfOpen {
+		t.Fatalf("expected the breaker to be half-open after the cooldown, got %s", state)
+	}
+
+	// The probe succeeds and closes the breaker
+	if response, _, err := client.Do(newRequest(t, server.URL+"/balance-inquiry"), false); err != nil || response.StatusCode != http.StatusOK {
+		t.Fatalf("expected the probe to succeed, got %v (%v)", response, err)
+	}
+	if state := client.BreakerState(endpoint); state != BreakerClosed {
+		t.Fatalf("expected the breaker to be closed, got %s", state)
+	}
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	breaker := NewBreaker(1, 10*time.Millisecond)
+
+	breaker.Allow()
+	breaker.Failure()
+	if err := breaker.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected the breaker to be open, got %v", err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	// A single probe at a time
+	if err := breaker.Allow(); err != nil {
+		t.Fatalf("expected the probe to be allowed, got %v", err)
+	}
+	if err := breaker.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected a second probe to be rejected, got %v", err)
+	}
+
+	// A failed probe opens the breaker again
+	breaker.Failure()
+	if state := breaker.State(); state != BreakerOpen {
+		t.Fatalf("expected the breaker to be open, got %s", state)
+	}
+
+	// A disabled breaker never opens
+	breaker = NewBreaker(0, time.Minute)
+	for i := 0; i < 10; i++ {
+		breaker.Allow()
+		breaker.Failure()
+	}
+	if err := breaker.Allow(); err != nil {
+		t.Fatalf("expected a disabled breaker to allow every request, got %v", err)
+	}
+}
@@ -0,0 +1,215 @@
+package bank_integration_ingress
+
+import (
+	"context"
+	"crypto/rsa"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rotisserie/eris"
+	biModels "github.com/voxtmault/bank-integration/models"
+	biStorage "github.com/voxtmault/bank-integration/storage"
+	biTokens "github.com/voxtmault/bank-integration/tokens"
+	biUtil "github.com/voxtmault/bank-integration/utils"
+)
+
+// The checks of a bank callback shared by the ingress of every bank. They return one of the errors below when the
+// request is rejected, the ingress of the bank answers it with its own response code.
+var (
+	ErrTimestampOutOfSkew   = eris.New("timestamp outside of the accepted clock skew")
+	ErrSignatureReplayed    = eris.New("signature already used")
+	ErrConnectionNotAllowed = eris.New("source ip outside of the client allowlist")
+	ErrInvalidExternalID    = eris.New("invalid field format")
+	ErrInvalidAccessToken   = eris.New("invalid access token")
+)
+
+// MissingHeader returns the first of the given headers that is empty
+func MissingHeader(request *http.Request, headers ...string) string {
+	for _, header := range headers {
+		if request.Header.Get(header) == "" {
+			return header
+		}
+	}
+
+	return ""
+}
+
+// AccessToken returns the access token along with the client it was issued to, nil when the token does not exist or
+// expired. Tokens issued before the token store are not returned either: without their client id they can not be
+// checked against the allowlist of the client, which has to request a new one.
+func AccessToken(ctx context.Context, rdb *biStorage.RedisInstance, accessToken string) (*biModels.AccessToken, error) {
+	token, err := biTokens.NewStore(rdb).Get(ctx, accessToken)
+	if err != nil {
+		return nil, eris.Wrap(err, "getting access token")
+	}
+	if token == nil || token.ClientID == "" {
+		return nil, nil
+	}
+
+	return token, nil
+}
+
+// ClientPublicKey returns the public key registered for the client, nil when the client has none
+func ClientPublicKey(ctx context.Context, rdb *biStorage.RedisInstance, clientID string) (*rsa.PublicKey, error) {
+	keyData, err := rdb.GetIndividualValueRedisHash(ctx, biUtil.ClientPublicKeysRedis, clientID)
+	if err != nil || keyData == "" {
+		return nil, err
+	}
+
+	return biUtil.ParsePublicKey([]byte(keyData))
+}
+
+// ClientTimestampSkew returns the clock skew accepted from the client, fallback when the client has none
+func ClientTimestampSkew(ctx context.Context, rdb *biStorage.RedisInstance, clientID string, fallback time.Duration) (time.Duration, error) {
+	value, err := rdb.GetIndividualValueRedisHash(ctx, biUtil.ClientTimestampSkewRedis, clientID)
+	if err != nil || value == "" {
+		return fallback, err
+	}
+
+	seconds, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, eris.Wrap(err, "parsing client timestamp skew")
+	}
+
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// VerifyReplay rejects a verified request whose X-TIMESTAMP (RFC3339) is outside the clock skew window of the
+// client, or whose signature was already used within that window. A skew of 0 disables the check.
+//
+// Only signatures that cover the request body can be told apart from a replay, the access token signature is made
+// over the client id and X-TIMESTAMP alone and is checked with VerifyTimestamp instead.
+func VerifyReplay(ctx context.Context, rdb *biStorage.RedisInstance, bankCode, clientID, timeStamp, signature string, fallbackSkew time.Duration) error {
+	ttl, err := timestampWindow(ctx, rdb, clientID, timeStamp, fallbackSkew)
+	if err != nil || ttl == 0 {
+		return err
+	}
+
+	// SET NX keeps concurrent replays of the same signature from both passing
+	reserved, _, err := rdb.ReserveKey(ctx, biUtil.ReplayKey(bankCode, clientID, signature), ttl)
+	if err != nil {
+		return eris.Wrap(err, "reserving signature")
+	}
+	if !reserved {
+		return ErrSignatureReplayed
+	}
+
+	return nil
+}
+
+// VerifyTimestamp rejects a verified request whose X-TIMESTAMP (RFC3339) is outside the clock skew window of the
+// client, a skew of 0 disables the check. Unlike VerifyReplay the signature is not remembered: a deterministic
+// signature such as the access token one is legitimately sent again by requests made within the same second.
+func VerifyTimestamp(ctx context.Context, rdb *biStorage.RedisInstance, clientID, timeStamp string, fallbackSkew time.Duration) error {
+	_, err := timestampWindow(ctx, rdb, clientID, timeStamp, fallbackSkew)
+	return err
+}
+
+// timestampWindow returns how long a signature made at timeStamp must be remembered, 0 when the check is disabled
+func timestampWindow(ctx context.Context, rdb *biStorage.RedisInstance, clientID, timeStamp string, fallbackSkew time.Duration) (time.Duration, error) {
+	skew, err := ClientTimestampSkew(ctx, rdb, clientID, fallbackSkew)
+	if err != nil {
+		return 0, eris.Wrap(err, "getting client timestamp skew")
+	}
+	if skew <= 0 {
+		return 0, nil
+	}
+
+	parsed, err := time.Parse(time.RFC3339, timeStamp)
+	if err != nil {
+		return 0, eris.Wrap(ErrTimestampOutOfSkew, "parsing timestamp")
+	}
+	ttl, ok := biUtil.ReplayWindow(parsed, time.Now(), skew)
+	if !ok {
+		return 0, ErrTimestampOutOfSkew
+	}
+
+	return ttl, nil
+}
+
+// VerifySourceIP rejects a request of a client coming from outside of the allowlist of the client, clients without
+// an allowlist are accepted from anywhere. The X-Forwarded-For appended by trustedProxies is used as the source IP.
+func VerifySourceIP(ctx context.Context, rdb *biStorage.RedisInstance, request *http.Request, clientID string, trustedProxies []netip.Prefix) error {
+	// Without a client there is no allowlist to check against
+	if clientID == "" {
+		return eris.Wrap(ErrConnectionNotAllowed, "unknown client")
+	}
+
+	value, err := rdb.GetIndividualValueRedisHash(ctx, biUtil.ClientIPAllowlistRedis, clientID)
+	if err != nil {
+		return eris.Wrap(err, "getting client ip allowlist")
+	}
+	if value == "" {
+		return nil
+	}
+
+	allowlist, err := biUtil.ParseCIDRs(value)
+	if err != nil {
+		return eris.Wrap(err, "parsing client ip allowlist")
+	}
+
+	addr, err := biUtil.SourceIP(request, trustedProxies)
+	if err != nil || !biUtil.ContainsIP(allowlist, addr) {
+		return eris.Wrapf(ErrConnectionNotAllowed, "source ip %s", addr)
+	}
+
+	return nil
+}
+
+// ExternalIDKey validates the X-EXTERNAL-ID of the request against the format of the bank and returns the key
+// reserving it. Only the first 36 characters of the id are kept. The key is scoped to the client the bearer access
+// token was issued to, X-PARTNER-ID is set by the caller and can not tell clients apart.
+func ExternalIDKey(ctx context.Context, rdb *biStorage.RedisInstance, request *http.Request, bankCode string, format *regexp.Regexp) (string, error) {
+	externalID := request.Header.Get("X-EXTERNAL-ID")
+	if len(externalID) > 36 {
+		externalID = externalID[:36]
+	}
+
+	if !format.MatchString(externalID) {
+		return "", eris.Wrapf(ErrInvalidExternalID, "external id %s", externalID)
+	}
+
+	token, err := AccessToken(ctx, rdb, strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer "))
+	if err != nil {
+		return "", err
+	}
+	if token == nil {
+		return "", eris.Wrap(ErrInvalidAccessToken, "scoping external id")
+	}
+
+	return biUtil.ExternalIDKey(bankCode, token.ClientID, request.Header.Get("X-TIMESTAMP"), externalID), nil
+}
+
+// ReserveExternalID reserves the external id key for ttl. When it is already reserved false is returned along with
+// the response saved for it, nil while the first request is still being processed.
+func ReserveExternalID(ctx context.Context, rdb *biStorage.RedisInstance, key string, ttl time.Duration) (bool, []byte, error) {
+	// SET NX keeps the check and the reservation atomic between concurrent callbacks
+	reserved, stored, err := rdb.ReserveKey(ctx, key, ttl)
+	if err != nil {
+		return false, nil, eris.Wrap(err, "reserving external id")
+	}
+	if reserved || stored == "" {
+		return reserved, nil, nil
+	}
+
+	response, err := biUtil.DecompressData([]byte(stored))
+	if err != nil {
+		return false, nil, eris.Wrap(err, "decompressing stored response")
+	}
+
+	return false, response, nil
+}
+
+// SaveExternalIDResponse saves the response of the request that reserved the external id key
+func SaveExternalIDResponse(ctx context.Context, rdb *biStorage.RedisInstance, key string, response []byte) error {
+	compressed, err := biUtil.CompressData(response)
+	if err != nil {
+		return eris.Wrap(err, "compressing response")
+	}
+
+	return rdb.SaveReservedKey(ctx, key, string(compressed))
+}
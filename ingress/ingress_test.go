@@ -0,0 +1,199 @@
+package bank_integration_ingress
+
+import (
+	"context"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/rotisserie/eris"
+	biStorage "github.com/voxtmault/bank-integration/storage"
+	biTokens "github.com/voxtmault/bank-integration/tokens"
+	biUtil "github.com/voxtmault/bank-integration/utils"
+)
+
+func setup(t *testing.T) (*biStorage.RedisInstance, *miniredis.Miniredis) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+
+	return &biStorage.RedisInstance{RDB: redis.NewClient(&redis.Options{Addr: mr.Addr()})}, mr
+}
+
+func TestVerifyReplay(t *testing.T) {
+	rdb, mr := setup(t)
+	ctx := context.Background()
+	now := time.Now().Format(time.RFC3339)
+
+	if err := VerifyReplay(ctx, rdb, biUtil.BankCodeBCA, "client-a", now, "signature", time.Minute); err != nil {
+		t.Fatalf("expected the first signature to pass, got %v", err)
+	}
+	if err := VerifyReplay(ctx, rdb, biUtil.BankCodeBCA, "client-a", now, "signature", time.Minute); !eris.Is(err, ErrSignatureReplayed) {
+		t.Fatalf("expected the signature to be replayed, got %v", err)
+	}
+
+	// Signatures are remembered per bank
+	if err := VerifyReplay(ctx, rdb, biUtil.BankCodeMandiri, "client-a", now, "signature", time.Minute); err != nil {
+		t.Fatalf("expected the signature of another bank to pass, got %v", err)
+	}
+
+	stale := time.Now().Add(-2 * time.Minute).Format(time.RFC3339)
+	if err := VerifyReplay(ctx, rdb, biUtil.BankCodeBCA, "client-a", stale, "other", time.Minute); !eris.Is(err, ErrTimestampOutOfSkew) {
+		t.Fatalf("expected the timestamp to be out of skew, got %v", err)
+	}
+
+	// The skew of the client takes precedence, 0 disables the check
+	mr.HSet(biUtil.ClientTimestampSkewRedis, "client-a", "300")
+	if err := VerifyReplay(ctx, rdb, biUtil.BankCodeBCA, "client-a", stale, "other", time.Minute); err != nil {
+		t.Fatalf("expected the skew of the client to be used, got %v", err)
+	}
+	if err := VerifyReplay(ctx, rdb, biUtil.BankCodeBCA, "client-b", stale, "other", 0); err != nil {
+		t.Fatalf("expected the check to be disabled, got %v", err)
+	}
+}
+
+func TestVerifyTimestamp(t *testing.T) {
+	rdb, mr := setup(t)
+	ctx := context.Background()
+	now := time.Now().Format(time.RFC3339)
+
+	// The same timestamp passes again, nothing is remembered
+	for i := 0; i < 2; i++ {
+		if err := VerifyTimestamp(ctx, rdb, "client-a", now, time.Minute); err != nil {
+			t.Fatalf("expected the timestamp to pass, got %v", err)
+		}
+	}
+	if keys := mr.Keys(); len(keys) != 0 {
+		t.Fatalf("expected nothing to be remembered, got %v", keys)
+	}
+
+	stale := time.Now().Add(-2 * time.Minute).Format(time.RFC3339)
+	if err := VerifyTimestamp(ctx, rdb, "client-a", stale, time.Minute); !eris.Is(err, ErrTimestampOutOfSkew) {
+		t.Fatalf("expected the timestamp to be out of skew, got %v", err)
+	}
+	if err := VerifyTimestamp(ctx, rdb, "client-a", stale, 0); err != nil {
+		t.Fatalf("expected the check to be disabled, got %v", err)
+	}
+}
+
+func TestVerifySourceIP(t *testing.T) {
+	rdb, mr := setup(t)
+	ctx := context.Background()
+
+	request := httptest.NewRequest("POST", "/", nil)
+	request.RemoteAddr = "203.0.113.7:4431"
+
+	if err := VerifySourceIP(ctx, rdb, request, "client-a", nil); err != nil {
+		t.Fatalf("expected a client without allowlist to pass, got %v", err)
+	}
+
+	mr.HSet(biUtil.ClientIPAllowlistRedis, "client-a", "203.0.113.0/24")
+	if err := VerifySourceIP(ctx, rdb, request, "client-a", nil); err != nil {
+		t.Fatalf("expected an allowed source ip to pass, got %v", err)
+	}
+
+	mr.HSet(biUtil.ClientIPAllowlistRedis, "client-a", "198.51.100.0/24")
+	if err := VerifySourceIP(ctx, rdb, request, "client-a", nil); !eris.Is(err, ErrConnectionNotAllowed) {
+		t.Fatalf("expected the source ip to be rejected, got %v", err)
+	}
+}
+
+func TestExternalID(t *testing.T) {
+	rdb, _ := setup(t)
+	ctx := context.Background()
+	numeric := regexp.MustCompile(`^\d+$`)
+
+	store := biTokens.NewStore(rdb)
+	for token, clientID := range map[string]string{"token-a": "client-a", "token-b": "client-b"} {
+		if _, err := store.Issue(ctx, token, clientID, "secret", "", time.Minute); err != nil {
+			t.Fatalf("issuing token: %v", err)
+		}
+	}
+
+	request := httptest.NewRequest("POST", "/", nil)
+	request.Header.Set("X-EXTERNAL-ID", "ABC")
+	request.Header.Set("Authorization", "Bearer token-a")
+	if _, err := ExternalIDKey(ctx, rdb, request, biUtil.BankCodeBCA, numeric); !eris.Is(err, ErrInvalidExternalID) {
+		t.Fatalf("expected the external id to be invalid, got %v", err)
+	}
+
+	// The key is scoped to the client of the access token whatever X-PARTNER-ID says
+	request.Header.Set("X-EXTERNAL-ID", "1234567890")
+	request.Header.Set("X-PARTNER-ID", "client-b")
+	key, err := ExternalIDKey(ctx, rdb, request, biUtil.BankCodeBCA, numeric)
+	if err != nil {
+		t.Fatalf("getting external id key: %v", err)
+	}
+	if !strings.HasPrefix(key, biUtil.UniqueExternalIDRedis+":"+biUtil.BankCodeBCA+":client-a:") {
+		t.Fatalf("expected the key to be scoped to the client of the access token, got %s", key)
+	}
+
+	other := request.Clone(ctx)
+	other.Header.Set("Authorization", "Bearer token-b")
+	if otherKey, err := ExternalIDKey(ctx, rdb, other, biUtil.BankCodeBCA, numeric); err != nil || otherKey == key {
+		t.Fatalf("expected another client to get its own key, got %s (%v)", otherKey, err)
+	}
+
+	other.Header.Set("Authorization", "Bearer unknown")
+	if _, err := ExternalIDKey(ctx, rdb, other, biUtil.BankCodeBCA, numeric); !eris.Is(err, ErrInvalidAccessToken) {
+		t.Fatalf("expected an unknown access token to be rejected, got %v", err)
+	}
+
+	reserved, response, err := ReserveExternalID(ctx, rdb, key, time.Minute)
+	if err != nil || !reserved || response != nil {
+		t.Fatalf("expected the external id to be reserved, got %v %s (%v)", reserved, response, err)
+	}
+
+	// Resent while the first request is processed, then once it is answered
+	if reserved, response, err = ReserveExternalID(ctx, rdb, key, time.Minute); err != nil || reserved || response != nil {
+		t.Fatalf("expected the external id to be in progress, got %v %s (%v)", reserved, response, err)
+	}
+	if err = SaveExternalIDResponse(ctx, rdb, key, []byte(`{"responseCode":"2002400"}`)); err != nil {
+		t.Fatalf("saving response: %v", err)
+	}
+	if reserved, response, err = ReserveExternalID(ctx, rdb, key, time.Minute); err != nil || reserved || string(response) != `{"responseCode":"2002400"}` {
+		t.Fatalf("expected the saved response, got %v %s (%v)", reserved, response, err)
+	}
+}
+
+func TestClientPublicKey(t *testing.T) {
+	rdb, mr := setup(t)
+	ctx := context.Background()
+
+	if key, err := ClientPublicKey(ctx, rdb, "client-a"); key != nil || err != nil {
+		t.Fatalf("expected no public key, got %v (%v)", key, err)
+	}
+
+	mr.HSet(biUtil.ClientPublicKeysRedis, "client-a", "not a public key")
+	if _, err := ClientPublicKey(ctx, rdb, "client-a"); err == nil {
+		t.Fatal("expected an invalid public key to fail")
+	}
+}
+
+func TestAccessToken(t *testing.T) {
+	rdb, mr := setup(t)
+	ctx := context.Background()
+
+	if _, err := biTokens.NewStore(rdb).Issue(ctx, "issued", "client-a", "secret", "", time.Minute); err != nil {
+		t.Fatalf("issuing token: %v", err)
+	}
+	token, err := AccessToken(ctx, rdb, "issued")
+	if err != nil || token == nil || token.ClientID != "client-a" {
+		t.Fatalf("expected the issued token, got %v (%v)", token, err)
+	}
+
+	// Issued before the token store, without the client the allowlist can not be applied
+	mr.Set(biUtil.AccessTokenRedis+":legacy", "secret")
+	if token, err = AccessToken(ctx, rdb, "legacy"); token != nil || err != nil {
+		t.Fatalf("expected the legacy token to be denied, got %v (%v)", token, err)
+	}
+
+	request := httptest.NewRequest("POST", "/", nil)
+	if err = VerifySourceIP(ctx, rdb, request, "", nil); !eris.Is(err, ErrConnectionNotAllowed) {
+		t.Fatalf("expected a request without client to be rejected, got %v", err)
+	}
+}
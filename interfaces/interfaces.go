@@ -2,7 +2,9 @@ package bank_integration_interfaces
 
 import (
 	"context"
+	"crypto/rsa"
 	"net/http"
+	"time"
 
 	biModel "github.com/voxtmault/bank-integration/models"
 	biStorage "github.com/voxtmault/bank-integration/storage"
@@ -26,9 +28,21 @@ type RequestIngress interface {
 	// VerifySymmetricSignature verifies the request headers for non access-token related http requests.
 	VerifySymmetricSignature(ctx context.Context, request *http.Request, redis *biStorage.RedisInstance, payload []byte) (bool, *biModel.BCAResponse)
 
-	ValidateAccessToken(ctx context.Context, redis *biStorage.RedisInstance, accessToken string) (string, error)
+	// ValidateAccessToken returns the access token along with the client it was issued to, nil when the token does
+	// not exist, expired or was issued without client id
+	ValidateAccessToken(ctx context.Context, redis *biStorage.RedisInstance, accessToken string) (*biModel.AccessToken, error)
 
-	ValidateUniqueExternalID(ctx context.Context, rdb *biStorage.RedisInstance, externalId string) (bool, error)
+	// ValidateUniqueExternalID reserves the X-EXTERNAL-ID of the request for ttl, the reservation is scoped to the
+	// client the access token was issued to and the day of X-TIMESTAMP. Call it once the signature is verified. When the id has already been used false is returned along
+	// with the response saved through SaveExternalIDResponse, empty while the first request is still being handled.
+	ValidateUniqueExternalID(ctx context.Context, rdb *biStorage.RedisInstance, request *http.Request, ttl time.Duration) (bool, []byte, error)
+
+	// SaveExternalIDResponse stores the response returned to the request that reserved its X-EXTERNAL-ID
+	SaveExternalIDResponse(ctx context.Context, rdb *biStorage.RedisInstance, request *http.Request, response []byte) error
+
+	// VerifyClientSecret reports whether storedSecret, the client secret of clientID as stored in authenticated_banks
+	// (encrypted once a master key is configured), is clientSecret
+	VerifyClientSecret(ctx context.Context, clientID, storedSecret, clientSecret string) (bool, error)
 }
 
 type Security interface {
@@ -36,10 +50,12 @@ type Security interface {
 	CreateAsymmetricSignature(ctx context.Context, timeStamp string) (string, error)
 
 	// VerifyAsymmetricSignature verifies the request headers ONLY for access-token related http requests.
-	// It will compares the received HMAC with the calculated HMAC based on the received public key from banks.
+	// It will compares the received HMAC with the calculated HMAC based on the public key of the client. When publicKey
+	// is nil, the public key of the bank configuration is only used for the client id given to the bank, the
+	// signature of any other client is rejected.
 	//
 	// This function will return a boolean value signifying the results of comparison and an error regarding the internal process
-	VerifyAsymmetricSignature(ctx context.Context, timeStamp, clientKey, signature string) (bool, error)
+	VerifyAsymmetricSignature(ctx context.Context, timeStamp, clientKey, signature string, publicKey *rsa.PublicKey) (bool, error)
 
 	// CreateSymmetricSignature returns a base64 encoded signature. Based on SHA512-HMAC algorithm.
 	CreateSymmetricSignature(ctx context.Context, obj *biModel.SymmetricSignatureRequirement) (string, error)
@@ -66,6 +82,14 @@ type SNAP interface {
 
 	TransferIntraBank(ctx context.Context, payload *biModel.BCATransferIntraBankReq) (*biModel.BCAResponseTransferIntraBank, error)
 
+	// GetTransactionStatus returns the latest status of a previously sent transfer. Mainly used to confirm the final
+	// state of transfers whose outcome is unknown.
+	GetTransactionStatus(ctx context.Context, payload *biModel.BCATransactionStatusInquiryRequest) (*biModel.BCATransactionStatusInquiryResponse, error)
+
+	// ResolveUnknownTransfers settles transfers whose outcome is unknown through transfer status inquiry.
+	// Meant to be called periodically by the importer.
+	ResolveUnknownTransfers(ctx context.Context) error
+
 	// BillPresentment returns the bill information and the payment code.
 	// Generally called by Bank API
 	BillPresentment(ctx context.Context, request *http.Request) (*biModel.VAResponsePayload, error)
@@ -81,6 +105,10 @@ type SNAP interface {
 
 	CreateVAV2(ctx context.Context, payload *biModel.CreatePaymentVARequestV2) error
 
+	// CancelVA cancels the VA Payment Request of the transaction that is still waiting for payment. Further bill
+	// presentment and payment flag requests of the said VA are answered with an invalid bill response.
+	CancelVA(ctx context.Context, idTransaction uint) error
+
 	// GetAllVAWaitingPayment is called upon program startup to populate transaction watcher
 	GetAllVAWaitingPayment(ctx context.Context) error
 
@@ -93,11 +121,23 @@ type SNAP interface {
 type Management interface {
 	GetAuthenticatedBanks(ctx context.Context) ([]*biModel.AuthenticatedBank, error)
 
-	RegisterBank(ctx context.Context, bankName string) (*biModel.BankClientCredential, error)
+	// RegisterBank generates the client credentials of a new client, publicKeyPath is the PEM public key verifying
+	// its access token requests
+	RegisterBank(ctx context.Context, bankName, publicKeyPath string) (*biModel.BankClientCredential, error)
+
+	// UpdateRegisteredBank updates the fields set in obj of a registered client, redis is updated right away
+	UpdateRegisteredBank(ctx context.Context, idBank uint, obj *biModel.UpdateAuthenticatedBank) error
+
+	// RotateClientSecret generates a new client secret for a registered client, the access tokens issued with the
+	// previous secret are invalidated
+	RotateClientSecret(ctx context.Context, idBank uint) (*biModel.BankClientCredential, error)
 
-	UpdateRegisteredBank(ctx context.Context) error
+	// RevokeRegisteredBank soft deletes a registered client, its credentials and access tokens are removed from redis
+	RevokeRegisteredBank(ctx context.Context, idBank uint) error
 
-	RevokeRegisteredBank(ctx context.Context) error
+	// ReencryptClientSecrets encrypts the client secrets stored in plaintext or with a previous master key using the
+	// current master key, it returns the number of re-encrypted secrets
+	ReencryptClientSecrets(ctx context.Context) (int, error)
 }
 
 type Internal interface {
@@ -0,0 +1,271 @@
+package bank_integration_keys
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"strings"
+
+	"github.com/rotisserie/eris"
+	biConfig "github.com/voxtmault/bank-integration/config"
+)
+
+// Encrypted values are formatted as enc:v1:{master key id}:{base64 wrapped data key}:{base64 nonce | ciphertext}
+const encryptedPrefix = "enc:v1:"
+
+// MasterKeyProvider wraps and unwraps the data keys of the envelope encryption, the master key itself never leaves
+// the provider. Applications keeping their master key in a KMS implement it on top of the KMS client.
+type MasterKeyProvider interface {
+	// KeyID identifies the master key, it is stored along every data key it wrapped and may not contain ':'
+	KeyID() string
+
+	WrapKey(ctx context.Context, dataKey []byte) ([]byte, error)
+	UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+// StaticMasterKey is an AES-256 master key read from the configuration, data keys are wrapped with AES-GCM
+type StaticMasterKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+func NewStaticMasterKey(id string, key []byte) (*StaticMasterKey, error) {
+	if id == "" || strings.Contains(id, ":") {
+		return nil, eris.New("master key id must be set and may not contain ':'")
+	}
+	if len(key) != 32 {
+		return nil, eris.New("master key must be 32 bytes long")
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StaticMasterKey{id: id, aead: aead}, nil
+}
+
+func (k *StaticMasterKey) KeyID() string {
+	return k.id
+}
+
+func (k *StaticMasterKey) WrapKey(ctx context.Context, dataKey []byte) ([]byte, error) {
+	return seal(k.aead, dataKey, []byte(k.id))
+}
+
+func (k *StaticMasterKey) UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	return open(k.aead, wrapped, []byte(k.id))
+}
+
+// Envelope encrypts secrets at rest. Every value is encrypted with its own AES-256-GCM data key, the data key is
+// wrapped by the primary master key and stored along the value. Values wrapped by a previous master key can still
+// be decrypted, the management ReencryptClientSecrets moves them to the primary one.
+//
+// A nil Envelope stores the values in plaintext, it is used when no master key is configured.
+type Envelope struct {
+	primary   MasterKeyProvider
+	providers map[string]MasterKeyProvider
+}
+
+func NewEnvelope(primary MasterKeyProvider, previous ...MasterKeyProvider) *Envelope {
+	e := &Envelope{
+		primary:   primary,
+		providers: map[string]MasterKeyProvider{primary.KeyID(): primary},
+	}
+	for _, provider := range previous {
+		e.providers[provider.KeyID()] = provider
+	}
+
+	return e
+}
+
+// NewEnvelopeFromConfig returns the envelope of SECRET_MASTER_KEY and SECRET_PREVIOUS_MASTER_KEYS, nil if no master
+// key is configured
+func NewEnvelopeFromConfig(cfg *biConfig.InternalConfig) (*Envelope, error) {
+	if cfg.SecretConfig.MasterKey == "" {
+		return nil, nil
+	}
+
+	primary, err := parseMasterKey(cfg.SecretConfig.MasterKeyID, cfg.SecretConfig.MasterKey)
+	if err != nil {
+		return nil, eris.Wrap(err, "parsing master key")
+	}
+
+	var previous []MasterKeyProvider
+	for _, entry := range strings.Split(cfg.SecretConfig.PreviousMasterKeys, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		id, key, found := strings.Cut(entry, ":")
+		if !found {
+			return nil, eris.New("previous master keys must be formatted as id:base64 key")
+		}
+
+		provider, err := parseMasterKey(id, key)
+		if err != nil {
+			return nil, eris.Wrapf(err, "parsing previous master key %s", id)
+		}
+		previous = append(previous, provider)
+	}
+
+	return NewEnvelope(primary, previous...), nil
+}
+
+// IsEncrypted reports whether value has been encrypted by an Envelope
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, encryptedPrefix)
+}
+
+// Encrypt encrypts plaintext, associatedData (e.g. the client id) is authenticated but not stored, the same value
+// has to be given to Decrypt. The plaintext is returned as is by a nil Envelope.
+func (e *Envelope) Encrypt(ctx context.Context, plaintext, associatedData string) (string, error) {
+	if e == nil {
+		return plaintext, nil
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", eris.Wrap(err, "generating data key")
+	}
+	defer clear(dataKey)
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	ciphertext, err := seal(aead, []byte(plaintext), []byte(associatedData))
+	if err != nil {
+		return "", err
+	}
+
+	wrapped, err := e.primary.WrapKey(ctx, dataKey)
+	if err != nil {
+		return "", eris.Wrap(err, "wrapping data key")
+	}
+
+	return encryptedPrefix + e.primary.KeyID() + ":" + base64.RawStdEncoding.EncodeToString(wrapped) + ":" +
+		base64.RawStdEncoding.EncodeToString(ciphertext), nil
+}
+
+// Decrypt returns the plaintext of a value returned by Encrypt. Values that are not encrypted, written before a
+// master key was configured, are returned as is.
+func (e *Envelope) Decrypt(ctx context.Context, value, associatedData string) (string, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+	if e == nil {
+		return "", eris.New("value is encrypted but no master key is configured")
+	}
+
+	parts := strings.Split(strings.TrimPrefix(value, encryptedPrefix), ":")
+	if len(parts) != 3 {
+		return "", eris.New("malformed encrypted value")
+	}
+
+	provider, ok := e.providers[parts[0]]
+	if !ok {
+		return "", eris.Errorf("unknown master key %s", parts[0])
+	}
+
+	wrapped, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", eris.Wrap(err, "decoding data key")
+	}
+	ciphertext, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", eris.Wrap(err, "decoding ciphertext")
+	}
+
+	dataKey, err := provider.UnwrapKey(ctx, wrapped)
+	if err != nil {
+		return "", eris.Wrap(err, "unwrapping data key")
+	}
+	defer clear(dataKey)
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := open(aead, ciphertext, []byte(associatedData))
+	if err != nil {
+		return "", err
+	}
+
+	return string(plaintext), nil
+}
+
+// Equal reports whether value, encrypted or not, holds plaintext. The plaintexts are compared in constant time.
+func (e *Envelope) Equal(ctx context.Context, value, plaintext, associatedData string) (bool, error) {
+	decrypted, err := e.Decrypt(ctx, value, associatedData)
+	if err != nil {
+		return false, err
+	}
+
+	return subtle.ConstantTimeCompare([]byte(decrypted), []byte(plaintext)) == 1, nil
+}
+
+// NeedsReencryption reports whether value is stored in plaintext or wrapped by a previous master key
+func (e *Envelope) NeedsReencryption(value string) bool {
+	if e == nil {
+		return false
+	}
+	if !IsEncrypted(value) {
+		return true
+	}
+
+	return !strings.HasPrefix(value, encryptedPrefix+e.primary.KeyID()+":")
+}
+
+// Helper Functions
+
+func parseMasterKey(id, encoded string) (*StaticMasterKey, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, eris.Wrap(err, "decoding master key")
+	}
+
+	return NewStaticMasterKey(id, key)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, eris.Wrap(err, "creating cipher")
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, eris.Wrap(err, "creating gcm")
+	}
+
+	return aead, nil
+}
+
+// seal returns nonce | ciphertext
+func seal(aead cipher.AEAD, plaintext, associatedData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, eris.Wrap(err, "generating nonce")
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, associatedData), nil
+}
+
+func open(aead cipher.AEAD, sealed, associatedData []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, eris.New("ciphertext too short")
+	}
+
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], associatedData)
+	if err != nil {
+		return nil, eris.Wrap(err, "decrypting")
+	}
+
+	return plaintext, nil
+}
@@ -0,0 +1,151 @@
+package bank_integration_keys
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	biConfig "github.com/voxtmault/bank-integration/config"
+)
+
+func newMasterKey(t *testing.T, id string, b byte) *StaticMasterKey {
+	t.Helper()
+
+	key, err := NewStaticMasterKey(id, bytes.Repeat([]byte{b}, 32))
+	if err != nil {
+		t.Fatalf("creating master key: %v", err)
+	}
+
+	return key
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	envelope := NewEnvelope(newMasterKey(t, "v1", 1))
+
+	encrypted, err := envelope.Encrypt(ctx, "client-secret", "client-id")
+	if err != nil {
+		t.Fatalf("encrypting: %v", err)
+	}
+	if !IsEncrypted(encrypted) || strings.Contains(encrypted, "client-secret") {
+		t.Fatalf("expected an encrypted value, got %s", encrypted)
+	}
+
+	// Every value has its own data key
+	again, _ := envelope.Encrypt(ctx, "client-secret", "client-id")
+	if again == encrypted {
+		t.Fatal("expected two encryptions of the same secret to differ")
+	}
+
+	plaintext, err := envelope.Decrypt(ctx, encrypted, "client-id")
+	if err != nil || plaintext != "client-secret" {
+		t.Fatalf("expected the secret back, got %q (%v)", plaintext, err)
+	}
+
+	// The value is bound to its client, it can't be copied to another row
+	if _, err = envelope.Decrypt(ctx, encrypted, "another-client"); err == nil {
+		t.Fatal("expected an error decrypting with another client id")
+	}
+
+	// Plaintext values written before the master key was configured are returned as is
+	if plaintext, err = envelope.Decrypt(ctx, "legacy-secret", "client-id"); err != nil || plaintext != "legacy-secret" {
+		t.Fatalf("expected the plaintext value back, got %q (%v)", plaintext, err)
+	}
+
+	var none *Envelope
+	if _, err = none.Decrypt(ctx, encrypted, "client-id"); err == nil {
+		t.Fatal("expected an error decrypting without master key")
+	}
+	if plaintext, _ = none.Encrypt(ctx, "client-secret", "client-id"); plaintext != "client-secret" {
+		t.Fatal("expected a nil envelope to keep the plaintext")
+	}
+}
+
+func TestEnvelopeMasterKeyRotation(t *testing.T) {
+	ctx := context.Background()
+	previous := NewEnvelope(newMasterKey(t, "v1", 1))
+
+	encrypted, err := previous.Encrypt(ctx, "client-secret", "client-id")
+	if err != nil {
+		t.Fatalf("encrypting: %v", err)
+	}
+
+	envelope := NewEnvelope(newMasterKey(t, "v2", 2), newMasterKey(t, "v1", 1))
+	if !envelope.NeedsReencryption(encrypted) || !envelope.NeedsReencryption("legacy-secret") {
+		t.Fatal("expected values of the previous master key and plaintext values to need re-encryption")
+	}
+
+	plaintext, err := envelope.Decrypt(ctx, encrypted, "client-id")
+	if err != nil || plaintext != "client-secret" {
+		t.Fatalf("expected the previous master key to decrypt, got %q (%v)", plaintext, err)
+	}
+
+	reencrypted, _ := envelope.Encrypt(ctx, plaintext, "client-id")
+	if envelope.NeedsReencryption(reencrypted) {
+		t.Fatal("expected values of the primary master key to be up to date")
+	}
+	if _, err = previous.Decrypt(ctx, reencrypted, "client-id"); err == nil {
+		t.Fatal("expected the previous envelope to not know the new master key")
+	}
+}
+
+func TestEnvelopeEqual(t *testing.T) {
+	ctx := context.Background()
+	envelope := NewEnvelope(newMasterKey(t, "v1", 1))
+
+	encrypted, err := envelope.Encrypt(ctx, "client-secret", "client-id")
+	if err != nil {
+		t.Fatalf("encrypting: %v", err)
+	}
+
+	for _, test := range []struct {
+		value, plaintext string
+		equal            bool
+	}{
+		{encrypted, "client-secret", true},
+		{encrypted, "other-secret", false},
+		{"client-secret", "client-secret", true}, // Stored before a master key was configured
+		{"client-secret", "other-secret", false},
+	} {
+		if equal, err := envelope.Equal(ctx, test.value, test.plaintext, "client-id"); err != nil || equal != test.equal {
+			t.Fatalf("comparing %q to %q: expected %v, got %v (%v)", test.value, test.plaintext, test.equal, equal, err)
+		}
+	}
+
+	var none *Envelope
+	if _, err = none.Equal(ctx, encrypted, "client-secret", "client-id"); err == nil {
+		t.Fatal("expected an encrypted value to fail without master key")
+	}
+}
+
+func TestNewEnvelopeFromConfig(t *testing.T) {
+	envelope, err := NewEnvelopeFromConfig(&biConfig.InternalConfig{})
+	if err != nil || envelope != nil {
+		t.Fatalf("expected no envelope without master key, got %v (%v)", envelope, err)
+	}
+
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	previous := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))
+
+	envelope, err = NewEnvelopeFromConfig(&biConfig.InternalConfig{SecretConfig: biConfig.SecretConfig{
+		MasterKey:          key,
+		MasterKeyID:        "v2",
+		PreviousMasterKeys: "v1:" + previous,
+	}})
+	if err != nil {
+		t.Fatalf("creating envelope: %v", err)
+	}
+	if envelope.primary.KeyID() != "v2" || envelope.providers["v1"] == nil {
+		t.Fatal("expected the primary and previous master keys to be loaded")
+	}
+
+	_, err = NewEnvelopeFromConfig(&biConfig.InternalConfig{SecretConfig: biConfig.SecretConfig{
+		MasterKey:   base64.StdEncoding.EncodeToString([]byte("too short")),
+		MasterKeyID: "v1",
+	}})
+	if err == nil {
+		t.Fatal("expected an error with a short master key")
+	}
+}
@@ -0,0 +1,294 @@
+package bank_integration_keys
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"database/sql"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rotisserie/eris"
+	biConfig "github.com/voxtmault/bank-integration/config"
+	biModels "github.com/voxtmault/bank-integration/models"
+	biUtil "github.com/voxtmault/bank-integration/utils"
+)
+
+// Auditor records a key rotation, rotations are always logged, the auditor keeps a durable trail of them
+type Auditor func(ctx context.Context, rotation *biModels.KeyRotation) error
+
+// DBAuditor writes the key rotations into key_rotation
+func DBAuditor(db *sql.DB) Auditor {
+	return func(ctx context.Context, rotation *biModels.KeyRotation) error {
+		statement := `
+		INSERT INTO key_rotation (id_bank, key_type, path, previous_fingerprint, fingerprint, grace_until)
+		VALUES (?,?,?,?,?,?)
+		`
+		var graceUntil sql.NullTime
+		if !rotation.GraceUntil.IsZero() {
+			graceUntil = sql.NullTime{Time: rotation.GraceUntil, Valid: true}
+		}
+
+		result, err := db.ExecContext(ctx, statement, rotation.IDBank, rotation.KeyType, rotation.Path,
+			rotation.PreviousFingerprint, rotation.Fingerprint, graceUntil,
+		)
+		if err != nil {
+			return eris.Wrap(err, "inserting key_rotation")
+		}
+
+		if id, err := result.LastInsertId(); err == nil {
+			rotation.ID = uint64(id)
+		}
+
+		return nil
+	}
+}
+
+type publicKey struct {
+	key         *rsa.PublicKey
+	fingerprint string
+	graceUntil  time.Time // Zero for the current key
+}
+
+// Manager holds the key material of a bank service: the signer of our private key, used to sign the requests sent
+// to the bank, and the bank public key, used to verify the signatures sent by the bank. The key material is loaded
+// again by Reload, either on demand or periodically once Start is called. A replaced bank public key is still accepted during the
+// grace period, signatures made by the bank right before it rotated its key keep being verified.
+type Manager struct {
+	bankConfig     *biConfig.BankConfig
+	signerProvider SignerProvider
+	publicKeyPath  string
+	gracePeriod    time.Duration
+
+	mu                 sync.RWMutex
+	signer             crypto.Signer
+	privateFingerprint string      // Fingerprint of the public key of the signer
+	publicKeys         []publicKey // Current key first, followed by the keys still in their grace period
+	auditor            Auditor
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewManager loads the signer of signerProvider and the public key of the bank configuration, the signer provider
+// selected by the internal configuration is used when signerProvider is nil
+func NewManager(cfg *biConfig.InternalConfig, bCfg *biConfig.BankConfig, signerProvider SignerProvider) (*Manager, error) {
+	if signerProvider == nil {
+		var err error
+		if signerProvider, err = NewSignerProvider(cfg); err != nil {
+			return nil, eris.Wrap(err, "creating signer provider")
+		}
+	}
+
+	m := &Manager{
+		bankConfig:     bCfg,
+		signerProvider: signerProvider,
+		publicKeyPath:  bCfg.PublicKeyPath,
+		gracePeriod:    cfg.KeyConfig.GracePeriod,
+	}
+
+	signer, privateFingerprint, err := loadSigner(context.Background(), signerProvider)
+	if err != nil {
+		return nil, eris.Wrap(err, "loading private key")
+	}
+
+	key, fingerprint, err := readPublicKey(m.publicKeyPath)
+	if err != nil {
+		return nil, eris.Wrap(err, "loading public key")
+	}
+
+	m.signer = signer
+	m.privateFingerprint = privateFingerprint
+	m.publicKeys = []publicKey{{key: key, fingerprint: fingerprint}}
+
+	return m, nil
+}
+
+// SetAuditor sets the auditor called on every rotation
+func (m *Manager) SetAuditor(auditor Auditor) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.auditor = auditor
+}
+
+// Signer returns the signer of the current private key
+func (m *Manager) Signer() crypto.Signer {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.signer
+}
+
+// PublicKeys returns the current bank public key followed by the previous ones still in their grace period
+func (m *Manager) PublicKeys() []*rsa.PublicKey {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	now := time.Now()
+	keys := make([]*rsa.PublicKey, 0, len(m.publicKeys))
+	for i, key := range m.publicKeys {
+		if i > 0 && now.After(key.graceUntil) {
+			continue
+		}
+		keys = append(keys, key.key)
+	}
+
+	return keys
+}
+
+// Reload loads the key material again and swaps the keys that changed. Both keys are loaded before anything is
+// swapped, the current keys are kept if any of them is missing or invalid.
+func (m *Manager) Reload(ctx context.Context) error {
+	signer, privateFingerprint, err := loadSigner(ctx, m.signerProvider)
+	if err != nil {
+		return eris.Wrap(err, "loading private key")
+	}
+
+	key, fingerprint, err := readPublicKey(m.publicKeyPath)
+	if err != nil {
+		return eris.Wrap(err, "loading public key")
+	}
+
+	var rotations []*biModels.KeyRotation
+
+	m.mu.Lock()
+	now := time.Now()
+	idBank := m.bankConfig.BankCredential.InternalBankID
+
+	if privateFingerprint != m.privateFingerprint {
+		rotations = append(rotations, &biModels.KeyRotation{
+			IDBank:              idBank,
+			KeyType:             biUtil.KeyTypePrivate,
+			Path:                m.signerProvider.String(),
+			PreviousFingerprint: m.privateFingerprint,
+			Fingerprint:         privateFingerprint,
+		})
+		m.signer = signer
+		m.privateFingerprint = privateFingerprint
+	}
+
+	if fingerprint != m.publicKeys[0].fingerprint {
+		previous := m.publicKeys[0]
+		previous.graceUntil = now.Add(m.gracePeriod)
+
+		publicKeys := []publicKey{{key: key, fingerprint: fingerprint}, previous}
+		for _, retired := range m.publicKeys[1:] {
+			if now.Before(retired.graceUntil) && retired.fingerprint != fingerprint {
+				publicKeys = append(publicKeys, retired)
+			}
+		}
+
+		rotations = append(rotations, &biModels.KeyRotation{
+			IDBank:              idBank,
+			KeyType:             biUtil.KeyTypePublic,
+			Path:                m.publicKeyPath,
+			PreviousFingerprint: previous.fingerprint,
+			Fingerprint:         fingerprint,
+			GraceUntil:          previous.graceUntil,
+		})
+		m.publicKeys = publicKeys
+	}
+	auditor := m.auditor
+	m.mu.Unlock()
+
+	for _, rotation := range rotations {
+		slog.Info("key rotated",
+			"id_bank", rotation.IDBank,
+			"key_type", rotation.KeyType,
+			"previous_fingerprint", rotation.PreviousFingerprint,
+			"fingerprint", rotation.Fingerprint,
+			"grace_until", rotation.GraceUntil,
+		)
+
+		if auditor != nil {
+			if err := auditor(ctx, rotation); err != nil {
+				slog.Error("error auditing key rotation", "key_type", rotation.KeyType, "error", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Start reloads the key material every interval until Stop is called, it is a no-op if interval is not positive
+func (m *Manager) Start(interval time.Duration) {
+	if interval <= 0 || m.cancel != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := m.Reload(ctx); err != nil {
+					slog.Error("error reloading keys, keeping the current ones", "error", err)
+				}
+			}
+		}
+	}()
+}
+
+// Stop stops the periodic reload
+func (m *Manager) Stop() {
+	if m == nil || m.cancel == nil {
+		return
+	}
+
+	m.cancel()
+	m.wg.Wait()
+	m.cancel = nil
+}
+
+// Helper Functions
+
+func loadSigner(ctx context.Context, provider SignerProvider) (crypto.Signer, string, error) {
+	signer, err := provider.Signer(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	publicKey, ok := signer.Public().(*rsa.PublicKey)
+	if !ok {
+		return nil, "", eris.New("not an RSA key")
+	}
+
+	fingerprint, err := biUtil.PublicKeyFingerprint(publicKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return signer, fingerprint, nil
+}
+
+func readPublicKey(path string) (*rsa.PublicKey, string, error) {
+	keyData, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", eris.Wrap(err, "reading file")
+	}
+
+	publicKey, err := biUtil.ParsePublicKey(keyData)
+	if err != nil {
+		return nil, "", err
+	}
+
+	fingerprint, err := biUtil.PublicKeyFingerprint(publicKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return publicKey, fingerprint, nil
+}
@@ -0,0 +1,240 @@
+package bank_integration_keys
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	biConfig "github.com/voxtmault/bank-integration/config"
+	biInterfaces "github.com/voxtmault/bank-integration/interfaces"
+	biModels "github.com/voxtmault/bank-integration/models"
+	biUtil "github.com/voxtmault/bank-integration/utils"
+)
+
+func generateKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+
+	return key
+}
+
+func writePrivateKey(t *testing.T, path string, key *rsa.PrivateKey) {
+	t.Helper()
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("writing private key: %v", err)
+	}
+}
+
+func writePublicKey(t *testing.T, path string, key *rsa.PrivateKey) {
+	t.Helper()
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("marshalling public key: %v", err)
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600); err != nil {
+		t.Fatalf("writing public key: %v", err)
+	}
+}
+
+func newManager(t *testing.T, grace time.Duration) (*Manager, string, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	privatePath := filepath.Join(dir, "private.pem")
+	publicPath := filepath.Join(dir, "bank.pem")
+	writePrivateKey(t, privatePath, generateKey(t))
+	writePublicKey(t, publicPath, generateKey(t))
+
+	bCfg := &biConfig.BankConfig{}
+	bCfg.BankCredential.InternalBankID = 1
+	bCfg.BankCredential.PublicKeyPath = publicPath
+
+	m, err := NewManager(&biConfig.InternalConfig{
+		PrivateKeyPath: privatePath,
+		KeyConfig:      biConfig.KeyConfig{GracePeriod: grace},
+	}, bCfg, nil)
+	if err != nil {
+		t.Fatalf("creating key manager: %v", err)
+	}
+
+	return m, privatePath, publicPath
+}
+
+func TestReloadKeepsPreviousPublicKeyDuringGracePeriod(t *testing.T) {
+	m, privatePath, publicPath := newManager(t, time.Hour)
+
+	previous := m.PublicKeys()[0]
+	previousFingerprint, _ := biUtil.PublicKeyFingerprint(previous)
+
+	// Nothing changed, nothing is rotated
+	var rotations []*biModels.KeyRotation
+	m.SetAuditor(func(ctx context.Context, rotation *biModels.KeyRotation) error {
+		rotations = append(rotations, rotation)
+		return nil
+	})
+	if err := m.Reload(context.Background()); err != nil {
+		t.Fatalf("reloading keys: %v", err)
+	}
+	if len(rotations) != 0 {
+		t.Fatalf("expected no rotation, got %d", len(rotations))
+	}
+
+	bankKey := generateKey(t)
+	writePublicKey(t, publicPath, bankKey)
+	ourKey := generateKey(t)
+	writePrivateKey(t, privatePath, ourKey)
+
+	if err := m.Reload(context.Background()); err != nil {
+		t.Fatalf("reloading keys: %v", err)
+	}
+
+	keys := m.PublicKeys()
+	if len(keys) != 2 || !keys[0].Equal(&bankKey.PublicKey) || !keys[1].Equal(previous) {
+		t.Fatalf("expected the new public key followed by the previous one, got %d keys", len(keys))
+	}
+	if !m.Signer().(*rsa.PrivateKey).Equal(ourKey) {
+		t.Fatal("expected the private key to be swapped")
+	}
+
+	if len(rotations) != 2 {
+		t.Fatalf("expected 2 rotations, got %d", len(rotations))
+	}
+	if rotations[0].KeyType != biUtil.KeyTypePrivate || !rotations[0].GraceUntil.IsZero() {
+		t.Fatalf("unexpected private key rotation %+v", rotations[0])
+	}
+	if rotations[1].KeyType != biUtil.KeyTypePublic || rotations[1].PreviousFingerprint != previousFingerprint ||
+		rotations[1].IDBank != 1 || time.Until(rotations[1].GraceUntil) <= 0 {
+		t.Fatalf("unexpected public key rotation %+v", rotations[1])
+	}
+}
+
+func TestReloadDropsPreviousPublicKeyAfterGracePeriod(t *testing.T) {
+	m, _, publicPath := newManager(t, 0)
+
+	bankKey := generateKey(t)
+	writePublicKey(t, publicPath, bankKey)
+	if err := m.Reload(context.Background()); err != nil {
+		t.Fatalf("reloading keys: %v", err)
+	}
+
+	time.Sleep(time.Millisecond)
+
+	keys := m.PublicKeys()
+	if len(keys) != 1 || !keys[0].Equal(&bankKey.PublicKey) {
+		t.Fatalf("expected only the new public key, got %d keys", len(keys))
+	}
+}
+
+func TestReloadKeepsCurrentKeysOnInvalidFile(t *testing.T) {
+	m, privatePath, publicPath := newManager(t, time.Hour)
+
+	signer := m.Signer()
+	publicKey := m.PublicKeys()[0]
+
+	// The private key is valid but the public key is not, nothing must be swapped
+	writePrivateKey(t, privatePath, generateKey(t))
+	if err := os.WriteFile(publicPath, []byte("not a key"), 0600); err != nil {
+		t.Fatalf("writing public key: %v", err)
+	}
+
+	if err := m.Reload(context.Background()); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if !m.Signer().(*rsa.PrivateKey).Equal(signer) || !m.PublicKeys()[0].Equal(publicKey) || len(m.PublicKeys()) != 1 {
+		t.Fatal("expected the current keys to be kept")
+	}
+}
+
+func TestDBAuditor(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("creating sql mock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("INSERT INTO key_rotation").
+		WithArgs(1, biUtil.KeyTypePublic, "/keys/bank.pem", "aa", "bb", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(9, 1))
+
+	rotation := &biModels.KeyRotation{
+		IDBank:              1,
+		KeyType:             biUtil.KeyTypePublic,
+		Path:                "/keys/bank.pem",
+		PreviousFingerprint: "aa",
+		Fingerprint:         "bb",
+		GraceUntil:          time.Now().Add(time.Hour),
+	}
+	if err := DBAuditor(db)(context.Background(), rotation); err != nil {
+		t.Fatalf("auditing rotation: %v", err)
+	}
+	if rotation.ID != 9 {
+		t.Fatalf("expected id 9, got %d", rotation.ID)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type staticSecurity struct {
+	biInterfaces.Security
+	signature string
+}
+
+func (s *staticSecurity) CreateAsymmetricSignature(ctx context.Context, timeStamp string) (string, error) {
+	return s.signature, nil
+}
+
+func TestSwappableSecurity(t *testing.T) {
+	security := NewSwappableSecurity(&staticSecurity{signature: "first"})
+
+	if security.Keys() != nil {
+		t.Fatal("expected no key manager")
+	}
+	if _, err := security.Swap(nil); err == nil {
+		t.Fatal("expected an error swapping a nil security")
+	}
+
+	// Swapping while signing must not race, run with -race
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if _, err := security.CreateAsymmetricSignature(context.Background(), ""); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+
+	previous, err := security.Swap(&staticSecurity{signature: "second"})
+	if err != nil {
+		t.Fatalf("swapping security: %v", err)
+	}
+	wg.Wait()
+
+	if previous.(*staticSecurity).signature != "first" {
+		t.Fatal("expected the previous security to be returned")
+	}
+	if signature, _ := security.CreateAsymmetricSignature(context.Background(), ""); signature != "second" {
+		t.Fatalf("expected the swapped security to sign, got %s", signature)
+	}
+}
@@ -0,0 +1,343 @@
+package bank_integration_keys
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"hash"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/rotisserie/eris"
+	biConfig "github.com/voxtmault/bank-integration/config"
+	biUtil "github.com/voxtmault/bank-integration/utils"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Signer providers accepted by PRIVATE_KEY_PROVIDER
+const (
+	SignerProviderPEM   = "pem"   // Plaintext PKCS1 / PKCS8 PEM file
+	SignerProviderPKCS8 = "pkcs8" // Encrypted PKCS8 PEM file, decrypted with PRIVATE_KEY_PASSPHRASE
+)
+
+// SignerProvider gives access to our private key through a crypto.Signer, the key itself may never leave its
+// storage (e.g. an HSM or a KMS). Signer is called on startup and on every reload of the key manager, String
+// identifies the key material in the key rotation trail and must not reveal any secret.
+type SignerProvider interface {
+	Signer(ctx context.Context) (crypto.Signer, error)
+	String() string
+}
+
+// NewSignerProvider returns the signer provider selected by PRIVATE_KEY_PROVIDER, PEM files are used by default
+func NewSignerProvider(cfg *biConfig.InternalConfig) (SignerProvider, error) {
+	switch cfg.KeyConfig.Provider {
+	case "", SignerProviderPEM:
+		return &PEMFileProvider{Path: cfg.PrivateKeyPath}, nil
+	case SignerProviderPKCS8:
+		if cfg.KeyConfig.Passphrase == "" {
+			return nil, eris.New("passphrase is required to decrypt the private key")
+		}
+		return &EncryptedPKCS8Provider{Path: cfg.PrivateKeyPath, Passphrase: []byte(cfg.KeyConfig.Passphrase)}, nil
+	default:
+		return nil, eris.Errorf("unsupported signer provider %s", cfg.KeyConfig.Provider)
+	}
+}
+
+// PEMFileProvider reads a plaintext PKCS1 or PKCS8 RSA private key
+type PEMFileProvider struct {
+	Path string
+}
+
+func (p *PEMFileProvider) Signer(ctx context.Context) (crypto.Signer, error) {
+	keyData, err := os.ReadFile(p.Path)
+	if err != nil {
+		return nil, eris.Wrap(err, "reading file")
+	}
+
+	return biUtil.ParsePrivateKey(keyData)
+}
+
+func (p *PEMFileProvider) String() string {
+	return SignerProviderPEM + ":" + p.Path
+}
+
+// EncryptedPKCS8Provider reads an ENCRYPTED PRIVATE KEY PEM file, as written by
+// `openssl pkcs8 -topk8 -v2 aes-256-cbc`. PBES2 with PBKDF2 (HMAC-SHA1 / SHA256 / SHA512) and AES-CBC or
+// DES-EDE3-CBC is supported.
+type EncryptedPKCS8Provider struct {
+	Path       string
+	Passphrase []byte
+}
+
+func (p *EncryptedPKCS8Provider) Signer(ctx context.Context) (crypto.Signer, error) {
+	keyData, err := os.ReadFile(p.Path)
+	if err != nil {
+		return nil, eris.Wrap(err, "reading file")
+	}
+
+	return ParseEncryptedPKCS8(keyData, p.Passphrase)
+}
+
+func (p *EncryptedPKCS8Provider) String() string {
+	return SignerProviderPKCS8 + ":" + p.Path
+}
+
+// PKCS11Token is the subset of a PKCS#11 session used to sign with a private key that never leaves the token. It
+// is implemented by the application on top of its PKCS#11 binding (e.g. github.com/miekg/pkcs11) or of a KMS
+// client, keeping cgo and vendor SDKs out of this module.
+type PKCS11Token interface {
+	// FindKey returns the handle of the private key object with the given label (CKA_LABEL) and its public key
+	FindKey(ctx context.Context, label string) (handle uint, publicKey crypto.PublicKey, err error)
+
+	// Sign signs data with the CKM_RSA_PKCS mechanism, data is the DER encoded DigestInfo of the hash to sign
+	Sign(ctx context.Context, handle uint, data []byte) ([]byte, error)
+}
+
+// PKCS11Provider signs through the private key labelled Label of a PKCS#11 token
+type PKCS11Provider struct {
+	Token PKCS11Token
+	Label string
+}
+
+func (p *PKCS11Provider) Signer(ctx context.Context) (crypto.Signer, error) {
+	if p.Token == nil {
+		return nil, eris.New("pkcs11 token is nil")
+	}
+
+	handle, publicKey, err := p.Token.FindKey(ctx, p.Label)
+	if err != nil {
+		return nil, eris.Wrap(err, "finding pkcs11 key")
+	}
+	if _, ok := publicKey.(*rsa.PublicKey); !ok {
+		return nil, eris.New("not an RSA key")
+	}
+
+	return &tokenSigner{token: p.Token, handle: handle, publicKey: publicKey}, nil
+}
+
+func (p *PKCS11Provider) String() string {
+	return "pkcs11:" + p.Label
+}
+
+// DER encoded DigestInfo prefixes of the hashes accepted by tokenSigner, see RFC 8017 section 9.2
+var digestInfoPrefixes = map[crypto.Hash][]byte{
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+type tokenSigner struct {
+	token     PKCS11Token
+	handle    uint
+	publicKey crypto.PublicKey
+}
+
+func (s *tokenSigner) Public() crypto.PublicKey {
+	return s.publicKey
+}
+
+// Sign produces a PKCS1 v1.5 signature, the same one as rsa.SignPKCS1v15
+func (s *tokenSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if _, ok := opts.(*rsa.PSSOptions); ok {
+		return nil, eris.New("pss signatures are not supported")
+	}
+
+	prefix, ok := digestInfoPrefixes[opts.HashFunc()]
+	if !ok {
+		return nil, eris.Errorf("unsupported hash %s", opts.HashFunc())
+	}
+	if len(digest) != opts.HashFunc().Size() {
+		return nil, eris.New("digest length does not match the hash")
+	}
+
+	signature, err := s.token.Sign(context.Background(), s.handle, append(append([]byte{}, prefix...), digest...))
+	if err != nil {
+		return nil, eris.Wrap(err, "signing with pkcs11 token")
+	}
+
+	return signature, nil
+}
+
+// LocalSignerProvider holds an RSA key in memory, it stands in for the other providers in tests
+type LocalSignerProvider struct {
+	mu  sync.RWMutex
+	key *rsa.PrivateKey
+}
+
+// NewLocalSignerProvider generates a new 2048 bits RSA key
+func NewLocalSignerProvider() (*LocalSignerProvider, error) {
+	p := &LocalSignerProvider{}
+	if err := p.Rotate(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Rotate generates a new key, it is picked up by the key manager on its next reload
+func (p *LocalSignerProvider) Rotate() error {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return eris.Wrap(err, "generating key")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.key = key
+
+	return nil
+}
+
+// PublicKey returns the public key of the current key, to be handed to the bank under test
+func (p *LocalSignerProvider) PublicKey() *rsa.PublicKey {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return &p.key.PublicKey
+}
+
+func (p *LocalSignerProvider) Signer(ctx context.Context) (crypto.Signer, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.key, nil
+}
+
+func (p *LocalSignerProvider) String() string {
+	return "local"
+}
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidDESEDE3CBC     = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+)
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// ParseEncryptedPKCS8 decrypts a PEM encoded, PBES2 encrypted, PKCS8 RSA private key
+func ParseEncryptedPKCS8(keyData, passphrase []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(keyData)
+	if block == nil || block.Type != "ENCRYPTED PRIVATE KEY" {
+		return nil, eris.New("failed to decode PEM block containing encrypted private key")
+	}
+
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(block.Bytes, &info); err != nil {
+		return nil, eris.Wrap(err, "parsing encrypted private key info")
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, eris.Errorf("unsupported encryption algorithm %s", info.Algorithm.Algorithm)
+	}
+
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, eris.Wrap(err, "parsing pbes2 parameters")
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, eris.Errorf("unsupported key derivation function %s", params.KeyDerivationFunc.Algorithm)
+	}
+
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, eris.Wrap(err, "parsing pbkdf2 parameters")
+	}
+
+	var prf func() hash.Hash
+	switch {
+	case len(kdf.PRF.Algorithm) == 0, kdf.PRF.Algorithm.Equal(oidHMACWithSHA1):
+		prf = sha1.New
+	case kdf.PRF.Algorithm.Equal(oidHMACWithSHA256):
+		prf = sha256.New
+	case kdf.PRF.Algorithm.Equal(oidHMACWithSHA512):
+		prf = sha512.New
+	default:
+		return nil, eris.Errorf("unsupported pbkdf2 prf %s", kdf.PRF.Algorithm)
+	}
+
+	var newCipher func(key []byte) (cipher.Block, error)
+	var keyLength int
+	switch scheme := params.EncryptionScheme.Algorithm; {
+	case scheme.Equal(oidAES128CBC):
+		newCipher, keyLength = aes.NewCipher, 16
+	case scheme.Equal(oidAES192CBC):
+		newCipher, keyLength = aes.NewCipher, 24
+	case scheme.Equal(oidAES256CBC):
+		newCipher, keyLength = aes.NewCipher, 32
+	case scheme.Equal(oidDESEDE3CBC):
+		newCipher, keyLength = des.NewTripleDESCipher, 24
+	default:
+		return nil, eris.Errorf("unsupported encryption scheme %s", scheme)
+	}
+	if kdf.KeyLength != 0 && kdf.KeyLength != keyLength {
+		return nil, eris.New("pbkdf2 key length does not match the encryption scheme")
+	}
+
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, eris.Wrap(err, "parsing encryption scheme iv")
+	}
+
+	c, err := newCipher(pbkdf2.Key(passphrase, kdf.Salt, kdf.IterationCount, keyLength, prf))
+	if err != nil {
+		return nil, eris.Wrap(err, "creating cipher")
+	}
+	if len(iv) != c.BlockSize() || len(info.EncryptedData) == 0 || len(info.EncryptedData)%c.BlockSize() != 0 {
+		return nil, eris.New("invalid encrypted private key")
+	}
+
+	plain := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(c, iv).CryptBlocks(plain, info.EncryptedData)
+
+	// Strip the PKCS7 padding, a wrong passphrase almost always ends up with an invalid padding
+	padding := int(plain[len(plain)-1])
+	if padding == 0 || padding > c.BlockSize() || !bytes.Equal(bytes.Repeat([]byte{byte(padding)}, padding), plain[len(plain)-padding:]) {
+		return nil, eris.New("decrypting private key, wrong passphrase")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(plain[:len(plain)-padding])
+	if err != nil {
+		return nil, eris.Wrap(err, "decrypting private key, wrong passphrase")
+	}
+
+	privateKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, eris.New("not an RSA private key")
+	}
+
+	return privateKey, nil
+}
@@ -0,0 +1,238 @@
+package bank_integration_keys
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	biConfig "github.com/voxtmault/bank-integration/config"
+	biModels "github.com/voxtmault/bank-integration/models"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// encryptPKCS8 is the inverse of ParseEncryptedPKCS8 using PBKDF2-HMAC-SHA256 and AES-256-CBC, the same defaults
+// as `openssl pkcs8 -topk8 -v2 aes-256-cbc`
+func encryptPKCS8(t *testing.T, key *rsa.PrivateKey, passphrase []byte) []byte {
+	t.Helper()
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshalling private key: %v", err)
+	}
+
+	salt, iv := make([]byte, 16), make([]byte, aes.BlockSize)
+	rand.Read(salt)
+	rand.Read(iv)
+
+	block, _ := aes.NewCipher(pbkdf2.Key(passphrase, salt, 2048, 32, sha256.New))
+	padding := aes.BlockSize - len(der)%aes.BlockSize
+	plain := append(der, bytes.Repeat([]byte{byte(padding)}, padding)...)
+	encrypted := make([]byte, len(plain))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, plain)
+
+	kdf, _ := asn1.Marshal(pbkdf2Params{Salt: salt, IterationCount: 2048, PRF: pkix.AlgorithmIdentifier{
+		Algorithm: oidHMACWithSHA256, Parameters: asn1.NullRawValue,
+	}})
+	ivParam, _ := asn1.Marshal(iv)
+	params, _ := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdf}},
+		EncryptionScheme:  pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParam}},
+	})
+	info, err := asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}},
+		EncryptedData: encrypted,
+	})
+	if err != nil {
+		t.Fatalf("marshalling encrypted private key: %v", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: info})
+}
+
+func TestEncryptedPKCS8Provider(t *testing.T) {
+	key := generateKey(t)
+	path := filepath.Join(t.TempDir(), "private.pem")
+	if err := os.WriteFile(path, encryptPKCS8(t, key, []byte("s3cret")), 0600); err != nil {
+		t.Fatalf("writing private key: %v", err)
+	}
+
+	provider, err := NewSignerProvider(&biConfig.InternalConfig{
+		PrivateKeyPath: path,
+		KeyConfig:      biConfig.KeyConfig{Provider: SignerProviderPKCS8, Passphrase: "s3cret"},
+	})
+	if err != nil {
+		t.Fatalf("creating signer provider: %v", err)
+	}
+
+	signer, err := provider.Signer(context.Background())
+	if err != nil {
+		t.Fatalf("loading signer: %v", err)
+	}
+	if !signer.(*rsa.PrivateKey).Equal(key) {
+		t.Fatal("expected the decrypted key to match")
+	}
+
+	wrong := &EncryptedPKCS8Provider{Path: path, Passphrase: []byte("wrong")}
+	if _, err := wrong.Signer(context.Background()); err == nil {
+		t.Fatal("expected an error with a wrong passphrase")
+	}
+}
+
+// The fixtures of testdata are encrypted from key.pem by openssl (3.0) with the passphrase s3cret:
+//
+//	openssl pkcs8 -topk8 -v2 aes-256-cbc -in key.pem -passout pass:s3cret                       # aes256-default.pem
+//	openssl pkcs8 -topk8 -v2 aes-256-cbc -v2prf hmacWithSHA1 -in key.pem -passout pass:s3cret   # aes256-sha1.pem
+//	openssl pkcs8 -topk8 -v2 aes-128-cbc -v2prf hmacWithSHA512 -in key.pem -passout pass:s3cret # aes128-sha512.pem
+//	openssl pkcs8 -topk8 -v2 des3 -in key.pem -passout pass:s3cret                              # des3-default.pem
+//	openssl pkcs8 -topk8 -v1 PBE-SHA1-3DES -in key.pem -passout pass:s3cret                     # pbes1.pem
+func TestParseEncryptedPKCS8OpenSSL(t *testing.T) {
+	keyData, err := os.ReadFile(filepath.Join("testdata", "key.pem"))
+	if err != nil {
+		t.Fatalf("reading key: %v", err)
+	}
+	block, _ := pem.Decode(keyData)
+	expected, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatalf("parsing key: %v", err)
+	}
+
+	for _, test := range []struct {
+		file  string
+		valid bool
+	}{
+		{"aes256-default.pem", true}, // hmacWithSHA256, the default prf of openssl
+		{"aes256-sha1.pem", true},    // hmacWithSHA1, the default prf of PKCS #5, left out of the parameters
+		{"aes128-sha512.pem", true},
+		{"des3-default.pem", true},
+		{"pbes1.pem", false}, // PBES1 is not supported
+	} {
+		t.Run(test.file, func(t *testing.T) {
+			encrypted, err := os.ReadFile(filepath.Join("testdata", test.file))
+			if err != nil {
+				t.Fatalf("reading fixture: %v", err)
+			}
+
+			key, err := ParseEncryptedPKCS8(encrypted, []byte("s3cret"))
+			if !test.valid {
+				if err == nil {
+					t.Fatal("expected the fixture to be rejected")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decrypting fixture: %v", err)
+			}
+			if !key.Equal(expected) {
+				t.Fatal("expected the decrypted key to match")
+			}
+
+			if _, err := ParseEncryptedPKCS8(encrypted, []byte("wrong")); err == nil {
+				t.Fatal("expected an error with a wrong passphrase")
+			}
+		})
+	}
+}
+
+func TestNewSignerProvider(t *testing.T) {
+	provider, err := NewSignerProvider(&biConfig.InternalConfig{PrivateKeyPath: "/keys/private.pem"})
+	if err != nil {
+		t.Fatalf("creating signer provider: %v", err)
+	}
+	if provider.String() != "pem:/keys/private.pem" {
+		t.Fatalf("expected the pem provider by default, got %s", provider)
+	}
+
+	if _, err := NewSignerProvider(&biConfig.InternalConfig{KeyConfig: biConfig.KeyConfig{Provider: SignerProviderPKCS8}}); err == nil {
+		t.Fatal("expected an error without passphrase")
+	}
+	if _, err := NewSignerProvider(&biConfig.InternalConfig{KeyConfig: biConfig.KeyConfig{Provider: "vault"}}); err == nil {
+		t.Fatal("expected an error with an unknown provider")
+	}
+}
+
+// fakeToken signs the DigestInfo as a CKM_RSA_PKCS token would
+type fakeToken struct {
+	key *rsa.PrivateKey
+}
+
+func (f *fakeToken) FindKey(ctx context.Context, label string) (uint, crypto.PublicKey, error) {
+	return 7, &f.key.PublicKey, nil
+}
+
+func (f *fakeToken) Sign(ctx context.Context, handle uint, data []byte) ([]byte, error) {
+	return rsa.SignPKCS1v15(nil, f.key, crypto.Hash(0), data)
+}
+
+func TestPKCS11ProviderSignsLikeRSA(t *testing.T) {
+	key := generateKey(t)
+	provider := &PKCS11Provider{Token: &fakeToken{key: key}, Label: "bank-integration"}
+
+	signer, err := provider.Signer(context.Background())
+	if err != nil {
+		t.Fatalf("loading signer: %v", err)
+	}
+
+	hashed := sha256.Sum256([]byte("client-id|2024-01-01T00:00:00+07:00"))
+	signature, err := signer.Sign(rand.Reader, hashed[:], crypto.SHA256)
+	if err != nil {
+		t.Fatalf("signing: %v", err)
+	}
+
+	// PKCS1 v1.5 signatures are deterministic, the bank must receive the exact same signature
+	expected, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if !bytes.Equal(signature, expected) {
+		t.Fatal("expected the token signature to match rsa.SignPKCS1v15")
+	}
+
+	if _, err := signer.Sign(rand.Reader, hashed[:], &rsa.PSSOptions{Hash: crypto.SHA256}); err == nil {
+		t.Fatal("expected an error for pss signatures")
+	}
+}
+
+func TestManagerWithLocalSigner(t *testing.T) {
+	_, _, publicPath := newManager(t, 0)
+
+	provider, err := NewLocalSignerProvider()
+	if err != nil {
+		t.Fatalf("creating local signer: %v", err)
+	}
+
+	bCfg := &biConfig.BankConfig{}
+	bCfg.BankCredential.PublicKeyPath = publicPath
+	m, err := NewManager(&biConfig.InternalConfig{}, bCfg, provider)
+	if err != nil {
+		t.Fatalf("creating key manager: %v", err)
+	}
+
+	var rotations []*biModels.KeyRotation
+	m.SetAuditor(func(ctx context.Context, rotation *biModels.KeyRotation) error {
+		rotations = append(rotations, rotation)
+		return nil
+	})
+
+	if err := provider.Rotate(); err != nil {
+		t.Fatalf("rotating local signer: %v", err)
+	}
+	if err := m.Reload(context.Background()); err != nil {
+		t.Fatalf("reloading keys: %v", err)
+	}
+
+	if !provider.PublicKey().Equal(m.Signer().Public()) {
+		t.Fatal("expected the rotated signer to be used")
+	}
+	if len(rotations) != 1 || rotations[0].Path != "local" {
+		t.Fatalf("expected a single rotation of the local signer, got %d", len(rotations))
+	}
+}
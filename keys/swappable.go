@@ -0,0 +1,75 @@
+package bank_integration_keys
+
+import (
+	"context"
+	"crypto/rsa"
+	"sync/atomic"
+
+	"github.com/rotisserie/eris"
+	biInterfaces "github.com/voxtmault/bank-integration/interfaces"
+	biModels "github.com/voxtmault/bank-integration/models"
+)
+
+// KeyHolder is implemented by the Security instances whose key material is held by a Manager
+type KeyHolder interface {
+	Keys() *Manager
+}
+
+type securityBox struct {
+	biInterfaces.Security
+}
+
+// SwappableSecurity is a Security delegating every call to an implementation that can be replaced at runtime,
+// the egress and ingress of a bank service hold the SwappableSecurity so that they never see a half swapped
+// instance. Calls already running finish with the implementation they started with.
+type SwappableSecurity struct {
+	current atomic.Pointer[securityBox]
+}
+
+var _ biInterfaces.Security = &SwappableSecurity{}
+
+func NewSwappableSecurity(security biInterfaces.Security) *SwappableSecurity {
+	s := &SwappableSecurity{}
+	s.current.Store(&securityBox{security})
+
+	return s
+}
+
+// Swap replaces the current implementation and returns the previous one
+func (s *SwappableSecurity) Swap(security biInterfaces.Security) (biInterfaces.Security, error) {
+	if security == nil {
+		return nil, eris.New("security is nil")
+	}
+
+	return s.current.Swap(&securityBox{security}).Security, nil
+}
+
+// Load returns the current implementation
+func (s *SwappableSecurity) Load() biInterfaces.Security {
+	return s.current.Load().Security
+}
+
+// Keys returns the key manager of the current implementation, nil if it does not use one
+func (s *SwappableSecurity) Keys() *Manager {
+	if holder, ok := s.Load().(KeyHolder); ok {
+		return holder.Keys()
+	}
+
+	return nil
+}
+
+func (s *SwappableSecurity) CreateAsymmetricSignature(ctx context.Context, timeStamp string) (string, error) {
+	return s.Load().CreateAsymmetricSignature(ctx, timeStamp)
+}
+
+func (s *SwappableSecurity) VerifyAsymmetricSignature(ctx context.Context, timeStamp, clientKey, signature string, publicKey *rsa.PublicKey) (bool, error) {
+	return s.Load().VerifyAsymmetricSignature(ctx, timeStamp, clientKey, signature, publicKey)
+}
+
+func (s *SwappableSecurity) CreateSymmetricSignature(ctx context.Context, obj *biModels.SymmetricSignatureRequirement) (string, error) {
+	return s.Load().CreateSymmetricSignature(ctx, obj)
+}
+
+func (s *SwappableSecurity) VerifySymmetricSignature(ctx context.Context, obj *biModels.SymmetricSignatureRequirement, clientSecret, signature string) (bool, error) {
+	return s.Load().VerifySymmetricSignature(ctx, obj, clientSecret, signature)
+}
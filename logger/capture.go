@@ -0,0 +1,210 @@
+package bank_integration_logger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	biModel "github.com/voxtmault/bank-integration/models"
+)
+
+const redacted = "[REDACTED]"
+
+// Headers whose values are never written to the logs
+var secretHeaders = map[string]struct{}{
+	"Authorization":       {},
+	"Cookie":              {},
+	"Set-Cookie":          {},
+	"X-Signature":         {},
+	"X-Client-Secret":     {},
+	"Proxy-Authorization": {},
+}
+
+// Body fields whose values are never written to the logs
+var secretFields = map[string]struct{}{
+	"accessToken":  {},
+	"clientSecret": {},
+}
+
+// Ingress wraps the handling of a request coming from a bank. The request along with the SNAP response returned
+// by fn is logged through the process wide Writer once fn returns. The log is available to fn under BankLogCtxKey.
+func Ingress[T any](ctx context.Context, request *http.Request, fn func(ctx context.Context, request *http.Request) (T, error)) (T, error) {
+	start := time.Now()
+
+	logMessage := &biModel.BankLog{
+		ClientIP:      request.RemoteAddr,
+		HTTPMethod:    request.Method,
+		Protocol:      request.Proto,
+		URI:           request.RequestURI,
+		RequestHeader: RedactHeader(request.Header),
+		CreatedAt:     start.Format(time.DateTime),
+	}
+	if logMessage.URI == "" {
+		logMessage.URI = request.URL.RequestURI()
+	}
+
+	reqParam, _ := json.Marshal(request.URL.Query())
+	logMessage.RequestParameter = string(reqParam)
+
+	if request.Body != nil {
+		body, err := io.ReadAll(request.Body)
+		request.Body.Close()
+		if err == nil {
+			logMessage.RequestBody = redactBody(body)
+		}
+		// fn still gets to read (and fail on) whatever could be read
+		request.Body = io.NopCloser(bytes.NewBuffer(body))
+	}
+
+	response, err := fn(context.WithValue(ctx, BankLogCtxKey, logMessage), request)
+
+	logMessage.Latency = float32(time.Since(start).Microseconds()) / 1000
+	statusCode, message := responseStatus(response)
+	logMessage.ResponseCode = uint(statusCode)
+	logMessage.ResponseMessage = message
+	if content, mErr := json.Marshal(response); mErr == nil {
+		logMessage.ResponseContent = redactBody(content)
+	}
+	if err != nil && logMessage.ResponseMessage == "" {
+		logMessage.ResponseMessage = err.Error()
+	}
+
+	GetWriter().Ingress(logMessage)
+
+	return response, err
+}
+
+// Do sends the request to a bank through client and reads the whole response body. The exchange is logged
+// through the process wide Writer, including failed attempts.
+func Do(client *http.Client, request *http.Request) (*http.Response, []byte, error) {
+	start := time.Now()
+
+	logMessage := &biModel.BankLog{
+		HostIP:        request.URL.Host,
+		HTTPMethod:    request.Method,
+		Protocol:      request.Proto,
+		URI:           request.URL.RequestURI(),
+		RequestHeader: RedactHeader(request.Header),
+		CreatedAt:     start.Format(time.DateTime),
+	}
+
+	reqParam, _ := json.Marshal(request.URL.Query())
+	logMessage.RequestParameter = string(reqParam)
+
+	if request.GetBody != nil {
+		if body, err := request.GetBody(); err == nil {
+			content, _ := io.ReadAll(body)
+			body.Close()
+			logMessage.RequestBody = redactBody(content)
+		}
+	}
+
+	defer func() {
+		logMessage.Latency = float32(time.Since(start).Microseconds()) / 1000
+		GetWriter().Egress(logMessage)
+	}()
+
+	response, err := client.Do(request)
+	if err != nil {
+		logMessage.ResponseMessage = err.Error()
+		return nil, nil, err
+	}
+	defer response.Body.Close()
+
+	logMessage.Protocol = response.Proto
+	logMessage.ResponseCode = uint(response.StatusCode)
+	logMessage.ResponseMessage = http.StatusText(response.StatusCode)
+	logMessage.ResponseHeader = RedactHeader(response.Header)
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		logMessage.ResponseMessage = err.Error()
+		return response, nil, err
+	}
+	logMessage.ResponseContent = redactBody(body)
+
+	var obj biModel.BCAResponse
+	if json.Unmarshal(body, &obj) == nil && obj.ResponseMessage != "" {
+		logMessage.ResponseMessage = obj.ResponseMessage
+	}
+
+	return response, body, nil
+}
+
+// RedactHeader returns the JSON representation of the headers with the secrets redacted
+func RedactHeader(header http.Header) string {
+	obj := make(map[string][]string, len(header))
+	for key, values := range header {
+		if _, secret := secretHeaders[http.CanonicalHeaderKey(key)]; secret {
+			obj[key] = []string{redacted}
+			continue
+		}
+		obj[key] = values
+	}
+
+	result, _ := json.Marshal(obj)
+	return string(result)
+}
+
+// redactBody masks the secret fields of a JSON object body, other bodies are returned as is
+func redactBody(body []byte) string {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(body, &obj); err != nil {
+		return string(body)
+	}
+
+	changed := false
+	for key := range obj {
+		if _, secret := secretFields[key]; secret {
+			obj[key] = json.RawMessage(`"` + redacted + `"`)
+			changed = true
+		}
+	}
+	if !changed {
+		return string(body)
+	}
+
+	result, _ := json.Marshal(obj)
+	return string(result)
+}
+
+// jsonColumn makes sure the value can be stored in a JSON column
+func jsonColumn(value string) string {
+	value = strings.TrimSpace(value)
+	if value == "" || value == "null" {
+		return "{}"
+	}
+	if json.Valid([]byte(value)) {
+		return value
+	}
+
+	quoted, _ := json.Marshal(value)
+	return string(quoted)
+}
+
+func responseStatus(response interface{}) (int, string) {
+	switch obj := response.(type) {
+	case *biModel.AccessTokenResponse:
+		if obj != nil && obj.BCAResponse != nil {
+			return obj.HTTPStatusCode, obj.ResponseMessage
+		}
+	case *biModel.VAResponsePayload:
+		if obj != nil {
+			return obj.HTTPStatusCode, obj.ResponseMessage
+		}
+	case *biModel.BCAInquiryVAResponse:
+		if obj != nil {
+			return obj.HTTPStatusCode, obj.ResponseMessage
+		}
+	case *biModel.BCAResponse:
+		if obj != nil {
+			return obj.HTTPStatusCode, obj.ResponseMessage
+		}
+	}
+
+	return http.StatusInternalServerError, ""
+}
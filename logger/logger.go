@@ -2,7 +2,9 @@ package bank_integration_logger
 
 import (
 	"context"
+	"database/sql"
 	"log/slog"
+	"time"
 
 	"github.com/rotisserie/eris"
 	biModel "github.com/voxtmault/bank-integration/models"
@@ -13,8 +15,23 @@ type contextKey string
 
 const BankLogCtxKey contextKey = "bank_log"
 
+// LogBankIngress synchronously inserts the log of a request coming from a bank. Prefer the async Writer, which
+// never blocks the caller.
 func LogBankIngress(ctx context.Context, log *biModel.BankLog) error {
-	con := biStorage.GetDBConnection()
+	return insertIngress(ctx, biStorage.GetDBConnection(), log)
+}
+
+// LogBankEgress synchronously inserts the log of a request sent to a bank. Prefer the async Writer, which
+// never blocks the caller.
+func LogBankEgress(ctx context.Context, log *biModel.BankLog) error {
+	return insertEgress(ctx, biStorage.GetDBConnection(), log)
+}
+
+func insertIngress(ctx context.Context, con *sql.DB, log *biModel.BankLog) error {
+	if log.CreatedAt == "" {
+		log.CreatedAt = time.Now().Format(time.DateTime)
+	}
+
 	tx, err := con.BeginTx(ctx, nil)
 	if err != nil {
 		slog.Error("failed to begin transaction", "reason", err)
@@ -22,14 +39,14 @@ func LogBankIngress(ctx context.Context, log *biModel.BankLog) error {
 	}
 
 	statement := `
-	INSERT INTO bank_ingress (client_ip, latency, http_method, protocol, uri, response_code,
-							  response_message, response_content, request_parameter, 
-							  request_body)
-	VALUES (?,?,?,?,?,?,?,?,?,?)
+	INSERT INTO bank_ingress (client_ip, latency, http_method, protocol, uri, response_header, response_code,
+							  response_message, response_content, request_header, request_parameter,
+							  request_body, created_at)
+	VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?)
 	`
 	if _, err = tx.ExecContext(ctx, statement, log.ClientIP, log.Latency, log.HTTPMethod, log.Protocol,
-		log.URI, log.ResponseCode, log.ResponseMessage, log.ResponseContent, log.RequestParameter,
-		log.RequestBody,
+		log.URI, jsonColumn(log.ResponseHeader), log.ResponseCode, log.ResponseMessage, jsonColumn(log.ResponseContent),
+		jsonColumn(log.RequestHeader), jsonColumn(log.RequestParameter), jsonColumn(log.RequestBody), log.CreatedAt,
 	); err != nil {
 		tx.Rollback()
 		slog.Error("failed to exec statement", "reason", err)
@@ -44,8 +61,11 @@ func LogBankIngress(ctx context.Context, log *biModel.BankLog) error {
 	return nil
 }
 
-func LogBankEgress(ctx context.Context, log *biModel.BankLog) error {
-	con := biStorage.GetDBConnection()
+func insertEgress(ctx context.Context, con *sql.DB, log *biModel.BankLog) error {
+	if log.CreatedAt == "" {
+		log.CreatedAt = time.Now().Format(time.DateTime)
+	}
+
 	tx, err := con.BeginTx(ctx, nil)
 	if err != nil {
 		slog.Error("failed to begin transaction", "reason", err)
@@ -53,14 +73,14 @@ func LogBankEgress(ctx context.Context, log *biModel.BankLog) error {
 	}
 
 	statement := `
-	INSERT INTO bank_egress (host_ip, latency, http_method, protocol, uri, response_code,
-							 response_message, response_content, created_at, request_parameter, 
-							 request_body)
-	VALUES (?,?,?,?,?,?,?,?,?,?,?)
+	INSERT INTO bank_egress (host_ip, latency, http_method, protocol, uri, response_header, response_code,
+							 response_message, response_content, request_header, request_parameter,
+							 request_body, created_at)
+	VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?)
 	`
 	if _, err = tx.ExecContext(ctx, statement, log.HostIP, log.Latency, log.HTTPMethod, log.Protocol,
-		log.URI, log.ResponseCode, log.ResponseMessage, log.ResponseContent, log.CreatedAt,
-		log.RequestParameter, log.RequestBody,
+		log.URI, jsonColumn(log.ResponseHeader), log.ResponseCode, log.ResponseMessage, jsonColumn(log.ResponseContent),
+		jsonColumn(log.RequestHeader), jsonColumn(log.RequestParameter), jsonColumn(log.RequestBody), log.CreatedAt,
 	); err != nil {
 		tx.Rollback()
 		slog.Error("failed to exec statement", "reason", err)
@@ -0,0 +1,188 @@
+package bank_integration_logger
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	biModel "github.com/voxtmault/bank-integration/models"
+)
+
+const (
+	DefaultWriterBufferSize = 1024
+
+	// writeTimeout bounds a single insert so that a stuck database can not hold the queue forever
+	writeTimeout = 10 * time.Second
+)
+
+type direction uint8
+
+const (
+	ingress direction = iota
+	egress
+)
+
+type entry struct {
+	direction direction
+	log       *biModel.BankLog
+}
+
+// Writer persists bank logs in the background. Enqueueing never blocks, when the buffer is full the log is
+// dropped and counted instead, so that logging failures never get in the way of a bank request.
+//
+// A nil *Writer is valid and discards every log.
+type Writer struct {
+	db    *sql.DB
+	queue chan entry
+
+	dropped atomic.Uint64
+	failed  atomic.Uint64
+
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+	closed    chan struct{}
+	mu        sync.RWMutex
+}
+
+var defaultWriter atomic.Pointer[Writer]
+
+// InitWriter starts the process wide writer used by the bank services, replacing (and closing) the previous one
+func InitWriter(db *sql.DB, bufferSize int) *Writer {
+	w := NewWriter(db, bufferSize)
+	if old := defaultWriter.Swap(w); old != nil {
+		old.Close()
+	}
+
+	return w
+}
+
+// GetWriter returns the process wide writer, nil when InitWriter has not been called
+func GetWriter() *Writer {
+	return defaultWriter.Load()
+}
+
+// CloseWriter flushes and stops the process wide writer
+func CloseWriter() {
+	if w := defaultWriter.Swap(nil); w != nil {
+		w.Close()
+	}
+}
+
+func NewWriter(db *sql.DB, bufferSize int) *Writer {
+	if bufferSize <= 0 {
+		bufferSize = DefaultWriterBufferSize
+	}
+
+	w := &Writer{
+		db:     db,
+		queue:  make(chan entry, bufferSize),
+		closed: make(chan struct{}),
+	}
+
+	w.wg.Add(1)
+	go w.run()
+
+	return w
+}
+
+// Ingress enqueues the log of a request coming from a bank
+func (w *Writer) Ingress(log *biModel.BankLog) {
+	w.enqueue(entry{direction: ingress, log: log})
+}
+
+// Egress enqueues the log of a request sent to a bank
+func (w *Writer) Egress(log *biModel.BankLog) {
+	w.enqueue(entry{direction: egress, log: log})
+}
+
+// Dropped returns the number of logs discarded because the buffer was full or the writer was closed
+func (w *Writer) Dropped() uint64 {
+	if w == nil {
+		return 0
+	}
+	return w.dropped.Load()
+}
+
+// Failed returns the number of logs that could not be inserted into the database
+func (w *Writer) Failed() uint64 {
+	if w == nil {
+		return 0
+	}
+	return w.failed.Load()
+}
+
+// Close stops accepting new logs and waits for the queued ones to be written
+func (w *Writer) Close() {
+	if w == nil {
+		return
+	}
+
+	w.closeOnce.Do(func() {
+		// Taking the write lock guarantees that no enqueue is in flight while the queue is closed
+		w.mu.Lock()
+		close(w.closed)
+		close(w.queue)
+		w.mu.Unlock()
+	})
+	w.wg.Wait()
+}
+
+func (w *Writer) enqueue(e entry) {
+	if w == nil || e.log == nil {
+		return
+	}
+
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	select {
+	case <-w.closed:
+		w.dropped.Add(1)
+		return
+	default:
+	}
+
+	select {
+	case w.queue <- e:
+	default:
+		w.dropped.Add(1)
+		slog.Warn("bank log buffer is full, dropping log", "uri", e.log.URI)
+	}
+}
+
+func (w *Writer) run() {
+	defer w.wg.Done()
+
+	for e := range w.queue {
+		w.write(e)
+	}
+}
+
+func (w *Writer) write(e entry) {
+	defer func() {
+		// A misbehaving driver must not take the writer down with it
+		if r := recover(); r != nil {
+			w.failed.Add(1)
+			slog.Error("panic while writing bank log", "reason", r)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), writeTimeout)
+	defer cancel()
+
+	var err error
+	switch e.direction {
+	case ingress:
+		err = insertIngress(ctx, w.db, e.log)
+	case egress:
+		err = insertEgress(ctx, w.db, e.log)
+	}
+
+	if err != nil {
+		w.failed.Add(1)
+		slog.Error("error writing bank log", "uri", e.log.URI, "error", err)
+	}
+}
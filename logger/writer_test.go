@@ -0,0 +1,106 @@
+package bank_integration_logger
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	biModel "github.com/voxtmault/bank-integration/models"
+)
+
+func TestWriterPersistsIngressAndEgress(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("creating sql mock: %v", err)
+	}
+	defer db.Close()
+
+	bank := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"responseCode":"2007300","responseMessage":"Successful","accessToken":"secret-token"}`))
+	}))
+	defer bank.Close()
+
+	// Egress log, the access token in the response and the signature header must not be stored
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO bank_egress").
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), http.MethodPost, sqlmock.AnyArg(), "/token", sqlmock.AnyArg(), 200,
+			"Successful", `{"accessToken":"[REDACTED]","responseCode":"2007300","responseMessage":"Successful"}`,
+			`{"X-Signature":["[REDACTED]"]}`, "{}", `{"grantType":"client_credentials"}`, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	// Ingress log, including a failed callback without any response
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO bank_ingress").
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), http.MethodPost, sqlmock.AnyArg(), "/callback?id=1", "{}", 500,
+			"database is down", "{}", `{"Authorization":["[REDACTED]"]}`, `{"id":["1"]}`, `{"virtualAccountNo":"123"}`, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	InitWriter(db, 8)
+
+	request, _ := http.NewRequest(http.MethodPost, bank.URL+"/token", strings.NewReader(`{"grantType":"client_credentials"}`))
+	request.Header.Set("X-SIGNATURE", "signature")
+	if _, body, err := Do(http.DefaultClient, request); err != nil || !strings.Contains(string(body), "secret-token") {
+		t.Fatalf("expected the caller to receive the whole response, got %s (%v)", body, err)
+	}
+
+	callback := httptest.NewRequest(http.MethodPost, "/callback?id=1", strings.NewReader(`{"virtualAccountNo":"123"}`))
+	callback.Header.Set("Authorization", "Bearer token")
+	errDatabase := errors.New("database is down")
+	_, err = Ingress(context.Background(), callback, func(ctx context.Context, request *http.Request) (*biModel.VAResponsePayload, error) {
+		if ctx.Value(BankLogCtxKey) == nil {
+			t.Error("expected the log to be available in the context")
+		}
+		// The body is still readable by the wrapped handler
+		if body, _ := io.ReadAll(request.Body); string(body) != `{"virtualAccountNo":"123"}` {
+			t.Errorf("unexpected body %s", body)
+		}
+		return nil, errDatabase
+	})
+	if err != errDatabase {
+		t.Fatalf("expected the handler error to be returned, got %v", err)
+	}
+
+	CloseWriter()
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriterNeverBlocks(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("creating sql mock: %v", err)
+	}
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+
+	w := NewWriter(db, 1)
+	for i := 0; i < 100; i++ {
+		w.Egress(&biModel.BankLog{URI: "/token"})
+	}
+	w.Close()
+
+	// Logs enqueued after Close are dropped as well
+	w.Ingress(&biModel.BankLog{URI: "/callback"})
+
+	if w.Dropped() == 0 {
+		t.Fatal("expected logs to be dropped when the buffer is full")
+	}
+	if w.Dropped()+w.Failed() != 101 {
+		t.Fatalf("expected every log to be either dropped or failed, got %d dropped and %d failed", w.Dropped(), w.Failed())
+	}
+
+	// A nil writer discards everything
+	var nilWriter *Writer
+	nilWriter.Ingress(&biModel.BankLog{})
+	nilWriter.Close()
+}
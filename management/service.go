@@ -3,11 +3,17 @@ package bank_integration_management
 import (
 	"context"
 	"database/sql"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
 
 	"github.com/rotisserie/eris"
 	biInterfaces "github.com/voxtmault/bank-integration/interfaces"
+	biKeys "github.com/voxtmault/bank-integration/keys"
 	biModel "github.com/voxtmault/bank-integration/models"
 	biStorage "github.com/voxtmault/bank-integration/storage"
+	biTokens "github.com/voxtmault/bank-integration/tokens"
 	biUtil "github.com/voxtmault/bank-integration/utils"
 )
 
@@ -15,15 +21,19 @@ type BankIntegrationManagement struct {
 	DB  *sql.DB
 	RDB *biStorage.RedisInstance
 	GS  biUtil.ClientCredential
+
+	// Secrets encrypts the client secrets at rest, they are stored in plaintext when nil
+	Secrets *biKeys.Envelope
 }
 
 var _ biInterfaces.Management = &BankIntegrationManagement{}
 
-func NewBankIntegrationManagement(db *sql.DB, rdb *biStorage.RedisInstance) *BankIntegrationManagement {
+func NewBankIntegrationManagement(db *sql.DB, rdb *biStorage.RedisInstance, secrets *biKeys.Envelope) *BankIntegrationManagement {
 	return &BankIntegrationManagement{
-		DB:  db,
-		RDB: rdb,
-		GS:  biUtil.ClientCredential{},
+		DB:      db,
+		RDB:     rdb,
+		GS:      biUtil.ClientCredential{},
+		Secrets: secrets,
 	}
 }
 
@@ -31,7 +41,7 @@ func (s *BankIntegrationManagement) GetAuthenticatedBanks(ctx context.Context) (
 	var arrObj []*biModel.AuthenticatedBank
 
 	statement := `
-	SELECT id, bank_name, note, created_at, updated_at
+	SELECT id, bank_name, COALESCE(public_key_path, ''), COALESCE(note, ''), created_at, updated_at
 	FROM authenticated_banks
 	WHERE deleted_at IS NULL
 	`
@@ -55,40 +65,370 @@ func (s *BankIntegrationManagement) GetAuthenticatedBanks(ctx context.Context) (
 	return arrObj, nil
 }
 
-func (s *BankIntegrationManagement) RegisterBank(ctx context.Context, bankName string) (*biModel.BankClientCredential, error) {
+func (s *BankIntegrationManagement) RegisterBank(ctx context.Context, bankName, publicKeyPath string) (*biModel.BankClientCredential, error) {
+
+	// The public key is optional, clients without one are verified with the public key of the bank configuration
+	keyData, err := readPublicKey(publicKeyPath)
+	if err != nil {
+		return nil, err
+	}
 
 	tx, err := s.DB.BeginTx(ctx, nil)
 	if err != nil {
-		tx.Rollback()
 		return nil, eris.Wrap(err, "begin transaction")
 	}
+	defer tx.Rollback()
 
 	id, secret := s.GS.GenerateClientCredential()
 
+	encrypted, err := s.Secrets.Encrypt(ctx, secret, id)
+	if err != nil {
+		return nil, eris.Wrap(err, "encrypting client secret")
+	}
+
 	statement := `
-	INSERT INTO authenticated_banks (bank_name, client_id, client_secret)
-	VALUES(?,?,?)
+	INSERT INTO authenticated_banks (bank_name, client_id, client_secret, public_key_path)
+	VALUES(?,?,?,NULLIF(?, ''))
 	`
-	if _, err = tx.ExecContext(ctx, statement, bankName, id, secret); err != nil {
-		tx.Rollback()
+	result, err := tx.ExecContext(ctx, statement, bankName, id, encrypted, publicKeyPath)
+	if err != nil {
 		return nil, eris.Wrap(err, "executing statement")
 	}
+	idBank, err := result.LastInsertId()
+	if err != nil {
+		return nil, eris.Wrap(err, "getting registered bank id")
+	}
 
 	if err = tx.Commit(); err != nil {
-		tx.Rollback()
 		return nil, eris.Wrap(err, "commit transaction")
 	}
 
+	// The client can request an access token right away, the ingress of every instance reads it from redis
+	pipe := s.RDB.RDB.TxPipeline()
+	pipe.HSet(ctx, biUtil.ClientCredentialsRedis, id, encrypted)
+	pipe.HSet(ctx, biUtil.AuthenticatedBankNameRedis, strconv.FormatInt(idBank, 10), bankName)
+	if keyData != nil {
+		pipe.HSet(ctx, biUtil.ClientPublicKeysRedis, id, string(keyData))
+	}
+	if _, err = pipe.Exec(ctx); err != nil {
+		return nil, eris.Wrap(err, "syncing registered bank to redis")
+	}
+
 	return &biModel.BankClientCredential{
-		ClientID:     id,
-		ClientSecret: secret,
+		ClientID:      id,
+		ClientSecret:  secret,
+		PublicKeyPath: publicKeyPath,
 	}, nil
 }
 
-func (s *BankIntegrationManagement) UpdateRegisteredBank(ctx context.Context) error {
+func (s *BankIntegrationManagement) UpdateRegisteredBank(ctx context.Context, idBank uint, obj *biModel.UpdateAuthenticatedBank) error {
+	if err := biUtil.ValidateStruct(ctx, obj); err != nil {
+		return eris.Wrap(err, "invalid registered bank")
+	}
+
+	// Only the fields that are set are written, e.g. renaming a client keeps its public key
+	var columns []string
+	var args []any
+	if obj.BankName != nil {
+		columns = append(columns, "bank_name = ?")
+		args = append(args, *obj.BankName)
+	}
+	if obj.Note != nil {
+		columns = append(columns, "note = NULLIF(?, '')")
+		args = append(args, *obj.Note)
+	}
+
+	var keyData []byte
+	if obj.PublicKeyPath != nil {
+		var err error
+		if keyData, err = readPublicKey(*obj.PublicKeyPath); err != nil {
+			return err
+		}
+		columns = append(columns, "public_key_path = NULLIF(?, '')")
+		args = append(args, *obj.PublicKeyPath)
+	}
+	if obj.TimestampSkew != nil {
+		columns = append(columns, "timestamp_skew = NULLIF(?, 0)")
+		args = append(args, *obj.TimestampSkew)
+	}
+
+	var ipAllowlist string
+	if obj.IPAllowlist != nil {
+		allowlist, err := biUtil.ParseCIDRs(strings.Join(*obj.IPAllowlist, ","))
+		if err != nil {
+			return eris.Wrap(err, "invalid ip allowlist")
+		}
+		ipAllowlist = biUtil.FormatCIDRs(allowlist)
+		columns = append(columns, "ip_allowlist = NULLIF(?, '')")
+		args = append(args, ipAllowlist)
+	}
+
+	if len(columns) == 0 {
+		return eris.New("nothing to update")
+	}
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return eris.Wrap(err, "begin transaction")
+	}
+	defer tx.Rollback()
+
+	clientID, err := getRegisteredBank(ctx, tx, idBank)
+	if err != nil {
+		return err
+	}
+
+	statement := `UPDATE authenticated_banks SET ` + strings.Join(columns, ", ") + ` WHERE id = ?`
+	if _, err = tx.ExecContext(ctx, statement, append(args, idBank)...); err != nil {
+		return eris.Wrap(err, "updating authenticated bank")
+	}
+
+	if err = tx.Commit(); err != nil {
+		return eris.Wrap(err, "commit transaction")
+	}
+
+	// Reflect the changes right away, the ingress of every instance reads them from redis
+	pipe := s.RDB.RDB.TxPipeline()
+	if obj.BankName != nil {
+		pipe.HSet(ctx, biUtil.AuthenticatedBankNameRedis, strconv.Itoa(int(idBank)), *obj.BankName)
+	}
+	if obj.PublicKeyPath != nil {
+		if keyData != nil {
+			pipe.HSet(ctx, biUtil.ClientPublicKeysRedis, clientID, string(keyData))
+		} else {
+			pipe.HDel(ctx, biUtil.ClientPublicKeysRedis, clientID)
+		}
+	}
+	if obj.TimestampSkew != nil {
+		if *obj.TimestampSkew > 0 {
+			pipe.HSet(ctx, biUtil.ClientTimestampSkewRedis, clientID, *obj.TimestampSkew)
+		} else {
+			pipe.HDel(ctx, biUtil.ClientTimestampSkewRedis, clientID)
+		}
+	}
+	if obj.IPAllowlist != nil {
+		if ipAllowlist != "" {
+			pipe.HSet(ctx, biUtil.ClientIPAllowlistRedis, clientID, ipAllowlist)
+		} else {
+			pipe.HDel(ctx, biUtil.ClientIPAllowlistRedis, clientID)
+		}
+	}
+	if _, err = pipe.Exec(ctx); err != nil {
+		return eris.Wrap(err, "syncing authenticated bank to redis")
+	}
+
 	return nil
 }
 
-func (s *BankIntegrationManagement) RevokeRegisteredBank(ctx context.Context) error {
+func (s *BankIntegrationManagement) RotateClientSecret(ctx context.Context, idBank uint) (*biModel.BankClientCredential, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, eris.Wrap(err, "begin transaction")
+	}
+	defer tx.Rollback()
+
+	clientID, err := getRegisteredBank(ctx, tx, idBank)
+	if err != nil {
+		return nil, err
+	}
+
+	_, secret := s.GS.GenerateClientCredential()
+
+	encrypted, err := s.Secrets.Encrypt(ctx, secret, clientID)
+	if err != nil {
+		return nil, eris.Wrap(err, "encrypting client secret")
+	}
+
+	statement := `UPDATE authenticated_banks SET client_secret = ? WHERE id = ?`
+	if _, err = tx.ExecContext(ctx, statement, encrypted, idBank); err != nil {
+		return nil, eris.Wrap(err, "updating client secret")
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, eris.Wrap(err, "commit transaction")
+	}
+
+	if err = s.RDB.RDB.HSet(ctx, biUtil.ClientCredentialsRedis, clientID, encrypted).Err(); err != nil {
+		return nil, eris.Wrap(err, "saving client credentials to redis")
+	}
+
+	// Access tokens carry the secret they were issued with, the client has to request a new one
+	if err = s.invalidateAccessTokens(ctx, clientID); err != nil {
+		return nil, err
+	}
+
+	return &biModel.BankClientCredential{
+		ClientID:     clientID,
+		ClientSecret: secret,
+	}, nil
+}
+
+func (s *BankIntegrationManagement) RevokeRegisteredBank(ctx context.Context, idBank uint) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return eris.Wrap(err, "begin transaction")
+	}
+	defer tx.Rollback()
+
+	clientID, err := getRegisteredBank(ctx, tx, idBank)
+	if err != nil {
+		return err
+	}
+
+	statement := `UPDATE authenticated_banks SET deleted_at = NOW() WHERE id = ?`
+	if _, err = tx.ExecContext(ctx, statement, idBank); err != nil {
+		return eris.Wrap(err, "revoking authenticated bank")
+	}
+
+	if err = tx.Commit(); err != nil {
+		return eris.Wrap(err, "commit transaction")
+	}
+
+	pipe := s.RDB.RDB.TxPipeline()
+	pipe.HDel(ctx, biUtil.ClientCredentialsRedis, clientID)
+	pipe.HDel(ctx, biUtil.AuthenticatedBankNameRedis, strconv.Itoa(int(idBank)))
+	pipe.HDel(ctx, biUtil.ClientPublicKeysRedis, clientID)
+	pipe.HDel(ctx, biUtil.ClientTimestampSkewRedis, clientID)
+	pipe.HDel(ctx, biUtil.ClientIPAllowlistRedis, clientID)
+	if _, err = pipe.Exec(ctx); err != nil {
+		return eris.Wrap(err, "removing authenticated bank from redis")
+	}
+
+	return s.invalidateAccessTokens(ctx, clientID)
+}
+
+func (s *BankIntegrationManagement) ReencryptClientSecrets(ctx context.Context) (int, error) {
+	if s.Secrets == nil {
+		return 0, eris.New("no master key configured")
+	}
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, eris.Wrap(err, "begin transaction")
+	}
+	defer tx.Rollback()
+
+	type registeredBank struct {
+		id           uint
+		clientID     string
+		clientSecret string
+		deleted      bool
+	}
+
+	// Revoked clients are re-encrypted as well, nothing is left in plaintext
+	statement := `
+	SELECT id, client_id, client_secret, deleted_at IS NOT NULL
+	FROM authenticated_banks
+	FOR UPDATE
+	`
+	rows, err := tx.QueryContext(ctx, statement)
+	if err != nil {
+		return 0, eris.Wrap(err, "querying authenticated banks")
+	}
+
+	var banks []registeredBank
+	for rows.Next() {
+		var obj registeredBank
+		if err = rows.Scan(&obj.id, &obj.clientID, &obj.clientSecret, &obj.deleted); err != nil {
+			rows.Close()
+			return 0, eris.Wrap(err, "scanning rows")
+		}
+
+		if s.Secrets.NeedsReencryption(obj.clientSecret) {
+			banks = append(banks, obj)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, eris.Wrap(err, "iterating rows")
+	}
+
+	credentials := make(map[string]interface{})
+	for _, obj := range banks {
+		secret, err := s.Secrets.Decrypt(ctx, obj.clientSecret, obj.clientID)
+		if err != nil {
+			return 0, eris.Wrapf(err, "decrypting client secret of authenticated bank %d", obj.id)
+		}
+
+		encrypted, err := s.Secrets.Encrypt(ctx, secret, obj.clientID)
+		if err != nil {
+			return 0, eris.Wrapf(err, "encrypting client secret of authenticated bank %d", obj.id)
+		}
+
+		if _, err = tx.ExecContext(ctx, `UPDATE authenticated_banks SET client_secret = ? WHERE id = ?`, encrypted, obj.id); err != nil {
+			return 0, eris.Wrap(err, "updating client secret")
+		}
+
+		if !obj.deleted {
+			credentials[obj.clientID] = encrypted
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, eris.Wrap(err, "commit transaction")
+	}
+
+	if len(credentials) > 0 {
+		if err = s.RDB.SaveRedisHash(ctx, biUtil.ClientCredentialsRedis, credentials); err != nil {
+			return 0, eris.Wrap(err, "saving client credentials to redis")
+		}
+	}
+
+	slog.Info("re-encrypted client secrets", "count", len(banks))
+
+	return len(banks), nil
+}
+
+// Helper Functions
+
+// getRegisteredBank locks the registered bank row and returns its client id
+func getRegisteredBank(ctx context.Context, tx *sql.Tx, idBank uint) (string, error) {
+	var clientID string
+
+	statement := `
+	SELECT client_id
+	FROM authenticated_banks
+	WHERE id = ? AND deleted_at IS NULL
+	FOR UPDATE
+	`
+	if err := tx.QueryRowContext(ctx, statement, idBank).Scan(&clientID); err != nil {
+		if err == sql.ErrNoRows {
+			return "", eris.New("registered bank not found")
+		}
+		return "", eris.Wrap(err, "querying authenticated bank")
+	}
+
+	return clientID, nil
+}
+
+// invalidateAccessTokens deletes every access token issued to the client. Access tokens issued before the token
+// store are not indexed by client, they are denied by the ingresses and left to expire.
+func (s *BankIntegrationManagement) invalidateAccessTokens(ctx context.Context, clientID string) error {
+	revoked, err := biTokens.NewStore(s.RDB).RevokeAllForClient(ctx, clientID)
+	if err != nil {
+		return eris.Wrap(err, "invalidating access tokens")
+	}
+
+	if revoked > 0 {
+		slog.Info("invalidated access tokens", "client_id", clientID, "count", revoked)
+	}
+
 	return nil
 }
+
+// readPublicKey returns the PEM encoded public key found in path, nil if path is empty
+func readPublicKey(path string) ([]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	keyData, err := os.ReadFile(path)
+	if err != nil {
+		return nil, eris.Wrap(err, "reading public key")
+	}
+	if _, err = biUtil.ParsePublicKey(keyData); err != nil {
+		return nil, eris.Wrap(err, "invalid public key")
+	}
+
+	return keyData, nil
+}
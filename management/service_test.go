@@ -0,0 +1,366 @@
+package bank_integration_management
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	biKeys "github.com/voxtmault/bank-integration/keys"
+	biModel "github.com/voxtmault/bank-integration/models"
+	biStorage "github.com/voxtmault/bank-integration/storage"
+	biTokens "github.com/voxtmault/bank-integration/tokens"
+	biUtil "github.com/voxtmault/bank-integration/utils"
+)
+
+const (
+	clientID     = "8d7e1f7c-46f4-4b8f-9d1d-3c3a9d6d7c10"
+	clientSecret = "0b6ff07b-4c43-4a53-98a4-2b8c1e0d9b64"
+)
+
+func setup(t *testing.T) (*BankIntegrationManagement, sqlmock.Sqlmock, *miniredis.Miniredis) {
+	t.Helper()
+
+	biUtil.InitValidator()
+
+	mr := miniredis.RunT(t)
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("creating sql mock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	mr.HSet(biUtil.ClientCredentialsRedis, clientID, clientSecret)
+	mr.HSet(biUtil.AuthenticatedBankNameRedis, "3", "BCA")
+	mr.HSet(biUtil.ClientPublicKeysRedis, clientID, "old key")
+
+	rdb := &biStorage.RedisInstance{RDB: redis.NewClient(&redis.Options{Addr: mr.Addr()})}
+
+	store := biTokens.NewStore(rdb)
+	for _, token := range []string{"token-1", "token-2"} {
+		if _, err := store.Issue(context.Background(), token, clientID, clientSecret, biUtil.AccessTokenScopeVA, time.Minute); err != nil {
+			t.Fatalf("issuing access token: %v", err)
+		}
+	}
+	if _, err := store.Issue(context.Background(), "other", "another-client", "another-secret", biUtil.AccessTokenScopeVA, time.Minute); err != nil {
+		t.Fatalf("issuing access token: %v", err)
+	}
+
+	return NewBankIntegrationManagement(db, rdb, nil), mock, mr
+}
+
+func expectRegisteredBank(mock sqlmock.Sqlmock) {
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT client_id FROM authenticated_banks").WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"client_id"}).AddRow(clientID))
+}
+
+func writePublicKey(t *testing.T) (string, string) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	data := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	path := filepath.Join(t.TempDir(), "client.pem")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("writing public key: %v", err)
+	}
+
+	return path, string(data)
+}
+
+func TestRegisterBank(t *testing.T) {
+	service, mock, mr := setup(t)
+	path, keyData := writePublicKey(t)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO authenticated_banks").WithArgs("BCA Syariah", sqlmock.AnyArg(), sqlmock.AnyArg(), path).
+		WillReturnResult(sqlmock.NewResult(7, 1))
+	mock.ExpectCommit()
+
+	credential, err := service.RegisterBank(context.Background(), "BCA Syariah", path)
+	if err != nil {
+		t.Fatalf("registering bank: %v", err)
+	}
+
+	// The client is known to the ingress without reloading the authenticated banks
+	if secret := mr.HGet(biUtil.ClientCredentialsRedis, credential.ClientID); secret != credential.ClientSecret {
+		t.Fatalf("expected the client credentials to be synced, got %q", secret)
+	}
+	if name := mr.HGet(biUtil.AuthenticatedBankNameRedis, "7"); name != "BCA Syariah" {
+		t.Fatalf("expected the bank name to be synced, got %q", name)
+	}
+	if key := mr.HGet(biUtil.ClientPublicKeysRedis, credential.ClientID); key != keyData {
+		t.Fatal("expected the public key to be synced")
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpdateRegisteredBank(t *testing.T) {
+	service, mock, mr := setup(t)
+	path, keyData := writePublicKey(t)
+
+	expectRegisteredBank(mock)
+	mock.ExpectExec("UPDATE authenticated_banks SET bank_name = \\?, note = NULLIF\\(\\?, ''\\), public_key_path = NULLIF\\(\\?, ''\\), timestamp_skew = NULLIF\\(\\?, 0\\), ip_allowlist = NULLIF\\(\\?, ''\\) WHERE id = \\?").
+		WithArgs("BCA Syariah", "moved", path, 120, "203.0.113.0/24,198.51.100.7/32", 3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err := service.UpdateRegisteredBank(context.Background(), 3, &biModel.UpdateAuthenticatedBank{
+		BankName:      ptr("BCA Syariah"),
+		Note:          ptr("moved"),
+		PublicKeyPath: ptr(path),
+		TimestampSkew: ptr[uint](120),
+		IPAllowlist:   &[]string{"203.0.113.0/24", "198.51.100.7"},
+	})
+	if err != nil {
+		t.Fatalf("updating registered bank: %v", err)
+	}
+
+	if name := mr.HGet(biUtil.AuthenticatedBankNameRedis, "3"); name != "BCA Syariah" {
+		t.Fatalf("expected the bank name to be synced, got %s", name)
+	}
+	if key := mr.HGet(biUtil.ClientPublicKeysRedis, clientID); key != keyData {
+		t.Fatal("expected the public key to be synced")
+	}
+	if skew := mr.HGet(biUtil.ClientTimestampSkewRedis, clientID); skew != "120" {
+		t.Fatalf("expected the timestamp skew to be synced, got %s", skew)
+	}
+	if allowlist := mr.HGet(biUtil.ClientIPAllowlistRedis, clientID); allowlist != "203.0.113.0/24,198.51.100.7/32" {
+		t.Fatalf("expected the ip allowlist to be synced, got %s", allowlist)
+	}
+
+	// Clearing the public key falls back to the public key of the bank configuration
+	expectRegisteredBank(mock)
+	mock.ExpectExec("UPDATE authenticated_banks SET public_key_path = NULLIF\\(\\?, ''\\), timestamp_skew = NULLIF\\(\\?, 0\\), ip_allowlist = NULLIF\\(\\?, ''\\) WHERE id = \\?").
+		WithArgs("", 0, "", 3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err = service.UpdateRegisteredBank(context.Background(), 3, &biModel.UpdateAuthenticatedBank{
+		PublicKeyPath: ptr(""),
+		TimestampSkew: ptr[uint](0),
+		IPAllowlist:   &[]string{},
+	})
+	if err != nil {
+		t.Fatalf("updating registered bank: %v", err)
+	}
+	if mr.HGet(biUtil.ClientPublicKeysRedis, clientID) != "" || mr.HGet(biUtil.ClientTimestampSkewRedis, clientID) != "" ||
+		mr.HGet(biUtil.ClientIPAllowlistRedis, clientID) != "" {
+		t.Fatal("expected the public key, the timestamp skew and the ip allowlist to be removed")
+	}
+	if name := mr.HGet(biUtil.AuthenticatedBankNameRedis, "3"); name != "BCA Syariah" {
+		t.Fatalf("expected the bank name to be kept, got %s", name)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpdateRegisteredBankPartial(t *testing.T) {
+	service, mock, mr := setup(t)
+	mr.HSet(biUtil.ClientTimestampSkewRedis, clientID, "120")
+	mr.HSet(biUtil.ClientIPAllowlistRedis, clientID, "203.0.113.0/24")
+
+	// Renaming the client leaves every other column and its redis copy alone
+	expectRegisteredBank(mock)
+	mock.ExpectExec("UPDATE authenticated_banks SET bank_name = \\? WHERE id = \\?").WithArgs("BCA Syariah", 3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	if err := service.UpdateRegisteredBank(context.Background(), 3, &biModel.UpdateAuthenticatedBank{BankName: ptr("BCA Syariah")}); err != nil {
+		t.Fatalf("updating registered bank: %v", err)
+	}
+
+	if name := mr.HGet(biUtil.AuthenticatedBankNameRedis, "3"); name != "BCA Syariah" {
+		t.Fatalf("expected the bank name to be synced, got %s", name)
+	}
+	if mr.HGet(biUtil.ClientPublicKeysRedis, clientID) != "old key" || mr.HGet(biUtil.ClientTimestampSkewRedis, clientID) != "120" ||
+		mr.HGet(biUtil.ClientIPAllowlistRedis, clientID) != "203.0.113.0/24" {
+		t.Fatal("expected the public key, the timestamp skew and the ip allowlist to be kept")
+	}
+
+	// An empty bank name or an update without any field is rejected
+	if err := service.UpdateRegisteredBank(context.Background(), 3, &biModel.UpdateAuthenticatedBank{BankName: ptr("")}); err == nil {
+		t.Fatal("expected an empty bank name to be rejected")
+	}
+	if err := service.UpdateRegisteredBank(context.Background(), 3, &biModel.UpdateAuthenticatedBank{}); err == nil {
+		t.Fatal("expected an empty update to be rejected")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpdateRegisteredBankInvalidPublicKey(t *testing.T) {
+	service, mock, _ := setup(t)
+
+	path := filepath.Join(t.TempDir(), "client.pem")
+	os.WriteFile(path, []byte("not a key"), 0600)
+
+	err := service.UpdateRegisteredBank(context.Background(), 3, &biModel.UpdateAuthenticatedBank{PublicKeyPath: &path})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpdateRegisteredBankInvalidIPAllowlist(t *testing.T) {
+	service, mock, _ := setup(t)
+
+	err := service.UpdateRegisteredBank(context.Background(), 3, &biModel.UpdateAuthenticatedBank{IPAllowlist: &[]string{"10.0.0.0/33"}})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRotateClientSecret(t *testing.T) {
+	service, mock, mr := setup(t)
+
+	expectRegisteredBank(mock)
+	mock.ExpectExec("UPDATE authenticated_banks SET client_secret").WithArgs(sqlmock.AnyArg(), 3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	credential, err := service.RotateClientSecret(context.Background(), 3)
+	if err != nil {
+		t.Fatalf("rotating client secret: %v", err)
+	}
+
+	if credential.ClientID != clientID || credential.ClientSecret == clientSecret {
+		t.Fatalf("expected a new secret for the same client, got %+v", credential)
+	}
+	if secret := mr.HGet(biUtil.ClientCredentialsRedis, clientID); secret != credential.ClientSecret {
+		t.Fatal("expected the new secret to be synced")
+	}
+	if mr.Exists(biUtil.AccessTokenRedis+":token-1") || mr.Exists(biUtil.AccessTokenRedis+":token-2") {
+		t.Fatal("expected the access tokens of the previous secret to be invalidated")
+	}
+	if !mr.Exists(biUtil.AccessTokenRedis + ":other") {
+		t.Fatal("expected the access tokens of other clients to be kept")
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRevokeRegisteredBank(t *testing.T) {
+	service, mock, mr := setup(t)
+
+	expectRegisteredBank(mock)
+	mock.ExpectExec("UPDATE authenticated_banks SET deleted_at").WithArgs(3).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	if err := service.RevokeRegisteredBank(context.Background(), 3); err != nil {
+		t.Fatalf("revoking registered bank: %v", err)
+	}
+
+	if mr.HGet(biUtil.ClientCredentialsRedis, clientID) != "" || mr.HGet(biUtil.AuthenticatedBankNameRedis, "3") != "" ||
+		mr.HGet(biUtil.ClientPublicKeysRedis, clientID) != "" {
+		t.Fatal("expected the client to be removed from redis")
+	}
+	if mr.Exists(biUtil.AccessTokenRedis+":token-1") || mr.Exists(biUtil.AccessTokenRedis+":token-2") {
+		t.Fatal("expected the access tokens of the client to be invalidated")
+	}
+	if !mr.Exists(biUtil.AccessTokenRedis + ":other") {
+		t.Fatal("expected the access tokens of other clients to be kept")
+	}
+
+	// Revoking twice is reported, the client is already gone
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT client_id FROM authenticated_banks").WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"client_id"}))
+	mock.ExpectRollback()
+
+	if err := service.RevokeRegisteredBank(context.Background(), 3); err == nil {
+		t.Fatal("expected an error revoking a revoked bank")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReencryptClientSecrets(t *testing.T) {
+	service, mock, mr := setup(t)
+	ctx := context.Background()
+
+	if _, err := service.ReencryptClientSecrets(ctx); err == nil {
+		t.Fatal("expected an error without master key")
+	}
+
+	previousKey, _ := biKeys.NewStaticMasterKey("v1", bytes.Repeat([]byte{1}, 32))
+	primaryKey, _ := biKeys.NewStaticMasterKey("v2", bytes.Repeat([]byte{2}, 32))
+	service.Secrets = biKeys.NewEnvelope(primaryKey, previousKey)
+
+	previous, _ := biKeys.NewEnvelope(previousKey).Encrypt(ctx, "another-secret", "another-client")
+	current, _ := service.Secrets.Encrypt(ctx, "current-secret", "current-client")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, client_id, client_secret").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "client_id", "client_secret", "deleted"}).
+			AddRow(3, clientID, clientSecret, false).
+			AddRow(4, "another-client", previous, false).
+			AddRow(5, "current-client", current, false).
+			AddRow(6, "revoked-client", "revoked-secret", true))
+	for _, id := range []int{3, 4, 6} {
+		mock.ExpectExec("UPDATE authenticated_banks SET client_secret").WithArgs(sqlmock.AnyArg(), id).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectCommit()
+
+	count, err := service.ReencryptClientSecrets(ctx)
+	if err != nil {
+		t.Fatalf("re-encrypting client secrets: %v", err)
+	}
+	if count != 3 {
+		t.Fatalf("expected 3 re-encrypted secrets, got %d", count)
+	}
+
+	for client, secret := range map[string]string{clientID: clientSecret, "another-client": "another-secret"} {
+		stored := mr.HGet(biUtil.ClientCredentialsRedis, client)
+		if service.Secrets.NeedsReencryption(stored) {
+			t.Fatalf("expected the secret of %s to be encrypted with the primary master key", client)
+		}
+		if plaintext, _ := service.Secrets.Decrypt(ctx, stored, client); plaintext != secret {
+			t.Fatalf("expected the secret of %s to be kept", client)
+		}
+	}
+	if mr.HGet(biUtil.ClientCredentialsRedis, "revoked-client") != "" {
+		t.Fatal("expected revoked clients to stay out of redis")
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func ptr[T any](value T) *T {
+	return &value
+}
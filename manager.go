@@ -3,28 +3,37 @@ package bank_integration
 import (
 	"context"
 	"log/slog"
-	"time"
 
-	"github.com/robfig/cron/v3"
 	"github.com/rotisserie/eris"
 	bcaRequest "github.com/voxtmault/bank-integration/bca/request"
 	bcaSecurity "github.com/voxtmault/bank-integration/bca/security"
 	bcaService "github.com/voxtmault/bank-integration/bca/service"
 	biConfig "github.com/voxtmault/bank-integration/config"
+	biHandler "github.com/voxtmault/bank-integration/handler"
+	biHTTPClient "github.com/voxtmault/bank-integration/httpclient"
 	biInterfaces "github.com/voxtmault/bank-integration/interfaces"
 	bank_integration_internal "github.com/voxtmault/bank-integration/internal"
+	biKeys "github.com/voxtmault/bank-integration/keys"
+	biLogger "github.com/voxtmault/bank-integration/logger"
 	management "github.com/voxtmault/bank-integration/management"
+	mandiriRequest "github.com/voxtmault/bank-integration/mandiri/request"
+	mandiriSecurity "github.com/voxtmault/bank-integration/mandiri/security"
+	mandiriService "github.com/voxtmault/bank-integration/mandiri/service"
+	biOutbox "github.com/voxtmault/bank-integration/outbox"
+	biRegistry "github.com/voxtmault/bank-integration/registry"
 	biStorage "github.com/voxtmault/bank-integration/storage"
+	biTokens "github.com/voxtmault/bank-integration/tokens"
 	biUtil "github.com/voxtmault/bank-integration/utils"
+	biWebhook "github.com/voxtmault/bank-integration/webhook"
 )
 
+// InitBankAPI loads the configuration of envPath and initializes the shared storage connections, http client and
+// secrets of the bank services.
+//
+// Deprecated parameter: timezone is ignored since the X-EXTERNAL-ID reservations expire on their own instead of being
+// cleared by a daily job, the services use the TZ of the configuration. It is kept so that existing callers build.
 func InitBankAPI(envPath, timezone string) error {
 
-	location, err := time.LoadLocation(timezone)
-	if err != nil {
-		return eris.Wrap(err, "failed to load timezone")
-	}
-
 	// Load Configs
 	cfg := biConfig.New(envPath)
 
@@ -39,82 +48,345 @@ func InitBankAPI(envPath, timezone string) error {
 	if err := biStorage.InitMariaDB(&cfg.MariaConfig); err != nil {
 		return eris.Wrap(err, "init mariadb connection")
 	}
+	// Bank ingress / egress logs are written in the background
+	biLogger.InitWriter(biStorage.GetDBConnection(), biLogger.DefaultWriterBufferSize)
+
 	obj, err := biStorage.InitRedis(&cfg.RedisConfig)
 	if err != nil {
 		return eris.Wrap(err, "init redis connection")
 	}
 
+	// Every bank service shares the same connection pool and circuit breakers
+	if httpClient, err = biHTTPClient.New(&cfg.EgressConfig, cfg.ForwardProxyConfig.ProxyAddress); err != nil {
+		return eris.Wrap(err, "init http client")
+	}
+
+	// Client secrets are encrypted at rest once a master key is configured
+	if secretEnvelope == nil {
+		if secretEnvelope, err = biKeys.NewEnvelopeFromConfig(cfg); err != nil {
+			return eris.Wrap(err, "init secret envelope")
+		}
+	}
+	if secretEnvelope == nil {
+		slog.Warn("SECRET_MASTER_KEY is not set, client secrets are stored in plaintext")
+	} else if _, err := MigrateClientSecrets(context.Background(), biStorage.GetDBConnection(), obj, secretEnvelope); err != nil {
+		return eris.Wrap(err, "migrate client secrets")
+	}
+
 	// Load Authenticated Banks to Redis
 	if err := LoadAuthenticatedBanks(biStorage.GetDBConnection(), obj); err != nil {
 		return eris.Wrap(err, "load authenticated banks")
 	}
 
-	// Create a new cron scheduler
-	c := cron.New(cron.WithLocation(location))
+	return nil
+}
 
-	// Schedule the task to run every day at midnight
-	_, err = c.AddFunc("0 0 * * *", func() {
-		if err := clearList(context.Background(), obj, "unique-external-id:*"); err != nil {
-			slog.Info("failed to clear unique external id", "reason", err)
-		} else {
-			slog.Info("unique external id cleared")
-		}
-	})
+func init() {
+	if err := biRegistry.Register(biUtil.BankCodeBCA, newBCAService); err != nil {
+		panic(err)
+	}
+	if err := biRegistry.Register(biUtil.BankCodeMandiri, newMandiriService); err != nil {
+		panic(err)
+	}
+}
+
+// InitBankService creates a new instance of the provider registered under bankCode using the bank configuration
+// found in envPath. Calling it multiple times with different configurations runs several instances side by side,
+// each one can later be resolved by its internal bank id through GetBankService.
+func InitBankService(bankCode, envPath string) (biInterfaces.SNAP, error) {
+	return InitBankServiceWithConfig(context.Background(), bankCode, biConfig.NewBankingConfig(envPath))
+}
+
+// InitBankServiceWithConfig is the same as InitBankService but accepts an already loaded bank configuration
+func InitBankServiceWithConfig(ctx context.Context, bankCode string, cfg *biConfig.BankConfig) (biInterfaces.SNAP, error) {
+	// Checks for problematic configurations
+	if err := biUtil.ValidateStruct(ctx, cfg); err != nil {
+		return nil, eris.Wrap(err, "invalid bank configuration")
+	}
+
+	service, err := biRegistry.Default().Open(ctx, bankCode, &biRegistry.Dependencies{
+		Config:     biConfig.GetConfig(),
+		DB:         biStorage.GetDBConnection(),
+		RDB:        biStorage.GetRedisInstance(),
+		Signer:     signerProvider,
+		Secrets:    secretEnvelope,
+		HTTPClient: httpClient,
+	}, cfg)
 	if err != nil {
-		return eris.Wrap(err, "failed to schedule task")
+		return nil, err
+	}
+
+	return service, nil
+}
+
+// httpClient sends the requests of every bank service, see GetEgressBreakerStates
+var httpClient *biHTTPClient.Client
+
+// GetEgressBreakerStates returns the state of the circuit breaker of every bank endpoint called so far, keyed by host
+// and path. Requests to an open endpoint fail right away with biHTTPClient.ErrCircuitOpen.
+func GetEgressBreakerStates() map[string]biHTTPClient.BreakerState {
+	if httpClient == nil {
+		return map[string]biHTTPClient.BreakerState{}
 	}
 
-	// Start the cron scheduler
-	c.Start()
+	return httpClient.BreakerStates()
+}
 
-	return nil
+// signerProvider is handed to the bank services initialized after UseSignerProvider
+var signerProvider biKeys.SignerProvider
+
+// secretEnvelope encrypts the client secrets at rest, see UseMasterKeyProvider
+var secretEnvelope *biKeys.Envelope
+
+// UseMasterKeyProvider encrypts the client secrets with the master key of primary instead of SECRET_MASTER_KEY, e.g.
+// a KMS key. The previous providers are still accepted to decrypt. It must be called before InitBankAPI.
+func UseMasterKeyProvider(primary biKeys.MasterKeyProvider, previous ...biKeys.MasterKeyProvider) {
+	secretEnvelope = biKeys.NewEnvelope(primary, previous...)
 }
 
+// UseSignerProvider makes the bank services initialized afterwards sign through provider instead of the private key
+// selected by PRIVATE_KEY_PROVIDER, e.g. a biKeys.PKCS11Provider wrapping an HSM
+func UseSignerProvider(provider biKeys.SignerProvider) {
+	signerProvider = provider
+}
+
+// GetBankService returns the running bank service instance of the given internal bank id
+func GetBankService(idBank uint) (biInterfaces.SNAP, error) {
+	return biRegistry.Default().Get(idBank)
+}
+
+// GetBankHandler returns an http.Handler serving the bank-facing SNAP endpoints (access token, bill presentment
+// and payment flag) of the running bank service instance of the given internal bank id
+func GetBankHandler(idBank uint) (*biHandler.Handler, error) {
+	service, err := biRegistry.Default().Get(idBank)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := biRegistry.Default().Config(idBank)
+	if err != nil {
+		return nil, err
+	}
+
+	return biHandler.New(service, &cfg.RequestedEndpoints), nil
+}
+
+// Deprecated: use InitBankService with utils.BankCodeBCA instead.
 func InitBCAService(envPath string) (biInterfaces.SNAP, error) {
-	cfg := biConfig.NewBankingConfig(envPath)
+	return InitBankService(biUtil.BankCodeBCA, envPath)
+}
 
-	// Checks for problematic configurations
-	if err := biUtil.ValidateStruct(context.Background(), cfg); err != nil {
-		return nil, eris.Wrap(err, "invalid bank configuration")
+// Deprecated: use GetBankService instead. When multiple BCA instances are running, the one with the lowest
+// internal bank id is returned.
+func GetBCAService() (biInterfaces.SNAP, error) {
+	services := biRegistry.Default().GetByBankCode(biUtil.BankCodeBCA)
+	if len(services) == 0 {
+		return nil, eris.New("bca service not initialized")
 	}
 
-	security, err := bcaSecurity.NewBCASecurity(biConfig.GetConfig(), cfg)
+	return services[0], nil
+}
+
+func newBCAService(ctx context.Context, deps *biRegistry.Dependencies, cfg *biConfig.BankConfig) (biInterfaces.SNAP, error) {
+	trustedProxies, err := biUtil.ParseCIDRs(cfg.IngressConfig.TrustedProxies)
+	if err != nil {
+		return nil, eris.Wrap(err, "parsing trusted proxies")
+	}
+
+	bankSecurity, err := bcaSecurity.NewBCASecurity(deps.Config, cfg, deps.Signer)
 	if err != nil {
 		slog.Error("failed to init bca security instance", "reason", err)
 		return nil, eris.Wrap(err, "init bca security")
 	}
+	security := biKeys.NewSwappableSecurity(bankSecurity)
+	startKeyManager(deps, bankSecurity.Keys())
+
+	ingress := bcaRequest.NewBCAIngress(security)
+	ingress.Secrets = deps.Secrets
+	ingress.TimestampSkew = cfg.IngressConfig.TimestampSkew
+	ingress.TrustedProxies = trustedProxies
 
 	service, err := bcaService.NewBCAService(
-		bcaRequest.NewBCAEgress(security, cfg, biConfig.GetConfig()),
-		bcaRequest.NewBCAIngress(security),
-		biConfig.GetConfig(),
+		bcaRequest.NewBCAEgress(security, cfg, deps.Config),
+		ingress,
+		deps.Config,
 		cfg,
-		biStorage.GetDBConnection(),
-		biStorage.GetRedisInstance(),
+		deps.DB,
+		deps.RDB,
 	)
+	if err != nil {
+		bankSecurity.Keys().Stop()
+		return nil, err
+	}
+	if deps.HTTPClient != nil {
+		service.HTTPClient = deps.HTTPClient
+	}
+	service.Security = security
+	service.OnClose(closeBankSecurity(security))
 
-	return service, err
+	return service, nil
 }
 
-func GetBCAService() (biInterfaces.SNAP, error) {
-	service := bcaService.GetBCAService()
-	if service == nil {
-		return nil, eris.New("bca service not initialized")
+func newMandiriService(ctx context.Context, deps *biRegistry.Dependencies, cfg *biConfig.BankConfig) (biInterfaces.SNAP, error) {
+	trustedProxies, err := biUtil.ParseCIDRs(cfg.IngressConfig.TrustedProxies)
+	if err != nil {
+		return nil, eris.Wrap(err, "parsing trusted proxies")
+	}
+
+	bankSecurity, err := mandiriSecurity.NewMandiriSecurity(deps.Config, cfg, deps.Signer)
+	if err != nil {
+		slog.Error("failed to init mandiri security instance", "reason", err)
+		return nil, eris.Wrap(err, "init mandiri security")
+	}
+	security := biKeys.NewSwappableSecurity(bankSecurity)
+	startKeyManager(deps, bankSecurity.Keys())
+
+	ingress := mandiriRequest.NewMandiriIngress(security)
+	ingress.Secrets = deps.Secrets
+	ingress.TimestampSkew = cfg.IngressConfig.TimestampSkew
+	ingress.TrustedProxies = trustedProxies
+
+	service, err := mandiriService.NewMandiriService(
+		mandiriRequest.NewMandiriEgress(security, cfg, deps.Config),
+		ingress,
+		deps.Config,
+		cfg,
+		deps.DB,
+		deps.RDB,
+	)
+	if err != nil {
+		bankSecurity.Keys().Stop()
+		return nil, err
+	}
+	if deps.HTTPClient != nil {
+		service.HTTPClient = deps.HTTPClient
 	}
+	service.Security = security
+	service.OnClose(closeBankSecurity(security))
 
 	return service, nil
 }
 
+// closeBankSecurity returns the function stopping the key reloads of security once the instance using it is closed
+func closeBankSecurity(security *biKeys.SwappableSecurity) func() {
+	return func() {
+		security.Keys().Stop()
+	}
+}
+
+// ReloadBankKeys reads the private key and the bank public key of the given internal bank id again. The previous
+// bank public key is still accepted for KEY_GRACE_PERIOD hours, the current keys are kept if a file is invalid.
+func ReloadBankKeys(ctx context.Context, idBank uint) error {
+	security, err := getBankSecurity(idBank)
+	if err != nil {
+		return err
+	}
+
+	keys := security.Keys()
+	if keys == nil {
+		return eris.New("bank security does not hold reloadable keys")
+	}
+
+	return keys.Reload(ctx)
+}
+
+// SwapBankSecurity replaces the security used by the running bank service instance of the given internal bank id,
+// requests in flight finish with the previous one.
+func SwapBankSecurity(idBank uint, security biInterfaces.Security) error {
+	current, err := getBankSecurity(idBank)
+	if err != nil {
+		return err
+	}
+
+	previous, err := current.Swap(security)
+	if err != nil {
+		return eris.Wrap(err, "swapping bank security")
+	}
+
+	if holder, ok := previous.(biKeys.KeyHolder); ok {
+		holder.Keys().Stop()
+	}
+	if holder, ok := security.(biKeys.KeyHolder); ok {
+		startKeyManager(&biRegistry.Dependencies{Config: biConfig.GetConfig(), DB: biStorage.GetDBConnection()}, holder.Keys())
+	}
+
+	return nil
+}
+
+// getBankSecurity returns the security of the running bank service instance of the given internal bank id
+func getBankSecurity(idBank uint) (*biKeys.SwappableSecurity, error) {
+	service, err := biRegistry.Default().Get(idBank)
+	if err != nil {
+		return nil, eris.Errorf("no bank service running for bank id %d", idBank)
+	}
+
+	security, ok := bankSecurity(service)
+	if !ok {
+		return nil, eris.Errorf("bank service of bank id %d does not hold a swappable security", idBank)
+	}
+
+	return security, nil
+}
+
+// bankSecurity returns the security of a bank service instance created by the factories of this package
+func bankSecurity(service biInterfaces.SNAP) (*biKeys.SwappableSecurity, bool) {
+	var security biInterfaces.Security
+	switch s := service.(type) {
+	case *bcaService.BCAService:
+		security = s.Security
+	case *mandiriService.MandiriService:
+		security = s.Security
+	}
+
+	swappable, ok := security.(*biKeys.SwappableSecurity)
+	return swappable, ok
+}
+
+// startKeyManager audits the key rotations into the database and starts the periodic reload if configured
+func startKeyManager(deps *biRegistry.Dependencies, keys *biKeys.Manager) {
+	if keys == nil {
+		return
+	}
+
+	if deps.DB != nil {
+		keys.SetAuditor(biKeys.DBAuditor(deps.DB))
+	}
+	if deps.Config != nil {
+		keys.Start(deps.Config.KeyConfig.ReloadInterval)
+	}
+}
+
+// NewPaymentEventDispatcher returns a dispatcher delivering the payment events of every bank service instance.
+// Register the subscribers then call Run in its own goroutine.
+func NewPaymentEventDispatcher() *biOutbox.Dispatcher {
+	return biOutbox.NewDispatcher(biStorage.GetDBConnection())
+}
+
+// NewWebhookService returns the merchant webhook service. Register its Subscriber to the payment event dispatcher
+// under biWebhook.SubscriberName then call Run in its own goroutine.
+func NewWebhookService() *biWebhook.Service {
+	service := biWebhook.NewService(biStorage.GetDBConnection(), &biConfig.GetConfig().WebhookConfig)
+	service.Secrets = secretEnvelope
+
+	return service
+}
+
 func InitManagementService() biInterfaces.Management {
 
 	service := management.NewBankIntegrationManagement(
 		biStorage.GetDBConnection(),
 		biStorage.GetRedisInstance(),
+		secretEnvelope,
 	)
 
 	return service
 }
 
+// InitTokenStore returns the store of the access tokens issued to the registered clients, used to list, revoke
+// and introspect them
+func InitTokenStore() *biTokens.Store {
+	return biTokens.NewStore(biStorage.GetRedisInstance())
+}
+
 func InitInternalService() biInterfaces.Internal {
 	service, _ := bank_integration_internal.NewInternalService(
 		biConfig.GetConfig(),
@@ -125,29 +397,16 @@ func InitInternalService() biInterfaces.Internal {
 	return service
 }
 
-func clearList(ctx context.Context, rdb *biStorage.RedisInstance, pattern string) error {
-	var cursor uint64
-	for {
-		keys, nextCursor, err := rdb.RDB.Scan(ctx, cursor, pattern, 100).Result()
-		if err != nil {
-			return err
-		}
-
-		if len(keys) > 0 {
-			if err := rdb.RDB.Del(ctx, keys...).Err(); err != nil {
-				return err
-			}
-		}
-
-		cursor = nextCursor
-		if cursor == 0 {
-			break
-		}
+func CloseBankAPI() {
+	// Close every bank service instance, stopping its distributed transaction watcher and its periodic key reloads.
+	// The watched transactions are kept in redis.
+	for _, idBank := range biRegistry.Default().BankIDs() {
+		biRegistry.Default().Remove(idBank)
 	}
-	return nil
-}
 
-func CloseBankAPI() {
+	// Flush the pending bank logs before closing the database connection
+	biLogger.CloseWriter()
+
 	if err := biStorage.Close(); err != nil {
 		slog.Error("failed to close storage connections", "reason", err)
 	}
@@ -3,7 +3,10 @@ package bank_integration
 import (
 	"testing"
 
+	bcaService "github.com/voxtmault/bank-integration/bca/service"
 	biConfig "github.com/voxtmault/bank-integration/config"
+	biKeys "github.com/voxtmault/bank-integration/keys"
+	mandiriService "github.com/voxtmault/bank-integration/mandiri/service"
 	biStorage "github.com/voxtmault/bank-integration/storage"
 )
 
@@ -23,3 +26,21 @@ func TestInitBCAService(t *testing.T) {
 		t.Fatalf("error initializing bca service: %v", err)
 	}
 }
+
+func TestBankSecurity(t *testing.T) {
+	security := biKeys.NewSwappableSecurity(nil)
+
+	if got, ok := bankSecurity(&bcaService.BCAService{Security: security}); !ok || got != security {
+		t.Fatal("expected the security of the bca service")
+	}
+	if got, ok := bankSecurity(&mandiriService.MandiriService{Security: security}); !ok || got != security {
+		t.Fatal("expected the security of the mandiri service")
+	}
+	if _, ok := bankSecurity(&bcaService.BCAService{}); ok {
+		t.Fatal("expected no security for a service created without one")
+	}
+
+	if _, err := getBankSecurity(7); err == nil {
+		t.Fatal("expected an error for a bank id without running instance")
+	}
+}
@@ -0,0 +1,230 @@
+package mandiri
+
+import (
+	"net/http"
+
+	biModels "github.com/voxtmault/bank-integration/models"
+)
+
+var MandiriErrorCodes = map[string]string{
+	"4017301": "Invalid Token (B2B)",                      // Token tidak valid
+	"4017300": "Unauthorized. [Signature]",                // Unauthorized, Signature tidak sah
+	"4007302": "Invalid Mandatory Field",                  // Mandatory field hilang
+	"4007301": "Invalid Field Format",                     // Format field tidak valid
+	"4092400": "Conflict",                                 // Konflik, X-EXTERNAL-ID yang sama
+	"2002400": "Successful",                               // Request berhasil
+	"4042414": "Paid Bill",                                // Tagihan sudah dibayar
+	"4042419": "Invalid Bill/Virtual Account",             // Tagihan atau Virtual Account kedaluwarsa
+	"4042412": "Invalid Bill/Virtual Account [Not Found]", // Tagihan atau Virtual Account tidak ditemukan
+	"4042513": "Invalid Amount",                           // Jumlah pembayaran tidak sesuai
+	"4002400": "Bad Request",                              // Kesalahan dalam request atau parsing
+	"5002400": "General Error",                            // Kesalahan umum di server
+}
+
+type MandiriCommonResponseMessage string
+
+func (m MandiriCommonResponseMessage) ToString() string {
+	return string(m)
+}
+
+// Common Mandiri Response Message Collections
+var (
+	MandiriCommonResponseMessageSuccess                          = MandiriCommonResponseMessage("Successful")
+	MandiriCommonResponseMessageInvalidToken                     = MandiriCommonResponseMessage("Invalid Token (B2B)")
+	MandiriCommonResponseMessageUnauthorizedSignature            = MandiriCommonResponseMessage("Unauthorized. [Signature]")
+	MandiriCommonResponseMessageUnauthorizedUnknownClient        = MandiriCommonResponseMessage("Unauthorized. [Unknown client]")
+	MandiriCommonResponseMessageUnauthorizedTimestamp            = MandiriCommonResponseMessage("Unauthorized. [X-TIMESTAMP]")
+	MandiriCommonResponseMessageUnauthorizedReplay               = MandiriCommonResponseMessage("Unauthorized. [Signature already used]")
+	MandiriCommonResponseMessageUnauthorizedConnectionNotAllowed = MandiriCommonResponseMessage("Unauthorized. [Connection not allowed]")
+	MandiriCommonResponseMessageMissingMandatoryField            = MandiriCommonResponseMessage("Invalid Mandatory Field")
+	MandiriCommonResponseMessageInvalidFieldFormat               = MandiriCommonResponseMessage("Invalid Field Format")
+	MandiriCommonResponseMessageDuplicateExternalID              = MandiriCommonResponseMessage("Conflict")
+	MandiriCommonResponseMessageVAPaid                           = MandiriCommonResponseMessage("Paid Bill")
+	MandiriCommonResponseMessageInvalidAmount                    = MandiriCommonResponseMessage("Invalid Amount")
+	MandiriCommonResponseMessageVAExpired                        = MandiriCommonResponseMessage("Invalid Bill/Virtual Account")
+	MandiriCommonResponseMessageVANotFound                       = MandiriCommonResponseMessage("Invalid Bill/Virtual Account [Not Found]")
+	MandiriCommonResponseMessageRequestParseError                = MandiriCommonResponseMessage("Bad Request")
+	MandiriCommonResponseMessageGeneralError                     = MandiriCommonResponseMessage("General Error")
+)
+
+// Authentication Expected Partner Responses
+var (
+	MandiriAuthResponseSuccess = biModels.BCAResponse{
+		HTTPStatusCode:  http.StatusOK,
+		ResponseCode:    "2007300",
+		ResponseMessage: MandiriCommonResponseMessageSuccess.ToString(),
+	}
+	MandiriAuthInvalidFieldFormatClient = biModels.BCAResponse{
+		HTTPStatusCode:  http.StatusBadRequest,
+		ResponseCode:    "4007301",
+		ResponseMessage: MandiriCommonResponseMessageInvalidFieldFormat.ToString() + " [clientId/clientSecret/grantType]",
+	}
+	MandiriAuthInvalidFieldFormatTimestamp = biModels.BCAResponse{
+		HTTPStatusCode:  http.StatusBadRequest,
+		ResponseCode:    "4007301",
+		ResponseMessage: MandiriCommonResponseMessageInvalidFieldFormat.ToString() + " [X-TIMESTAMP]",
+	}
+	MandiriAuthInvalidMandatoryField = biModels.BCAResponse{
+		HTTPStatusCode:  http.StatusBadRequest,
+		ResponseCode:    "4007302",
+		ResponseMessage: MandiriCommonResponseMessageMissingMandatoryField.ToString(),
+	}
+	MandiriAuthUnauthorizedSignature = biModels.BCAResponse{
+		HTTPStatusCode:  http.StatusUnauthorized,
+		ResponseCode:    "4017300",
+		ResponseMessage: MandiriCommonResponseMessageUnauthorizedSignature.ToString(),
+	}
+	MandiriAuthUnauthorizedUnknownClient = biModels.BCAResponse{
+		HTTPStatusCode:  http.StatusUnauthorized,
+		ResponseCode:    "4017300",
+		ResponseMessage: MandiriCommonResponseMessageUnauthorizedUnknownClient.ToString(),
+	}
+	MandiriAuthUnauthorizedTimestamp = biModels.BCAResponse{
+		HTTPStatusCode:  http.StatusUnauthorized,
+		ResponseCode:    "4017300",
+		ResponseMessage: MandiriCommonResponseMessageUnauthorizedTimestamp.ToString(),
+	}
+	MandiriAuthUnauthorizedReplay = biModels.BCAResponse{
+		HTTPStatusCode:  http.StatusUnauthorized,
+		ResponseCode:    "4017300",
+		ResponseMessage: MandiriCommonResponseMessageUnauthorizedReplay.ToString(),
+	}
+	MandiriAuthUnauthorizedConnectionNotAllowed = biModels.BCAResponse{
+		HTTPStatusCode:  http.StatusUnauthorized,
+		ResponseCode:    "4017300",
+		ResponseMessage: MandiriCommonResponseMessageUnauthorizedConnectionNotAllowed.ToString(),
+	}
+	MandiriAuthInvalidToken = biModels.BCAResponse{
+		HTTPStatusCode:  http.StatusUnauthorized,
+		ResponseCode:    "4017301",
+		ResponseMessage: MandiriCommonResponseMessageInvalidToken.ToString(),
+	}
+	MandiriAuthGeneralError = biModels.BCAResponse{
+		HTTPStatusCode:  http.StatusInternalServerError,
+		ResponseCode:    "5007300",
+		ResponseMessage: MandiriCommonResponseMessageGeneralError.ToString(),
+	}
+)
+
+// Bill Inquiry Expected Partner Responses
+var (
+	MandiriBillInquiryResponseSuccess = biModels.BCAResponse{
+		HTTPStatusCode:  http.StatusOK,
+		ResponseCode:    "2002400",
+		ResponseMessage: MandiriCommonResponseMessageSuccess.ToString(),
+	}
+	MandiriBillInquiryResponseUnauthorizedSignature = biModels.BCAResponse{
+		HTTPStatusCode:  http.StatusUnauthorized,
+		ResponseCode:    "4012400",
+		ResponseMessage: MandiriCommonResponseMessageUnauthorizedSignature.ToString(),
+	}
+	MandiriBillInquiryResponseUnauthorizedUnknownClient = biModels.BCAResponse{
+		HTTPStatusCode:  http.StatusUnauthorized,
+		ResponseCode:    "4012400",
+		ResponseMessage: MandiriCommonResponseMessageUnauthorizedUnknownClient.ToString(),
+	}
+	MandiriBillInquiryResponseMissingMandatoryField = biModels.BCAResponse{
+		HTTPStatusCode:  http.StatusBadRequest,
+		ResponseCode:    "4002402",
+		ResponseMessage: MandiriCommonResponseMessageMissingMandatoryField.ToString(),
+	}
+	MandiriBillInquiryResponseInvalidFieldFormat = biModels.BCAResponse{
+		HTTPStatusCode:  http.StatusBadRequest,
+		ResponseCode:    "4002401",
+		ResponseMessage: MandiriCommonResponseMessageInvalidFieldFormat.ToString(),
+	}
+	MandiriBillInquiryResponseDuplicateExternalID = biModels.BCAResponse{
+		HTTPStatusCode:  http.StatusConflict,
+		ResponseCode:    "4092400",
+		ResponseMessage: MandiriCommonResponseMessageDuplicateExternalID.ToString(),
+	}
+	MandiriBillInquiryResponseVAPaid = biModels.BCAResponse{
+		HTTPStatusCode:  http.StatusNotFound,
+		ResponseCode:    "4042414",
+		ResponseMessage: MandiriCommonResponseMessageVAPaid.ToString(),
+	}
+	MandiriBillInquiryResponseVAExpired = biModels.BCAResponse{
+		HTTPStatusCode:  http.StatusNotFound,
+		ResponseCode:    "4042419",
+		ResponseMessage: MandiriCommonResponseMessageVAExpired.ToString(),
+	}
+	MandiriBillInquiryResponseVANotFound = biModels.BCAResponse{
+		HTTPStatusCode:  http.StatusNotFound,
+		ResponseCode:    "4042412",
+		ResponseMessage: MandiriCommonResponseMessageVANotFound.ToString(),
+	}
+	MandiriBillInquiryResponseRequestParseError = biModels.BCAResponse{
+		HTTPStatusCode:  http.StatusBadRequest,
+		ResponseCode:    "4002400",
+		ResponseMessage: MandiriCommonResponseMessageRequestParseError.ToString(),
+	}
+	MandiriBillInquiryResponseGeneralError = biModels.BCAResponse{
+		HTTPStatusCode:  http.StatusInternalServerError,
+		ResponseCode:    "5002400",
+		ResponseMessage: MandiriCommonResponseMessageGeneralError.ToString(),
+	}
+)
+
+// Payment Flag Expected Partner Responses
+var (
+	MandiriPaymentFlagResponseSuccess = biModels.BCAResponse{
+		HTTPStatusCode:  http.StatusOK,
+		ResponseCode:    "2002500",
+		ResponseMessage: MandiriCommonResponseMessageSuccess.ToString(),
+	}
+	MandiriPaymentFlagResponseUnauthorizedSignature = biModels.BCAResponse{
+		HTTPStatusCode:  http.StatusUnauthorized,
+		ResponseCode:    "4012500",
+		ResponseMessage: MandiriCommonResponseMessageUnauthorizedSignature.ToString(),
+	}
+	MandiriPaymentFlagResponseUnauthorizedUnknownClient = biModels.BCAResponse{
+		HTTPStatusCode:  http.StatusUnauthorized,
+		ResponseCode:    "4012500",
+		ResponseMessage: MandiriCommonResponseMessageUnauthorizedUnknownClient.ToString(),
+	}
+	MandiriPaymentFlagResponseMissingMandatoryField = biModels.BCAResponse{
+		HTTPStatusCode:  http.StatusBadRequest,
+		ResponseCode:    "4002502",
+		ResponseMessage: MandiriCommonResponseMessageMissingMandatoryField.ToString(),
+	}
+	MandiriPaymentFlagResponseInvalidFieldFormat = biModels.BCAResponse{
+		HTTPStatusCode:  http.StatusBadRequest,
+		ResponseCode:    "4002501",
+		ResponseMessage: MandiriCommonResponseMessageInvalidFieldFormat.ToString(),
+	}
+	MandiriPaymentFlagResponseDuplicateExternalID = biModels.BCAResponse{
+		HTTPStatusCode:  http.StatusConflict,
+		ResponseCode:    "4092500",
+		ResponseMessage: MandiriCommonResponseMessageDuplicateExternalID.ToString(),
+	}
+	MandiriPaymentFlagResponseVAPaid = biModels.BCAResponse{
+		HTTPStatusCode:  http.StatusNotFound,
+		ResponseCode:    "4042514",
+		ResponseMessage: MandiriCommonResponseMessageVAPaid.ToString(),
+	}
+	MandiriPaymentFlagResponseVAExpired = biModels.BCAResponse{
+		HTTPStatusCode:  http.StatusNotFound,
+		ResponseCode:    "4042519",
+		ResponseMessage: MandiriCommonResponseMessageVAExpired.ToString(),
+	}
+	MandiriPaymentFlagResponseVANotFound = biModels.BCAResponse{
+		HTTPStatusCode:  http.StatusNotFound,
+		ResponseCode:    "4042512",
+		ResponseMessage: MandiriCommonResponseMessageVANotFound.ToString(),
+	}
+	MandiriPaymentFlagResponseInvalidAmount = biModels.BCAResponse{
+		HTTPStatusCode:  http.StatusNotFound,
+		ResponseCode:    "4042513",
+		ResponseMessage: MandiriCommonResponseMessageInvalidAmount.ToString(),
+	}
+	MandiriPaymentFlagResponseRequestParseError = biModels.BCAResponse{
+		HTTPStatusCode:  http.StatusBadRequest,
+		ResponseCode:    "4002500",
+		ResponseMessage: MandiriCommonResponseMessageRequestParseError.ToString(),
+	}
+	MandiriPaymentFlagResponseGeneralError = biModels.BCAResponse{
+		HTTPStatusCode:  http.StatusInternalServerError,
+		ResponseCode:    "5002500",
+		ResponseMessage: MandiriCommonResponseMessageGeneralError.ToString(),
+	}
+)
@@ -0,0 +1,24 @@
+package mandiri
+
+// Mandiri follows the SNAP BI string to sign, the notable difference with BCA is that X-TIMESTAMP is expected
+// with millisecond precision. Incoming timestamps are parsed as RFC3339 which also accepts the fractional seconds.
+const TimestampFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// SNAP service codes used by Mandiri, they are embedded in the 3rd & 4th digit of every response code
+const (
+	MandiriServiceBalanceInquiry  = "11"
+	MandiriServiceBillInquiry     = "24"
+	MandiriServicePaymentFlag     = "25"
+	MandiriServiceVAInquiryStatus = "26"
+	MandiriServiceAccessToken     = "73"
+)
+
+// Expected success response codes of the requests sent to Mandiri
+const (
+	MandiriAccessTokenSuccessCode     = "2007300"
+	MandiriBalanceInquirySuccessCode  = "2001100"
+	MandiriVAInquiryStatusSuccessCode = "2002600"
+)
+
+// Mandiri company codes (partnerServiceId) are at most 5 digits and padded with spaces in front up to 8 characters
+const PartnerServiceIDLength = 8
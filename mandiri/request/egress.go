@@ -0,0 +1,99 @@
+package mandiri_request
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rotisserie/eris"
+	biConfig "github.com/voxtmault/bank-integration/config"
+	biInterfaces "github.com/voxtmault/bank-integration/interfaces"
+	"github.com/voxtmault/bank-integration/mandiri"
+	biModels "github.com/voxtmault/bank-integration/models"
+)
+
+type MandiriEgress struct {
+	bankConfig     *biConfig.BankConfig
+	internalConfig *biConfig.InternalConfig
+
+	// Security is mainly used to generate signatures for request headers
+	Security biInterfaces.Security
+}
+
+var _ biInterfaces.RequestEgress = &MandiriEgress{}
+
+func NewMandiriEgress(security biInterfaces.Security, bCfg *biConfig.BankConfig, cfg *biConfig.InternalConfig) *MandiriEgress {
+	return &MandiriEgress{
+		bankConfig:     bCfg,
+		internalConfig: cfg,
+		Security:       security,
+	}
+}
+
+func (s *MandiriEgress) GenerateAccessRequestHeader(ctx context.Context, request *http.Request) error {
+	timeStamp := time.Now().Format(mandiri.TimestampFormat)
+
+	signature, err := s.Security.CreateAsymmetricSignature(ctx, timeStamp)
+	if err != nil {
+		slog.Debug("error creating signature", "error", err)
+		return eris.Wrap(err, "creating signature")
+	}
+
+	// Checks if the caller has set a content-type already
+	if request.Header.Get("Content-Type") == "" {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	request.Header.Set("X-TIMESTAMP", timeStamp)
+	request.Header.Set("X-CLIENT-KEY", s.bankConfig.BankCredential.ClientID)
+	request.Header.Set("X-SIGNATURE", signature)
+
+	return nil
+}
+
+func (s *MandiriEgress) GenerateGeneralRequestHeader(ctx context.Context, request *http.Request, relativeURL, accessToken string) error {
+	timeStamp := time.Now().Format(mandiri.TimestampFormat)
+
+	var bodyBytes []byte
+	if request.Body != nil {
+		var err error
+		bodyBytes, err = io.ReadAll(request.Body)
+		if err != nil {
+			return eris.Wrap(err, "reading request body")
+		}
+		request.Body.Close()
+		request.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+	}
+
+	signature, err := s.Security.CreateSymmetricSignature(ctx, &biModels.SymmetricSignatureRequirement{
+		HTTPMethod:  request.Method,
+		AccessToken: accessToken,
+		Timestamp:   timeStamp,
+		RequestBody: bodyBytes,
+		RelativeURL: relativeURL,
+	})
+	if err != nil {
+		slog.Debug("error creating signature", "error", err)
+		return eris.Wrap(err, "creating signature")
+	}
+
+	// Checks if the caller has set a content-type already
+	if request.Header.Get("Content-Type") == "" {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	request.Header.Set("Authorization", "Bearer "+accessToken)
+	request.Header.Set("X-TIMESTAMP", timeStamp)
+	request.Header.Set("X-SIGNATURE", signature)
+	request.Header.Set("ORIGIN", s.internalConfig.AppHost)
+
+	if request.Header.Get("X-EXTERNAL-ID") == "" {
+		request.Header.Set("X-EXTERNAL-ID", strconv.FormatInt(time.Now().UnixNano(), 10))
+	}
+
+	return nil
+}
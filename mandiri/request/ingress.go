@@ -0,0 +1,266 @@
+package mandiri_request
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/rotisserie/eris"
+	biIngress "github.com/voxtmault/bank-integration/ingress"
+	biInterfaces "github.com/voxtmault/bank-integration/interfaces"
+	biKeys "github.com/voxtmault/bank-integration/keys"
+	"github.com/voxtmault/bank-integration/mandiri"
+	biModels "github.com/voxtmault/bank-integration/models"
+	biStorage "github.com/voxtmault/bank-integration/storage"
+	biUtil "github.com/voxtmault/bank-integration/utils"
+)
+
+type MandiriIngress struct {
+	// Security is mainly used to verify the signatures of the request headers
+	Security biInterfaces.Security
+
+	// Secrets decrypts the client secrets, they are stored encrypted when a master key is configured
+	Secrets *biKeys.Envelope
+
+	// TimestampSkew is the accepted clock skew of the X-TIMESTAMP, signatures are rejected once seen within it. Clients
+	// can have their own skew (authenticated_banks.timestamp_skew), 0 disables the check for the other clients.
+	TimestampSkew time.Duration
+
+	// TrustedProxies are the proxies in front of us, the X-Forwarded-For they append is used as the source IP of the
+	// request when it is matched against the allowlist of the client (authenticated_banks.ip_allowlist)
+	TrustedProxies []netip.Prefix
+}
+
+var _ biInterfaces.RequestIngress = &MandiriIngress{}
+
+// Mandiri X-EXTERNAL-ID is alphanumeric, unlike BCA which only sends numeric ids
+var externalIDPattern = regexp.MustCompile(`^[a-zA-Z0-9\-]+$`)
+
+func NewMandiriIngress(security biInterfaces.Security) *MandiriIngress {
+	return &MandiriIngress{
+		Security: security,
+	}
+}
+
+func (s *MandiriIngress) VerifyAsymmetricSignature(ctx context.Context, request *http.Request, redis *biStorage.RedisInstance) (bool, *biModels.BCAResponse, string) {
+	timeStamp := request.Header.Get("X-TIMESTAMP")
+	clientKey := request.Header.Get("X-CLIENT-KEY")
+	signature := request.Header.Get("X-SIGNATURE")
+
+	if header := biIngress.MissingHeader(request, "X-CLIENT-KEY", "X-TIMESTAMP", "X-SIGNATURE"); header != "" {
+		slog.Debug("mandatory header is empty", "header", header)
+
+		response := mandiri.MandiriAuthInvalidMandatoryField
+		response.ResponseMessage = response.ResponseMessage + " [" + header + "]"
+
+		return false, &response, ""
+	}
+
+	// RFC3339 parsing also accepts the millisecond precision used by Mandiri
+	if _, err := time.Parse(time.RFC3339, timeStamp); err != nil {
+		slog.Debug("invalid timestamp format")
+		return false, &mandiri.MandiriAuthInvalidFieldFormatTimestamp, ""
+	}
+
+	clientSecret, err := redis.GetIndividualValueRedisHash(ctx, biUtil.ClientCredentialsRedis, clientKey)
+	if err != nil {
+		slog.Debug("error getting client secret", "error", err)
+		return false, &mandiri.MandiriAuthGeneralError, ""
+	}
+
+	if clientSecret == "" {
+		slog.Debug("clientId is not registered")
+		return false, &mandiri.MandiriAuthUnauthorizedUnknownClient, ""
+	}
+
+	if response := s.verifySourceIP(ctx, redis, request, clientKey); response != nil {
+		return false, response, ""
+	}
+
+	// Every registered client signs with its own key
+	publicKey, err := biIngress.ClientPublicKey(ctx, redis, clientKey)
+	if err != nil {
+		slog.Debug("error getting client public key", "error", err)
+		return false, &mandiri.MandiriAuthGeneralError, ""
+	}
+
+	result, err := s.Security.VerifyAsymmetricSignature(ctx, timeStamp, clientKey, signature, publicKey)
+	if err != nil {
+		slog.Debug("error verifying signature", "error", err)
+
+		if strings.Contains(eris.Cause(err).Error(), "verification error") {
+			return false, &mandiri.MandiriAuthUnauthorizedSignature, ""
+		}
+
+		return false, &mandiri.MandiriAuthGeneralError, ""
+	}
+
+	// The token signature is the same for every request of a second, it is only held to the clock skew window
+	if result {
+		if response := s.replayResponse(biIngress.VerifyTimestamp(ctx, redis, clientKey, timeStamp, s.TimestampSkew), clientKey, timeStamp); response != nil {
+			return false, response, ""
+		}
+	}
+
+	return result, nil, clientSecret
+}
+
+func (s *MandiriIngress) VerifySymmetricSignature(ctx context.Context, request *http.Request, redis *biStorage.RedisInstance, payload []byte) (bool, *biModels.BCAResponse) {
+	var obj biModels.SymmetricSignatureRequirement
+
+	obj.Timestamp = request.Header.Get("X-TIMESTAMP")
+	obj.AccessToken = request.Header.Get("Authorization")
+	signature := request.Header.Get("X-SIGNATURE")
+
+	if header := biIngress.MissingHeader(request, "X-TIMESTAMP", "Authorization", "X-SIGNATURE"); header != "" {
+		slog.Debug("mandatory header is empty", "header", header)
+
+		response := mandiri.MandiriAuthInvalidMandatoryField
+		response.ResponseMessage = response.ResponseMessage + " [" + header + "]"
+
+		return false, &response
+	}
+
+	if _, err := time.Parse(time.RFC3339, obj.Timestamp); err != nil {
+		slog.Debug("invalid timestamp format")
+		return false, &mandiri.MandiriAuthInvalidFieldFormatTimestamp
+	}
+
+	if !strings.HasPrefix(obj.AccessToken, "Bearer ") {
+		slog.Debug("accessToken does not have Bearer prefix")
+
+		response := mandiri.MandiriAuthInvalidFieldFormatClient
+		response.ResponseMessage = "Invalid Field Format {Authorization}"
+
+		return false, &response
+	}
+	obj.AccessToken = strings.TrimPrefix(obj.AccessToken, "Bearer ")
+
+	token, err := s.ValidateAccessToken(ctx, redis, obj.AccessToken)
+	if err != nil {
+		slog.Debug("error getting client secret", "error", err)
+		return false, &mandiri.MandiriAuthGeneralError
+	}
+
+	if token == nil {
+		slog.Debug("accessToken is not registered")
+		return false, &mandiri.MandiriAuthInvalidToken
+	}
+
+	obj.HTTPMethod = request.Method
+	obj.RelativeURL = request.URL.Path
+	obj.RequestBody = payload
+
+	if response := s.verifySourceIP(ctx, redis, request, token.ClientID); response != nil {
+		return false, response
+	}
+
+	// The client secret is only decrypted in memory, for the time of the verification
+	clientSecret, err := s.Secrets.Decrypt(ctx, token.ClientSecret, token.ClientID)
+	if err != nil {
+		slog.Debug("error decrypting client secret", "error", err)
+		return false, &mandiri.MandiriAuthGeneralError
+	}
+
+	result, err := s.Security.VerifySymmetricSignature(ctx, &obj, clientSecret, signature)
+	if err != nil {
+		slog.Debug("error verifying signature", "error", err)
+		return false, &mandiri.MandiriAuthGeneralError
+	}
+
+	if result {
+		if response := s.verifyReplay(ctx, redis, token.ClientID, obj.Timestamp, signature); response != nil {
+			return false, response
+		}
+	}
+
+	return result, nil
+}
+
+func (s *MandiriIngress) ValidateAccessToken(ctx context.Context, rdb *biStorage.RedisInstance, accessToken string) (*biModels.AccessToken, error) {
+	token, err := biIngress.AccessToken(ctx, rdb, accessToken)
+	if err != nil {
+		slog.Debug("error getting access token", "error", err)
+		return nil, err
+	}
+
+	if token == nil {
+		slog.Debug("token not found in redis, possibly expired, nonexistent or issued without client id")
+	}
+
+	return token, nil
+}
+
+func (s *MandiriIngress) ValidateUniqueExternalID(ctx context.Context, rdb *biStorage.RedisInstance, request *http.Request, ttl time.Duration) (bool, []byte, error) {
+	key, err := biIngress.ExternalIDKey(ctx, rdb, request, biUtil.BankCodeMandiri, externalIDPattern)
+	if err != nil {
+		slog.Debug("invalid externalId", "error", err)
+		return false, nil, err
+	}
+
+	reserved, response, err := biIngress.ReserveExternalID(ctx, rdb, key, ttl)
+	if err != nil {
+		slog.Debug("error reserving externalId", "error", err)
+		return false, nil, err
+	}
+	if !reserved {
+		slog.Debug("externalId already exists", "key", key)
+	}
+
+	return reserved, response, nil
+}
+
+func (s *MandiriIngress) SaveExternalIDResponse(ctx context.Context, rdb *biStorage.RedisInstance, request *http.Request, response []byte) error {
+	key, err := biIngress.ExternalIDKey(ctx, rdb, request, biUtil.BankCodeMandiri, externalIDPattern)
+	if err != nil {
+		return err
+	}
+
+	return biIngress.SaveExternalIDResponse(ctx, rdb, key, response)
+}
+
+func (s *MandiriIngress) VerifyClientSecret(ctx context.Context, clientID, storedSecret, clientSecret string) (bool, error) {
+	return s.Secrets.Equal(ctx, storedSecret, clientSecret, clientID)
+}
+
+// verifyReplay answers the rejection of biIngress.VerifyReplay with the Mandiri response code
+func (s *MandiriIngress) verifyReplay(ctx context.Context, rdb *biStorage.RedisInstance, clientID, timeStamp, signature string) *biModels.BCAResponse {
+	return s.replayResponse(biIngress.VerifyReplay(ctx, rdb, biUtil.BankCodeMandiri, clientID, timeStamp, signature, s.TimestampSkew), clientID, timeStamp)
+}
+
+// replayResponse maps the rejection of biIngress.VerifyReplay or biIngress.VerifyTimestamp to the Mandiri response code
+func (s *MandiriIngress) replayResponse(err error, clientID, timeStamp string) *biModels.BCAResponse {
+	switch {
+	case err == nil:
+		return nil
+	case eris.Is(err, biIngress.ErrTimestampOutOfSkew):
+		slog.Debug("timestamp outside of the accepted clock skew", "timestamp", timeStamp)
+		return &mandiri.MandiriAuthUnauthorizedTimestamp
+	case eris.Is(err, biIngress.ErrSignatureReplayed):
+		slog.Debug("signature already used", "client id", clientID)
+		return &mandiri.MandiriAuthUnauthorizedReplay
+	}
+
+	slog.Debug("error verifying replay", "error", err)
+	return &mandiri.MandiriAuthGeneralError
+}
+
+// verifySourceIP answers the rejection of biIngress.VerifySourceIP with the Mandiri response code
+func (s *MandiriIngress) verifySourceIP(ctx context.Context, rdb *biStorage.RedisInstance, request *http.Request, clientID string) *biModels.BCAResponse {
+	err := biIngress.VerifySourceIP(ctx, rdb, request, clientID, s.TrustedProxies)
+	if err == nil {
+		return nil
+	}
+	if eris.Is(err, biIngress.ErrConnectionNotAllowed) {
+		slog.Warn("rejected callback from a source ip outside of the client allowlist", "client id", clientID,
+			"remote addr", request.RemoteAddr, "x-forwarded-for", request.Header.Values("X-Forwarded-For"), "error", err)
+		return &mandiri.MandiriAuthUnauthorizedConnectionNotAllowed
+	}
+
+	slog.Debug("error verifying source ip", "error", err)
+	return &mandiri.MandiriAuthGeneralError
+}
@@ -0,0 +1,207 @@
+package mandiri_security
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/rotisserie/eris"
+	biConfig "github.com/voxtmault/bank-integration/config"
+	biInterfaces "github.com/voxtmault/bank-integration/interfaces"
+	biKeys "github.com/voxtmault/bank-integration/keys"
+	biModels "github.com/voxtmault/bank-integration/models"
+)
+
+type MandiriSecurity struct {
+	// Banking Instance
+	bankConfig *biConfig.BankConfig
+
+	// Variables loaded on runtime
+
+	keys *biKeys.Manager // Holds the signer of our private key and the Mandiri public key, reloaded on rotation
+}
+
+// Mandiri Security implements the Security interface
+var _ biInterfaces.Security = &MandiriSecurity{}
+
+// NewMandiriSecurity signs through the signer of signerProvider, the signer provider selected by
+// PRIVATE_KEY_PROVIDER is used when it is nil
+func NewMandiriSecurity(cfg *biConfig.InternalConfig, bCfg *biConfig.BankConfig, signerProvider biKeys.SignerProvider) (*MandiriSecurity, error) {
+	obj := &MandiriSecurity{
+		bankConfig: bCfg,
+	}
+
+	var err error
+	obj.keys, err = biKeys.NewManager(cfg, bCfg, signerProvider)
+	if err != nil {
+		slog.Error("error loading keys", "error", err)
+		return nil, eris.Wrap(err, "loading keys")
+	}
+
+	return obj, nil
+}
+
+// Keys returns the key manager holding our private key and the Mandiri public key
+func (s *MandiriSecurity) Keys() *biKeys.Manager {
+	return s.keys
+}
+
+// CreateAsymmetricSignature signs clientId|timestamp using SHA256withRSA, the timestamp is expected to be formatted
+// using mandiri.TimestampFormat.
+func (s *MandiriSecurity) CreateAsymmetricSignature(ctx context.Context, timeStamp string) (string, error) {
+	signer := s.keys.Signer()
+
+	hashed := sha256.Sum256([]byte(fmt.Sprintf("%s|%s", s.bankConfig.BankCredential.ClientID, timeStamp)))
+
+	signature, err := signer.Sign(rand.Reader, hashed[:], crypto.SHA256)
+	if err != nil {
+		return "", eris.Wrap(err, "signing string")
+	}
+
+	return base64.StdEncoding.EncodeToString(signature), nil
+}
+
+func (s *MandiriSecurity) VerifyAsymmetricSignature(ctx context.Context, timeStamp, clientKey, signature string, publicKey *rsa.PublicKey) (bool, error) {
+	decodedSignature, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return false, eris.Wrap(err, "decoding signature")
+	}
+
+	hashed := sha256.Sum256([]byte(fmt.Sprintf("%s|%s", clientKey, timeStamp)))
+
+	// Every registered client signs with its own key, the bank public keys are kept for the client id given to the
+	// configured bank. A rotated bank public key is still accepted during its grace period.
+	publicKeys := []*rsa.PublicKey{publicKey}
+	if publicKey == nil {
+		if clientKey != s.bankConfig.BankRequestedCredentials.ClientID {
+			return false, eris.Wrapf(rsa.ErrVerification, "no public key registered for client %s", clientKey)
+		}
+		publicKeys = s.keys.PublicKeys()
+	}
+
+	for _, key := range publicKeys {
+		if err = rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], decodedSignature); err == nil {
+			return true, nil
+		}
+	}
+
+	return false, eris.Wrap(err, "verifying signature")
+}
+
+func (s *MandiriSecurity) CreateSymmetricSignature(ctx context.Context, obj *biModels.SymmetricSignatureRequirement) (string, error) {
+	stringToSign, err := s.stringToSign(obj)
+	if err != nil {
+		return "", eris.Wrap(err, "building string to sign")
+	}
+
+	slog.Debug("string to sign", "data", stringToSign)
+
+	h := hmac.New(sha512.New, []byte(s.bankConfig.BankCredential.ClientSecret))
+	h.Write([]byte(stringToSign))
+
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+func (s *MandiriSecurity) VerifySymmetricSignature(ctx context.Context, obj *biModels.SymmetricSignatureRequirement, clientSecret, signature string) (bool, error) {
+	stringToSign, err := s.stringToSign(obj)
+	if err != nil {
+		return false, eris.Wrap(err, "building string to sign")
+	}
+
+	slog.Debug("string to sign", "data", stringToSign)
+
+	h := hmac.New(sha512.New, []byte(clientSecret))
+	h.Write([]byte(stringToSign))
+
+	calculatedSignature := base64.StdEncoding.EncodeToString(h.Sum(nil))
+
+	return hmac.Equal([]byte(signature), []byte(calculatedSignature)), nil
+}
+
+// Helper Functions
+
+// stringToSign returns HTTPMethod:RelativeURL:AccessToken:Lowercase(Hex(SHA256(Minify(Body)))):Timestamp
+func (s *MandiriSecurity) stringToSign(obj *biModels.SymmetricSignatureRequirement) (string, error) {
+	relativeURL, err := processRelativeURL(obj.RelativeURL)
+	if err != nil {
+		return "", eris.Wrap(err, "processing relative url")
+	}
+
+	requestBody, err := processRequestBody(obj.RequestBody)
+	if err != nil {
+		return "", eris.Wrap(err, "processing request body")
+	}
+
+	return obj.HTTPMethod + ":" + relativeURL + ":" + obj.AccessToken + ":" + requestBody + ":" + obj.Timestamp, nil
+}
+
+// processRequestBody returns a lowercase hex encoded SHA256 hash of the minified request body
+func processRequestBody(obj []byte) (string, error) {
+	var buf bytes.Buffer
+	if len(obj) > 0 {
+		if err := json.Compact(&buf, obj); err != nil {
+			return "", eris.Wrap(err, "minifying json")
+		}
+	}
+
+	hashed := sha256.Sum256(buf.Bytes())
+
+	return strings.ToLower(hex.EncodeToString(hashed[:])), nil
+}
+
+// processRelativeURL encodes the path & query according to the SNAP rules, query parameters are sorted by name and value
+func processRelativeURL(rawUrl string) (string, error) {
+	parsedURL, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", eris.Wrap(err, "parsing url")
+	}
+
+	encodedURL := encode(parsedURL.Path, "/")
+
+	queryParams, err := url.ParseQuery(parsedURL.RawQuery)
+	if err != nil {
+		return "", eris.Wrap(err, "parsing query")
+	}
+
+	var sortedParams []string
+	for name, values := range queryParams {
+		for _, value := range values {
+			sortedParams = append(sortedParams, encode(name, "")+"="+encode(value, ""))
+		}
+	}
+	sort.Strings(sortedParams)
+
+	if len(sortedParams) > 0 {
+		encodedURL += "?" + strings.Join(sortedParams, "&")
+	}
+
+	return encodedURL, nil
+}
+
+// encode percent-encodes every character except the RFC 3986 unreserved characters and the given extra characters
+func encode(value, extra string) string {
+	var encoded strings.Builder
+	for _, c := range []byte(value) {
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || strings.IndexByte(extra, c) >= 0 {
+			encoded.WriteByte(c)
+		} else {
+			encoded.WriteString(fmt.Sprintf("%%%02X", c))
+		}
+	}
+
+	return encoded.String()
+}
@@ -0,0 +1,1323 @@
+package mandiri_service
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"github.com/rotisserie/eris"
+	biConfig "github.com/voxtmault/bank-integration/config"
+	biHTTPClient "github.com/voxtmault/bank-integration/httpclient"
+	biInterfaces "github.com/voxtmault/bank-integration/interfaces"
+	biLogger "github.com/voxtmault/bank-integration/logger"
+	"github.com/voxtmault/bank-integration/mandiri"
+	biModels "github.com/voxtmault/bank-integration/models"
+	biOutbox "github.com/voxtmault/bank-integration/outbox"
+	biStorage "github.com/voxtmault/bank-integration/storage"
+	biTokens "github.com/voxtmault/bank-integration/tokens"
+	biUtil "github.com/voxtmault/bank-integration/utils"
+	watcher "github.com/voxtmault/bank-integration/watcher"
+)
+
+type MandiriService struct {
+
+	// Dependency Injection
+	Egress          biInterfaces.RequestEgress
+	Ingress         biInterfaces.RequestIngress
+	GeneralSecurity biUtil.GeneralSecurity
+
+	// Security signs and verifies the requests of Egress and Ingress, set by the factory creating the instance so
+	// that its keys can be reloaded or the security swapped while the instance is running
+	Security biInterfaces.Security
+
+	// Every bank service instance owns its Watcher, same as BCAService
+	Watcher *watcher.TransactionWatcher
+
+	// Configs
+	bankConfig     *biConfig.BankConfig
+	internalConfig *biConfig.InternalConfig
+
+	// HTTPClient sends the requests to Mandiri, shared by every bank service when created through the registry
+	HTTPClient *biHTTPClient.Client
+
+	// tokenRenewer renews the Mandiri access token, a single replica requests it at a time
+	tokenRenewer *biTokens.Renewer
+	// tokenLock guards the access token of BankRuntimeConfig, it is renewed while other requests are being signed
+	tokenLock sync.RWMutex
+
+	// closers release the resources tied to the instance on Close, see OnClose
+	closers   []func()
+	closeLock sync.Mutex
+
+	// DB Connections
+	DB  *sql.DB
+	RDB *biStorage.RedisInstance
+}
+
+var _ biInterfaces.SNAP = &MandiriService{}
+
+// NewMandiriService creates a new instance of the Mandiri service. Same as BCA, every call returns an independent
+// instance identified by the internal bank id of the given BankConfig.
+func NewMandiriService(egress biInterfaces.RequestEgress, ingress biInterfaces.RequestIngress, cfg *biConfig.InternalConfig, bCfg *biConfig.BankConfig, db *sql.DB, rdb *biStorage.RedisInstance) (*MandiriService, error) {
+
+	service := &MandiriService{
+		Egress:         egress,
+		Ingress:        ingress,
+		internalConfig: cfg,
+		bankConfig:     bCfg,
+		DB:             db,
+		RDB:            rdb,
+		Watcher:        watcher.NewTransactionWatcher(),
+	}
+
+	// Get current loaded MandiriService internal bank id and bank name
+	if err := service.getInternalBankInfo(); err != nil {
+		slog.Error("error getting internal bank id", "error", err)
+		return nil, err
+	}
+
+	service.tokenRenewer = biTokens.NewRenewer(rdb, service.accessTokenKey(), service.requestAccessToken)
+
+	// Watched transactions are shared through redis when multiple replicas serve the same bank
+	if cfg.TransactionWatcherConfig.Distributed {
+		service.Watcher = watcher.NewDistributedTransactionWatcher(db, rdb.RDB, &cfg.TransactionWatcherConfig,
+			bCfg.BankCredential.InternalBankID, bCfg.BankCredential.InternalBankName)
+		service.Watcher.Start()
+	}
+
+	// Get VA created by the loaded bank id that is still waiting for payment and add it to the watcher
+	if err := service.GetAllVAWaitingPayment(context.Background()); err != nil {
+		slog.Error("error getting all va waiting payment", "error", err)
+		service.Watcher.Stop()
+		return nil, err
+	}
+
+	if cfg.ForwardProxyConfig.ProxyAddress != "" {
+		slog.Debug("using forward proxy", "proxy", cfg.ForwardProxyConfig.ProxyAddress)
+	}
+
+	httpClient, err := biHTTPClient.New(&cfg.EgressConfig, cfg.ForwardProxyConfig.ProxyAddress)
+	if err != nil {
+		service.Watcher.Stop()
+		return nil, eris.Wrap(err, "creating http client")
+	}
+	service.HTTPClient = httpClient
+
+	return service, nil
+}
+
+func (s *MandiriService) GetWatcher() *watcher.TransactionWatcher {
+	return s.Watcher
+}
+
+// OnClose registers f to be run by Close, e.g. to stop the key reloads of the security used by the instance
+func (s *MandiriService) OnClose(f func()) {
+	s.closeLock.Lock()
+	defer s.closeLock.Unlock()
+
+	s.closers = append(s.closers, f)
+}
+
+// Close stops the transaction watcher and runs the functions registered through OnClose once, the registry calls it
+// when the instance is removed or rejected
+func (s *MandiriService) Close() error {
+	s.closeLock.Lock()
+	closers := s.closers
+	s.closers = nil
+	s.closeLock.Unlock()
+
+	s.Watcher.Stop()
+	for _, f := range closers {
+		f()
+	}
+
+	return nil
+}
+
+// Egress
+
+// GetAccessToken does not returns the token itself to the caller. It saves the token into the current instance of the service.
+// A token set in redis by another instance serving the same bank id is reused until it expires within the refresh
+// margin, only one instance requests a new one while the others wait for it.
+func (s *MandiriService) GetAccessToken(ctx context.Context) error {
+	return s.renewAccessToken(ctx, "")
+}
+
+// renewAccessToken loads a valid access token into the current instance, rejected is a token refused by Mandiri that
+// must not be used anymore
+func (s *MandiriService) renewAccessToken(ctx context.Context, rejected string) error {
+	accessToken, ttl, err := s.tokenRenewer.Renew(ctx, s.bankConfig.BankRuntimeConfig.AccessTokenRefreshMargin, rejected)
+	if err != nil {
+		slog.Debug("error renewing access token", "error", err)
+		return eris.Wrap(err, "renewing access token")
+	}
+
+	slog.Debug("loaded mandiri access token", "expires in", ttl.String())
+
+	s.tokenLock.Lock()
+	s.bankConfig.BankRuntimeConfig.AccessToken = accessToken
+	s.bankConfig.BankRuntimeConfig.ExpiresAt = time.Now().Add(ttl).Unix()
+	s.tokenLock.Unlock()
+
+	return nil
+}
+
+// accessToken returns the access token loaded into the instance and its expiry (unix seconds)
+func (s *MandiriService) accessToken() (string, int64) {
+	s.tokenLock.RLock()
+	defer s.tokenLock.RUnlock()
+
+	return s.bankConfig.BankRuntimeConfig.AccessToken, s.bankConfig.BankRuntimeConfig.ExpiresAt
+}
+
+// requestAccessToken requests a new access token to Mandiri, it is saved into redis by the token renewer
+func (s *MandiriService) requestAccessToken(ctx context.Context) (string, time.Duration, error) {
+	baseUrl := s.bankConfig.BankServiceEndpoints.BaseUrl + s.bankConfig.BankServiceEndpoints.AccessTokenURL
+	jsonBody, err := json.Marshal(biModels.GrantType{
+		GrantType: "client_credentials",
+	})
+	if err != nil {
+		return "", 0, eris.Wrap(err, "marshalling body")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, baseUrl, bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return "", 0, eris.Wrap(err, "creating request")
+	}
+
+	if err = s.Egress.GenerateAccessRequestHeader(ctx, req); err != nil {
+		slog.Debug("error generating access token request header", "error", err)
+		return "", 0, eris.Wrap(err, "access token request header")
+	}
+
+	response, err := s.RequestHandler(ctx, req)
+	if err != nil {
+		if response != "" {
+			return "", 0, eris.Wrap(eris.New(response), "sending request")
+		}
+		return "", 0, eris.Wrap(err, "sending request")
+	}
+
+	var atObj biModels.AccessTokenResponse
+	if err = json.Unmarshal([]byte(response), &atObj); err != nil {
+		return "", 0, eris.Wrap(err, "unmarshalling response")
+	}
+
+	if atObj.BCAResponse != nil && atObj.ResponseCode != mandiri.MandiriAccessTokenSuccessCode {
+		return "", 0, eris.New(atObj.ResponseMessage)
+	}
+
+	// Mandiri returns the token lifetime in seconds, fallback to the configured value if it's missing
+	expiresIn, err := strconv.Atoi(atObj.ExpiresIn)
+	if err != nil || expiresIn <= 0 {
+		expiresIn = int(s.bankConfig.AccessTokenExpirationTime)
+	}
+
+	return atObj.AccessToken, time.Second * time.Duration(expiresIn), nil
+}
+
+func (s *MandiriService) CheckAccessToken(ctx context.Context) error {
+	// The token is renewed before it expires, Mandiri would reject it in flight otherwise
+	token, expiresAt := s.accessToken()
+	renewAt := expiresAt - int64(s.bankConfig.BankRuntimeConfig.AccessTokenRefreshMargin.Seconds())
+	if token == "" || time.Now().Unix() >= renewAt {
+		slog.Debug("access token is empty or about to expire, getting a new one")
+		if err := s.GetAccessToken(ctx); err != nil {
+			return eris.Wrap(err, "getting access token")
+		}
+	}
+
+	return nil
+}
+
+func (s *MandiriService) BalanceInquiry(ctx context.Context) (*biModels.BCAAccountBalance, error) {
+
+	// Checks if the access token is empty, if yes then get a new one
+	if err := s.CheckAccessToken(ctx); err != nil {
+		return nil, eris.Wrap(err, "checking access token")
+	}
+
+	payload := biModels.BCABalanceInquiry{
+		PartnerReferenceNumber: uuid.New().String(),
+		AccountNumber:          s.bankConfig.BankCredential.SourceAccount,
+	}
+
+	if err := biUtil.ValidateStruct(ctx, payload); err != nil {
+		return nil, eris.Wrap(err, "validating payload")
+	}
+
+	response, err := s.sendRequest(ctx, s.bankConfig.BankServiceEndpoints.BalanceInquiryURL, s.bankConfig.BankChannelConfig.BusinessChannelId, payload, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var obj biModels.BCAAccountBalance
+	if err = json.Unmarshal([]byte(response), &obj); err != nil {
+		return nil, eris.Wrap(err, "unmarshalling balance inquiry response")
+	}
+
+	if obj.ResponseCode != mandiri.MandiriBalanceInquirySuccessCode {
+		return nil, eris.New(obj.ResponseMessage)
+	}
+
+	return &obj, nil
+}
+
+// GetVAPaymentStatus asks Mandiri for the payment status of the latest bill of the given virtual account
+func (s *MandiriService) GetVAPaymentStatus(ctx context.Context, vaNum string) (*biModels.VAPaymentStatusResponse, error) {
+	if vaNum == "" {
+		return nil, eris.New("empty va number")
+	}
+
+	var payload biModels.VAPaymentStatusRequest
+	statement := `
+	SELECT partnerServiceId, customerNo, virtualAccountNo, COALESCE(inquiryRequestId, '')
+	FROM va_request
+	WHERE TRIM(virtualAccountNo) = ? AND id_bank = ?
+	ORDER BY created_at DESC
+	LIMIT 1
+	`
+	if err := s.DB.QueryRowContext(ctx, statement, strings.ReplaceAll(vaNum, " ", ""), s.bankConfig.BankCredential.InternalBankID).Scan(
+		&payload.PartnerServiceId, &payload.CustomerNo, &payload.VirtualAccountNo, &payload.InquiryRequestId,
+	); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, eris.New("va number not found")
+		}
+		return nil, eris.Wrap(err, "querying va_request")
+	}
+
+	if payload.InquiryRequestId == "" {
+		return nil, eris.New("va has not been inquired by mandiri yet")
+	}
+	payload.PaymentRequestId = payload.InquiryRequestId
+	payload.AdditionalInfo = map[string]interface{}{}
+
+	if err := biUtil.ValidateStruct(ctx, payload); err != nil {
+		return nil, eris.Wrap(err, "validating object")
+	}
+
+	if err := s.CheckAccessToken(ctx); err != nil {
+		return nil, eris.Wrap(err, "checking access token")
+	}
+
+	response, err := s.sendRequest(ctx, s.bankConfig.BankServiceEndpoints.PaymentFlagURL, s.bankConfig.BankChannelConfig.VAChannelId, payload, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var obj biModels.VAPaymentStatusResponse
+	if err = json.Unmarshal([]byte(response), &obj); err != nil {
+		return nil, eris.Wrap(err, "unmarshalling va payment status response")
+	}
+
+	if obj.ResponseCode != mandiri.MandiriVAInquiryStatusSuccessCode {
+		return nil, eris.New(obj.ResponseMessage)
+	}
+
+	return &obj, nil
+}
+
+// TransferIntraBank is not offered through the Mandiri provider, it is only used as a virtual account issuer
+func (s *MandiriService) TransferIntraBank(ctx context.Context, payload *biModels.BCATransferIntraBankReq) (*biModels.BCAResponseTransferIntraBank, error) {
+	return nil, eris.New("transfer is not supported by the mandiri provider")
+}
+
+// GetTransactionStatus is not offered through the Mandiri provider, it is only used as a virtual account issuer
+func (s *MandiriService) GetTransactionStatus(ctx context.Context, payload *biModels.BCATransactionStatusInquiryRequest) (*biModels.BCATransactionStatusInquiryResponse, error) {
+	return nil, eris.New("transfer is not supported by the mandiri provider")
+}
+
+// ResolveUnknownTransfers is a no-op since the Mandiri provider never sends transfers
+func (s *MandiriService) ResolveUnknownTransfers(ctx context.Context) error {
+	return nil
+}
+
+func (s *MandiriService) CreateVA(ctx context.Context, payload *biModels.CreateVAReq) error {
+	partnerId := s.padPartnerServiceId(s.bankConfig.BankCredential.VAPrefix)
+	query := `
+	INSERT INTO va_request (partnerServiceId, customerNo, virtualAccountNo, totalAmountValue,
+							virtualAccountName, expired_date, id_bank, id_wallet)
+	VALUES(?,?,?,?,?,?,?,NULLIF(?,0))
+	`
+	expiredTime := time.Now().Add(time.Hour * time.Duration(s.bankConfig.VirtualAccountConfig.VirtualAccountLife))
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return eris.Wrap(err, "beginning transaction")
+	}
+	defer tx.Rollback()
+
+	vaNumber := partnerId + payload.CustomerNo
+	checkPaid, err := s.CheckVAPaid(ctx, tx, vaNumber)
+	if err != nil {
+		return eris.Wrap(err, "check va paid")
+	}
+
+	if !checkPaid {
+		return eris.New("previous va number has not been paid yet")
+	}
+
+	result, err := tx.ExecContext(ctx, query, partnerId, payload.CustomerNo, vaNumber, strconv.Itoa(payload.JumlahPembayaran)+".00",
+		payload.NamaUser, expiredTime.Format(time.DateTime), s.bankConfig.BankCredential.InternalBankID, payload.WalletID)
+	if err != nil {
+		return eris.Wrap(err, "inserting into va_request")
+	}
+	id, _ := result.LastInsertId()
+
+	if err = tx.Commit(); err != nil {
+		return eris.Wrap(err, "committing transaction")
+	}
+
+	watchedTransaction := watcher.NewWatcher()
+	watchedTransaction.IDTransaction = uint(id)
+	watchedTransaction.ExpireAt = expiredTime.Local()
+	watchedTransaction.IDBank = s.bankConfig.BankCredential.InternalBankID
+
+	s.Watcher.AddWatcher(watchedTransaction)
+
+	return nil
+}
+
+func (s *MandiriService) CreateVAV2(ctx context.Context, payload *biModels.CreatePaymentVARequestV2) error {
+	// Override the bank id to the current instance
+	payload.IDBank = s.bankConfig.BankCredential.InternalBankID
+
+	if err := biUtil.ValidateStruct(ctx, payload); err != nil {
+		return eris.Wrap(err, "validating payload")
+	}
+
+	// Make sure that the total billed ammount ends in .00
+	if !strings.HasSuffix(payload.TotalAmount, ".00") {
+		payload.TotalAmount += ".00"
+	}
+
+	partnerId := s.padPartnerServiceId(s.bankConfig.BankCredential.VAPrefix)
+	rule := payload.AmountRule()
+	query := `
+	INSERT INTO va_request (id_bank, id_wallet, id_transaction, expired_date, partnerServiceId, customerNo,
+							virtualAccountNo, totalAmountValue, virtualAccountName, id_order, virtualAccountTrxType,
+							minAmountValue, maxAmountValue)
+	VALUES(?,NULLIF(?,0),NULLIF(?,0),?,?,?,?,?,?,NULLIF(?,0),?,?,?)
+	`
+	expiredTime := time.Now().Add(time.Hour * time.Duration(s.bankConfig.VirtualAccountConfig.VirtualAccountLife))
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return eris.Wrap(err, "beginning transaction")
+	}
+	defer tx.Rollback()
+
+	vaNumber := partnerId + payload.CustomerNo
+	checkPaid, err := s.CheckVAPaid(ctx, tx, vaNumber)
+	if err != nil {
+		return eris.Wrap(err, "check va paid")
+	}
+
+	if !checkPaid {
+		slog.Debug("va number has not been paid yet")
+		return eris.New("previous va number has not been paid yet")
+	}
+
+	if _, err = tx.ExecContext(ctx, query, payload.IDBank, payload.IDWallet, payload.IDTransaction, expiredTime.Format(time.DateTime),
+		partnerId, payload.CustomerNo, vaNumber, payload.TotalAmount, payload.AccountName, payload.IDOrder, rule.TrxType,
+		rule.Min, rule.Max); err != nil {
+		return eris.Wrap(err, "inserting into va_request")
+	}
+
+	if err = tx.Commit(); err != nil {
+		return eris.Wrap(err, "committing transaction")
+	}
+
+	// Create Transaction Watcher after successfull transaction commit
+	watchedTransaction := watcher.NewWatcher()
+	watchedTransaction.IDTransaction = payload.IDTransaction
+	watchedTransaction.ExpireAt = expiredTime.Local()
+	watchedTransaction.ExternalChannel = payload.ExternalChannel
+	watchedTransaction.IDBank = payload.IDBank
+
+	s.Watcher.AddWatcher(watchedTransaction)
+
+	return nil
+}
+
+// CancelVA cancels the pending VA Payment Request of the transaction, same as BCAService.CancelVA
+func (s *MandiriService) CancelVA(ctx context.Context, idTransaction uint) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return eris.Wrap(err, "beginning transaction")
+	}
+	defer tx.Rollback()
+
+	event := biModels.PaymentEvent{
+		IDBank:        s.bankConfig.BankCredential.InternalBankID,
+		EventType:     biUtil.PaymentEventVACancelled,
+		IDTransaction: idTransaction,
+	}
+	statement := `
+	SELECT id, TRIM(virtualAccountNo), COALESCE(inquiryRequestId, ''), paidAmountValue, paidAmountCurrency,
+		   totalAmountValue, totalAmountCurrency
+	FROM va_request
+	WHERE id_transaction = ? AND id_bank = ? AND id_va_status = ?
+	ORDER BY created_at DESC
+	LIMIT 1
+	FOR UPDATE
+	`
+	if err = tx.QueryRowContext(ctx, statement, idTransaction, event.IDBank, biUtil.VAStatusPending).Scan(
+		&event.IDVARequest, &event.VirtualAccountNo, &event.PaymentRequestID, &event.PaidAmount.Value,
+		&event.PaidAmount.Currency, &event.TotalAmount.Value, &event.TotalAmount.Currency,
+	); err != nil {
+		if err == sql.ErrNoRows {
+			return eris.New("no va waiting for payment found")
+		}
+		return eris.Wrap(err, "querying va_request")
+	}
+
+	statement = `
+	UPDATE va_request SET id_va_status = ?
+	WHERE id = ?
+	`
+	if _, err = tx.ExecContext(ctx, statement, biUtil.VAStatusCancelled, event.IDVARequest); err != nil {
+		return eris.Wrap(err, "updating va_request")
+	}
+
+	if err = biOutbox.Record(ctx, tx, &event); err != nil {
+		return eris.Wrap(err, "recording payment event")
+	}
+
+	if err = tx.Commit(); err != nil {
+		return eris.Wrap(err, "committing transaction")
+	}
+
+	// Stops the watcher, notifies the external channel and logs the cancellation
+	s.Watcher.TransactionCancelled(idTransaction)
+
+	return nil
+}
+
+// Ingress
+
+// GenerateAccessToken is called by Mandiri to generate access tokens used for the VA callbacks
+func (s *MandiriService) GenerateAccessToken(ctx context.Context, request *http.Request) (*biModels.AccessTokenResponse, error) {
+	return biLogger.Ingress(ctx, request, s.generateAccessToken)
+}
+
+func (s *MandiriService) generateAccessToken(ctx context.Context, request *http.Request) (*biModels.AccessTokenResponse, error) {
+	bodyBytes, err := io.ReadAll(request.Body)
+	if err != nil {
+		return &biModels.AccessTokenResponse{BCAResponse: &mandiri.MandiriAuthGeneralError}, eris.Wrap(err, "reading request body")
+	}
+	defer request.Body.Close()
+
+	var body biModels.GrantType
+	if err := json.Unmarshal(bodyBytes, &body); err != nil {
+		slog.Debug("failed to decode request body", "reason", err)
+		return &biModels.AccessTokenResponse{BCAResponse: &mandiri.MandiriAuthGeneralError}, eris.Wrap(err, "decoding request body")
+	}
+
+	if err := biUtil.ValidateStruct(ctx, body); err != nil {
+		slog.Debug("error validating request body", "error", err)
+		return &biModels.AccessTokenResponse{BCAResponse: &mandiri.MandiriAuthInvalidFieldFormatClient}, nil
+	}
+
+	result, authResponse, clientSecret := s.Ingress.VerifyAsymmetricSignature(ctx, request, s.RDB)
+	if authResponse != nil {
+		return &biModels.AccessTokenResponse{BCAResponse: authResponse}, nil
+	}
+
+	if !result {
+		return &biModels.AccessTokenResponse{BCAResponse: &mandiri.MandiriAuthUnauthorizedSignature}, nil
+	}
+
+	token, err := s.GeneralSecurity.GenerateAccessToken(ctx)
+	if err != nil {
+		slog.Debug("error generating access token", "reason", err)
+		return &biModels.AccessTokenResponse{BCAResponse: &mandiri.MandiriAuthGeneralError}, eris.Wrap(err, "generating access token")
+	}
+
+	// Save the access token to redis along with the client it is issued to & expiration time
+	if _, err := biTokens.NewStore(s.RDB).Issue(ctx, token, request.Header.Get("X-CLIENT-KEY"), clientSecret, biUtil.AccessTokenScopeVA,
+		time.Second*time.Duration(s.bankConfig.BankRequestedCredentials.AccessTokenExpireTime)); err != nil {
+		slog.Debug("error saving access token to redis", "reason", err)
+		return &biModels.AccessTokenResponse{BCAResponse: &mandiri.MandiriAuthGeneralError}, eris.Wrap(err, "saving access token to redis")
+	}
+
+	success := mandiri.MandiriAuthResponseSuccess
+
+	return &biModels.AccessTokenResponse{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   strconv.Itoa(int(s.bankConfig.BankRequestedCredentials.AccessTokenExpireTime)),
+		BCAResponse: &success,
+	}, nil
+}
+
+// BillPresentment is called by Mandiri when a customer inquires a virtual account
+func (s *MandiriService) BillPresentment(ctx context.Context, request *http.Request) (*biModels.VAResponsePayload, error) {
+	return biLogger.Ingress(ctx, request, s.billPresentment)
+}
+
+func (s *MandiriService) billPresentment(ctx context.Context, request *http.Request) (*biModels.VAResponsePayload, error) {
+	var response biModels.VAResponsePayload
+
+	if errResponse := s.verifyCallbackHeader(request, mandiri.MandiriBillInquiryResponseMissingMandatoryField, mandiri.MandiriBillInquiryResponseUnauthorizedUnknownClient); errResponse != nil {
+		response.BCAResponse = *errResponse
+		return &response, nil
+	}
+
+	bodyBytes, err := io.ReadAll(request.Body)
+	if err != nil {
+		slog.Debug("error reading request body", "error", err)
+		response.BCAResponse = mandiri.MandiriBillInquiryResponseRequestParseError
+		return &response, nil
+	}
+	defer request.Body.Close()
+
+	var payload biModels.BCAVARequestPayload
+	if err := json.Unmarshal(bodyBytes, &payload); err != nil {
+		slog.Debug("error un-marshaling request body", "error", err)
+		response.BCAResponse = mandiri.MandiriBillInquiryResponseRequestParseError
+		return &response, nil
+	}
+
+	response.VirtualAccountData = biModels.VABCAResponseData{}.Default()
+	response.VirtualAccountData.InquiryStatus = "01"
+	response.VirtualAccountData.PartnerServiceID = payload.PartnerServiceID
+	response.VirtualAccountData.CustomerNo = payload.CustomerNo
+	response.VirtualAccountData.VirtualAccountNo = payload.VirtualAccountNo
+	response.VirtualAccountData.InquiryRequestID = payload.InquiryRequestID
+
+	if err := biUtil.ValidateStruct(ctx, payload); err != nil {
+		field, missing := validationErrorField(err)
+		if missing {
+			response.BCAResponse = mandiri.MandiriBillInquiryResponseMissingMandatoryField
+			response.BCAResponse.ResponseMessage = "Invalid Mandatory Field {" + field + "}"
+			response.VirtualAccountData.InquiryReason.English = "Invalid Mandatory Field {" + field + "}"
+			response.VirtualAccountData.InquiryReason.Indonesia = "Field Wajib Tidak Valid {" + field + "}"
+		} else {
+			response.BCAResponse = mandiri.MandiriBillInquiryResponseInvalidFieldFormat
+			response.BCAResponse.ResponseMessage = "Invalid Field Format {" + field + "}"
+			response.VirtualAccountData.InquiryReason.English = "Invalid Field Format {" + field + "}"
+			response.VirtualAccountData.InquiryReason.Indonesia = "Format Field Tidak Valid {" + field + "}"
+		}
+
+		return &response, nil
+	}
+
+	result, authResponse := s.Ingress.VerifySymmetricSignature(ctx, request, s.RDB, bodyBytes)
+	if authResponse != nil {
+		slog.Debug("verifying symmetric signature failed", "response", authResponse)
+
+		response.BCAResponse = *authResponse
+		response.BCAResponse.ResponseCode = response.BCAResponse.ResponseCode[:3] + mandiri.MandiriServiceBillInquiry + response.BCAResponse.ResponseCode[5:]
+		response.VirtualAccountData = nil
+
+		return &response, nil
+	}
+
+	if !result {
+		response.BCAResponse = mandiri.MandiriBillInquiryResponseUnauthorizedSignature
+		response.VirtualAccountData = nil
+
+		return &response, nil
+	}
+
+	externalUnique, storedResponse, err := s.Ingress.ValidateUniqueExternalID(ctx, s.RDB, request, s.bankConfig.IngressConfig.ExternalIDTTL)
+	if err != nil {
+		slog.Debug("error validating externalId", "error", err)
+
+		if eris.Cause(err).Error() == "invalid field format" {
+			response.BCAResponse = mandiri.MandiriBillInquiryResponseInvalidFieldFormat
+			response.BCAResponse.ResponseMessage = "Invalid Field Format [X-EXTERNAL-ID]"
+		} else {
+			response.BCAResponse = mandiri.MandiriBillInquiryResponseGeneralError
+		}
+
+		return &response, nil
+	}
+
+	if !externalUnique {
+		slog.Debug("externalId is not unique")
+
+		// The conflict is answered with the data returned to the request that used the external id first
+		var stored biModels.VAResponsePayload
+		if json.Unmarshal(storedResponse, &stored) == nil && stored.VirtualAccountData != nil {
+			response.VirtualAccountData = stored.VirtualAccountData
+		}
+
+		response.BCAResponse = mandiri.MandiriBillInquiryResponseDuplicateExternalID
+		response.VirtualAccountData.InquiryStatus = "01"
+		response.VirtualAccountData.InquiryReason.English = "Cannot use the same X-EXTERNAL-ID"
+		response.VirtualAccountData.InquiryReason.Indonesia = "Tidak bisa menggunakan X-EXTERNAL-ID yang sama"
+
+		return &response, nil
+	}
+
+	response.VirtualAccountData.SubCompany = "00000"
+	response.VirtualAccountData.VirtualAccountTrxType = "C"
+
+	if err = s.BillPresentmentCore(ctx, &response, &payload); err != nil {
+		slog.Error("error in BillPresentmentCore", "error", err)
+	}
+
+	s.saveExternalIDResponse(ctx, request, &response)
+
+	return &response, nil
+}
+
+func (s *MandiriService) BillPresentmentCore(ctx context.Context, response *biModels.VAResponsePayload, payload *biModels.BCAVARequestPayload) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		response.BCAResponse = mandiri.MandiriBillInquiryResponseGeneralError
+		return eris.Wrap(err, "beginning transaction")
+	}
+	defer tx.Rollback()
+
+	var paidAmount biModels.Amount
+	var expDate string
+	var vaStatus biUtil.VAPaymentStatus
+	var rule biUtil.VAAmountRule
+	statement := `
+	SELECT partnerServiceId, customerNo, virtualAccountNo, virtualAccountName, totalAmountValue, totalAmountCurrency,
+		   paidAmountValue, paidAmountCurrency, COALESCE(expired_date, CURRENT_TIMESTAMP()) AS effective_expired_date,
+		   id_va_status, virtualAccountTrxType, minAmountValue, maxAmountValue, cumulativePaymentAmountValue
+	FROM va_request
+	WHERE TRIM(virtualAccountNo) = ? AND id_bank = ?
+	ORDER BY created_at DESC
+	LIMIT 1
+	`
+	err = tx.QueryRowContext(ctx, statement, strings.ReplaceAll(payload.VirtualAccountNo, " ", ""), s.bankConfig.BankCredential.InternalBankID).Scan(
+		&response.VirtualAccountData.PartnerServiceID,
+		&response.VirtualAccountData.CustomerNo,
+		&response.VirtualAccountData.VirtualAccountNo,
+		&response.VirtualAccountData.VirtualAccountName,
+		&response.VirtualAccountData.TotalAmount.Value,
+		&response.VirtualAccountData.TotalAmount.Currency,
+		&paidAmount.Value,
+		&paidAmount.Currency,
+		&expDate,
+		&vaStatus,
+		&rule.TrxType, &rule.Min, &rule.Max, &rule.Cumulative,
+	)
+	if err == sql.ErrNoRows {
+		response.BCAResponse = mandiri.MandiriBillInquiryResponseVANotFound
+		response.VirtualAccountData.InquiryReason.English = "Bill Not Found"
+		response.VirtualAccountData.InquiryReason.Indonesia = "Tagihan tidak ditemukan"
+
+		return nil
+	} else if err != nil {
+		response.BCAResponse = mandiri.MandiriBillInquiryResponseGeneralError
+		return eris.Wrap(err, "querying va_request")
+	}
+
+	if paidAmount.Value != "0.00" && paidAmount.Value != "" {
+		response.BCAResponse = mandiri.MandiriBillInquiryResponseVAPaid
+		response.VirtualAccountData.InquiryReason.English = "Paid Bill"
+		response.VirtualAccountData.InquiryReason.Indonesia = "Tagihan Telah Terbayar"
+
+		return nil
+	}
+
+	if vaStatus == biUtil.VAStatusCancelled {
+		response.BCAResponse = mandiri.MandiriBillInquiryResponseVAExpired
+		response.VirtualAccountData.InquiryReason.English = "Bill Cancelled"
+		response.VirtualAccountData.InquiryReason.Indonesia = "Tagihan telah dibatalkan"
+
+		return nil
+	}
+
+	nExpDate, _ := time.ParseInLocation(time.DateTime, expDate, time.Local)
+	if time.Now().After(nExpDate) {
+		response.BCAResponse = mandiri.MandiriBillInquiryResponseVAExpired
+		response.VirtualAccountData.InquiryReason.English = "Bill Expired"
+		response.VirtualAccountData.InquiryReason.Indonesia = "Tagihan sudah kadaluarsa"
+
+		return nil
+	}
+
+	statement = `
+	UPDATE va_request SET inquiryRequestId = ?
+	WHERE TRIM(virtualAccountNo) = ? AND paidAmountValue = '0.00' AND id_va_status = ? AND id_bank = ?
+	`
+	if _, err = tx.ExecContext(ctx, statement, payload.InquiryRequestID, strings.ReplaceAll(payload.VirtualAccountNo, " ", ""),
+		biUtil.VAStatusPending, s.bankConfig.BankCredential.InternalBankID); err != nil {
+		response.BCAResponse = mandiri.MandiriBillInquiryResponseGeneralError
+		return eris.Wrap(err, "updating va_request")
+	}
+
+	if err = tx.Commit(); err != nil {
+		response.BCAResponse = mandiri.MandiriBillInquiryResponseGeneralError
+		return eris.Wrap(err, "committing transaction")
+	}
+
+	// Advertise the amount matching the VA type, same as BCA
+	rule.Total = response.VirtualAccountData.TotalAmount.Value
+	response.VirtualAccountData.VirtualAccountTrxType = string(rule.TrxType)
+	response.VirtualAccountData.TotalAmount.Value = rule.AdvertisedAmount()
+
+	response.BCAResponse = mandiri.MandiriBillInquiryResponseSuccess
+	response.VirtualAccountData.InquiryStatus = "00"
+	response.VirtualAccountData.InquiryReason.English = "Success"
+	response.VirtualAccountData.InquiryReason.Indonesia = "Sukses"
+
+	return nil
+}
+
+// InquiryVA is called by Mandiri to flag a virtual account as paid
+func (s *MandiriService) InquiryVA(ctx context.Context, request *http.Request) (*biModels.BCAInquiryVAResponse, error) {
+	return biLogger.Ingress(ctx, request, s.inquiryVA)
+}
+
+func (s *MandiriService) inquiryVA(ctx context.Context, request *http.Request) (*biModels.BCAInquiryVAResponse, error) {
+	var response biModels.BCAInquiryVAResponse
+
+	if errResponse := s.verifyCallbackHeader(request, mandiri.MandiriPaymentFlagResponseMissingMandatoryField, mandiri.MandiriPaymentFlagResponseUnauthorizedUnknownClient); errResponse != nil {
+		response.BCAResponse = *errResponse
+		return &response, nil
+	}
+
+	bodyBytes, err := io.ReadAll(request.Body)
+	if err != nil {
+		slog.Debug("error reading request body", "error", err)
+		response.BCAResponse = mandiri.MandiriPaymentFlagResponseRequestParseError
+		return &response, nil
+	}
+	defer request.Body.Close()
+
+	var payload biModels.BCAInquiryRequest
+	if err := json.Unmarshal(bodyBytes, &payload); err != nil {
+		slog.Debug("error un-marshaling request body", "error", err)
+		response.BCAResponse = mandiri.MandiriPaymentFlagResponseRequestParseError
+		return &response, nil
+	}
+
+	response.AdditionalInfo = payload.AdditionalInfo
+	response.VirtualAccountData = &biModels.VirtualAccountDataInquiry{
+		BillDetails:         payload.BillDetails,
+		FreeTexts:           payload.FreeTexts,
+		PaymentRequestID:    payload.PaymentRequestID,
+		ReferenceNo:         payload.ReferenceNo,
+		CustomerNo:          payload.CustomerNo,
+		VirtualAccountNo:    payload.VirtualAccountNo,
+		VirtualAccountName:  payload.VirtualAccountName,
+		VirtualAccountEmail: payload.VirtualAccountEmail,
+		VirtualAccountPhone: payload.VirtualAccountPhone,
+		TrxID:               payload.TrxID,
+		TrxDateTime:         payload.TrxDateTime,
+		PartnerServiceID:    payload.PartnerServiceID,
+		FlagAdvise:          "N",
+		PaymentFlagStatus:   "01", // Default to failure
+	}
+
+	if err := biUtil.ValidateStruct(ctx, payload); err != nil {
+		field, missing := validationErrorField(err)
+		if missing {
+			response.BCAResponse = mandiri.MandiriPaymentFlagResponseMissingMandatoryField
+			response.BCAResponse.ResponseMessage = "Invalid Mandatory Field {" + field + "}"
+			response.VirtualAccountData.PaymentFlagReason.English = "Invalid Mandatory Field {" + field + "}"
+			response.VirtualAccountData.PaymentFlagReason.Indonesia = "Field Wajib Tidak Valid {" + field + "}"
+		} else {
+			response.BCAResponse = mandiri.MandiriPaymentFlagResponseInvalidFieldFormat
+			response.BCAResponse.ResponseMessage = "Invalid Field Format {" + field + "}"
+			response.VirtualAccountData.PaymentFlagReason.English = "Invalid Field Format {" + field + "}"
+			response.VirtualAccountData.PaymentFlagReason.Indonesia = "Format Field Tidak Valid {" + field + "}"
+		}
+
+		return &response, nil
+	}
+
+	result, authResponse := s.Ingress.VerifySymmetricSignature(ctx, request, s.RDB, bodyBytes)
+	if authResponse != nil {
+		slog.Debug("verifying symmetric signature failed", "response", authResponse)
+
+		response.BCAResponse = *authResponse
+		response.BCAResponse.ResponseCode = response.BCAResponse.ResponseCode[:3] + mandiri.MandiriServicePaymentFlag + response.BCAResponse.ResponseCode[5:]
+		response.VirtualAccountData = nil
+
+		return &response, nil
+	}
+
+	if !result {
+		response.BCAResponse = mandiri.MandiriPaymentFlagResponseUnauthorizedSignature
+		response.VirtualAccountData = nil
+
+		return &response, nil
+	}
+
+	externalUnique, storedResponse, err := s.Ingress.ValidateUniqueExternalID(ctx, s.RDB, request, s.bankConfig.IngressConfig.ExternalIDTTL)
+	if err != nil {
+		slog.Debug("error validating externalId", "error", err)
+
+		if eris.Cause(err).Error() == "invalid field format" {
+			response.BCAResponse = mandiri.MandiriPaymentFlagResponseInvalidFieldFormat
+			response.BCAResponse.ResponseMessage = "Invalid Field Format [X-EXTERNAL-ID]"
+		} else {
+			response.BCAResponse = mandiri.MandiriPaymentFlagResponseGeneralError
+		}
+
+		return &response, nil
+	}
+
+	if !externalUnique {
+		slog.Debug("externalId is not unique")
+
+		// The conflict is answered with the data returned to the request that used the external id first
+		var stored biModels.BCAInquiryVAResponse
+		if json.Unmarshal(storedResponse, &stored) == nil && stored.VirtualAccountData != nil {
+			response.VirtualAccountData = stored.VirtualAccountData
+			response.AdditionalInfo = stored.AdditionalInfo
+		}
+
+		response.BCAResponse = mandiri.MandiriPaymentFlagResponseDuplicateExternalID
+		response.VirtualAccountData.PaymentFlagStatus = "01"
+		response.VirtualAccountData.PaymentFlagReason.English = "Cannot use the same X-EXTERNAL-ID"
+		response.VirtualAccountData.PaymentFlagReason.Indonesia = "Tidak bisa menggunakan X-EXTERNAL-ID yang sama"
+
+		return &response, nil
+	}
+
+	if err = s.InquiryVACore(ctx, &response, &payload); err != nil {
+		slog.Error("error in InquiryVACore", "error", err)
+	}
+
+	s.saveExternalIDResponse(ctx, request, &response)
+
+	return &response, nil
+}
+
+func (s *MandiriService) InquiryVACore(ctx context.Context, response *biModels.BCAInquiryVAResponse, payload *biModels.BCAInquiryRequest) error {
+	response.VirtualAccountData.PaidAmount = payload.PaidAmount
+	response.VirtualAccountData.TotalAmount = payload.TotalAmount
+
+	// The total amount of an open VA is 0, only the paid amount is mandatory
+	if payload.PaidAmount.Value == "" || payload.PaidAmount.Value == "0.00" {
+		response.BCAResponse = mandiri.MandiriPaymentFlagResponseInvalidAmount
+		response.VirtualAccountData.PaymentFlagReason.English = "Invalid Amount at Paid Amount or Total Amount"
+		response.VirtualAccountData.PaymentFlagReason.Indonesia = "Jumlah Tidak Valid pada Jumlah Bayar atau Jumlah Total"
+
+		return nil
+	}
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		response.BCAResponse = mandiri.MandiriPaymentFlagResponseGeneralError
+		return eris.Wrap(err, "beginning transaction")
+	}
+	defer tx.Rollback()
+
+	var paidAmount, totalAmount biModels.Amount
+	var expDate string
+	var idVARequest, idTransaction uint
+	var vaStatus biUtil.VAPaymentStatus
+	var rule biUtil.VAAmountRule
+	statement := `
+	SELECT paidAmountValue, paidAmountCurrency, totalAmountValue, totalAmountCurrency, virtualAccountName,
+		   COALESCE(expired_date, CURRENT_TIMESTAMP()) AS effective_expired_date, COALESCE(id_transaction, 0), id,
+		   id_va_status, virtualAccountTrxType, minAmountValue, maxAmountValue, cumulativePaymentAmountValue
+	FROM va_request
+	WHERE inquiryRequestId = ? AND TRIM(virtualAccountNo) = ? AND id_bank = ?
+	LIMIT 1
+	FOR UPDATE
+	`
+	err = tx.QueryRowContext(ctx, statement, payload.PaymentRequestID, strings.ReplaceAll(payload.VirtualAccountNo, " ", ""), s.bankConfig.BankCredential.InternalBankID).Scan(
+		&paidAmount.Value, &paidAmount.Currency, &totalAmount.Value, &totalAmount.Currency,
+		&response.VirtualAccountData.VirtualAccountName, &expDate, &idTransaction, &idVARequest, &vaStatus,
+		&rule.TrxType, &rule.Min, &rule.Max, &rule.Cumulative,
+	)
+	if err == sql.ErrNoRows {
+		response.BCAResponse = mandiri.MandiriPaymentFlagResponseVANotFound
+		response.VirtualAccountData.PaymentFlagReason.English = "Bill Not Found"
+		response.VirtualAccountData.PaymentFlagReason.Indonesia = "Tagihan Tidak Ditemukan"
+
+		return nil
+	} else if err != nil {
+		response.BCAResponse = mandiri.MandiriPaymentFlagResponseGeneralError
+		return eris.Wrap(err, "querying va_request")
+	}
+
+	if paidAmount.Value != "" && paidAmount.Value != "0.00" {
+		response.BCAResponse = mandiri.MandiriPaymentFlagResponseVAPaid
+		response.VirtualAccountData.PaymentFlagReason.English = "Bill has been paid"
+		response.VirtualAccountData.PaymentFlagReason.Indonesia = "Tagihan Telah Terbayar"
+
+		return nil
+	}
+
+	if vaStatus == biUtil.VAStatusCancelled {
+		response.BCAResponse = mandiri.MandiriPaymentFlagResponseVAExpired
+		response.VirtualAccountData.PaymentFlagReason.English = "Bill has been cancelled"
+		response.VirtualAccountData.PaymentFlagReason.Indonesia = "Tagihan telah dibatalkan"
+
+		return nil
+	}
+
+	nExpDate, _ := time.ParseInLocation(time.DateTime, expDate, time.Local)
+	if time.Now().After(nExpDate) {
+		response.BCAResponse = mandiri.MandiriPaymentFlagResponseVAExpired
+		response.VirtualAccountData.PaymentFlagReason.English = "Bill has been expired"
+		response.VirtualAccountData.PaymentFlagReason.Indonesia = "Tagihan sudah kadaluarsa"
+
+		return nil
+	}
+
+	var reportedCumulative string
+	if payload.CumulativePaymentAmount != nil {
+		reportedCumulative = payload.CumulativePaymentAmount.Value
+	}
+	rule.Total = totalAmount.Value
+	cumulative, settled, err := rule.Apply(payload.PaidAmount.Value, reportedCumulative)
+	if err != nil {
+		slog.Debug("paid amount is not accepted", "trx type", rule.TrxType, "error", err)
+		response.BCAResponse = mandiri.MandiriPaymentFlagResponseInvalidAmount
+		response.VirtualAccountData.PaymentFlagReason.English = "Invalid Amount"
+		response.VirtualAccountData.PaymentFlagReason.Indonesia = "Jumlah yang dibayarkan tidak sesuai"
+
+		return nil
+	}
+
+	// An installment only moves the cumulative amount, the VA keeps waiting for payment until it is settled
+	paidValue, status, eventType := "0.00", biUtil.VAStatusPending, biUtil.PaymentEventVAInstallment
+	if settled {
+		paidValue, status, eventType = cumulative, biUtil.VAStatusPaid, biUtil.PaymentEventVAPaid
+	}
+
+	statement = `
+	UPDATE va_request SET paidAmountValue = ?, paidAmountCurrency = ?, cumulativePaymentAmountValue = ?, id_va_status = ?
+	WHERE inquiryRequestId = ? AND id_bank = ?
+	`
+	if _, err = tx.ExecContext(ctx, statement, paidValue, payload.PaidAmount.Currency, cumulative, status,
+		payload.PaymentRequestID, s.bankConfig.BankCredential.InternalBankID); err != nil {
+		response.BCAResponse = mandiri.MandiriPaymentFlagResponseGeneralError
+		return eris.Wrap(err, "updating va_request")
+	}
+
+	// Written in the same transaction as the va_request update, delivered by the payment event dispatcher
+	if err = biOutbox.Record(ctx, tx, &biModels.PaymentEvent{
+		IDBank:           s.bankConfig.BankCredential.InternalBankID,
+		EventType:        eventType,
+		IDVARequest:      idVARequest,
+		IDTransaction:    idTransaction,
+		VirtualAccountNo: strings.ReplaceAll(payload.VirtualAccountNo, " ", ""),
+		PaymentRequestID: payload.PaymentRequestID,
+		PaidAmount:       payload.PaidAmount,
+		TotalAmount:      totalAmount,
+	}); err != nil {
+		response.BCAResponse = mandiri.MandiriPaymentFlagResponseGeneralError
+		return eris.Wrap(err, "recording payment event")
+	}
+
+	if err = tx.Commit(); err != nil {
+		response.BCAResponse = mandiri.MandiriPaymentFlagResponseGeneralError
+		return eris.Wrap(err, "committing transaction")
+	}
+
+	response.BCAResponse = mandiri.MandiriPaymentFlagResponseSuccess
+	response.VirtualAccountData.PaymentFlagStatus = "00"
+	response.VirtualAccountData.PaymentFlagReason.English = "Success"
+	response.VirtualAccountData.PaymentFlagReason.Indonesia = "Sukses"
+
+	if !settled {
+		slog.Info("installment received", "idTransaction", idTransaction, "cumulative", cumulative)
+		return nil
+	}
+
+	// Update the watcher
+	slog.Debug("updating transaction watcher", "idTransaction", idTransaction)
+	s.Watcher.TransactionPaid(idTransaction)
+
+	return nil
+}
+
+// Transaction Watcher
+func (s *MandiriService) GetWatchedTransaction(ctx context.Context) []*biModels.TransactionWatcherPublic {
+	return s.Watcher.GetWatchers()
+}
+
+func (s *MandiriService) GetAllVAWaitingPayment(ctx context.Context) error {
+	query := `
+	SELECT id_transaction, expired_date
+	FROM va_request
+	WHERE id_va_status = ? AND id_bank = ?
+	`
+	rows, err := s.DB.QueryContext(ctx, query, biUtil.VAStatusPending, s.bankConfig.BankCredential.InternalBankID)
+	if err != nil {
+		return eris.Wrap(err, "querying va_request")
+	}
+	defer rows.Close()
+
+	loc, _ := time.LoadLocation(os.Getenv("TZ"))
+	for rows.Next() {
+		obj := watcher.NewWatcher()
+		expireAt := ""
+		if err = rows.Scan(&obj.IDTransaction, &expireAt); err != nil {
+			return eris.Wrap(err, "scan va_table")
+		}
+		obj.ExpireAt, err = time.ParseInLocation(time.DateTime, expireAt, loc)
+		if err != nil {
+			slog.Error("skipping transaction due to parsing time error", "error", err, "transaction id", obj.IDTransaction)
+			continue
+		}
+		obj.IDBank = s.bankConfig.BankCredential.InternalBankID
+		obj.BankName = s.bankConfig.BankCredential.InternalBankName
+
+		s.Watcher.AddWatcher(obj)
+	}
+
+	return rows.Err()
+}
+
+// Service Utils
+
+// saveExternalIDResponse stores the response returned to the request that reserved its X-EXTERNAL-ID, duplicates
+// of the external id are answered from it
+func (s *MandiriService) saveExternalIDResponse(ctx context.Context, request *http.Request, response any) {
+	content, err := json.Marshal(response)
+	if err != nil {
+		slog.Error("error marshalling response", "error", err)
+		return
+	}
+
+	if err := s.Ingress.SaveExternalIDResponse(ctx, s.RDB, request, content); err != nil {
+		slog.Error("error saving external id response", "error", err)
+	}
+}
+
+// RequestHandler sends the request once, it is used for the requests that must not be sent twice. ErrCircuitOpen
+// of the http client is returned right away while Mandiri keeps failing.
+func (s *MandiriService) RequestHandler(ctx context.Context, request *http.Request) (string, error) {
+	return s.handleRequest(ctx, request, false)
+}
+
+// IdempotentRequestHandler is RequestHandler for the read only requests (balance, status), they are retried on
+// transient failures
+func (s *MandiriService) IdempotentRequestHandler(ctx context.Context, request *http.Request) (string, error) {
+	return s.handleRequest(ctx, request, true)
+}
+
+func (s *MandiriService) handleRequest(ctx context.Context, request *http.Request, idempotent bool) (string, error) {
+	// The exchange is logged into bank_egress in the background
+	response, body, err := s.HTTPClient.Do(request, idempotent)
+	if err != nil {
+		return "", eris.Wrap(err, "sending request")
+	}
+
+	// A token rejected before its expiry is renewed and the request sent once more, Mandiri has not processed it
+	if isTokenRejected(request, response, body) {
+		slog.Debug("access token rejected, renewing it", "url", request.URL.String())
+
+		if err := s.resignRequest(ctx, request); err != nil {
+			return "", eris.Wrap(err, "renewing rejected access token")
+		}
+
+		response, body, err = s.HTTPClient.Do(request, idempotent)
+		if err != nil {
+			return "", eris.Wrap(err, "sending request")
+		}
+	}
+
+	slog.Debug("response", "status", response.StatusCode, "response", string(body))
+
+	if response.StatusCode != http.StatusOK {
+		var obj biModels.BCAResponse
+		if err := json.Unmarshal(body, &obj); err != nil {
+			return "", eris.Wrap(err, "unmarshalling error response")
+		}
+
+		obj.HTTPStatusCode = response.StatusCode
+
+		errResponse, err := json.Marshal(obj)
+		if err != nil {
+			return "", eris.Wrap(err, "marshalling error response")
+		}
+
+		return string(errResponse), eris.New("non-200 status code")
+	}
+
+	return string(body), nil
+}
+
+// resignRequest renews the access token rejected by Mandiri and signs the request again with the new one
+func (s *MandiriService) resignRequest(ctx context.Context, request *http.Request) error {
+	if err := s.renewAccessToken(ctx, biUtil.BearerToken(request)); err != nil {
+		return err
+	}
+
+	if request.GetBody != nil {
+		body, err := request.GetBody()
+		if err != nil {
+			return eris.Wrap(err, "rewinding request body")
+		}
+		request.Body = body
+	}
+
+	relativeURL := strings.TrimPrefix(request.URL.String(), s.bankConfig.BankServiceEndpoints.BaseUrl)
+	token, _ := s.accessToken()
+	if err := s.Egress.GenerateGeneralRequestHeader(ctx, request, relativeURL, token); err != nil {
+		return eris.Wrap(err, "constructing request header")
+	}
+
+	return nil
+}
+
+// isTokenRejected reports whether the response rejects the access token the request was sent with
+func isTokenRejected(request *http.Request, response *http.Response, body []byte) bool {
+	if response.StatusCode != http.StatusUnauthorized || biUtil.BearerToken(request) == "" {
+		return false
+	}
+
+	var obj biModels.BCAResponse
+	if err := json.Unmarshal(body, &obj); err != nil {
+		return false
+	}
+
+	return biUtil.IsInvalidTokenResponse(obj.ResponseCode)
+}
+
+// CheckVAPaid checks the DB for VA Payment Request under the VA Number. If no active request is found then
+// return true, else return false.
+func (s *MandiriService) CheckVAPaid(ctx context.Context, tx *sql.Tx, virtualAccountNum string) (bool, error) {
+	query := `
+	SELECT expired_date
+	FROM va_request
+	WHERE TRIM(virtualAccountNo) = ? AND paidAmountValue = '0.00' AND id_va_status = ?
+	`
+	var expDate string
+	if err := tx.QueryRowContext(ctx, query, strings.ReplaceAll(virtualAccountNum, " ", ""), biUtil.VAStatusPending).Scan(&expDate); err != nil {
+		if err == sql.ErrNoRows {
+			return true, nil
+		}
+		return false, eris.Wrap(err, "querying va_request")
+	}
+
+	// Counter measure when Transaction Watcher fails to update the status of the transaction for some reason
+	nExp, err := time.ParseInLocation(time.DateTime, expDate, time.Local)
+	if err != nil {
+		return false, eris.Wrap(err, "parsing expire date time")
+	}
+
+	return time.Now().After(nExp), nil
+}
+
+// sendRequest signs and sends a POST request to the given Mandiri endpoint, returning the raw response body. Only
+// idempotent requests are retried.
+func (s *MandiriService) sendRequest(ctx context.Context, relativeURL, channelID string, payload interface{}, idempotent bool) (string, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return "", eris.Wrap(err, "marshalling payload")
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, s.bankConfig.BankServiceEndpoints.BaseUrl+relativeURL, bytes.NewBuffer(body))
+	if err != nil {
+		return "", eris.Wrap(err, "creating request")
+	}
+
+	token, _ := s.accessToken()
+	if err = s.Egress.GenerateGeneralRequestHeader(ctx, request, relativeURL, token); err != nil {
+		return "", eris.Wrap(err, "constructing request header")
+	}
+
+	request.Header.Set("X-PARTNER-ID", s.bankConfig.BankCredential.PartnerID)
+	request.Header.Set("CHANNEL-ID", channelID)
+
+	response, err := s.handleRequest(ctx, request, idempotent)
+	if err != nil {
+		if response != "" {
+			return "", eris.Wrap(eris.New(response), "sending request")
+		}
+		return "", eris.Wrap(err, "sending request")
+	}
+
+	return response, nil
+}
+
+// verifyCallbackHeader validates the SNAP headers sent by Mandiri on the VA callbacks
+func (s *MandiriService) verifyCallbackHeader(request *http.Request, missingField, unknownClient biModels.BCAResponse) *biModels.BCAResponse {
+	for _, header := range []struct {
+		name     string
+		expected string
+	}{
+		{"CHANNEL-ID", s.bankConfig.BankChannelConfig.VAChannelId},
+		{"X-PARTNER-ID", s.bankConfig.BankCredential.PartnerID},
+		{"X-EXTERNAL-ID", ""},
+	} {
+		value := request.Header.Get(header.name)
+		if value == "" {
+			response := missingField
+			response.ResponseMessage = "Invalid Mandatory Field {" + header.name + "}"
+			return &response
+		}
+
+		if header.expected != "" && value != header.expected {
+			response := unknownClient
+			return &response
+		}
+	}
+
+	return nil
+}
+
+// validationErrorField returns the first invalid field and whether it is caused by a missing value
+func validationErrorField(err error) (string, bool) {
+	if errs, ok := err.(validator.ValidationErrors); ok && len(errs) > 0 {
+		slog.Debug("error validating struct field", "field", errs[0].Field(), "tag", errs[0].Tag())
+		return errs[0].Field(), errs[0].Tag() == "required" || errs[0].Tag() == "min"
+	}
+
+	return "", false
+}
+
+func (s *MandiriService) getInternalBankInfo() error {
+	credentials := s.bankConfig.BankRequestedCredentials
+
+	statement := `
+	SELECT id, bank_name, client_secret
+	FROM authenticated_banks
+	WHERE client_id = ? AND deleted_at IS NULL
+	LIMIT 1
+	`
+	var storedSecret string
+	if err := s.DB.QueryRow(statement, credentials.ClientID).Scan(
+		&s.bankConfig.BankCredential.InternalBankID, &s.bankConfig.BankCredential.InternalBankName, &storedSecret); err != nil {
+		if err == sql.ErrNoRows {
+			slog.Warn("unauthorized bank credentials")
+			return eris.New("unauthorized")
+		}
+		return eris.Wrap(err, "getting internal bank id")
+	}
+
+	// The stored client secret is encrypted once a master key is configured, it can not be matched in the query
+	valid, err := s.Ingress.VerifyClientSecret(context.Background(), credentials.ClientID, storedSecret, credentials.ClientSecret)
+	if err != nil {
+		return eris.Wrap(err, "verifying client secret")
+	}
+	if !valid {
+		slog.Warn("unauthorized bank credentials")
+		return eris.New("unauthorized")
+	}
+
+	slog.Debug("internal bank info", "id", s.bankConfig.BankCredential.InternalBankID, "name", s.bankConfig.BankCredential.InternalBankName)
+
+	return nil
+}
+
+// accessTokenKey returns the redis key of the Mandiri access token of the current instance
+func (s *MandiriService) accessTokenKey() string {
+	return fmt.Sprintf("%s:%d", biUtil.MandiriAccessToken, s.bankConfig.BankCredential.InternalBankID)
+}
+
+func (s *MandiriService) padPartnerServiceId(id string) string {
+	for len(id) < mandiri.PartnerServiceIDLength {
+		id = " " + id
+	}
+
+	return id
+}
@@ -0,0 +1,160 @@
+package mandiri_test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	biConfig "github.com/voxtmault/bank-integration/config"
+	"github.com/voxtmault/bank-integration/mandiri"
+)
+
+const mockAccessToken = "mandiri-mock-access-token"
+
+// mockMandiri emulates the Mandiri SNAP endpoints used by the provider. Signatures are verified independently
+// from the mandiri_security package so that the tests catch changes in the string to sign.
+type mockMandiri struct {
+	server *httptest.Server
+
+	bCfg       *biConfig.BankConfig
+	partnerKey *rsa.PublicKey
+
+	tokenRequests   atomic.Int32
+	balanceRequests atomic.Int32
+}
+
+func newMockMandiri(t *testing.T, bCfg *biConfig.BankConfig, partnerKey *rsa.PublicKey) *mockMandiri {
+	t.Helper()
+
+	m := &mockMandiri{
+		bCfg:       bCfg,
+		partnerKey: partnerKey,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+bCfg.BankServiceEndpoints.AccessTokenURL, m.accessToken)
+	mux.HandleFunc("POST "+bCfg.BankServiceEndpoints.BalanceInquiryURL, m.balanceInquiry)
+
+	m.server = httptest.NewServer(mux)
+	t.Cleanup(m.server.Close)
+
+	return m
+}
+
+func (m *mockMandiri) accessToken(w http.ResponseWriter, r *http.Request) {
+	m.tokenRequests.Add(1)
+
+	timeStamp := r.Header.Get("X-TIMESTAMP")
+	if _, err := time.Parse(mandiri.TimestampFormat, timeStamp); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"responseCode": "4007301", "responseMessage": "Invalid Field Format [X-TIMESTAMP]"})
+		return
+	}
+
+	if r.Header.Get("X-CLIENT-KEY") != m.bCfg.BankCredential.ClientID {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"responseCode": "4017300", "responseMessage": "Unauthorized. [Unknown client]"})
+		return
+	}
+
+	signature, _ := base64.StdEncoding.DecodeString(r.Header.Get("X-SIGNATURE"))
+	hashed := sha256.Sum256([]byte(m.bCfg.BankCredential.ClientID + "|" + timeStamp))
+	if err := rsa.VerifyPKCS1v15(m.partnerKey, crypto.SHA256, hashed[:], signature); err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"responseCode": "4017300", "responseMessage": "Unauthorized. [Signature]"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"responseCode":    mandiri.MandiriAccessTokenSuccessCode,
+		"responseMessage": "Successful",
+		"accessToken":     mockAccessToken,
+		"tokenType":       "Bearer",
+		"expiresIn":       "900",
+	})
+}
+
+func (m *mockMandiri) balanceInquiry(w http.ResponseWriter, r *http.Request) {
+	m.balanceRequests.Add(1)
+
+	body, _ := io.ReadAll(r.Body)
+	if r.Header.Get("Authorization") != "Bearer "+mockAccessToken {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"responseCode": "4011101", "responseMessage": "Invalid Token (B2B)"})
+		return
+	}
+	if !m.verifySymmetricSignature(r, body) {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"responseCode": "4011100", "responseMessage": "Unauthorized. [Signature]"})
+		return
+	}
+
+	if r.Header.Get("X-PARTNER-ID") != m.bCfg.BankCredential.PartnerID || r.Header.Get("CHANNEL-ID") != m.bCfg.BankChannelConfig.BusinessChannelId {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"responseCode": "4011100", "responseMessage": "Unauthorized. [Unknown client]"})
+		return
+	}
+
+	var payload map[string]interface{}
+	json.Unmarshal(body, &payload)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"responseCode":       mandiri.MandiriBalanceInquirySuccessCode,
+		"responseMessage":    "Successful",
+		"referenceNo":        "2020102977770000000009",
+		"partnerReferenceNo": payload["partnerReferenceNo"],
+		"accountNo":          payload["accountNo"],
+		"name":               "PT Mandiri Mock",
+		"accountInfos": []map[string]interface{}{
+			{
+				"balanceType":      "Cash",
+				"amount":           map[string]string{"value": "200000.00", "currency": "IDR"},
+				"availableBalance": map[string]string{"value": "200000.00", "currency": "IDR"},
+				"status":           "0001",
+			},
+		},
+	})
+}
+
+func (m *mockMandiri) verifySymmetricSignature(r *http.Request, body []byte) bool {
+	if r.Header.Get("Authorization") != "Bearer "+mockAccessToken {
+		return false
+	}
+
+	if _, err := time.Parse(mandiri.TimestampFormat, r.Header.Get("X-TIMESTAMP")); err != nil {
+		return false
+	}
+
+	signature := symmetricSignature(m.bCfg.BankCredential.ClientSecret, r.Method, r.URL.Path, mockAccessToken, body, r.Header.Get("X-TIMESTAMP"))
+
+	return hmac.Equal([]byte(r.Header.Get("X-SIGNATURE")), []byte(signature))
+}
+
+// symmetricSignature computes the SNAP HMAC-SHA512 signature, used by both the mock and the callback tests
+func symmetricSignature(secret, method, path, accessToken string, body []byte, timeStamp string) string {
+	var minified bytes.Buffer
+	json.Compact(&minified, body)
+	hashedBody := sha256.Sum256(minified.Bytes())
+
+	stringToSign := fmt.Sprintf("%s:%s:%s:%s:%s", method, path, accessToken,
+		strings.ToLower(hex.EncodeToString(hashedBody[:])), timeStamp)
+
+	h := hmac.New(sha512.New, []byte(secret))
+	h.Write([]byte(stringToSign))
+
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
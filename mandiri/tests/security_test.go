@@ -0,0 +1,100 @@
+package mandiri_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/voxtmault/bank-integration/mandiri"
+	biModels "github.com/voxtmault/bank-integration/models"
+)
+
+func TestAsymmetricSignature(t *testing.T) {
+	env := setup(t)
+
+	// Mandiri signs its access token requests with its own private key
+	timeStamp := time.Now().Format(mandiri.TimestampFormat)
+	clientKey := env.bCfg.BankRequestedCredentials.ClientID
+	hashed := sha256.Sum256([]byte(clientKey + "|" + timeStamp))
+	raw, err := rsa.SignPKCS1v15(rand.Reader, env.mandiriKey, crypto.SHA256, hashed[:])
+	if err != nil {
+		t.Fatalf("signing: %v", err)
+	}
+	signature := base64.StdEncoding.EncodeToString(raw)
+
+	ok, err := env.security.VerifyAsymmetricSignature(context.Background(), timeStamp, clientKey, signature, nil)
+	if err != nil || !ok {
+		t.Fatalf("expected valid signature, got %v (%v)", ok, err)
+	}
+
+	if ok, _ := env.security.VerifyAsymmetricSignature(context.Background(), timeStamp, "other-client", signature, nil); ok {
+		t.Fatal("expected signature of another client to be rejected")
+	}
+}
+
+func TestSymmetricSignature(t *testing.T) {
+	env := setup(t)
+
+	body := []byte(`{
+		"partnerServiceId": "   88908",
+		"customerNo": "12345"
+	}`)
+	obj := &biModels.SymmetricSignatureRequirement{
+		HTTPMethod:  http.MethodPost,
+		AccessToken: mockAccessToken,
+		Timestamp:   time.Now().Format(mandiri.TimestampFormat),
+		RequestBody: body,
+		RelativeURL: "/openapi/transfer-va/v1.0/status",
+	}
+
+	signature, err := env.security.CreateSymmetricSignature(context.Background(), obj)
+	if err != nil {
+		t.Fatalf("creating signature: %v", err)
+	}
+
+	expected := symmetricSignature(env.bCfg.BankCredential.ClientSecret, obj.HTTPMethod, obj.RelativeURL, obj.AccessToken, body, obj.Timestamp)
+	if signature != expected {
+		t.Fatalf("unexpected signature %s, expected %s", signature, expected)
+	}
+
+	ok, err := env.security.VerifySymmetricSignature(context.Background(), obj, env.bCfg.BankCredential.ClientSecret, signature)
+	if err != nil || !ok {
+		t.Fatalf("expected valid signature, got %v (%v)", ok, err)
+	}
+
+	obj.RequestBody = []byte(`{"partnerServiceId":"   88908","customerNo":"54321"}`)
+	if ok, _ := env.security.VerifySymmetricSignature(context.Background(), obj, env.bCfg.BankCredential.ClientSecret, signature); ok {
+		t.Fatal("expected tampered body to be rejected")
+	}
+}
+
+func TestSymmetricSignatureQueryOrder(t *testing.T) {
+	env := setup(t)
+
+	obj := &biModels.SymmetricSignatureRequirement{
+		HTTPMethod:  http.MethodGet,
+		AccessToken: mockAccessToken,
+		Timestamp:   time.Now().Format(mandiri.TimestampFormat),
+		RelativeURL: "/openapi/statement?toDate=2024-01-02&fromDate=2024-01-01",
+	}
+	first, err := env.security.CreateSymmetricSignature(context.Background(), obj)
+	if err != nil {
+		t.Fatalf("creating signature: %v", err)
+	}
+
+	obj.RelativeURL = "/openapi/statement?fromDate=2024-01-01&toDate=2024-01-02"
+	second, err := env.security.CreateSymmetricSignature(context.Background(), obj)
+	if err != nil {
+		t.Fatalf("creating signature: %v", err)
+	}
+
+	if first != second {
+		t.Fatal("expected query parameters to be sorted before signing")
+	}
+}
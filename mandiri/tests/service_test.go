@@ -0,0 +1,669 @@
+package mandiri_test
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/voxtmault/bank-integration/mandiri"
+	mandiriRequest "github.com/voxtmault/bank-integration/mandiri/request"
+	mandiriService "github.com/voxtmault/bank-integration/mandiri/service"
+	biUtil "github.com/voxtmault/bank-integration/utils"
+)
+
+func TestBalanceInquiry(t *testing.T) {
+	env := setup(t)
+
+	for i := 0; i < 2; i++ {
+		balance, err := env.service.BalanceInquiry(context.Background())
+		if err != nil {
+			t.Fatalf("balance inquiry: %v", err)
+		}
+		if balance.AccountNumber != env.bCfg.BankCredential.SourceAccount || len(balance.AccountInfos) != 1 {
+			t.Fatalf("unexpected balance response: %+v", balance)
+		}
+	}
+
+	// The access token is requested once and reused afterwards
+	if got := env.mock.tokenRequests.Load(); got != 1 {
+		t.Fatalf("expected 1 access token request, got %d", got)
+	}
+	if got := env.mock.balanceRequests.Load(); got != 2 {
+		t.Fatalf("expected 2 balance inquiry requests, got %d", got)
+	}
+
+	token, err := env.redis.Get(fmt.Sprintf("%s:%d", biUtil.MandiriAccessToken, internalBankID))
+	if err != nil || token != mockAccessToken {
+		t.Fatalf("expected access token to be cached per bank id, got %q (%v)", token, err)
+	}
+}
+
+func TestBalanceInquiryRenewsRejectedToken(t *testing.T) {
+	env := setup(t)
+
+	// A token still valid in redis but no longer accepted by Mandiri
+	key := fmt.Sprintf("%s:%d", biUtil.MandiriAccessToken, internalBankID)
+	env.redis.Set(key, "revoked-access-token")
+	env.redis.SetTTL(key, 10*time.Minute)
+
+	if _, err := env.service.BalanceInquiry(context.Background()); err != nil {
+		t.Fatalf("balance inquiry: %v", err)
+	}
+
+	// The rejected request is signed again with a new token and sent once more
+	if got := env.mock.tokenRequests.Load(); got != 1 {
+		t.Fatalf("expected 1 access token request, got %d", got)
+	}
+	if got := env.mock.balanceRequests.Load(); got != 2 {
+		t.Fatalf("expected 2 balance inquiry requests, got %d", got)
+	}
+	if token, _ := env.redis.Get(key); token != mockAccessToken {
+		t.Fatalf("expected the rejected token to be replaced in redis, got %q", token)
+	}
+}
+
+func TestBalanceInquiryRenewsExpiringToken(t *testing.T) {
+	env := setup(t)
+	env.bCfg.BankRuntimeConfig.AccessTokenRefreshMargin = time.Minute
+
+	// The token expires within the refresh margin, it is renewed before being sent
+	key := fmt.Sprintf("%s:%d", biUtil.MandiriAccessToken, internalBankID)
+	env.redis.Set(key, "expiring-access-token")
+	env.redis.SetTTL(key, 30*time.Second)
+
+	if _, err := env.service.BalanceInquiry(context.Background()); err != nil {
+		t.Fatalf("balance inquiry: %v", err)
+	}
+
+	if got := env.mock.tokenRequests.Load(); got != 1 {
+		t.Fatalf("expected 1 access token request, got %d", got)
+	}
+	if got := env.mock.balanceRequests.Load(); got != 1 {
+		t.Fatalf("expected a single balance inquiry request, got %d", got)
+	}
+	if ttl := env.redis.TTL(key); ttl != 900*time.Second {
+		t.Fatalf("expected the renewed token to expire in 900s, got %s", ttl)
+	}
+}
+
+func TestGenerateAccessToken(t *testing.T) {
+	env := setup(t)
+
+	clientKey := env.bCfg.BankRequestedCredentials.ClientID
+	env.redis.HSet(biUtil.ClientCredentialsRedis, clientKey, env.bCfg.BankRequestedCredentials.ClientSecret)
+
+	timeStamp := time.Now().Format(mandiri.TimestampFormat)
+	hashed := sha256.Sum256([]byte(clientKey + "|" + timeStamp))
+	raw, err := rsa.SignPKCS1v15(rand.Reader, env.mandiriKey, crypto.SHA256, hashed[:])
+	if err != nil {
+		t.Fatalf("signing: %v", err)
+	}
+
+	request := httptest.NewRequest(http.MethodPost, env.bCfg.RequestedEndpoints.AuthURL, bytes.NewBufferString(`{"grantType":"client_credentials"}`))
+	request.Header.Set("X-TIMESTAMP", timeStamp)
+	request.Header.Set("X-CLIENT-KEY", clientKey)
+	request.Header.Set("X-SIGNATURE", base64.StdEncoding.EncodeToString(raw))
+
+	response, err := env.service.GenerateAccessToken(context.Background(), request)
+	if err != nil {
+		t.Fatalf("generating access token: %v", err)
+	}
+	if response.ResponseCode != mandiri.MandiriAuthResponseSuccess.ResponseCode || response.AccessToken == "" {
+		t.Fatalf("unexpected response: %+v", response.BCAResponse)
+	}
+
+	token, err := env.service.Ingress.ValidateAccessToken(context.Background(), env.rdb, response.AccessToken)
+	if err != nil || token == nil || token.ClientSecret != env.bCfg.BankRequestedCredentials.ClientSecret {
+		t.Fatalf("expected generated token to be stored with the client secret, got %+v (%v)", token, err)
+	}
+	if token.ClientID != clientKey || token.Scope != biUtil.AccessTokenScopeVA {
+		t.Fatalf("expected generated token to be issued to the client, got %+v", token)
+	}
+
+	// Replaying the request with a tampered signature is rejected
+	request = httptest.NewRequest(http.MethodPost, env.bCfg.RequestedEndpoints.AuthURL, bytes.NewBufferString(`{"grantType":"client_credentials"}`))
+	request.Header.Set("X-TIMESTAMP", timeStamp)
+	request.Header.Set("X-CLIENT-KEY", clientKey)
+	request.Header.Set("X-SIGNATURE", base64.StdEncoding.EncodeToString([]byte("tampered")))
+
+	response, _ = env.service.GenerateAccessToken(context.Background(), request)
+	if response.HTTPStatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected unauthorized response, got %+v", response.BCAResponse)
+	}
+}
+
+func TestGenerateAccessTokenReplay(t *testing.T) {
+	env := setup(t)
+
+	clientKey := env.bCfg.BankRequestedCredentials.ClientID
+	env.redis.HSet(biUtil.ClientCredentialsRedis, clientKey, env.bCfg.BankRequestedCredentials.ClientSecret)
+	env.redis.HSet(biUtil.ClientTimestampSkewRedis, clientKey, "300")
+
+	newRequest := func(timeStamp time.Time) *http.Request {
+		formatted := timeStamp.Format(mandiri.TimestampFormat)
+		hashed := sha256.Sum256([]byte(clientKey + "|" + formatted))
+		raw, err := rsa.SignPKCS1v15(rand.Reader, env.mandiriKey, crypto.SHA256, hashed[:])
+		if err != nil {
+			t.Fatalf("signing: %v", err)
+		}
+
+		request := httptest.NewRequest(http.MethodPost, env.bCfg.RequestedEndpoints.AuthURL, bytes.NewBufferString(`{"grantType":"client_credentials"}`))
+		request.Header.Set("X-TIMESTAMP", formatted)
+		request.Header.Set("X-CLIENT-KEY", clientKey)
+		request.Header.Set("X-SIGNATURE", base64.StdEncoding.EncodeToString(raw))
+
+		return request
+	}
+
+	// A request signed outside of the clock skew of the client is rejected, even with a valid signature
+	response, _ := env.service.GenerateAccessToken(context.Background(), newRequest(time.Now().Add(-10*time.Minute)))
+	if response.ResponseMessage != mandiri.MandiriAuthUnauthorizedTimestamp.ResponseMessage || response.HTTPStatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected unauthorized timestamp response, got %+v", response.BCAResponse)
+	}
+
+	// The token signature only covers the client id and X-TIMESTAMP, two requests made within the same second carry
+	// the same signature and are both answered
+	timeStamp := time.Now()
+	for i := 0; i < 2; i++ {
+		response, _ = env.service.GenerateAccessToken(context.Background(), newRequest(timeStamp))
+		if response.ResponseCode != mandiri.MandiriAuthResponseSuccess.ResponseCode {
+			t.Fatalf("expected request %d to be answered, got %+v", i+1, response.BCAResponse)
+		}
+	}
+
+	for _, key := range env.redis.Keys() {
+		if strings.HasPrefix(key, biUtil.ReplaySignatureRedis+":") {
+			t.Fatalf("expected the token signature not to be remembered, got %s", key)
+		}
+	}
+}
+
+func TestBillPresentmentReplay(t *testing.T) {
+	env := setup(t)
+
+	accessToken := "callback-access-token"
+	issueAccessToken(t, env, accessToken)
+	env.redis.HSet(biUtil.ClientTimestampSkewRedis, env.bCfg.BankRequestedCredentials.ClientID, "300")
+
+	body := []byte(`{"partnerServiceId":"   88908","customerNo":"12345","virtualAccountNo":"   8890812345","inquiryRequestId":"202410180000000000000000000001"}`)
+	path := env.bCfg.RequestedEndpoints.BillPresentmentURL
+
+	request := newCallbackRequest(env, path, accessToken, "1003", body)
+	result, response := env.service.Ingress.VerifySymmetricSignature(context.Background(), request, env.rdb, body)
+	if !result || response != nil {
+		t.Fatalf("expected the signature to be verified, got %+v", response)
+	}
+
+	result, response = env.service.Ingress.VerifySymmetricSignature(context.Background(), request, env.rdb, body)
+	if result || response == nil || response.ResponseMessage != mandiri.MandiriAuthUnauthorizedReplay.ResponseMessage {
+		t.Fatalf("expected unauthorized replay response, got %+v", response)
+	}
+
+	// Callbacks answer with their own service code
+	timeStamp := time.Now().Add(10 * time.Minute).Format(mandiri.TimestampFormat)
+	request = newCallbackRequest(env, path, accessToken, "1004", body)
+	request.Header.Set("X-TIMESTAMP", timeStamp)
+	request.Header.Set("X-SIGNATURE", symmetricSignature(env.bCfg.BankRequestedCredentials.ClientSecret, http.MethodPost, path, accessToken, body, timeStamp))
+
+	billResponse, err := env.service.BillPresentment(context.Background(), request)
+	if err != nil {
+		t.Fatalf("bill presentment: %v", err)
+	}
+	if billResponse.ResponseCode != "4012400" || billResponse.ResponseMessage != mandiri.MandiriAuthUnauthorizedTimestamp.ResponseMessage {
+		t.Fatalf("expected unauthorized timestamp response, got %+v", billResponse.BCAResponse)
+	}
+}
+
+func TestCallbackIPAllowlist(t *testing.T) {
+	env := setup(t)
+
+	clientKey := env.bCfg.BankRequestedCredentials.ClientID
+	env.redis.HSet(biUtil.ClientCredentialsRedis, clientKey, env.bCfg.BankRequestedCredentials.ClientSecret)
+	env.redis.HSet(biUtil.ClientIPAllowlistRedis, clientKey, "203.0.113.0/24")
+	env.ingress.TrustedProxies, _ = biUtil.ParseCIDRs("10.0.0.0/8")
+
+	newTokenRequest := func(remoteAddr, xForwardedFor string) *http.Request {
+		timeStamp := time.Now().Format(mandiri.TimestampFormat)
+		hashed := sha256.Sum256([]byte(clientKey + "|" + timeStamp))
+		raw, err := rsa.SignPKCS1v15(rand.Reader, env.mandiriKey, crypto.SHA256, hashed[:])
+		if err != nil {
+			t.Fatalf("signing: %v", err)
+		}
+
+		request := httptest.NewRequest(http.MethodPost, env.bCfg.RequestedEndpoints.AuthURL, bytes.NewBufferString(`{"grantType":"client_credentials"}`))
+		request.RemoteAddr = remoteAddr
+		request.Header.Set("X-TIMESTAMP", timeStamp)
+		request.Header.Set("X-CLIENT-KEY", clientKey)
+		request.Header.Set("X-SIGNATURE", base64.StdEncoding.EncodeToString(raw))
+		if xForwardedFor != "" {
+			request.Header.Set("X-Forwarded-For", xForwardedFor)
+		}
+
+		return request
+	}
+
+	for _, tc := range []struct {
+		name          string
+		remoteAddr    string
+		xForwardedFor string
+		status        int
+	}{
+		{"allowed", "203.0.113.7:4431", "", http.StatusOK},
+		{"outside allowlist", "198.51.100.1:4431", "", http.StatusUnauthorized},
+		{"trusted proxy", "10.0.0.2:4431", "203.0.113.7", http.StatusOK},
+		{"untrusted proxy", "198.51.100.1:4431", "203.0.113.7", http.StatusUnauthorized},
+		{"trusted proxy outside allowlist", "10.0.0.2:4431", "198.51.100.1", http.StatusUnauthorized},
+	} {
+		response, _ := env.service.GenerateAccessToken(context.Background(), newTokenRequest(tc.remoteAddr, tc.xForwardedFor))
+		if response.HTTPStatusCode != tc.status {
+			t.Fatalf("%s: expected status %d, got %+v", tc.name, tc.status, response.BCAResponse)
+		}
+		if tc.status == http.StatusUnauthorized && response.ResponseMessage != mandiri.MandiriAuthUnauthorizedConnectionNotAllowed.ResponseMessage {
+			t.Fatalf("%s: expected connection not allowed response, got %+v", tc.name, response.BCAResponse)
+		}
+	}
+
+	// Callbacks are rejected before their signature is checked, with their own service code
+	accessToken := "callback-access-token"
+	issueAccessToken(t, env, accessToken)
+
+	body := []byte(`{"partnerServiceId":"   88908","customerNo":"12345","virtualAccountNo":"   8890812345","inquiryRequestId":"202410180000000000000000000001"}`)
+	request := newCallbackRequest(env, env.bCfg.RequestedEndpoints.BillPresentmentURL, accessToken, "1005", body)
+	request.RemoteAddr = "198.51.100.1:4431"
+	request.Header.Set("X-SIGNATURE", "invalid")
+
+	response, err := env.service.BillPresentment(context.Background(), request)
+	if err != nil {
+		t.Fatalf("bill presentment: %v", err)
+	}
+	if response.ResponseCode != "4012400" || response.ResponseMessage != mandiri.MandiriAuthUnauthorizedConnectionNotAllowed.ResponseMessage {
+		t.Fatalf("expected connection not allowed response, got %+v", response.BCAResponse)
+	}
+}
+
+func TestGenerateAccessTokenWithClientPublicKey(t *testing.T) {
+	env := setup(t)
+
+	// A partner app registered with its own key pair next to the bank
+	partnerKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&partnerKey.PublicKey)
+	clientKey, clientSecret := "partner-app", "partner-secret"
+	env.redis.HSet(biUtil.ClientCredentialsRedis, clientKey, clientSecret)
+	env.redis.HSet(biUtil.ClientPublicKeysRedis, clientKey, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})))
+
+	sign := func(key *rsa.PrivateKey, timeStamp string) string {
+		hashed := sha256.Sum256([]byte(clientKey + "|" + timeStamp))
+		raw, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+		if err != nil {
+			t.Fatalf("signing: %v", err)
+		}
+		return base64.StdEncoding.EncodeToString(raw)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		key    *rsa.PrivateKey
+		status int
+	}{
+		{"client key", partnerKey, http.StatusOK},
+		{"bank key", env.mandiriKey, http.StatusUnauthorized},
+		// A client registered without a key of its own is not verified with the bank key either
+		{"without client key", env.mandiriKey, http.StatusUnauthorized},
+	} {
+		if tc.name == "without client key" {
+			env.redis.HDel(biUtil.ClientPublicKeysRedis, clientKey)
+		}
+		timeStamp := time.Now().Format(mandiri.TimestampFormat)
+		request := httptest.NewRequest(http.MethodPost, env.bCfg.RequestedEndpoints.AuthURL, bytes.NewBufferString(`{"grantType":"client_credentials"}`))
+		request.Header.Set("X-TIMESTAMP", timeStamp)
+		request.Header.Set("X-CLIENT-KEY", clientKey)
+		request.Header.Set("X-SIGNATURE", sign(tc.key, timeStamp))
+
+		response, _ := env.service.GenerateAccessToken(context.Background(), request)
+		if response.HTTPStatusCode != tc.status {
+			t.Fatalf("%s: expected status %d, got %+v", tc.name, tc.status, response.BCAResponse)
+		}
+	}
+}
+
+func TestBillPresentment(t *testing.T) {
+	env := setup(t)
+
+	accessToken := "callback-access-token"
+	issueAccessToken(t, env, accessToken)
+
+	body := []byte(`{"partnerServiceId":"   88908","customerNo":"12345","virtualAccountNo":"   8890812345","inquiryRequestId":"202410180000000000000000000001"}`)
+	expiredDate := time.Now().Add(time.Hour).Format(time.DateTime)
+
+	env.sqlMock.ExpectBegin()
+	env.sqlMock.ExpectQuery("SELECT partnerServiceId, customerNo, virtualAccountNo").
+		WithArgs("8890812345", internalBankID).
+		WillReturnRows(sqlmock.NewRows([]string{"partnerServiceId", "customerNo", "virtualAccountNo", "virtualAccountName",
+			"totalAmountValue", "totalAmountCurrency", "paidAmountValue", "paidAmountCurrency", "effective_expired_date", "id_va_status", "virtualAccountTrxType",
+			"minAmountValue", "maxAmountValue", "cumulativePaymentAmountValue"}).
+			AddRow("   88908", "12345", "   8890812345", "John Doe", "150000.00", "IDR", "0.00", "IDR", expiredDate, biUtil.VAStatusPending,
+				"C", "0.00", "0.00", "0.00"))
+	env.sqlMock.ExpectExec("UPDATE va_request SET inquiryRequestId").
+		WithArgs("202410180000000000000000000001", "8890812345", biUtil.VAStatusPending, internalBankID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	env.sqlMock.ExpectCommit()
+
+	request := newCallbackRequest(env, env.bCfg.RequestedEndpoints.BillPresentmentURL, accessToken, "1001", body)
+	response, err := env.service.BillPresentment(context.Background(), request)
+	if err != nil {
+		t.Fatalf("bill presentment: %v", err)
+	}
+
+	if response.ResponseCode != mandiri.MandiriBillInquiryResponseSuccess.ResponseCode {
+		t.Fatalf("unexpected response: %+v", response.BCAResponse)
+	}
+	if response.VirtualAccountData.InquiryStatus != "00" || response.VirtualAccountData.TotalAmount.Value != "150000.00" {
+		t.Fatalf("unexpected virtual account data: %+v", response.VirtualAccountData)
+	}
+	if err := env.sqlMock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reusing the same X-EXTERNAL-ID is rejected before touching the database, the conflict is answered with the
+	// data returned to the first request
+	for i := 0; i < 2; i++ {
+		request = newCallbackRequest(env, env.bCfg.RequestedEndpoints.BillPresentmentURL, accessToken, "1001", body)
+		response, _ = env.service.BillPresentment(context.Background(), request)
+		if response.ResponseCode != mandiri.MandiriBillInquiryResponseDuplicateExternalID.ResponseCode || response.HTTPStatusCode != http.StatusConflict {
+			t.Fatalf("expected duplicate external id response, got %+v", response.BCAResponse)
+		}
+		if response.VirtualAccountData.TotalAmount.Value != "150000.00" || response.VirtualAccountData.InquiryStatus != "01" {
+			t.Fatalf("unexpected conflict virtual account data: %+v", response.VirtualAccountData)
+		}
+	}
+
+	// The reservation is scoped to the client of the access token and expires on its own
+	keys := env.redis.Keys()
+	var reserved bool
+	for _, key := range keys {
+		if strings.HasPrefix(key, biUtil.UniqueExternalIDRedis+":"+biUtil.BankCodeMandiri+":"+env.bCfg.BankRequestedCredentials.ClientID+":") {
+			reserved = env.redis.TTL(key) == 48*time.Hour
+		}
+	}
+	if !reserved {
+		t.Fatalf("expected the external id to be reserved for 48 hours, got keys %v", keys)
+	}
+}
+
+func TestBillPresentmentInvalidSignature(t *testing.T) {
+	env := setup(t)
+
+	accessToken := "callback-access-token"
+	issueAccessToken(t, env, accessToken)
+
+	body := []byte(`{"partnerServiceId":"   88908","customerNo":"12345","virtualAccountNo":"   8890812345","inquiryRequestId":"202410180000000000000000000001"}`)
+	request := newCallbackRequest(env, env.bCfg.RequestedEndpoints.BillPresentmentURL, accessToken, "1002", body)
+	request.Header.Set("X-SIGNATURE", "invalid")
+
+	response, err := env.service.BillPresentment(context.Background(), request)
+	if err != nil {
+		t.Fatalf("bill presentment: %v", err)
+	}
+	if response.ResponseCode != mandiri.MandiriBillInquiryResponseUnauthorizedSignature.ResponseCode || response.VirtualAccountData != nil {
+		t.Fatalf("unexpected response: %+v", response.BCAResponse)
+	}
+}
+
+func TestInquiryVA(t *testing.T) {
+	env := setup(t)
+
+	accessToken := "callback-access-token"
+	issueAccessToken(t, env, accessToken)
+
+	body := []byte(`{"partnerServiceId":"   88908","customerNo":"12345","virtualAccountNo":"   8890812345",
+		"paymentRequestId":"202410180000000000000000000001","paidAmount":{"value":"150000.00","currency":"IDR"},
+		"totalAmount":{"value":"150000.00","currency":"IDR"}}`)
+	expiredDate := time.Now().Add(time.Hour).Format(time.DateTime)
+
+	env.sqlMock.ExpectBegin()
+	env.sqlMock.ExpectQuery("SELECT paidAmountValue, paidAmountCurrency, totalAmountValue").
+		WithArgs("202410180000000000000000000001", "8890812345", internalBankID).
+		WillReturnRows(sqlmock.NewRows([]string{"paidAmountValue", "paidAmountCurrency", "totalAmountValue", "totalAmountCurrency",
+			"virtualAccountName", "effective_expired_date", "id_transaction", "id", "id_va_status", "virtualAccountTrxType",
+			"minAmountValue", "maxAmountValue", "cumulativePaymentAmountValue"}).
+			AddRow("0.00", "IDR", "150000.00", "IDR", "John Doe", expiredDate, 42, 9, biUtil.VAStatusPending, "C", "0.00", "0.00", "0.00"))
+	env.sqlMock.ExpectExec("UPDATE va_request SET paidAmountValue").
+		WithArgs("150000.00", "IDR", "150000.00", biUtil.VAStatusPaid, "202410180000000000000000000001", internalBankID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	env.sqlMock.ExpectExec("INSERT INTO payment_event").
+		WithArgs(internalBankID, biUtil.PaymentEventVAPaid, 9, 42, "8890812345", "202410180000000000000000000001",
+			"150000.00", "IDR", "150000.00", "IDR").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	env.sqlMock.ExpectCommit()
+
+	request := newCallbackRequest(env, env.bCfg.RequestedEndpoints.PaymentFlagURL, accessToken, "2001", body)
+	response, err := env.service.InquiryVA(context.Background(), request)
+	if err != nil {
+		t.Fatalf("inquiry va: %v", err)
+	}
+
+	if response.ResponseCode != mandiri.MandiriPaymentFlagResponseSuccess.ResponseCode || response.VirtualAccountData.PaymentFlagStatus != "00" {
+		t.Fatalf("unexpected response: %+v %+v", response.BCAResponse, response.VirtualAccountData)
+	}
+	if err := env.sqlMock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInquiryVAPartialPayment(t *testing.T) {
+	env := setup(t)
+
+	accessToken := "callback-access-token"
+	issueAccessToken(t, env, accessToken)
+
+	columns := []string{"paidAmountValue", "paidAmountCurrency", "totalAmountValue", "totalAmountCurrency",
+		"virtualAccountName", "effective_expired_date", "id_transaction", "id", "id_va_status", "virtualAccountTrxType",
+		"minAmountValue", "maxAmountValue", "cumulativePaymentAmountValue"}
+	expiredDate := time.Now().Add(time.Hour).Format(time.DateTime)
+
+	// The first installment only moves the cumulative amount, the VA keeps waiting for payment
+	env.sqlMock.ExpectBegin()
+	env.sqlMock.ExpectQuery("SELECT paidAmountValue, paidAmountCurrency, totalAmountValue").
+		WithArgs("202410180000000000000000000001", "8890812345", internalBankID).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow("0.00", "IDR", "150000.00", "IDR", "John Doe", expiredDate, 42, 9, biUtil.VAStatusPending, "I", "50000.00", "0.00", "0.00"))
+	env.sqlMock.ExpectExec("UPDATE va_request SET paidAmountValue").
+		WithArgs("0.00", "IDR", "100000.00", biUtil.VAStatusPending, "202410180000000000000000000001", internalBankID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	env.sqlMock.ExpectExec("INSERT INTO payment_event").
+		WithArgs(internalBankID, biUtil.PaymentEventVAInstallment, 9, 42, "8890812345", "202410180000000000000000000001",
+			"100000.00", "IDR", "150000.00", "IDR").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	env.sqlMock.ExpectCommit()
+
+	body := []byte(`{"partnerServiceId":"   88908","customerNo":"12345","virtualAccountNo":"   8890812345",
+		"paymentRequestId":"202410180000000000000000000001","paidAmount":{"value":"100000.00","currency":"IDR"},
+		"totalAmount":{"value":"150000.00","currency":"IDR"}}`)
+	request := newCallbackRequest(env, env.bCfg.RequestedEndpoints.PaymentFlagURL, accessToken, "2101", body)
+	response, err := env.service.InquiryVA(context.Background(), request)
+	if err != nil {
+		t.Fatalf("inquiry va: %v", err)
+	}
+	if response.ResponseCode != mandiri.MandiriPaymentFlagResponseSuccess.ResponseCode || response.VirtualAccountData.PaymentFlagStatus != "00" {
+		t.Fatalf("unexpected response: %+v %+v", response.BCAResponse, response.VirtualAccountData)
+	}
+
+	// An installment exceeding the remaining amount is rejected
+	env.sqlMock.ExpectBegin()
+	env.sqlMock.ExpectQuery("SELECT paidAmountValue, paidAmountCurrency, totalAmountValue").
+		WithArgs("202410180000000000000000000001", "8890812345", internalBankID).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow("0.00", "IDR", "150000.00", "IDR", "John Doe", expiredDate, 42, 9, biUtil.VAStatusPending, "I", "50000.00", "0.00", "100000.00"))
+	env.sqlMock.ExpectRollback()
+
+	request = newCallbackRequest(env, env.bCfg.RequestedEndpoints.PaymentFlagURL, accessToken, "2102", body)
+	response, _ = env.service.InquiryVA(context.Background(), request)
+	if response.ResponseCode != mandiri.MandiriPaymentFlagResponseInvalidAmount.ResponseCode {
+		t.Fatalf("expected invalid amount response, got %+v", response.BCAResponse)
+	}
+
+	// The last installment settles the VA
+	env.sqlMock.ExpectBegin()
+	env.sqlMock.ExpectQuery("SELECT paidAmountValue, paidAmountCurrency, totalAmountValue").
+		WithArgs("202410180000000000000000000001", "8890812345", internalBankID).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow("0.00", "IDR", "150000.00", "IDR", "John Doe", expiredDate, 42, 9, biUtil.VAStatusPending, "I", "50000.00", "0.00", "100000.00"))
+	env.sqlMock.ExpectExec("UPDATE va_request SET paidAmountValue").
+		WithArgs("150000.00", "IDR", "150000.00", biUtil.VAStatusPaid, "202410180000000000000000000001", internalBankID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	env.sqlMock.ExpectExec("INSERT INTO payment_event").
+		WithArgs(internalBankID, biUtil.PaymentEventVAPaid, 9, 42, "8890812345", "202410180000000000000000000001",
+			"50000.00", "IDR", "150000.00", "IDR").
+		WillReturnResult(sqlmock.NewResult(2, 1))
+	env.sqlMock.ExpectCommit()
+
+	body = []byte(`{"partnerServiceId":"   88908","customerNo":"12345","virtualAccountNo":"   8890812345",
+		"paymentRequestId":"202410180000000000000000000001","paidAmount":{"value":"50000.00","currency":"IDR"},
+		"totalAmount":{"value":"50000.00","currency":"IDR"}}`)
+	request = newCallbackRequest(env, env.bCfg.RequestedEndpoints.PaymentFlagURL, accessToken, "2103", body)
+	response, err = env.service.InquiryVA(context.Background(), request)
+	if err != nil {
+		t.Fatalf("inquiry va: %v", err)
+	}
+	if response.ResponseCode != mandiri.MandiriPaymentFlagResponseSuccess.ResponseCode {
+		t.Fatalf("unexpected response: %+v", response.BCAResponse)
+	}
+	if err := env.sqlMock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCancelVA(t *testing.T) {
+	env := setup(t)
+
+	accessToken := "callback-access-token"
+	issueAccessToken(t, env, accessToken)
+
+	env.sqlMock.ExpectBegin()
+	env.sqlMock.ExpectQuery("SELECT id, TRIM\\(virtualAccountNo\\)").
+		WithArgs(42, internalBankID, biUtil.VAStatusPending).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "virtualAccountNo", "inquiryRequestId", "paidAmountValue",
+			"paidAmountCurrency", "totalAmountValue", "totalAmountCurrency"}).
+			AddRow(9, "8890812345", "", "0.00", "IDR", "150000.00", "IDR"))
+	env.sqlMock.ExpectExec("UPDATE va_request SET id_va_status").
+		WithArgs(biUtil.VAStatusCancelled, 9).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	env.sqlMock.ExpectExec("INSERT INTO payment_event").
+		WithArgs(internalBankID, biUtil.PaymentEventVACancelled, 9, 42, "8890812345", "", "0.00", "IDR", "150000.00", "IDR").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	env.sqlMock.ExpectCommit()
+
+	if err := env.service.CancelVA(context.Background(), 42); err != nil {
+		t.Fatalf("cancelling va: %v", err)
+	}
+
+	// The cancelled VA is no longer a valid bill
+	body := []byte(`{"partnerServiceId":"   88908","customerNo":"12345","virtualAccountNo":"   8890812345","inquiryRequestId":"202410180000000000000000000001"}`)
+	env.sqlMock.ExpectBegin()
+	env.sqlMock.ExpectQuery("SELECT partnerServiceId, customerNo, virtualAccountNo").
+		WithArgs("8890812345", internalBankID).
+		WillReturnRows(sqlmock.NewRows([]string{"partnerServiceId", "customerNo", "virtualAccountNo", "virtualAccountName",
+			"totalAmountValue", "totalAmountCurrency", "paidAmountValue", "paidAmountCurrency", "effective_expired_date", "id_va_status", "virtualAccountTrxType",
+			"minAmountValue", "maxAmountValue", "cumulativePaymentAmountValue"}).
+			AddRow("   88908", "12345", "   8890812345", "John Doe", "150000.00", "IDR", "0.00", "IDR",
+				time.Now().Add(time.Hour).Format(time.DateTime), biUtil.VAStatusCancelled, "C", "0.00", "0.00", "0.00"))
+	env.sqlMock.ExpectRollback()
+
+	request := newCallbackRequest(env, env.bCfg.RequestedEndpoints.BillPresentmentURL, accessToken, "3001", body)
+	response, err := env.service.BillPresentment(context.Background(), request)
+	if err != nil {
+		t.Fatalf("bill presentment: %v", err)
+	}
+	if response.ResponseCode != mandiri.MandiriBillInquiryResponseVAExpired.ResponseCode || response.VirtualAccountData.InquiryStatus != "01" {
+		t.Fatalf("expected invalid bill response, got %+v", response.BCAResponse)
+	}
+
+	// Nothing left to cancel
+	env.sqlMock.ExpectBegin()
+	env.sqlMock.ExpectQuery("SELECT id, TRIM\\(virtualAccountNo\\)").
+		WithArgs(42, internalBankID, biUtil.VAStatusPending).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	env.sqlMock.ExpectRollback()
+
+	if err := env.service.CancelVA(context.Background(), 42); err == nil {
+		t.Fatal("expected an error when no va is waiting for payment")
+	}
+	if err := env.sqlMock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newCallbackRequest(env *testEnv, path, accessToken, externalID string, body []byte) *http.Request {
+	timeStamp := time.Now().Format(mandiri.TimestampFormat)
+
+	request := httptest.NewRequest(http.MethodPost, path, bytes.NewBuffer(body))
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", "Bearer "+accessToken)
+	request.Header.Set("X-TIMESTAMP", timeStamp)
+	request.Header.Set("X-SIGNATURE", symmetricSignature(env.bCfg.BankRequestedCredentials.ClientSecret, http.MethodPost, path, accessToken, body, timeStamp))
+	request.Header.Set("X-PARTNER-ID", env.bCfg.BankCredential.PartnerID)
+	request.Header.Set("CHANNEL-ID", env.bCfg.BankChannelConfig.VAChannelId)
+	request.Header.Set("X-EXTERNAL-ID", externalID)
+
+	return request
+}
+
+func TestNewMandiriServiceClientSecret(t *testing.T) {
+	env := setup(t)
+	ctx := context.Background()
+	credentials := env.bCfg.BankRequestedCredentials
+
+	other, err := env.secrets.Encrypt(ctx, "another-secret", credentials.ClientID)
+	if err != nil {
+		t.Fatalf("encrypting client secret: %v", err)
+	}
+
+	for _, test := range []struct {
+		name         string
+		storedSecret string
+		valid        bool
+	}{
+		{"plaintext", credentials.ClientSecret, true}, // Stored before a master key was configured
+		{"another encrypted secret", other, false},
+		{"another plaintext secret", "another-secret", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			env.sqlMock.ExpectQuery("SELECT id, bank_name, client_secret FROM authenticated_banks").
+				WithArgs(credentials.ClientID).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "bank_name", "client_secret"}).AddRow(internalBankID, "Mandiri", test.storedSecret))
+			if test.valid {
+				env.sqlMock.ExpectQuery("SELECT id_transaction, expired_date FROM va_request").
+					WillReturnRows(sqlmock.NewRows([]string{"id_transaction", "expired_date"}))
+			}
+
+			service, err := mandiriService.NewMandiriService(mandiriRequest.NewMandiriEgress(env.security, env.bCfg, env.cfg),
+				env.ingress, env.cfg, env.bCfg, env.service.DB, env.rdb)
+			if test.valid != (err == nil) {
+				t.Fatalf("expected valid %v, got %v", test.valid, err)
+			}
+			if service != nil {
+				service.Close()
+			}
+		})
+	}
+
+	if err := env.sqlMock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet sql expectations: %v", err)
+	}
+}
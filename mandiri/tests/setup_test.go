@@ -0,0 +1,205 @@
+package mandiri_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	biConfig "github.com/voxtmault/bank-integration/config"
+	biKeys "github.com/voxtmault/bank-integration/keys"
+	mandiriRequest "github.com/voxtmault/bank-integration/mandiri/request"
+	mandiriSecurity "github.com/voxtmault/bank-integration/mandiri/security"
+	mandiriService "github.com/voxtmault/bank-integration/mandiri/service"
+	biStorage "github.com/voxtmault/bank-integration/storage"
+	biTokens "github.com/voxtmault/bank-integration/tokens"
+	biUtil "github.com/voxtmault/bank-integration/utils"
+)
+
+const internalBankID = 7
+
+// testEnv bundles everything needed to run the Mandiri provider against the local mock server
+type testEnv struct {
+	cfg  *biConfig.InternalConfig
+	bCfg *biConfig.BankConfig
+
+	partnerKey *rsa.PrivateKey // Our key pair, Mandiri holds the public key
+	mandiriKey *rsa.PrivateKey // Mandiri key pair, we hold the public key
+
+	security *mandiriSecurity.MandiriSecurity
+	mock     *mockMandiri
+	redis    *miniredis.Miniredis
+	rdb      *biStorage.RedisInstance
+	sqlMock  sqlmock.Sqlmock
+	secrets  *biKeys.Envelope // Client secrets are stored encrypted
+	ingress  *mandiriRequest.MandiriIngress
+	service  *mandiriService.MandiriService
+}
+
+func setup(t *testing.T) *testEnv {
+	t.Helper()
+
+	validate := biUtil.InitValidator()
+	validate.RegisterValidation("bcaPartnerServiceID", biUtil.ValidatePartnerServiceID)
+	validate.RegisterValidation("bcaVA", biUtil.ValidateBCAVirtualAccountNumber)
+
+	dir := t.TempDir()
+	env := &testEnv{
+		partnerKey: generateKey(t),
+		mandiriKey: generateKey(t),
+	}
+
+	privateKeyPath := filepath.Join(dir, "private.pem")
+	writePEM(t, privateKeyPath, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(env.partnerKey))
+
+	publicKey, err := x509.MarshalPKIXPublicKey(&env.mandiriKey.PublicKey)
+	if err != nil {
+		t.Fatalf("marshalling public key: %v", err)
+	}
+	publicKeyPath := filepath.Join(dir, "mandiri.pem")
+	writePEM(t, publicKeyPath, "PUBLIC KEY", publicKey)
+
+	env.cfg = &biConfig.InternalConfig{
+		PrivateKeyPath: privateKeyPath,
+		AppHost:        "localhost",
+		TZ:             "Asia/Jakarta",
+	}
+	env.bCfg = &biConfig.BankConfig{
+		BankCredential: biConfig.BankCredential{
+			ClientID:      uuid.NewString(),
+			ClientSecret:  uuid.NewString(),
+			VAPrefix:      "88908",
+			PartnerID:     "MANDIRI-PARTNER",
+			PublicKeyPath: publicKeyPath,
+			SourceAccount: "1150006399259",
+		},
+		BankChannelConfig: biConfig.BankChannelConfig{
+			VAChannelId:       "95231",
+			BusinessChannelId: "95221",
+		},
+		BankRuntimeConfig: biConfig.BankRuntimeConfig{
+			AccessTokenExpirationTime: 900,
+		},
+		BankRequestedCredentials: biConfig.BankRequestedCredentials{
+			ClientID:              uuid.NewString(),
+			ClientSecret:          uuid.NewString(),
+			AccessTokenExpireTime: 900,
+		},
+		BankServiceEndpoints: biConfig.BankServiceEndpoints{
+			AccessTokenURL:    "/openapi/auth/v2.0/access-token/b2b",
+			BalanceInquiryURL: "/openapi/customers/v2.0/balance-inquiry",
+			PaymentFlagURL:    "/openapi/transfer-va/v1.0/status",
+		},
+		RequestedEndpoints: biConfig.RequestedEndpoints{
+			AuthURL:            "/mandiri/v1.0/access-token/b2b",
+			BillPresentmentURL: "/mandiri/v1.0/transfer-va/inquiry",
+			PaymentFlagURL:     "/mandiri/v1.0/transfer-va/payment",
+		},
+		IngressConfig: biConfig.IngressConfig{
+			ExternalIDTTL: 48 * time.Hour,
+		},
+		VirtualAccountConfig: biConfig.VirtualAccountConfig{
+			VirtualAccountLife: 24,
+		},
+	}
+
+	env.mock = newMockMandiri(t, env.bCfg, &env.partnerKey.PublicKey)
+	env.bCfg.BankServiceEndpoints.BaseUrl = env.mock.server.URL
+
+	env.redis = miniredis.RunT(t)
+	env.rdb = &biStorage.RedisInstance{RDB: redis.NewClient(&redis.Options{Addr: env.redis.Addr()})}
+
+	db, sqlMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("creating sql mock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	env.sqlMock = sqlMock
+
+	env.security, err = mandiriSecurity.NewMandiriSecurity(env.cfg, env.bCfg, nil)
+	if err != nil {
+		t.Fatalf("creating mandiri security: %v", err)
+	}
+
+	masterKey, err := biKeys.NewStaticMasterKey("test", bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatalf("creating master key: %v", err)
+	}
+	env.secrets = biKeys.NewEnvelope(masterKey)
+
+	// The client secret is stored encrypted, as migrated on startup once a master key is configured
+	credentials := env.bCfg.BankRequestedCredentials
+	storedSecret, err := env.secrets.Encrypt(context.Background(), credentials.ClientSecret, credentials.ClientID)
+	if err != nil {
+		t.Fatalf("encrypting client secret: %v", err)
+	}
+	sqlMock.ExpectQuery("SELECT id, bank_name, client_secret FROM authenticated_banks").
+		WithArgs(credentials.ClientID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "bank_name", "client_secret"}).AddRow(internalBankID, "Mandiri", storedSecret))
+	sqlMock.ExpectQuery("SELECT id_transaction, expired_date FROM va_request").
+		WithArgs(biUtil.VAStatusPending, internalBankID).
+		WillReturnRows(sqlmock.NewRows([]string{"id_transaction", "expired_date"}))
+
+	env.ingress = mandiriRequest.NewMandiriIngress(env.security)
+	env.ingress.Secrets = env.secrets
+
+	env.service, err = mandiriService.NewMandiriService(
+		mandiriRequest.NewMandiriEgress(env.security, env.bCfg, env.cfg),
+		env.ingress,
+		env.cfg,
+		env.bCfg,
+		db,
+		env.rdb,
+	)
+	if err != nil {
+		t.Fatalf("creating mandiri service: %v", err)
+	}
+
+	return env
+}
+
+// issueAccessToken stores an access token issued to the client of the requested credentials, along with its
+// encrypted client secret
+func issueAccessToken(t *testing.T, env *testEnv, accessToken string) {
+	t.Helper()
+
+	credentials := env.bCfg.BankRequestedCredentials
+	secret, err := env.secrets.Encrypt(context.Background(), credentials.ClientSecret, credentials.ClientID)
+	if err != nil {
+		t.Fatalf("encrypting client secret: %v", err)
+	}
+
+	if _, err := biTokens.NewStore(env.rdb).Issue(context.Background(), accessToken, credentials.ClientID, secret,
+		biUtil.AccessTokenScopeVA, time.Minute); err != nil {
+		t.Fatalf("issuing access token: %v", err)
+	}
+}
+
+func generateKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating rsa key: %v", err)
+	}
+
+	return key
+}
+
+func writePEM(t *testing.T, path, blockType string, data []byte) {
+	t.Helper()
+
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: data}), 0600); err != nil {
+		t.Fatalf("writing %s: %v", path, err)
+	}
+}
@@ -4,14 +4,16 @@ type BankLog struct {
 	ID               uint    `json:"id"`
 	HostIP           string  `json:"host_ip"`
 	ClientIP         string  `json:"client_ip"`
-	Latency          float32 `json:"latency"`
+	Latency          float32 `json:"latency"` // In milliseconds
 	HTTPMethod       string  `json:"http_method"`
 	Protocol         string  `json:"protocol"`
 	URI              string  `json:"uri"`
+	RequestHeader    string  `json:"request_header"`    // In JSON Format, secrets are redacted
 	RequestParameter string  `json:"request_parameter"` // In JSON Format
 	RequestBody      string  `json:"request_body"`      // In JSON Format
 	ResponseCode     uint    `json:"response_code"`
 	ResponseMessage  string  `json:"response_message"`
+	ResponseHeader   string  `json:"response_header"`  // In JSON Format, secrets are redacted
 	ResponseContent  string  `json:"response_content"` // In JSON Format
 	CreatedAt        string  `json:"created_at"`
 }
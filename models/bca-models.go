@@ -1,5 +1,14 @@
 package bank_integration_models
 
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/rotisserie/eris"
+	biConst "github.com/voxtmault/bank-integration/utils"
+)
+
 type BCARequestHeader struct {
 	Timestamp     string `validate:"required,timezone"`
 	ContentType   string `validate:"required"`
@@ -335,6 +344,20 @@ type BCAInquiryRequest struct {
 	AdditionalInfo          interface{} `json:"additionalInfo,omitempty"`                                                            // Additional information for custom use (optional)
 }
 
+// Digest identifies the content of a payment flag request. FlagAdvise is left out since it is the only field
+// changed by BCA when resending a payment flag.
+func (r BCAInquiryRequest) Digest() (string, error) {
+	r.FlagAdvise = ""
+
+	content, err := json.Marshal(r)
+	if err != nil {
+		return "", eris.Wrap(err, "marshalling payment flag request")
+	}
+	sum := sha256.Sum256(content)
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
 type InquiryResponse struct {
 	ResponseCode       string             `json:"responseCode" validate:"required"`       // Response code from partner
 	ResponseMessage    string             `json:"responseMessage" validate:"required"`    // Response message from partner
@@ -374,6 +397,19 @@ type BCAInquiryVAResponse struct {
 	BCAResponse
 	VirtualAccountData *VirtualAccountDataInquiry `json:"virtualAccountData,omitempty"` // Data related to virtual account
 	AdditionalInfo     interface{}                `json:"additionalInfo"`               // Additional information (optional)
+
+	Replayed json.RawMessage `json:"-"` // Body of the answer replayed to a resent payment flag, sent as is
+}
+
+// MarshalJSON gives back the replayed body when there is one, a resent payment flag gets the exact bytes of the
+// first answer
+func (r BCAInquiryVAResponse) MarshalJSON() ([]byte, error) {
+	if len(r.Replayed) > 0 {
+		return r.Replayed, nil
+	}
+
+	type response BCAInquiryVAResponse
+	return json.Marshal(response(r))
 }
 
 type VirtualAccountDataInquiry struct {
@@ -436,6 +472,33 @@ type CreatePaymentVARequestV2 struct {
 	AccountName     string    `json:"account_name" validate:"required,max=255"`
 	TotalAmount     string    `json:"total_amount" validate:"required,number"`
 	ExternalChannel chan uint `json:"-"`
+
+	// Defaults to a closed (fixed amount) bill, see biUtil.VATrxType for the other types. MinAmount and MaxAmount
+	// bound a single payment of a non closed VA.
+	VirtualAccountTrxType string `json:"virtual_account_trx_type" validate:"omitempty,oneof=C O I M L"`
+	MinAmount             string `json:"min_amount" validate:"required_if=VirtualAccountTrxType M,omitempty,number"`
+	MaxAmount             string `json:"max_amount" validate:"required_if=VirtualAccountTrxType L,omitempty,number"`
+}
+
+// AmountRule returns the amount rule of the requested VA with the amounts in the SNAP format
+func (r *CreatePaymentVARequestV2) AmountRule() *biConst.VAAmountRule {
+	rule := &biConst.VAAmountRule{
+		TrxType: biConst.VATrxType(r.VirtualAccountTrxType),
+		Total:   r.TotalAmount,
+		Min:     "0.00",
+		Max:     "0.00",
+	}
+	if rule.TrxType == "" {
+		rule.TrxType = biConst.VATrxTypeClosed
+	}
+	if minimum, err := biConst.ParseAmount(r.MinAmount); err == nil {
+		rule.Min = biConst.FormatAmount(minimum)
+	}
+	if maximum, err := biConst.ParseAmount(r.MaxAmount); err == nil {
+		rule.Max = biConst.FormatAmount(maximum)
+	}
+
+	return rule
 }
 
 type VAPaymentStatusRequest struct {
@@ -521,4 +584,77 @@ type BCATransactionStatusInquiryResponse struct {
 	SourceAccountNo            string `json:"sourceAccountNo"`
 	LatestTransactionStatus    string `json:"latestTransactionStatus"`
 	TransactionStatusDesc      string `json:"transactionStatusDesc"`
+
+	// Typed representation of LatestTransactionStatus, populated by the service after a successful inquiry
+	TransactionStatus BCATransactionStatus `json:"-"`
+}
+
+// BCATransactionStatus is the typed form of the latestTransactionStatus field returned by BCA Transfer Status Inquiry
+type BCATransactionStatus uint
+
+const (
+	BCATransactionStatusUnknown   BCATransactionStatus = iota // Status code not recognized by this library
+	BCATransactionStatusSuccess                               // 00
+	BCATransactionStatusInitiated                             // 01
+	BCATransactionStatusPaying                                // 02
+	BCATransactionStatusPending                               // 03
+	BCATransactionStatusRefunded                              // 04
+	BCATransactionStatusCanceled                              // 05
+	BCATransactionStatusFailed                                // 06
+	BCATransactionStatusNotFound                              // 07
+)
+
+var bcaTransactionStatusCodes = map[string]BCATransactionStatus{
+	"00": BCATransactionStatusSuccess,
+	"01": BCATransactionStatusInitiated,
+	"02": BCATransactionStatusPaying,
+	"03": BCATransactionStatusPending,
+	"04": BCATransactionStatusRefunded,
+	"05": BCATransactionStatusCanceled,
+	"06": BCATransactionStatusFailed,
+	"07": BCATransactionStatusNotFound,
+}
+
+// ParseBCATransactionStatus maps the latestTransactionStatus code sent by BCA into BCATransactionStatus.
+// Unrecognized codes are mapped into BCATransactionStatusUnknown
+func ParseBCATransactionStatus(code string) BCATransactionStatus {
+	if status, ok := bcaTransactionStatusCodes[code]; ok {
+		return status
+	}
+
+	return BCATransactionStatusUnknown
+}
+
+func (s BCATransactionStatus) String() string {
+	switch s {
+	case BCATransactionStatusSuccess:
+		return "Success"
+	case BCATransactionStatusInitiated:
+		return "Initiated"
+	case BCATransactionStatusPaying:
+		return "Paying"
+	case BCATransactionStatusPending:
+		return "Pending"
+	case BCATransactionStatusRefunded:
+		return "Refunded"
+	case BCATransactionStatusCanceled:
+		return "Canceled"
+	case BCATransactionStatusFailed:
+		return "Failed"
+	case BCATransactionStatusNotFound:
+		return "Not Found"
+	default:
+		return "Unknown"
+	}
+}
+
+// IsFinal reports whether the transfer has reached a state that will no longer change on BCA side
+func (s BCATransactionStatus) IsFinal() bool {
+	switch s {
+	case BCATransactionStatusSuccess, BCATransactionStatusRefunded, BCATransactionStatusCanceled,
+		BCATransactionStatusFailed, BCATransactionStatusNotFound:
+		return true
+	default:
+		return false
+	}
 }
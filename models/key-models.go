@@ -0,0 +1,19 @@
+package bank_integration_models
+
+import (
+	"time"
+
+	biConst "github.com/voxtmault/bank-integration/utils"
+)
+
+// KeyRotation is written into key_rotation every time the key manager of a bank service picks up new key material
+type KeyRotation struct {
+	ID                  uint64          `json:"id"`
+	IDBank              uint            `json:"id_bank"`
+	KeyType             biConst.KeyType `json:"key_type"`
+	Path                string          `json:"path"`
+	PreviousFingerprint string          `json:"previous_fingerprint"`
+	Fingerprint         string          `json:"fingerprint"`
+	GraceUntil          time.Time       `json:"grace_until"` // Previous public key is still accepted until then
+	CreatedAt           string          `json:"created_at"`
+}
@@ -1,5 +1,7 @@
 package bank_integration_models
 
+import "time"
+
 type AuthenticatedBank struct {
 	ID            uint   `json:"id"`
 	BankName      string `json:"bank_name"`
@@ -14,3 +16,35 @@ type BankClientCredential struct {
 	ClientSecret  string `json:"client_secret"`
 	PublicKeyPath string `json:"public_key_path"`
 }
+
+// UpdateAuthenticatedBank updates the editable fields of a registered client, fields left nil are kept as they are.
+// An empty PublicKeyPath removes the public key of the client, a 0 TimestampSkew (seconds) falls back to the
+// TIMESTAMP_SKEW of the bank configuration and an empty IPAllowlist (CIDRs or single addresses) accepts the callbacks
+// of the client from anywhere.
+type UpdateAuthenticatedBank struct {
+	BankName      *string   `json:"bank_name" validate:"omitnil,min=1"`
+	Note          *string   `json:"note"`
+	PublicKeyPath *string   `json:"public_key_path"`
+	TimestampSkew *uint     `json:"timestamp_skew"`
+	IPAllowlist   *[]string `json:"ip_allowlist"`
+}
+
+// AccessToken is an access token issued to a registered client
+type AccessToken struct {
+	Token        string    `json:"token"`
+	ClientID     string    `json:"client_id"` // Empty for the tokens issued before the token store
+	ClientSecret string    `json:"-"`
+	Scope        string    `json:"scope"`
+	IssuedAt     time.Time `json:"issued_at"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// AccessTokenIntrospection follows the RFC 7662 introspection response, only Active is set for inactive tokens
+type AccessTokenIntrospection struct {
+	Active    bool   `json:"active"`
+	ClientID  string `json:"client_id,omitempty"`
+	Scope     string `json:"scope,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+}
@@ -0,0 +1,20 @@
+package bank_integration_models
+
+import (
+	biConst "github.com/voxtmault/bank-integration/utils"
+)
+
+// PaymentEvent is written into the payment_event outbox in the same DB transaction as the va_request update,
+// and delivered at least once to every subscriber of the payment event dispatcher.
+type PaymentEvent struct {
+	ID               uint64                   `json:"id"` // Monotonic, used as the subscribers checkpoint
+	IDBank           uint                     `json:"id_bank"`
+	EventType        biConst.PaymentEventType `json:"event_type"`
+	IDVARequest      uint                     `json:"id_va_request"`
+	IDTransaction    uint                     `json:"id_transaction"`
+	VirtualAccountNo string                   `json:"virtual_account_no"`
+	PaymentRequestID string                   `json:"payment_request_id"`
+	PaidAmount       Amount                   `json:"paid_amount"`
+	TotalAmount      Amount                   `json:"total_amount"`
+	CreatedAt        string                   `json:"created_at"`
+}
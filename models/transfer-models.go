@@ -0,0 +1,27 @@
+package bank_integration_models
+
+import (
+	biConst "github.com/voxtmault/bank-integration/utils"
+)
+
+// TransferLedger represents a single outbound transfer persisted before it is sent to the bank
+type TransferLedger struct {
+	ID                   uint                   `json:"id"`
+	IDBank               uint                   `json:"id_bank"`
+	PartnerReferenceNo   string                 `json:"partner_reference_no"` // Our own identifier of the transfer, sent as partnerReferenceNo
+	ExternalID           string                 `json:"external_id"`          // X-EXTERNAL-ID used when sending the transfer, reused on every retry
+	ServiceCode          string                 `json:"service_code"`         // SNAP service code of the transfer, used for transfer status inquiry
+	SourceAccountNo      string                 `json:"source_account_no"`
+	BeneficiaryAccountNo string                 `json:"beneficiary_account_no"`
+	BeneficiaryBankCode  string                 `json:"beneficiary_bank_code"`
+	Amount               Amount                 `json:"amount"`
+	TransactionDate      string                 `json:"transaction_date"`
+	Status               biConst.TransferStatus `json:"status"`
+	ReferenceNo          string                 `json:"reference_no"`  // Reference number given by the bank upon success
+	RequestBody          []byte                 `json:"-"`             // Exact body sent to the bank, replayed on retry
+	ResponseBody         string                 `json:"-"`             // Last response body received from the bank
+	StatusReason         string                 `json:"status_reason"` // Reason of the current status
+	Attempts             uint                   `json:"attempts"`
+	CreatedAt            string                 `json:"created_at"`
+	UpdatedAt            string                 `json:"updated_at"`
+}
@@ -0,0 +1,32 @@
+package bank_integration_models
+
+import (
+	biConst "github.com/voxtmault/bank-integration/utils"
+)
+
+// WebhookEndpoint is an HTTP endpoint receiving the payment events. IDBank and IDTransaction narrow the scope of the
+// endpoint to a single authenticated bank or a single transaction (order), 0 matches everything.
+type WebhookEndpoint struct {
+	ID            uint                       `json:"id"`
+	IDBank        uint                       `json:"id_bank"`
+	IDTransaction uint                       `json:"id_transaction"`
+	URL           string                     `json:"url" validate:"required,url"`
+	Secret        string                     `json:"secret,omitempty"` // Key of the HMAC-SHA512 signature, generated when empty
+	EventTypes    []biConst.PaymentEventType `json:"event_types"`      // Empty means every event type
+	Active        bool                       `json:"active"`
+	CreatedAt     string                     `json:"created_at"`
+}
+
+// WebhookDelivery tracks the delivery of a single payment event to a single endpoint
+type WebhookDelivery struct {
+	ID                uint64                        `json:"id"`
+	IDWebhookEndpoint uint                          `json:"id_webhook_endpoint"`
+	IDPaymentEvent    uint64                        `json:"id_payment_event"`
+	Status            biConst.WebhookDeliveryStatus `json:"status"`
+	Attempts          uint                          `json:"attempts"`
+	NextAttemptAt     string                        `json:"next_attempt_at"`
+	LastResponseCode  int                           `json:"last_response_code"`
+	LastError         string                        `json:"last_error"`
+	CreatedAt         string                        `json:"created_at"`
+	UpdatedAt         string                        `json:"updated_at"`
+}
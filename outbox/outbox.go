@@ -0,0 +1,328 @@
+package bank_integration_outbox
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rotisserie/eris"
+	biModels "github.com/voxtmault/bank-integration/models"
+)
+
+const (
+	DefaultPollInterval  = 2 * time.Second
+	DefaultBatchSize     = 100
+	DefaultLeaseDuration = time.Minute
+	DefaultSettleWindow  = 10 * time.Minute
+)
+
+// Subscriber receives the payment events. Events are delivered at least once and by id, an event committed after a
+// more recent one is delivered once it is visible. Returning an error stops the delivery to the subscriber, the same
+// event is delivered again on the next attempt. Subscribers should
+// therefore be idempotent, e.g. by keeping track of PaymentEvent.ID.
+type Subscriber func(ctx context.Context, event *biModels.PaymentEvent) error
+
+// Record writes the payment event into the outbox. It must be called with the same transaction that updates
+// va_request so that an event exists if and only if the update is committed.
+func Record(ctx context.Context, tx *sql.Tx, event *biModels.PaymentEvent) error {
+	statement := `
+	INSERT INTO payment_event (id_bank, event_type, id_va_request, id_transaction, virtual_account_no,
+							   payment_request_id, paid_amount_value, paid_amount_currency, total_amount_value,
+							   total_amount_currency)
+	VALUES (?,?,?,?,?,?,?,?,?,?)
+	`
+	result, err := tx.ExecContext(ctx, statement, event.IDBank, event.EventType, event.IDVARequest, event.IDTransaction,
+		event.VirtualAccountNo, event.PaymentRequestID, event.PaidAmount.Value, event.PaidAmount.Currency,
+		event.TotalAmount.Value, event.TotalAmount.Currency,
+	)
+	if err != nil {
+		return eris.Wrap(err, "inserting payment_event")
+	}
+
+	if id, err := result.LastInsertId(); err == nil {
+		event.ID = uint64(id)
+	}
+
+	return nil
+}
+
+// Dispatcher delivers the payment events of the outbox to the registered subscribers. Every subscriber has a mark
+// (payment_event_checkpoint.last_contiguous_id) below which every event has been delivered to it, only the events
+// above it are looked at. The events delivered above the mark are recorded in payment_event_delivery, so that an
+// event committed after a more recent one is still delivered, and dropped once the mark passes them. Multiple
+// replicas may run a dispatcher with the same subscribers, a replica leases a subscriber for LeaseDuration so that
+// only one of them delivers to it at a time. No database lock is held while the subscriber is called.
+type Dispatcher struct {
+	db          *sql.DB
+	owner       string // Identifies the leases taken by this dispatcher
+	subscribers map[string]Subscriber
+
+	PollInterval  time.Duration
+	BatchSize     int
+	LeaseDuration time.Duration // Renewed after every delivered event, a crashed replica is taken over once it expires
+	// SettleWindow is the time the transaction recording an event is expected to commit within, the mark of a
+	// subscriber only passes the events recorded before it. An event committed later than that may be skipped.
+	SettleWindow time.Duration
+
+	sync.RWMutex
+}
+
+func NewDispatcher(db *sql.DB) *Dispatcher {
+	return &Dispatcher{
+		db:            db,
+		owner:         uuid.NewString(),
+		subscribers:   make(map[string]Subscriber),
+		PollInterval:  DefaultPollInterval,
+		BatchSize:     DefaultBatchSize,
+		LeaseDuration: DefaultLeaseDuration,
+		SettleWindow:  DefaultSettleWindow,
+	}
+}
+
+// Subscribe registers a subscriber under a stable name, the name is used as the delivery key. A new subscriber
+// starts from the first event still present in the outbox.
+func (d *Dispatcher) Subscribe(name string, subscriber Subscriber) error {
+	if name == "" || len(name) > 64 {
+		return eris.New("subscriber name must be between 1 and 64 characters")
+	}
+	if subscriber == nil {
+		return eris.New("nil subscriber")
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	if _, exists := d.subscribers[name]; exists {
+		return eris.Errorf("subscriber %s is already registered", name)
+	}
+	d.subscribers[name] = subscriber
+
+	return nil
+}
+
+// Run delivers the pending events every PollInterval until ctx is cancelled
+func (d *Dispatcher) Run(ctx context.Context) error {
+	ticker := time.NewTicker(d.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		// Failures are logged per subscriber and retried on the next tick
+		d.Dispatch(ctx)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Dispatch delivers every pending event to every subscriber once. Errors of a subscriber do not prevent the
+// delivery to the other subscribers.
+func (d *Dispatcher) Dispatch(ctx context.Context) error {
+	d.RLock()
+	names := make([]string, 0, len(d.subscribers))
+	for name := range d.subscribers {
+		names = append(names, name)
+	}
+	d.RUnlock()
+	sort.Strings(names)
+
+	failed := 0
+	for _, name := range names {
+		d.RLock()
+		subscriber := d.subscribers[name]
+		d.RUnlock()
+
+		for {
+			delivered, err := d.dispatchBatch(ctx, name, subscriber)
+			if err != nil {
+				slog.Error("error dispatching payment events", "subscriber", name, "error", err)
+				failed++
+				break
+			}
+			// A partial batch means the subscriber caught up with the outbox
+			if delivered < d.BatchSize {
+				break
+			}
+		}
+	}
+
+	if failed > 0 {
+		return eris.Errorf("payment event delivery failed for %d subscriber(s)", failed)
+	}
+
+	return nil
+}
+
+func (d *Dispatcher) dispatchBatch(ctx context.Context, name string, subscriber Subscriber) (int, error) {
+	if _, err := d.db.ExecContext(ctx, `INSERT IGNORE INTO payment_event_checkpoint (subscriber) VALUES (?)`, name); err != nil {
+		return 0, eris.Wrap(err, "creating checkpoint")
+	}
+
+	// The lease is committed right away, another replica holding it is left alone
+	leased, err := d.lease(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+	if !leased {
+		slog.Debug("payment event subscriber is leased by another dispatcher", "subscriber", name)
+		return 0, nil
+	}
+	defer d.release(context.WithoutCancel(ctx), name)
+
+	events, err := d.pendingEvents(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+
+	delivered := 0
+	for _, event := range events {
+		if err := deliver(ctx, subscriber, event); err != nil {
+			slog.Warn("payment event delivery failed", "subscriber", name, "event", event.ID, "error", err)
+			return delivered, eris.Wrap(err, "delivering payment event")
+		}
+
+		statement := `INSERT IGNORE INTO payment_event_delivery (subscriber, id_payment_event) VALUES (?,?)`
+		if _, err := d.db.ExecContext(ctx, statement, name, event.ID); err != nil {
+			return delivered, eris.Wrap(err, "recording payment event delivery")
+		}
+		delivered++
+
+		if leased, err = d.lease(ctx, name); err != nil {
+			return delivered, err
+		}
+		if !leased {
+			return delivered, eris.Errorf("lease of subscriber %s has been taken over", name)
+		}
+	}
+
+	if err := d.advance(ctx, name); err != nil {
+		return delivered, err
+	}
+
+	return delivered, nil
+}
+
+// advance moves the mark of the subscriber up to the first event not delivered to it yet, passing only the events
+// recorded more than SettleWindow ago: the id of an event whose transaction is still in flight is not visible yet.
+// The deliveries recorded below the new mark are dropped.
+func (d *Dispatcher) advance(ctx context.Context, name string) error {
+	statement := `
+	SELECT c.last_contiguous_id,
+		   COALESCE((SELECT MAX(p.id) FROM payment_event p
+					 WHERE p.id > c.last_contiguous_id AND p.created_at < NOW() - INTERVAL ? SECOND), 0),
+		   COALESCE((SELECT MIN(p.id) FROM payment_event p
+					 LEFT JOIN payment_event_delivery d ON d.id_payment_event = p.id AND d.subscriber = c.subscriber
+					 WHERE p.id > c.last_contiguous_id AND d.id_payment_event IS NULL), 0)
+	FROM payment_event_checkpoint c
+	WHERE c.subscriber = ?
+	`
+	var mark, settled, pending uint64
+	if err := d.db.QueryRowContext(ctx, statement, int(d.SettleWindow.Seconds()), name).Scan(&mark, &settled, &pending); err != nil {
+		return eris.Wrap(err, "querying checkpoint")
+	}
+
+	next := settled
+	if pending != 0 && pending-1 < next {
+		next = pending - 1
+	}
+	if next <= mark {
+		return nil
+	}
+
+	statement = `
+	UPDATE payment_event_checkpoint SET last_contiguous_id = ?
+	WHERE subscriber = ? AND locked_by = ? AND last_contiguous_id = ?
+	`
+	if _, err := d.db.ExecContext(ctx, statement, next, name, d.owner, mark); err != nil {
+		return eris.Wrap(err, "advancing checkpoint")
+	}
+
+	statement = `DELETE FROM payment_event_delivery WHERE subscriber = ? AND id_payment_event <= ?`
+	if _, err := d.db.ExecContext(ctx, statement, name, next); err != nil {
+		return eris.Wrap(err, "pruning payment event deliveries")
+	}
+
+	return nil
+}
+
+// lease takes or renews the lease of the subscriber, false is returned while another dispatcher holds it
+func (d *Dispatcher) lease(ctx context.Context, name string) (bool, error) {
+	statement := `
+	UPDATE payment_event_checkpoint SET locked_by = ?, locked_until = NOW() + INTERVAL ? SECOND
+	WHERE subscriber = ? AND (locked_by = ? OR locked_until IS NULL OR locked_until < NOW())
+	`
+	result, err := d.db.ExecContext(ctx, statement, d.owner, int(d.LeaseDuration.Seconds()), name, d.owner)
+	if err != nil {
+		return false, eris.Wrap(err, "leasing subscriber")
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, eris.Wrap(err, "leasing subscriber")
+	}
+
+	return affected > 0, nil
+}
+
+// release gives the lease of the subscriber back, so that the next dispatcher does not wait for it to expire
+func (d *Dispatcher) release(ctx context.Context, name string) {
+	statement := `UPDATE payment_event_checkpoint SET locked_until = NULL WHERE subscriber = ? AND locked_by = ?`
+	if _, err := d.db.ExecContext(ctx, statement, name, d.owner); err != nil {
+		slog.Error("error releasing payment event subscriber", "subscriber", name, "error", err)
+	}
+}
+
+// pendingEvents returns the events above the mark of the subscriber not delivered to it yet, oldest first
+func (d *Dispatcher) pendingEvents(ctx context.Context, name string) ([]*biModels.PaymentEvent, error) {
+	statement := `
+	SELECT p.id, p.id_bank, p.event_type, p.id_va_request, p.id_transaction, p.virtual_account_no, p.payment_request_id,
+		   p.paid_amount_value, p.paid_amount_currency, p.total_amount_value, p.total_amount_currency, p.created_at
+	FROM payment_event_checkpoint c
+	JOIN payment_event p ON p.id > c.last_contiguous_id
+	LEFT JOIN payment_event_delivery d ON d.id_payment_event = p.id AND d.subscriber = c.subscriber
+	WHERE c.subscriber = ? AND d.id_payment_event IS NULL
+	ORDER BY p.id
+	LIMIT ?
+	`
+	rows, err := d.db.QueryContext(ctx, statement, name, d.BatchSize)
+	if err != nil {
+		return nil, eris.Wrap(err, "querying payment_event")
+	}
+	defer rows.Close()
+
+	var events []*biModels.PaymentEvent
+	for rows.Next() {
+		var obj biModels.PaymentEvent
+		if err := rows.Scan(&obj.ID, &obj.IDBank, &obj.EventType, &obj.IDVARequest, &obj.IDTransaction,
+			&obj.VirtualAccountNo, &obj.PaymentRequestID, &obj.PaidAmount.Value, &obj.PaidAmount.Currency,
+			&obj.TotalAmount.Value, &obj.TotalAmount.Currency, &obj.CreatedAt,
+		); err != nil {
+			return nil, eris.Wrap(err, "scanning payment_event")
+		}
+		events = append(events, &obj)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, eris.Wrap(err, "iterating payment_event")
+	}
+
+	return events, nil
+}
+
+// deliver calls the subscriber, a panicking subscriber is treated as a failed delivery
+func deliver(ctx context.Context, subscriber Subscriber, event *biModels.PaymentEvent) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("subscriber panicked: %v", r)
+		}
+	}()
+
+	return subscriber(ctx, event)
+}
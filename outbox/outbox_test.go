@@ -0,0 +1,233 @@
+package bank_integration_outbox
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	biModels "github.com/voxtmault/bank-integration/models"
+	biUtil "github.com/voxtmault/bank-integration/utils"
+)
+
+var eventColumns = []string{"id", "id_bank", "event_type", "id_va_request", "id_transaction", "virtual_account_no",
+	"payment_request_id", "paid_amount_value", "paid_amount_currency", "total_amount_value", "total_amount_currency", "created_at"}
+
+func expectBatch(mock sqlmock.Sqlmock, subscriber string, rows *sqlmock.Rows) {
+	mock.ExpectExec("INSERT IGNORE INTO payment_event_checkpoint").WithArgs(subscriber).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectLease(mock, subscriber, true)
+	mock.ExpectQuery("LEFT JOIN payment_event_delivery").WithArgs(subscriber, DefaultBatchSize).WillReturnRows(rows)
+}
+
+func expectLease(mock sqlmock.Sqlmock, subscriber string, leased bool) {
+	affected := int64(0)
+	if leased {
+		affected = 1
+	}
+	mock.ExpectExec("UPDATE payment_event_checkpoint SET locked_by").
+		WithArgs(sqlmock.AnyArg(), 60, subscriber, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, affected))
+}
+
+func expectDelivery(mock sqlmock.Sqlmock, subscriber string, id uint64) {
+	mock.ExpectExec("INSERT IGNORE INTO payment_event_delivery").WithArgs(subscriber, id).WillReturnResult(sqlmock.NewResult(0, 1))
+	expectLease(mock, subscriber, true)
+}
+
+// expectAdvance expects the mark of the subscriber to be looked up, and moved to next when it is above mark
+func expectAdvance(mock sqlmock.Sqlmock, subscriber string, mark, settled, pending, next uint64) {
+	mock.ExpectQuery("SELECT c.last_contiguous_id").WithArgs(600, subscriber).
+		WillReturnRows(sqlmock.NewRows([]string{"last_contiguous_id", "settled", "pending"}).AddRow(mark, settled, pending))
+	if next <= mark {
+		return
+	}
+	mock.ExpectExec("UPDATE payment_event_checkpoint SET last_contiguous_id").
+		WithArgs(next, subscriber, sqlmock.AnyArg(), mark).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM payment_event_delivery").WithArgs(subscriber, next).WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func expectRelease(mock sqlmock.Sqlmock, subscriber string) {
+	mock.ExpectExec("UPDATE payment_event_checkpoint SET locked_until = NULL").WithArgs(subscriber, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func TestRecord(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("creating sql mock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO payment_event").
+		WithArgs(1, biUtil.PaymentEventVAPaid, 3, 4, "1234500001", "req-1", "10000.00", "IDR", "10000.00", "IDR").
+		WillReturnResult(sqlmock.NewResult(77, 1))
+	mock.ExpectCommit()
+
+	tx, _ := db.Begin()
+	event := &biModels.PaymentEvent{
+		IDBank:           1,
+		EventType:        biUtil.PaymentEventVAPaid,
+		IDVARequest:      3,
+		IDTransaction:    4,
+		VirtualAccountNo: "1234500001",
+		PaymentRequestID: "req-1",
+		PaidAmount:       biModels.Amount{Value: "10000.00", Currency: "IDR"},
+		TotalAmount:      biModels.Amount{Value: "10000.00", Currency: "IDR"},
+	}
+	if err := Record(context.Background(), tx, event); err != nil {
+		t.Fatalf("recording event: %v", err)
+	}
+	tx.Commit()
+
+	if event.ID != 77 {
+		t.Fatalf("expected the event id to be set, got %d", event.ID)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDispatchCheckpointsDeliveredEvents(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("creating sql mock: %v", err)
+	}
+	defer db.Close()
+
+	d := NewDispatcher(db)
+
+	var received []uint64
+	failOn := uint64(12)
+	if err := d.Subscribe("orders", func(ctx context.Context, event *biModels.PaymentEvent) error {
+		if event.ID == failOn {
+			return errors.New("order service is down")
+		}
+		received = append(received, event.ID)
+		return nil
+	}); err != nil {
+		t.Fatalf("subscribing: %v", err)
+	}
+	if err := d.Subscribe("orders", func(ctx context.Context, event *biModels.PaymentEvent) error { return nil }); err == nil {
+		t.Fatal("expected duplicate subscriber to fail")
+	}
+
+	// First pass, event 12 fails so only 11 is recorded as delivered
+	expectBatch(mock, "orders", sqlmock.NewRows(eventColumns).
+		AddRow(11, 1, "va.paid", 3, 4, "1234500001", "req-1", "10000.00", "IDR", "10000.00", "IDR", "2024-10-18 10:00:00").
+		AddRow(12, 1, "va.paid", 5, 6, "1234500002", "req-2", "20000.00", "IDR", "20000.00", "IDR", "2024-10-18 10:00:01"))
+	expectDelivery(mock, "orders", 11)
+	expectRelease(mock, "orders")
+
+	if err := d.Dispatch(context.Background()); err == nil {
+		t.Fatal("expected the failed delivery to be reported")
+	}
+
+	// Second pass, event 12 is delivered again along with event 9, committed after event 11 with a lower id
+	failOn = 0
+	expectBatch(mock, "orders", sqlmock.NewRows(eventColumns).
+		AddRow(9, 1, "va.paid", 1, 2, "1234500009", "req-9", "5000.00", "IDR", "5000.00", "IDR", "2024-10-18 09:59:59").
+		AddRow(12, 1, "va.paid", 5, 6, "1234500002", "req-2", "20000.00", "IDR", "20000.00", "IDR", "2024-10-18 10:00:01"))
+	expectDelivery(mock, "orders", 9)
+	expectDelivery(mock, "orders", 12)
+	expectAdvance(mock, "orders", 0, 12, 0, 12)
+	expectRelease(mock, "orders")
+
+	if err := d.Dispatch(context.Background()); err != nil {
+		t.Fatalf("dispatching: %v", err)
+	}
+
+	if len(received) != 3 || received[0] != 11 || received[1] != 9 || received[2] != 12 {
+		t.Fatalf("unexpected delivered events: %v", received)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDispatchAdvancesMark(t *testing.T) {
+	for _, test := range []struct {
+		name                   string
+		mark, settled, pending uint64
+		next                   uint64
+	}{
+		{"every settled event delivered", 8, 12, 15, 12},
+		{"up to the first undelivered event", 8, 12, 10, 9},
+		{"only events still settling", 8, 8, 0, 8},
+		{"first event above the mark undelivered", 8, 12, 9, 8},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("creating sql mock: %v", err)
+			}
+			defer db.Close()
+
+			d := NewDispatcher(db)
+			d.Subscribe("orders", func(ctx context.Context, event *biModels.PaymentEvent) error { return nil })
+
+			expectBatch(mock, "orders", sqlmock.NewRows(eventColumns))
+			expectAdvance(mock, "orders", test.mark, test.settled, test.pending, test.next)
+			expectRelease(mock, "orders")
+
+			if err := d.Dispatch(context.Background()); err != nil {
+				t.Fatalf("dispatching: %v", err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestDispatchRecoversPanickingSubscriber(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("creating sql mock: %v", err)
+	}
+	defer db.Close()
+
+	d := NewDispatcher(db)
+	d.Subscribe("panics", func(ctx context.Context, event *biModels.PaymentEvent) error {
+		panic("boom")
+	})
+
+	expectBatch(mock, "panics", sqlmock.NewRows(eventColumns).
+		AddRow(1, 1, "va.paid", 3, 4, "1234500001", "req-1", "10000.00", "IDR", "10000.00", "IDR", "2024-10-18 10:00:00"))
+	expectRelease(mock, "panics")
+
+	if err := d.Dispatch(context.Background()); err == nil {
+		t.Fatal("expected the panic to be reported as a failed delivery")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDispatchSkipsLeasedSubscriber(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("creating sql mock: %v", err)
+	}
+	defer db.Close()
+
+	d := NewDispatcher(db)
+	called := false
+	d.Subscribe("orders", func(ctx context.Context, event *biModels.PaymentEvent) error {
+		called = true
+		return nil
+	})
+
+	// Another replica holds the lease, the events are left to it
+	mock.ExpectExec("INSERT IGNORE INTO payment_event_checkpoint").WithArgs("orders").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectLease(mock, "orders", false)
+
+	if err := d.Dispatch(context.Background()); err != nil {
+		t.Fatalf("dispatching: %v", err)
+	}
+	if called {
+		t.Fatal("expected the subscriber not to be called")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
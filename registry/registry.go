@@ -0,0 +1,231 @@
+package bank_integration_registry
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"log/slog"
+	"sort"
+	"sync"
+
+	"github.com/rotisserie/eris"
+	biConfig "github.com/voxtmault/bank-integration/config"
+	biHTTPClient "github.com/voxtmault/bank-integration/httpclient"
+	biInterfaces "github.com/voxtmault/bank-integration/interfaces"
+	biKeys "github.com/voxtmault/bank-integration/keys"
+	biStorage "github.com/voxtmault/bank-integration/storage"
+)
+
+// Dependencies bundles the shared resources that are handed to every provider factory
+type Dependencies struct {
+	Config *biConfig.InternalConfig
+	DB     *sql.DB
+	RDB    *biStorage.RedisInstance
+
+	// Signer signs the requests sent to the banks, the signer provider selected by PRIVATE_KEY_PROVIDER is used
+	// when it is nil
+	Signer biKeys.SignerProvider
+
+	// Secrets encrypts the client secrets at rest, nil when no master key is configured
+	Secrets *biKeys.Envelope
+
+	// HTTPClient sends the requests to the banks, every service creates its own when it is nil
+	HTTPClient *biHTTPClient.Client
+}
+
+// Factory creates a new SNAP implementation of a bank provider. A provider is free to create as many instances as
+// requested, each instance is identified by the InternalBankID of its BankConfig once the factory returns.
+type Factory func(ctx context.Context, deps *Dependencies, bCfg *biConfig.BankConfig) (biInterfaces.SNAP, error)
+
+// Registry maps bank codes (e.g. utils.BankCodeBCA) to provider factories and keeps track of the running
+// instances by their internal bank id, allowing multiple instances of the same provider to run side by side.
+type Registry struct {
+	factories map[string]Factory
+	instances map[uint]*instance
+	sync.RWMutex
+}
+
+type instance struct {
+	bankCode string
+	bCfg     *biConfig.BankConfig
+	service  biInterfaces.SNAP
+}
+
+var defaultRegistry = New()
+
+func New() *Registry {
+	return &Registry{
+		factories: make(map[string]Factory),
+		instances: make(map[uint]*instance),
+	}
+}
+
+// Default returns the process wide registry used by the top level helpers of the library
+func Default() *Registry {
+	return defaultRegistry
+}
+
+// Register adds a provider factory into the default registry
+func Register(bankCode string, factory Factory) error {
+	return defaultRegistry.Register(bankCode, factory)
+}
+
+// Register adds a provider factory for the given bank code. Registering the same bank code twice is an error.
+func (r *Registry) Register(bankCode string, factory Factory) error {
+	if bankCode == "" {
+		return eris.New("empty bank code")
+	}
+	if factory == nil {
+		return eris.New("nil provider factory")
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if _, exists := r.factories[bankCode]; exists {
+		return eris.Errorf("provider %s is already registered", bankCode)
+	}
+	r.factories[bankCode] = factory
+
+	return nil
+}
+
+// Providers returns the sorted list of registered bank codes
+func (r *Registry) Providers() []string {
+	r.RLock()
+	defer r.RUnlock()
+
+	codes := make([]string, 0, len(r.factories))
+	for code := range r.factories {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+
+	return codes
+}
+
+// Open creates a new instance of the provider registered under bankCode and keeps it under its internal bank id. An
+// instance whose bank id is already served is closed (see io.Closer) and an error returned.
+func (r *Registry) Open(ctx context.Context, bankCode string, deps *Dependencies, bCfg *biConfig.BankConfig) (biInterfaces.SNAP, error) {
+	r.RLock()
+	factory, exists := r.factories[bankCode]
+	existing := r.instances[bCfg.BankCredential.InternalBankID]
+	r.RUnlock()
+	if !exists {
+		return nil, eris.Errorf("provider %s is not registered", bankCode)
+	}
+
+	// A bank id known beforehand is checked before creating anything
+	if existing != nil {
+		return nil, eris.Errorf("bank id %d is already served by a %s provider instance", bCfg.BankCredential.InternalBankID, existing.bankCode)
+	}
+
+	service, err := factory(ctx, deps, bCfg)
+	if err != nil {
+		return nil, eris.Wrapf(err, "creating %s provider instance", bankCode)
+	}
+
+	// The internal bank id is resolved by the provider from authenticated_banks
+	idBank := bCfg.BankCredential.InternalBankID
+	if idBank == 0 {
+		closeService(service)
+		return nil, eris.Errorf("%s provider instance did not resolve its internal bank id", bankCode)
+	}
+
+	r.Lock()
+	if existing, exists := r.instances[idBank]; exists {
+		r.Unlock()
+		closeService(service)
+		return nil, eris.Errorf("bank id %d is already served by a %s provider instance", idBank, existing.bankCode)
+	}
+	r.instances[idBank] = &instance{
+		bankCode: bankCode,
+		bCfg:     bCfg,
+		service:  service,
+	}
+	r.Unlock()
+
+	slog.Debug("provider instance opened", "bank code", bankCode, "id bank", idBank)
+
+	return service, nil
+}
+
+// Get returns the instance serving the given internal bank id
+func (r *Registry) Get(idBank uint) (biInterfaces.SNAP, error) {
+	r.RLock()
+	defer r.RUnlock()
+
+	if obj, exists := r.instances[idBank]; exists {
+		return obj.service, nil
+	}
+
+	return nil, eris.Errorf("no provider instance for bank id %d", idBank)
+}
+
+// Config returns the bank configuration the instance serving the given internal bank id was opened with
+func (r *Registry) Config(idBank uint) (*biConfig.BankConfig, error) {
+	r.RLock()
+	defer r.RUnlock()
+
+	if obj, exists := r.instances[idBank]; exists {
+		return obj.bCfg, nil
+	}
+
+	return nil, eris.Errorf("no provider instance for bank id %d", idBank)
+}
+
+// GetByBankCode returns every instance of the given provider, ordered by their internal bank id
+func (r *Registry) GetByBankCode(bankCode string) []biInterfaces.SNAP {
+	r.RLock()
+	defer r.RUnlock()
+
+	var ids []uint
+	for id, obj := range r.instances {
+		if obj.bankCode == bankCode {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	services := make([]biInterfaces.SNAP, 0, len(ids))
+	for _, id := range ids {
+		services = append(services, r.instances[id].service)
+	}
+
+	return services
+}
+
+// BankIDs returns the sorted internal bank ids of every running instance
+func (r *Registry) BankIDs() []uint {
+	r.RLock()
+	defer r.RUnlock()
+
+	ids := make([]uint, 0, len(r.instances))
+	for id := range r.instances {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	return ids
+}
+
+// Remove forgets the instance serving the given internal bank id and closes it (see io.Closer)
+func (r *Registry) Remove(idBank uint) {
+	r.Lock()
+	obj, exists := r.instances[idBank]
+	delete(r.instances, idBank)
+	r.Unlock()
+
+	if exists {
+		closeService(obj.service)
+	}
+}
+
+// closeService releases the resources of an instance implementing io.Closer (watchers, key reloads)
+func closeService(service biInterfaces.SNAP) {
+	if closer, ok := service.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			slog.Error("error closing provider instance", "error", err)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package bank_integration_registry
+
+import (
+	"context"
+	"testing"
+
+	biConfig "github.com/voxtmault/bank-integration/config"
+	biInterfaces "github.com/voxtmault/bank-integration/interfaces"
+)
+
+type fakeService struct {
+	biInterfaces.SNAP
+	idBank uint
+	closed int
+}
+
+func (s *fakeService) Close() error {
+	s.closed++
+	return nil
+}
+
+// created holds every instance made by fakeFactory, in order
+var created []*fakeService
+
+func fakeFactory(ctx context.Context, deps *Dependencies, bCfg *biConfig.BankConfig) (biInterfaces.SNAP, error) {
+	// Mimics a provider resolving its internal bank id from authenticated_banks
+	bCfg.BankCredential.InternalBankID = uint(len(bCfg.BankRequestedCredentials.ClientID))
+	service := &fakeService{idBank: bCfg.BankCredential.InternalBankID}
+	created = append(created, service)
+	return service, nil
+}
+
+func TestRegistryMultipleInstances(t *testing.T) {
+	r := New()
+
+	if err := r.Register("fake", fakeFactory); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	if err := r.Register("fake", fakeFactory); err == nil {
+		t.Fatal("expected duplicate registration to fail")
+	}
+
+	first, err := r.Open(context.Background(), "fake", &Dependencies{}, &biConfig.BankConfig{
+		BankRequestedCredentials: biConfig.BankRequestedCredentials{ClientID: "a"},
+	})
+	if err != nil {
+		t.Fatalf("open first instance: %v", err)
+	}
+	second, err := r.Open(context.Background(), "fake", &Dependencies{}, &biConfig.BankConfig{
+		BankRequestedCredentials: biConfig.BankRequestedCredentials{ClientID: "ab"},
+	})
+	if err != nil {
+		t.Fatalf("open second instance: %v", err)
+	}
+
+	if _, err := r.Open(context.Background(), "fake", &Dependencies{}, &biConfig.BankConfig{
+		BankRequestedCredentials: biConfig.BankRequestedCredentials{ClientID: "b"},
+	}); err == nil {
+		t.Fatal("expected an instance with a duplicate bank id to fail")
+	}
+
+	if _, err := r.Open(context.Background(), "unknown", &Dependencies{}, &biConfig.BankConfig{}); err == nil {
+		t.Fatal("expected an unregistered provider to fail")
+	}
+
+	got, err := r.Get(1)
+	if err != nil || got != first {
+		t.Fatalf("expected first instance for bank id 1, got %v (%v)", got, err)
+	}
+	got, err = r.Get(2)
+	if err != nil || got != second {
+		t.Fatalf("expected second instance for bank id 2, got %v (%v)", got, err)
+	}
+
+	if bCfg, err := r.Config(2); err != nil || bCfg.BankRequestedCredentials.ClientID != "ab" {
+		t.Fatalf("expected bank config of the second instance, got %v (%v)", bCfg, err)
+	}
+
+	if services := r.GetByBankCode("fake"); len(services) != 2 || services[0] != first {
+		t.Fatalf("unexpected instances by bank code: %v", services)
+	}
+
+	r.Remove(1)
+	if _, err := r.Get(1); err == nil {
+		t.Fatal("expected removed instance to be gone")
+	}
+	if closed := first.(*fakeService).closed; closed != 1 {
+		t.Fatalf("expected removed instance to be closed once, got %d", closed)
+	}
+	r.Remove(1)
+	if closed := first.(*fakeService).closed; closed != 1 {
+		t.Fatalf("expected an unknown bank id not to close anything, got %d", closed)
+	}
+}
+
+func TestRegistryRejectedInstanceClosed(t *testing.T) {
+	created = nil
+	r := New()
+	if err := r.Register("fake", fakeFactory); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+
+	if _, err := r.Open(context.Background(), "fake", &Dependencies{}, &biConfig.BankConfig{
+		BankRequestedCredentials: biConfig.BankRequestedCredentials{ClientID: "a"},
+	}); err != nil {
+		t.Fatalf("open first instance: %v", err)
+	}
+
+	// Resolved to a served bank id only once created, the instance is closed
+	if _, err := r.Open(context.Background(), "fake", &Dependencies{}, &biConfig.BankConfig{
+		BankRequestedCredentials: biConfig.BankRequestedCredentials{ClientID: "b"},
+	}); err == nil {
+		t.Fatal("expected an instance with a duplicate bank id to fail")
+	}
+	if len(created) != 2 || created[1].closed != 1 {
+		t.Fatalf("expected the rejected instance to be closed once, got %d instances", len(created))
+	}
+	if created[0].closed != 0 {
+		t.Fatal("expected the served instance to stay open")
+	}
+
+	// A served bank id known beforehand never reaches the factory
+	bCfg := &biConfig.BankConfig{BankRequestedCredentials: biConfig.BankRequestedCredentials{ClientID: "c"}}
+	bCfg.BankCredential.InternalBankID = 1
+	if _, err := r.Open(context.Background(), "fake", &Dependencies{}, bCfg); err == nil {
+		t.Fatal("expected a known duplicate bank id to fail")
+	}
+	if len(created) != 2 {
+		t.Fatalf("expected no instance to be created for a known duplicate, got %d instances", len(created))
+	}
+}
@@ -4,19 +4,40 @@ import (
 	"context"
 	"database/sql"
 	"log/slog"
+	"os"
 	"strconv"
 
 	"github.com/rotisserie/eris"
+	biKeys "github.com/voxtmault/bank-integration/keys"
+	management "github.com/voxtmault/bank-integration/management"
 	biStorage "github.com/voxtmault/bank-integration/storage"
 	biUtil "github.com/voxtmault/bank-integration/utils"
 )
 
+// MigrateClientSecrets encrypts the client secrets stored in plaintext, or with a previous master key, with the
+// primary master key of secrets and returns how many were rewritten. Secrets already encrypted with the primary
+// master key are left as is, so running it again, or from several instances at once, only migrates what is left.
+// InitBankAPI runs it before loading the authenticated banks once SECRET_MASTER_KEY is set.
+func MigrateClientSecrets(ctx context.Context, db *sql.DB, rdb *biStorage.RedisInstance, secrets *biKeys.Envelope) (int, error) {
+	if secrets == nil {
+		return 0, eris.New("no master key configured")
+	}
+
+	count, err := management.NewBankIntegrationManagement(db, rdb, secrets).ReencryptClientSecrets(ctx)
+	if err != nil {
+		return 0, eris.Wrap(err, "migrating client secrets")
+	}
+
+	return count, nil
+}
+
 // LoadAuthenticatedBanks will first retrieve the registered banks client credentials from a DB
 // and then load them up into redis for faster lookup
 func LoadAuthenticatedBanks(db *sql.DB, rdb *biStorage.RedisInstance) error {
 
 	statement := `
-	SELECT client_id, client_secret, id, bank_name
+	SELECT client_id, client_secret, id, bank_name, COALESCE(public_key_path, ''), COALESCE(timestamp_skew, 0),
+	COALESCE(ip_allowlist, '')
 	FROM authenticated_banks
 	WHERE deleted_at IS NULL
 	`
@@ -27,13 +48,25 @@ func LoadAuthenticatedBanks(db *sql.DB, rdb *biStorage.RedisInstance) error {
 	}
 	defer rows.Close()
 
-	var clientId, clientSecret, bankName string
-	var id int
+	var clientId, clientSecret, bankName, publicKeyPath, ipAllowlist string
+	var id, timestampSkew int
 	for rows.Next() {
-		if err := rows.Scan(&clientId, &clientSecret, &id, &bankName); err != nil {
+		if err := rows.Scan(&clientId, &clientSecret, &id, &bankName, &publicKeyPath, &timestampSkew, &ipAllowlist); err != nil {
 			return eris.Wrap(err, "scanning rows")
 		}
 
+		// A client registered with its own public key must never be verified with the bank key, an unreadable key
+		// fails the startup before any credential of the client is loaded
+		var keyData []byte
+		if publicKeyPath != "" {
+			if keyData, err = os.ReadFile(publicKeyPath); err == nil {
+				_, err = biUtil.ParsePublicKey(keyData)
+			}
+			if err != nil {
+				return eris.Wrapf(err, "loading public key of authenticated bank %d", id)
+			}
+		}
+
 		// Set the client credentials to redis
 		if err := rdb.RDB.HSet(context.Background(), biUtil.ClientCredentialsRedis, clientId, clientSecret).Err(); err != nil {
 			return eris.Wrap(err, "saving client credentials to redis")
@@ -43,7 +76,28 @@ func LoadAuthenticatedBanks(db *sql.DB, rdb *biStorage.RedisInstance) error {
 		if err := rdb.RDB.HSet(context.Background(), biUtil.AuthenticatedBankNameRedis, strconv.Itoa(id), bankName).Err(); err != nil {
 			return eris.Wrap(err, "saving authenticated bank name to redis")
 		}
+
+		// Clients without their own clock skew use the one of the bank configuration
+		if timestampSkew > 0 {
+			if err := rdb.RDB.HSet(context.Background(), biUtil.ClientTimestampSkewRedis, clientId, timestampSkew).Err(); err != nil {
+				return eris.Wrap(err, "saving client timestamp skew to redis")
+			}
+		}
+
+		// Clients without an allowlist are accepted from anywhere
+		if ipAllowlist != "" {
+			if err := rdb.RDB.HSet(context.Background(), biUtil.ClientIPAllowlistRedis, clientId, ipAllowlist).Err(); err != nil {
+				return eris.Wrap(err, "saving client ip allowlist to redis")
+			}
+		}
+
+		// The public key is cached as PEM so that every instance verifies with the same key without reading the file
+		if keyData != nil {
+			if err := rdb.RDB.HSet(context.Background(), biUtil.ClientPublicKeysRedis, clientId, string(keyData)).Err(); err != nil {
+				return eris.Wrap(err, "saving client public key to redis")
+			}
+		}
 	}
 
-	return nil
+	return rows.Err()
 }
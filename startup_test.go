@@ -1,11 +1,20 @@
 package bank_integration
 
 import (
+	"bytes"
+	"context"
 	"log/slog"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
 	biConfig "github.com/voxtmault/bank-integration/config"
+	biKeys "github.com/voxtmault/bank-integration/keys"
 	biStorage "github.com/voxtmault/bank-integration/storage"
+	biUtil "github.com/voxtmault/bank-integration/utils"
 )
 
 func TestLoadAuthenticatedBanks(t *testing.T) {
@@ -24,3 +33,99 @@ func TestLoadAuthenticatedBanks(t *testing.T) {
 		t.Errorf("load authenticated banks: %v", err)
 	}
 }
+
+func TestLoadAuthenticatedBanksInvalidPublicKey(t *testing.T) {
+	db, sqlMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("creating sql mock: %v", err)
+	}
+	defer db.Close()
+
+	mr := miniredis.RunT(t)
+	rdb := &biStorage.RedisInstance{RDB: redis.NewClient(&redis.Options{Addr: mr.Addr()})}
+
+	publicKeyPath := filepath.Join(t.TempDir(), "client.pem")
+	if err := os.WriteFile(publicKeyPath, []byte("not a public key"), 0600); err != nil {
+		t.Fatalf("writing public key: %v", err)
+	}
+
+	sqlMock.ExpectQuery("FROM authenticated_banks").WillReturnRows(sqlmock.NewRows([]string{
+		"client_id", "client_secret", "id", "bank_name", "public_key_path", "timestamp_skew", "ip_allowlist",
+	}).AddRow("partner-app", "partner-secret", 4, "Partner", publicKeyPath, 0, ""))
+
+	if err := LoadAuthenticatedBanks(db, rdb); err == nil {
+		t.Fatal("expected an invalid client public key to fail loading the authenticated banks")
+	}
+
+	// The client must not be accepted with the bank public key instead of its own
+	if exists, _ := rdb.RDB.HExists(context.Background(), biUtil.ClientCredentialsRedis, "partner-app").Result(); exists {
+		t.Fatal("expected the credentials of the client not to be loaded")
+	}
+}
+
+func TestMigrateClientSecrets(t *testing.T) {
+	db, sqlMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("creating sql mock: %v", err)
+	}
+	defer db.Close()
+
+	mr := miniredis.RunT(t)
+	rdb := &biStorage.RedisInstance{RDB: redis.NewClient(&redis.Options{Addr: mr.Addr()})}
+	ctx := context.Background()
+
+	if _, err := MigrateClientSecrets(ctx, db, rdb, nil); err == nil {
+		t.Fatal("expected an error without master key")
+	}
+
+	previousKey, _ := biKeys.NewStaticMasterKey("v1", bytes.Repeat([]byte{1}, 32))
+	primaryKey, _ := biKeys.NewStaticMasterKey("v2", bytes.Repeat([]byte{2}, 32))
+	secrets := biKeys.NewEnvelope(primaryKey, previousKey)
+
+	previous, _ := biKeys.NewEnvelope(previousKey).Encrypt(ctx, "previous-secret", "previous-client")
+	current, _ := secrets.Encrypt(ctx, "current-secret", "current-client")
+
+	// Plaintext rows next to the ones already migrated, of the primary or of a previous master key
+	columns := []string{"id", "client_id", "client_secret", "deleted"}
+	sqlMock.ExpectBegin()
+	sqlMock.ExpectQuery("SELECT id, client_id, client_secret").WillReturnRows(sqlmock.NewRows(columns).
+		AddRow(1, "plaintext-client", "plaintext-secret", false).
+		AddRow(2, "previous-client", previous, false).
+		AddRow(3, "current-client", current, false).
+		AddRow(4, "revoked-client", "revoked-secret", true))
+	for _, id := range []int{1, 2, 4} {
+		sqlMock.ExpectExec("UPDATE authenticated_banks SET client_secret").WithArgs(sqlmock.AnyArg(), id).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	sqlMock.ExpectCommit()
+
+	count, err := MigrateClientSecrets(ctx, db, rdb, secrets)
+	if err != nil {
+		t.Fatalf("migrating client secrets: %v", err)
+	}
+	if count != 3 {
+		t.Fatalf("expected 3 migrated secrets, got %d", count)
+	}
+	for client, secret := range map[string]string{"plaintext-client": "plaintext-secret", "previous-client": "previous-secret"} {
+		stored := mr.HGet(biUtil.ClientCredentialsRedis, client)
+		if plaintext, _ := secrets.Decrypt(ctx, stored, client); secrets.NeedsReencryption(stored) || plaintext != secret {
+			t.Fatalf("expected the secret of %s to be encrypted with the primary master key", client)
+		}
+	}
+
+	// Run again, nothing is left to migrate
+	sqlMock.ExpectBegin()
+	sqlMock.ExpectQuery("SELECT id, client_id, client_secret").WillReturnRows(sqlmock.NewRows(columns).
+		AddRow(1, "plaintext-client", mr.HGet(biUtil.ClientCredentialsRedis, "plaintext-client"), false).
+		AddRow(2, "previous-client", mr.HGet(biUtil.ClientCredentialsRedis, "previous-client"), false).
+		AddRow(3, "current-client", current, false))
+	sqlMock.ExpectCommit()
+
+	if count, err = MigrateClientSecrets(ctx, db, rdb, secrets); err != nil || count != 0 {
+		t.Fatalf("expected nothing to migrate, got %d (%v)", count, err)
+	}
+
+	if err := sqlMock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet sql expectations: %v", err)
+	}
+}
@@ -118,3 +118,36 @@ func (r *RedisInstance) GetRedisHash(ctx context.Context, key string) (map[strin
 
 	return data, nil
 }
+
+// ReserveKey sets key for exp only if it does not exist yet. When the key already exists false is returned along
+// with its current value.
+func (r *RedisInstance) ReserveKey(ctx context.Context, key string, exp time.Duration) (bool, string, error) {
+	return r.ReserveKeyValue(ctx, key, "", exp)
+}
+
+// ReserveKeyValue is ReserveKey setting key to value
+func (r *RedisInstance) ReserveKeyValue(ctx context.Context, key, value string, exp time.Duration) (bool, string, error) {
+	reserved, err := r.RDB.SetNX(ctx, key, value, exp).Result()
+	if err != nil {
+		return false, "", eris.Wrap(err, "reserving key in redis cache")
+	}
+	if reserved {
+		return true, "", nil
+	}
+
+	current, err := r.RDB.Get(ctx, key).Result()
+	if err != nil && err != redis.Nil {
+		return false, "", eris.Wrap(err, "getting reserved key from redis cache")
+	}
+
+	return false, current, nil
+}
+
+// SaveReservedKey replaces the value of a key reserved through ReserveKey, its expiration is kept
+func (r *RedisInstance) SaveReservedKey(ctx context.Context, key string, value interface{}) error {
+	if err := r.RDB.SetArgs(ctx, key, value, redis.SetArgs{Mode: "XX", KeepTTL: true}).Err(); err != nil && err != redis.Nil {
+		return eris.Wrap(err, "saving reserved key to redis cache")
+	}
+
+	return nil
+}
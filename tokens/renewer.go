@@ -0,0 +1,165 @@
+package bank_integration_tokens
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/rotisserie/eris"
+	biStorage "github.com/voxtmault/bank-integration/storage"
+)
+
+// FetchFunc requests a new access token from the bank, returning the token and its lifetime
+type FetchFunc func(ctx context.Context) (string, time.Duration, error)
+
+// Renewer keeps the access token we hold for a bank API in redis, shared by every replica serving the bank.
+// Concurrent renewals of a process dropping the same rejected token share a single request and a redis lock
+// ({key}:lock) lets a single replica request the token, the other replicas wait for it to be stored.
+type Renewer struct {
+	rdb   *biStorage.RedisInstance
+	key   string
+	fetch FetchFunc
+
+	LockTTL      time.Duration // Time a replica holds the lock, it must outlast a token request
+	PollInterval time.Duration // Interval between two reads of the token while another replica holds the lock
+
+	inflight map[string]*renewal // Renewals in progress by rejected token
+	sync.Mutex
+}
+
+// renewal is a renewal in progress, the callers joining it wait for done
+type renewal struct {
+	done  chan struct{}
+	token string
+	ttl   time.Duration
+	err   error
+}
+
+// deleteIfEqualScript deletes KEYS[1] only if its value is ARGV[1]
+var deleteIfEqualScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+func NewRenewer(rdb *biStorage.RedisInstance, key string, fetch FetchFunc) *Renewer {
+	return &Renewer{
+		rdb:          rdb,
+		key:          key,
+		fetch:        fetch,
+		LockTTL:      30 * time.Second,
+		PollInterval: 100 * time.Millisecond,
+		inflight:     make(map[string]*renewal),
+	}
+}
+
+// Renew returns a token that is still valid for more than margin, requesting a new one when the stored token is
+// missing or about to expire. rejected is a token the bank has refused, it is dropped from redis unless another
+// replica has already replaced it. A caller joins the renewal in progress only when it has been started for the same
+// rejected token, a renewal started before the token was rejected could give it back.
+func (r *Renewer) Renew(ctx context.Context, margin time.Duration, rejected string) (string, time.Duration, error) {
+	r.Lock()
+	current := r.inflight[rejected]
+	if current == nil {
+		current = &renewal{done: make(chan struct{})}
+		r.inflight[rejected] = current
+
+		// The renewal is shared, a caller giving up must not cancel it for the others
+		go func() {
+			current.token, current.ttl, current.err = r.renew(context.WithoutCancel(ctx), margin, rejected)
+
+			r.Lock()
+			delete(r.inflight, rejected)
+			r.Unlock()
+			close(current.done)
+		}()
+	}
+	r.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return "", 0, eris.Wrap(ctx.Err(), "waiting for access token renewal")
+	case <-current.done:
+		return current.token, current.ttl, current.err
+	}
+}
+
+func (r *Renewer) renew(ctx context.Context, margin time.Duration, rejected string) (string, time.Duration, error) {
+	if rejected != "" {
+		if err := deleteIfEqualScript.Run(ctx, r.rdb.RDB, []string{r.key}, rejected).Err(); err != nil {
+			return "", 0, eris.Wrap(err, "dropping rejected access token from redis")
+		}
+	}
+
+	lockKey := r.key + ":lock"
+	owner := uuid.New().String()
+
+	for {
+		token, ttl, err := r.load(ctx)
+		if err != nil {
+			return "", 0, err
+		}
+		if token != "" && token != rejected && ttl > margin {
+			return token, ttl, nil
+		}
+
+		acquired, err := r.rdb.RDB.SetNX(ctx, lockKey, owner, r.LockTTL).Result()
+		if err != nil {
+			return "", 0, eris.Wrap(err, "acquiring access token lock")
+		}
+
+		if acquired {
+			return r.fetchAndStore(ctx, lockKey, owner)
+		}
+
+		// Another replica is requesting the token, the lock expiring lets us take over if it died
+		select {
+		case <-ctx.Done():
+			return "", 0, eris.Wrap(ctx.Err(), "waiting for access token lock")
+		case <-time.After(r.PollInterval):
+		}
+	}
+}
+
+func (r *Renewer) fetchAndStore(ctx context.Context, lockKey, owner string) (string, time.Duration, error) {
+	defer func() {
+		if err := deleteIfEqualScript.Run(ctx, r.rdb.RDB, []string{lockKey}, owner).Err(); err != nil {
+			slog.Error("error releasing access token lock", "key", lockKey, "error", err)
+		}
+	}()
+
+	token, ttl, err := r.fetch(ctx)
+	if err != nil {
+		return "", 0, eris.Wrap(err, "requesting access token")
+	}
+
+	if err = r.rdb.RDB.Set(ctx, r.key, token, ttl).Err(); err != nil {
+		return "", 0, eris.Wrap(err, "saving access token to redis")
+	}
+
+	slog.Debug("renewed access token", "key", r.key, "expires in", ttl.String())
+
+	return token, ttl, nil
+}
+
+// load returns the stored token and its remaining lifetime, an empty token when there is none
+func (r *Renewer) load(ctx context.Context) (string, time.Duration, error) {
+	token, err := r.rdb.RDB.Get(ctx, r.key).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return "", 0, nil
+		}
+		return "", 0, eris.Wrap(err, "getting access token from redis")
+	}
+
+	ttl, err := r.rdb.RDB.TTL(ctx, r.key).Result()
+	if err != nil {
+		return "", 0, eris.Wrap(err, "getting access token TTL from redis")
+	}
+
+	return token, ttl, nil
+}
@@ -0,0 +1,208 @@
+package bank_integration_tokens
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	biStorage "github.com/voxtmault/bank-integration/storage"
+)
+
+const renewerKey = "bca-access-token:1"
+
+// newRenewer returns a renewer whose token requests wait for release, every request is counted by calls
+func newRenewer(mr *miniredis.Miniredis, token string, release <-chan struct{}, calls *atomic.Int32) *Renewer {
+	rdb := &biStorage.RedisInstance{RDB: redis.NewClient(&redis.Options{Addr: mr.Addr()})}
+
+	renewer := NewRenewer(rdb, renewerKey, func(ctx context.Context) (string, time.Duration, error) {
+		calls.Add(1)
+		if release != nil {
+			<-release
+		}
+		return token, 15 * time.Minute, nil
+	})
+	renewer.PollInterval = 5 * time.Millisecond
+
+	return renewer
+}
+
+func TestRenewSingleFlight(t *testing.T) {
+	mr := miniredis.RunT(t)
+	release := make(chan struct{})
+	var calls atomic.Int32
+	renewer := newRenewer(mr, "token-1", release, &calls)
+
+	var wg sync.WaitGroup
+	tokens := make([]string, 10)
+	for i := range tokens {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tokens[i], _, _ = renewer.Renew(context.Background(), time.Minute, "")
+		}(i)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls.Load() != 1 {
+		t.Fatalf("expected a single token request, got %d", calls.Load())
+	}
+	for i, token := range tokens {
+		if token != "token-1" {
+			t.Fatalf("caller %d got %q", i, token)
+		}
+	}
+	if token, _ := mr.Get(renewerKey); token != "token-1" {
+		t.Fatalf("expected the token to be stored in redis, got %q", token)
+	}
+	if mr.Exists(renewerKey + ":lock") {
+		t.Fatal("expected the lock to be released")
+	}
+}
+
+func TestRenewAcrossReplicas(t *testing.T) {
+	mr := miniredis.RunT(t)
+	release := make(chan struct{})
+	var callsA, callsB atomic.Int32
+	replicaA := newRenewer(mr, "token-a", release, &callsA)
+	replicaB := newRenewer(mr, "token-b", nil, &callsB)
+
+	done := make(chan string)
+	go func() {
+		token, _, _ := replicaA.Renew(context.Background(), time.Minute, "")
+		done <- token
+	}()
+
+	// Replica A holds the lock while requesting its token
+	deadline := time.Now().Add(time.Second)
+	for !mr.Exists(renewerKey + ":lock") {
+		if time.Now().After(deadline) {
+			t.Fatal("expected replica A to acquire the lock")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(release)
+	}()
+
+	token, _, err := replicaB.Renew(context.Background(), time.Minute, "")
+	if err != nil || token != "token-a" {
+		t.Fatalf("expected replica B to wait for the token of replica A, got %q (%v)", token, err)
+	}
+	if callsB.Load() != 0 {
+		t.Fatalf("expected replica B not to request a token, got %d requests", callsB.Load())
+	}
+	if token := <-done; token != "token-a" {
+		t.Fatalf("expected replica A to get its own token, got %q", token)
+	}
+}
+
+func TestRenewRefreshMargin(t *testing.T) {
+	mr := miniredis.RunT(t)
+	var calls atomic.Int32
+	renewer := newRenewer(mr, "token-2", nil, &calls)
+
+	// A token valid past the margin is reused
+	mr.Set(renewerKey, "token-1")
+	mr.SetTTL(renewerKey, 10*time.Minute)
+	if token, ttl, _ := renewer.Renew(context.Background(), time.Minute, ""); token != "token-1" || ttl != 10*time.Minute {
+		t.Fatalf("expected the stored token to be reused, got %q expiring in %s", token, ttl)
+	}
+
+	// A token expiring within the margin is renewed
+	mr.SetTTL(renewerKey, 30*time.Second)
+	if token, _, _ := renewer.Renew(context.Background(), time.Minute, ""); token != "token-2" {
+		t.Fatalf("expected the token to be renewed, got %q", token)
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("expected a single token request, got %d", calls.Load())
+	}
+}
+
+func TestRenewRejected(t *testing.T) {
+	mr := miniredis.RunT(t)
+	var calls atomic.Int32
+	renewer := newRenewer(mr, "token-2", nil, &calls)
+
+	mr.Set(renewerKey, "token-1")
+	mr.SetTTL(renewerKey, 10*time.Minute)
+
+	token, _, err := renewer.Renew(context.Background(), time.Minute, "token-1")
+	if err != nil || token != "token-2" {
+		t.Fatalf("expected the rejected token to be replaced, got %q (%v)", token, err)
+	}
+
+	// The token has already been replaced by another caller, it is kept
+	for i := 0; i < 2; i++ {
+		token, _, _ = renewer.Renew(context.Background(), time.Minute, "token-1")
+	}
+	if token != "token-2" || calls.Load() != 1 {
+		t.Fatalf("expected the replaced token to be kept, got %q after %d requests", token, calls.Load())
+	}
+}
+
+func TestRenewRejectedDuringRenewal(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := &biStorage.RedisInstance{RDB: redis.NewClient(&redis.Options{Addr: mr.Addr()})}
+	release := make(chan struct{})
+	var calls atomic.Int32
+
+	renewer := NewRenewer(rdb, renewerKey, func(ctx context.Context) (string, time.Duration, error) {
+		call := calls.Add(1)
+		if call == 1 {
+			<-release
+		}
+		return fmt.Sprintf("token-%d", call), 15 * time.Minute, nil
+	})
+	renewer.PollInterval = 5 * time.Millisecond
+
+	done := make(chan string)
+	go func() {
+		token, _, _ := renewer.Renew(context.Background(), time.Minute, "")
+		done <- token
+	}()
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// token-1, about to be given by the renewal in progress, has been rejected in the meantime
+	rejected := make(chan string)
+	go func() {
+		token, _, _ := renewer.Renew(context.Background(), time.Minute, "token-1")
+		rejected <- token
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+
+	if token := <-done; token != "token-1" {
+		t.Fatalf("expected the first renewal to get token-1, got %q", token)
+	}
+	if token := <-rejected; token != "token-2" {
+		t.Fatalf("expected the caller rejecting token-1 to get a new token, got %q", token)
+	}
+}
+
+func TestRenewFetchError(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := &biStorage.RedisInstance{RDB: redis.NewClient(&redis.Options{Addr: mr.Addr()})}
+
+	renewer := NewRenewer(rdb, renewerKey, func(ctx context.Context) (string, time.Duration, error) {
+		return "", 0, fmt.Errorf("bank unavailable")
+	})
+
+	if _, _, err := renewer.Renew(context.Background(), time.Minute, ""); err == nil {
+		t.Fatal("expected the error of the token request")
+	}
+	if mr.Exists(renewerKey + ":lock") {
+		t.Fatal("expected the lock to be released")
+	}
+}
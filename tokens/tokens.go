@@ -0,0 +1,227 @@
+package bank_integration_tokens
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rotisserie/eris"
+	biModels "github.com/voxtmault/bank-integration/models"
+	biStorage "github.com/voxtmault/bank-integration/storage"
+	biUtil "github.com/voxtmault/bank-integration/utils"
+)
+
+// Store keeps track of the access tokens issued to the registered clients. Every token is stored under
+// access-tokens:{token} until it expires and indexed per client under access-tokens-client:{client id}, allowing
+// the tokens of a client to be listed and revoked.
+type Store struct {
+	rdb *biStorage.RedisInstance
+}
+
+func NewStore(rdb *biStorage.RedisInstance) *Store {
+	return &Store{rdb: rdb}
+}
+
+// storedToken is the value of access-tokens:{token}, unlike the model it carries the client secret
+type storedToken struct {
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	Scope        string `json:"scope"`
+	IssuedAt     int64  `json:"issued_at"`
+	ExpiresAt    int64  `json:"expires_at"`
+}
+
+// Issue stores a new access token of clientID valid for ttl
+func (s *Store) Issue(ctx context.Context, token, clientID, clientSecret, scope string, ttl time.Duration) (*biModels.AccessToken, error) {
+	now := time.Now()
+	obj := &biModels.AccessToken{
+		Token:        token,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Scope:        scope,
+		IssuedAt:     now.Truncate(time.Second),
+		ExpiresAt:    now.Add(ttl).Truncate(time.Second),
+	}
+
+	data, err := json.Marshal(storedToken{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Scope:        scope,
+		IssuedAt:     obj.IssuedAt.Unix(),
+		ExpiresAt:    obj.ExpiresAt.Unix(),
+	})
+	if err != nil {
+		return nil, eris.Wrap(err, "marshalling access token")
+	}
+
+	index := clientKey(clientID)
+	pipe := s.rdb.RDB.TxPipeline()
+	pipe.Set(ctx, tokenKey(token), data, ttl)
+	pipe.ZAdd(ctx, index, redis.Z{Score: float64(obj.ExpiresAt.Unix()), Member: token})
+	pipe.ZRemRangeByScore(ctx, index, "-inf", strconv.FormatInt(now.Unix(), 10))
+	if _, err = pipe.Exec(ctx); err != nil {
+		return nil, eris.Wrap(err, "saving access token to redis")
+	}
+
+	return obj, nil
+}
+
+// Get returns the access token, nil if it does not exist or expired
+func (s *Store) Get(ctx context.Context, token string) (*biModels.AccessToken, error) {
+	data, err := s.rdb.RDB.Get(ctx, tokenKey(token)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, eris.Wrap(err, "getting access token from redis")
+	}
+
+	return decode(token, data)
+}
+
+// ListTokens returns the active access tokens of clientID ordered by expiry time
+func (s *Store) ListTokens(ctx context.Context, clientID string) ([]*biModels.AccessToken, error) {
+	index := clientKey(clientID)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	if err := s.rdb.RDB.ZRemRangeByScore(ctx, index, "-inf", now).Err(); err != nil {
+		return nil, eris.Wrap(err, "pruning expired access tokens")
+	}
+
+	tokens, err := s.rdb.RDB.ZRange(ctx, index, 0, -1).Result()
+	if err != nil {
+		return nil, eris.Wrap(err, "listing access tokens")
+	}
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+
+	keys := make([]string, len(tokens))
+	for i, token := range tokens {
+		keys[i] = tokenKey(token)
+	}
+
+	values, err := s.rdb.RDB.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, eris.Wrap(err, "getting access tokens from redis")
+	}
+
+	var arrObj []*biModels.AccessToken
+	for i, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			// Revoked or expired since it was listed
+			continue
+		}
+
+		obj, err := decode(tokens[i], data)
+		if err != nil {
+			return nil, err
+		}
+		arrObj = append(arrObj, obj)
+	}
+
+	return arrObj, nil
+}
+
+// RevokeToken deletes the access token, revoking an unknown token is not an error
+func (s *Store) RevokeToken(ctx context.Context, token string) error {
+	obj, err := s.Get(ctx, token)
+	if err != nil {
+		return err
+	}
+	if obj == nil {
+		return nil
+	}
+
+	pipe := s.rdb.RDB.TxPipeline()
+	pipe.Del(ctx, tokenKey(token))
+	if obj.ClientID != "" {
+		pipe.ZRem(ctx, clientKey(obj.ClientID), token)
+	}
+	if _, err = pipe.Exec(ctx); err != nil {
+		return eris.Wrap(err, "revoking access token")
+	}
+
+	return nil
+}
+
+// revokeAllScript deletes every access token indexed under KEYS[1] along with the index, ARGV[1] is the prefix of
+// the access token keys. Running as a single script, a token issued meanwhile is either revoked or left indexed.
+var revokeAllScript = redis.NewScript(`
+local deleted = 0
+for _, token in ipairs(redis.call('ZRANGE', KEYS[1], 0, -1)) do
+	deleted = deleted + redis.call('DEL', ARGV[1] .. token)
+end
+redis.call('DEL', KEYS[1])
+return deleted
+`)
+
+// RevokeAllForClient deletes every access token issued to clientID and returns how many were revoked
+func (s *Store) RevokeAllForClient(ctx context.Context, clientID string) (int, error) {
+	deleted, err := revokeAllScript.Run(ctx, s.rdb.RDB, []string{clientKey(clientID)}, tokenKey("")).Int()
+	if err != nil {
+		return 0, eris.Wrap(err, "revoking access tokens")
+	}
+
+	return deleted, nil
+}
+
+// Introspect describes the access token as an RFC 7662 introspection response
+func (s *Store) Introspect(ctx context.Context, token string) (*biModels.AccessTokenIntrospection, error) {
+	obj, err := s.Get(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if obj == nil {
+		return &biModels.AccessTokenIntrospection{Active: false}, nil
+	}
+
+	result := &biModels.AccessTokenIntrospection{
+		Active:    true,
+		ClientID:  obj.ClientID,
+		Scope:     obj.Scope,
+		TokenType: "Bearer",
+	}
+	if !obj.IssuedAt.IsZero() {
+		result.IssuedAt = obj.IssuedAt.Unix()
+		result.ExpiresAt = obj.ExpiresAt.Unix()
+	}
+
+	return result, nil
+}
+
+// Helper Functions
+
+func tokenKey(token string) string {
+	return fmt.Sprintf("%s:%s", biUtil.AccessTokenRedis, token)
+}
+
+func clientKey(clientID string) string {
+	return fmt.Sprintf("%s:%s", biUtil.AccessTokenClientRedis, clientID)
+}
+
+func decode(token, data string) (*biModels.AccessToken, error) {
+	// Tokens issued before the token store only hold the client secret
+	if !strings.HasPrefix(data, "{") {
+		return &biModels.AccessToken{Token: token, ClientSecret: data}, nil
+	}
+
+	var stored storedToken
+	if err := json.Unmarshal([]byte(data), &stored); err != nil {
+		return nil, eris.Wrap(err, "unmarshalling access token")
+	}
+
+	return &biModels.AccessToken{
+		Token:        token,
+		ClientID:     stored.ClientID,
+		ClientSecret: stored.ClientSecret,
+		Scope:        stored.Scope,
+		IssuedAt:     time.Unix(stored.IssuedAt, 0),
+		ExpiresAt:    time.Unix(stored.ExpiresAt, 0),
+	}, nil
+}
@@ -0,0 +1,161 @@
+package bank_integration_tokens
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	biStorage "github.com/voxtmault/bank-integration/storage"
+	biUtil "github.com/voxtmault/bank-integration/utils"
+)
+
+func setup(t *testing.T) (*Store, *miniredis.Miniredis) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+
+	return NewStore(&biStorage.RedisInstance{RDB: redis.NewClient(&redis.Options{Addr: mr.Addr()})}), mr
+}
+
+func TestIssueAndIntrospect(t *testing.T) {
+	store, mr := setup(t)
+	ctx := context.Background()
+
+	issued, err := store.Issue(ctx, "token-1", "client-a", "secret-a", biUtil.AccessTokenScopeVA, 15*time.Minute)
+	if err != nil {
+		t.Fatalf("issuing access token: %v", err)
+	}
+
+	token, err := store.Get(ctx, "token-1")
+	if err != nil || token == nil {
+		t.Fatalf("expected the access token, got %v (%v)", token, err)
+	}
+	if token.ClientID != "client-a" || token.ClientSecret != "secret-a" || token.Scope != biUtil.AccessTokenScopeVA ||
+		!token.ExpiresAt.Equal(issued.ExpiresAt) {
+		t.Fatalf("unexpected access token %+v", token)
+	}
+	if ttl := mr.TTL(biUtil.AccessTokenRedis + ":token-1"); ttl != 15*time.Minute {
+		t.Fatalf("expected the access token to expire in 15 minutes, got %s", ttl)
+	}
+
+	introspection, err := store.Introspect(ctx, "token-1")
+	if err != nil {
+		t.Fatalf("introspecting access token: %v", err)
+	}
+	if !introspection.Active || introspection.ClientID != "client-a" || introspection.ExpiresAt != issued.ExpiresAt.Unix() {
+		t.Fatalf("unexpected introspection %+v", introspection)
+	}
+
+	introspection, err = store.Introspect(ctx, "unknown")
+	if err != nil || introspection.Active {
+		t.Fatalf("expected an inactive token, got %+v (%v)", introspection, err)
+	}
+}
+
+func TestLegacyAccessToken(t *testing.T) {
+	store, mr := setup(t)
+
+	// Tokens issued before the token store only hold the client secret
+	mr.Set(biUtil.AccessTokenRedis+":legacy", "secret-a")
+
+	token, err := store.Get(context.Background(), "legacy")
+	if err != nil || token == nil || token.ClientSecret != "secret-a" || token.ClientID != "" {
+		t.Fatalf("expected the legacy access token, got %+v (%v)", token, err)
+	}
+}
+
+func TestListAndRevoke(t *testing.T) {
+	store, mr := setup(t)
+	ctx := context.Background()
+
+	for _, token := range []string{"token-1", "token-2", "token-3"} {
+		if _, err := store.Issue(ctx, token, "client-a", "secret-a", biUtil.AccessTokenScopeVA, time.Minute); err != nil {
+			t.Fatalf("issuing access token: %v", err)
+		}
+	}
+	if _, err := store.Issue(ctx, "token-b", "client-b", "secret-b", biUtil.AccessTokenScopeVA, time.Minute); err != nil {
+		t.Fatalf("issuing access token: %v", err)
+	}
+
+	// An expired token is no longer listed
+	mr.Del(biUtil.AccessTokenRedis + ":token-3")
+
+	tokens, err := store.ListTokens(ctx, "client-a")
+	if err != nil {
+		t.Fatalf("listing access tokens: %v", err)
+	}
+	if len(tokens) != 2 {
+		t.Fatalf("expected 2 access tokens, got %d", len(tokens))
+	}
+
+	if err = store.RevokeToken(ctx, "token-1"); err != nil {
+		t.Fatalf("revoking access token: %v", err)
+	}
+	if err = store.RevokeToken(ctx, "token-1"); err != nil {
+		t.Fatalf("revoking a revoked access token: %v", err)
+	}
+	if token, _ := store.Get(ctx, "token-1"); token != nil {
+		t.Fatal("expected the access token to be revoked")
+	}
+
+	revoked, err := store.RevokeAllForClient(ctx, "client-a")
+	if err != nil {
+		t.Fatalf("revoking access tokens: %v", err)
+	}
+	if revoked != 1 {
+		t.Fatalf("expected 1 revoked access token, got %d", revoked)
+	}
+	if tokens, _ = store.ListTokens(ctx, "client-a"); len(tokens) != 0 {
+		t.Fatalf("expected no access token left, got %d", len(tokens))
+	}
+	if token, _ := store.Get(ctx, "token-b"); token == nil {
+		t.Fatal("expected the access tokens of other clients to be kept")
+	}
+}
+
+func TestRevokeAllWhileIssuing(t *testing.T) {
+	store, mr := setup(t)
+	ctx := context.Background()
+
+	// Every token left once the issuers are done must still be indexed, so that it can be revoked
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			store.Issue(ctx, fmt.Sprintf("token-%d", i), "client-a", "secret-a", biUtil.AccessTokenScopeVA, time.Minute)
+		}()
+		go func() {
+			defer wg.Done()
+			store.RevokeAllForClient(ctx, "client-a")
+		}()
+	}
+	wg.Wait()
+
+	tokens, err := store.ListTokens(ctx, "client-a")
+	if err != nil {
+		t.Fatalf("listing access tokens: %v", err)
+	}
+	stored := 0
+	for _, key := range mr.Keys() {
+		if strings.HasPrefix(key, tokenKey("")) {
+			stored++
+		}
+	}
+	if len(tokens) != stored {
+		t.Fatalf("expected every stored access token to be indexed, %d stored and %d indexed", stored, len(tokens))
+	}
+
+	revoked, err := store.RevokeAllForClient(ctx, "client-a")
+	if err != nil {
+		t.Fatalf("revoking access tokens: %v", err)
+	}
+	if revoked != len(tokens) || len(mr.Keys()) != 0 {
+		t.Fatalf("expected every access token to be revoked, revoked %d and %d keys left", revoked, len(mr.Keys()))
+	}
+}
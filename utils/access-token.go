@@ -0,0 +1,25 @@
+package bank_integration_utils
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// IsInvalidTokenResponse reports whether a SNAP response code rejects the access token of the request, i.e.
+// 401{service code}01 "Invalid Token (B2B)" (e.g. 4012401)
+func IsInvalidTokenResponse(responseCode string) bool {
+	return len(responseCode) == 7 &&
+		strings.HasPrefix(responseCode, strconv.Itoa(http.StatusUnauthorized)) &&
+		strings.HasSuffix(responseCode, "01")
+}
+
+// BearerToken returns the access token of the Authorization header, empty when the request does not carry one
+func BearerToken(request *http.Request) string {
+	token, found := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		return ""
+	}
+
+	return token
+}
@@ -0,0 +1,37 @@
+package bank_integration_utils
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestIsInvalidTokenResponse(t *testing.T) {
+	cases := map[string]bool{
+		"4012401": true,
+		"4011101": true,
+		"4017301": true,
+		"4012400": false, // Unauthorized
+		"4017300": false,
+		"2002400": false,
+		"401":     false,
+		"":        false,
+	}
+
+	for code, expected := range cases {
+		if got := IsInvalidTokenResponse(code); got != expected {
+			t.Errorf("IsInvalidTokenResponse(%q) = %v, expected %v", code, got, expected)
+		}
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	request, _ := http.NewRequest(http.MethodPost, "http://localhost", nil)
+	if token := BearerToken(request); token != "" {
+		t.Fatalf("expected no token, got %q", token)
+	}
+
+	request.Header.Set("Authorization", "Bearer abc")
+	if token := BearerToken(request); token != "abc" {
+		t.Fatalf("expected abc, got %q", token)
+	}
+}
@@ -5,19 +5,55 @@ var ClientCredentialsRedis = "client-credentials"
 var AuthenticatedBankNameRedis = "authenticated-bank-name"
 var VendorsLogoRedis = "vendors_logo"
 
-// Format stored in redis is access-tokens:{token} as the key and the value is the client secret
-// Structure is a regular key-value pair
+// Stored in redis as a hash set with the key being client-id and the value being the PEM encoded public key of the
+// client, used to verify the asymmetric signature of its access token requests
+var ClientPublicKeysRedis = "client-public-keys"
+
+// Stored in redis as a hash set with the key being client-id and the value being the accepted X-TIMESTAMP clock skew
+// of the client in seconds, clients without one use the TIMESTAMP_SKEW of the bank configuration
+var ClientTimestampSkewRedis = "client-timestamp-skew"
+
+// Stored in redis as a hash set with the key being client-id and the value being the comma separated CIDRs the
+// callbacks of the client may come from, clients without one are accepted from anywhere
+var ClientIPAllowlistRedis = "client-ip-allowlist"
+
+// Format stored in redis is access-tokens:{token} as the key and the value is the JSON encoded access token (client
+// id, client secret, scope, issue & expiry time). Tokens issued before the token store hold the client secret only.
 var AccessTokenRedis = "access-tokens"
 
+// Format stored in redis is access-tokens-client:{client id}, a sorted set of the tokens issued to the client scored
+// by their expiry time (unix)
+var AccessTokenClientRedis = "access-tokens-client"
+
+// Scope of the access tokens issued to the banks, they grant access to the virtual account callbacks
+const AccessTokenScopeVA = "virtual-account"
+
 // Bank API Access Tokens
 const (
-	BCAAccessToken = "bca-access-token"
+	BCAAccessToken     = "bca-access-token"
+	MandiriAccessToken = "mandiri-access-token"
 )
 
+// Format stored in redis is unique-external-id:{bank code}:{client}:{date}:{external id}, see ExternalIDKey. The
+// value is the (compressed) response returned to the request that reserved the external id
 var UniqueExternalIDRedis = "unique-external-id"
 
+// Format stored in redis is replay-signature:{bank code}:{client}:{sha256 of the signature}, see ReplayKey. Verified
+// signatures are kept until their X-TIMESTAMP leaves the clock skew window
+var ReplaySignatureRedis = "replay-signature"
+
+// Format stored in redis is payment-flag:{id bank}:{paymentRequestId}, a hash of the digest of the first payment
+// flag request and the (compressed) response returned to it
+var PaymentFlagRedis = "payment-flag"
+
+// Distributed transaction watcher, transaction-watcher:{id bank} is a sorted set of id transaction scored by the
+// expiration time (unix ms), transaction-watcher:{id bank}:attempts keeps the attempts and
+// transaction-watcher:{id bank}:events is the pub/sub channel of the payment status changes
+var TransactionWatcherRedis = "transaction-watcher"
+
 const (
-	BankCodeBCA = "bca"
+	BankCodeBCA     = "bca"
+	BankCodeMandiri = "mandiri"
 )
 
 type VAPaymentStatus uint
@@ -29,6 +65,17 @@ const (
 	VAStatusCancelled VAPaymentStatus = 4
 )
 
+// VATrxType is the virtualAccountTrxType advertised in bill presentment, it decides which paid amounts are accepted
+type VATrxType string
+
+const (
+	VATrxTypeClosed  VATrxType = "C" // Fixed bill, the paid amount must be equal to the total amount
+	VATrxTypeOpen    VATrxType = "O" // Any amount, optionally within the minimum / maximum range
+	VATrxTypePartial VATrxType = "I" // Installments, settled once the cumulative paid amount reaches the total amount
+	VATrxTypeMinimum VATrxType = "M" // At least the minimum amount
+	VATrxTypeMaximum VATrxType = "L" // At most the maximum amount
+)
+
 type TransactionWatcherStatus uint
 
 const (
@@ -37,4 +84,37 @@ const (
 	WatcherCancelled TransactionWatcherStatus = 3
 )
 
+type TransferStatus uint
+
+const (
+	TransferStatusPending TransferStatus = 1 // Persisted, not yet confirmed by the bank
+	TransferStatusSuccess TransferStatus = 2 // Bank confirmed that the funds have been moved
+	TransferStatusFailed  TransferStatus = 3 // Bank rejected the transfer, safe to create a new one
+	TransferStatusUnknown TransferStatus = 4 // Outcome is unknown (timeout, 5xx, etc), must be resolved through status inquiry
+)
+
+type PaymentEventType string
+
+const (
+	PaymentEventVAPaid        PaymentEventType = "va.paid"        // A virtual account bill has been flagged as paid by the bank
+	PaymentEventVAInstallment PaymentEventType = "va.installment" // A partial payment that did not settle the bill yet
+	PaymentEventVAExpired     PaymentEventType = "va.expired"     // A virtual account bill expired before being paid
+	PaymentEventVACancelled   PaymentEventType = "va.cancelled"   // A virtual account bill has been cancelled
+)
+
+type KeyType string
+
+const (
+	KeyTypePrivate KeyType = "private" // Our private key, used to sign the requests sent to the bank
+	KeyTypePublic  KeyType = "public"  // The bank public key, used to verify the signatures sent by the bank
+)
+
+type WebhookDeliveryStatus uint
+
+const (
+	WebhookDeliveryPending   WebhookDeliveryStatus = 1 // Waiting for its next attempt
+	WebhookDeliveryDelivered WebhookDeliveryStatus = 2 // Acknowledged with a 2xx response
+	WebhookDeliveryDead      WebhookDeliveryStatus = 3 // Gave up after the maximum attempts, can be requeued manually
+)
+
 const ()
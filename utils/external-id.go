@@ -0,0 +1,18 @@
+package bank_integration_utils
+
+import (
+	"fmt"
+	"time"
+)
+
+// ExternalIDKey returns the redis key reserving an X-EXTERNAL-ID, formatted as
+// unique-external-id:{bank code}:{client}:{date}:{external id}. SNAP only requires the id to be unique within a day,
+// the day is taken from the X-TIMESTAMP of the request, or today when it can not be parsed.
+func ExternalIDKey(bankCode, clientID, timeStamp, externalID string) string {
+	day := time.Now()
+	if parsed, err := time.Parse(time.RFC3339, timeStamp); err == nil {
+		day = parsed
+	}
+
+	return fmt.Sprintf("%s:%s:%s:%s:%s", UniqueExternalIDRedis, bankCode, clientID, day.Format("20060102"), externalID)
+}
@@ -0,0 +1,17 @@
+package bank_integration_utils
+
+import (
+	"testing"
+)
+
+func TestExternalIDKey(t *testing.T) {
+	key := ExternalIDKey(BankCodeBCA, "partner", "2024-10-18T23:59:59+07:00", "123")
+	if key != "unique-external-id:bca:partner:20241018:123" {
+		t.Fatalf("unexpected key %s", key)
+	}
+
+	// The day of the timestamp is kept as sent, regardless of the local time zone
+	if key := ExternalIDKey(BankCodeBCA, "partner", "2024-10-19T00:00:01+07:00", "123"); key != "unique-external-id:bca:partner:20241019:123" {
+		t.Fatalf("unexpected key %s", key)
+	}
+}
@@ -0,0 +1,27 @@
+package bank_integration_utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// ReplayKey returns the redis key caching a verified signature, formatted as
+// replay-signature:{bank code}:{client}:{sha256 of the signature}
+func ReplayKey(bankCode, clientID, signature string) string {
+	digest := sha256.Sum256([]byte(signature))
+
+	return fmt.Sprintf("%s:%s:%s:%s", ReplaySignatureRedis, bankCode, clientID, hex.EncodeToString(digest[:]))
+}
+
+// ReplayWindow returns how long a signature made at timeStamp must be remembered, i.e. until timeStamp leaves the
+// clock skew window. It returns false when timeStamp is already outside the window.
+func ReplayWindow(timeStamp, now time.Time, skew time.Duration) (time.Duration, bool) {
+	if timeStamp.Before(now.Add(-skew)) || timeStamp.After(now.Add(skew)) {
+		return 0, false
+	}
+
+	// A signature at the edge of the window is still remembered for a moment, redis rejects a zero expiration
+	return max(timeStamp.Add(skew).Sub(now), time.Second), true
+}
@@ -0,0 +1,41 @@
+package bank_integration_utils
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplayWindow(t *testing.T) {
+	now := time.Now()
+	skew := 5 * time.Minute
+
+	for _, tc := range []struct {
+		name      string
+		timeStamp time.Time
+		ttl       time.Duration
+		ok        bool
+	}{
+		{"now", now, skew, true},
+		{"past", now.Add(-4 * time.Minute), time.Minute, true},
+		{"future", now.Add(4 * time.Minute), 9 * time.Minute, true},
+		{"edge", now.Add(-skew), time.Second, true},
+		{"too old", now.Add(-6 * time.Minute), 0, false},
+		{"too far ahead", now.Add(6 * time.Minute), 0, false},
+	} {
+		ttl, ok := ReplayWindow(tc.timeStamp, now, skew)
+		if ok != tc.ok || ttl != tc.ttl {
+			t.Errorf("%s: expected (%s, %t), got (%s, %t)", tc.name, tc.ttl, tc.ok, ttl, ok)
+		}
+	}
+}
+
+func TestReplayKey(t *testing.T) {
+	key := ReplayKey(BankCodeBCA, "client", "signature")
+	if !strings.HasPrefix(key, ReplaySignatureRedis+":"+BankCodeBCA+":client:") || strings.HasSuffix(key, ":signature") {
+		t.Fatalf("unexpected replay key %s", key)
+	}
+	if ReplayKey(BankCodeBCA, "another", "signature") == key {
+		t.Fatal("expected the replay key to be scoped to the client")
+	}
+}
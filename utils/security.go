@@ -3,7 +3,12 @@ package bank_integration_utils
 import (
 	"context"
 	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
 	"log/slog"
 
 	"github.com/rotisserie/eris"
@@ -31,3 +36,65 @@ func (s *GeneralSecurity) GenerateAccessToken(ctx context.Context) (string, erro
 
 	return token[:64], nil
 }
+
+// ParsePublicKey parses a PEM encoded (PKIX) RSA public key
+func ParsePublicKey(keyData []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(keyData)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, eris.New("failed to decode PEM block containing public key")
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, eris.Wrap(err, "parsing public key")
+	}
+
+	publicKey, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, eris.New("unexpected type of public key")
+	}
+
+	return publicKey, nil
+}
+
+// ParsePrivateKey parses a PEM encoded RSA private key, both PKCS1 and PKCS8 blocks are accepted
+func ParsePrivateKey(keyData []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(keyData)
+	if block == nil {
+		return nil, eris.New("failed to decode PEM block containing private key")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, eris.Wrap(err, "failed to parse PKCS1 private key")
+		}
+		return privateKey, nil
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, eris.Wrap(err, "failed to parse PKCS8 private key")
+		}
+		privateKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, eris.New("not an RSA private key")
+		}
+		return privateKey, nil
+	default:
+		return nil, eris.New("unsupported key type " + block.Type)
+	}
+}
+
+// PublicKeyFingerprint returns the hex encoded SHA256 of the PKIX encoding of the public key, it identifies a key
+// pair in logs without revealing it
+func PublicKeyFingerprint(publicKey *rsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return "", eris.Wrap(err, "marshalling public key")
+	}
+
+	sum := sha256.Sum256(der)
+
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,91 @@
+package bank_integration_utils
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/rotisserie/eris"
+)
+
+// ParseCIDRs parses a comma separated list of CIDRs, a single IP address is taken as a /32 (or /128) network
+func ParseCIDRs(value string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, eris.Wrapf(err, "parsing ip address %s", entry)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, eris.Wrapf(err, "parsing cidr %s", entry)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
+
+// FormatCIDRs is the reverse of ParseCIDRs
+func FormatCIDRs(prefixes []netip.Prefix) string {
+	values := make([]string, len(prefixes))
+	for i, prefix := range prefixes {
+		values[i] = prefix.String()
+	}
+
+	return strings.Join(values, ",")
+}
+
+// ContainsIP reports whether addr is part of one of the given networks
+func ContainsIP(prefixes []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SourceIP returns the address the request originates from. X-Forwarded-For is only followed while the hop that
+// appended the address is one of the trusted proxies, so a client can't spoof its address by sending the header
+// itself.
+func SourceIP(request *http.Request, trustedProxies []netip.Prefix) (netip.Addr, error) {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		host = request.RemoteAddr
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, eris.Wrapf(err, "parsing remote address %s", request.RemoteAddr)
+	}
+	addr = addr.Unmap()
+
+	// Proxies append the address of their peer, the chain is walked from the nearest hop
+	var hops []string
+	for _, header := range request.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0 && ContainsIP(trustedProxies, addr); i-- {
+		forwarded, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			return netip.Addr{}, eris.Wrapf(err, "parsing forwarded address %s", hops[i])
+		}
+		addr = forwarded.Unmap()
+	}
+
+	return addr, nil
+}
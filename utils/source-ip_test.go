@@ -0,0 +1,74 @@
+package bank_integration_utils
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	prefixes, err := ParseCIDRs(" 10.0.0.0/8, 192.168.1.7,2001:db8::/32,")
+	if err != nil {
+		t.Fatalf("parsing cidrs: %v", err)
+	}
+	if formatted := FormatCIDRs(prefixes); formatted != "10.0.0.0/8,192.168.1.7/32,2001:db8::/32" {
+		t.Fatalf("unexpected cidrs %s", formatted)
+	}
+
+	if prefixes, err = ParseCIDRs(""); err != nil || len(prefixes) != 0 {
+		t.Fatalf("expected no cidr, got %v (%v)", prefixes, err)
+	}
+	if _, err = ParseCIDRs("10.0.0.0/8,not an ip"); err == nil {
+		t.Fatal("expected an error with an invalid entry")
+	}
+}
+
+func TestSourceIP(t *testing.T) {
+	trusted, _ := ParseCIDRs("10.0.0.0/8")
+
+	for _, tc := range []struct {
+		name          string
+		remoteAddr    string
+		xForwardedFor []string
+		expected      string
+	}{
+		{"direct", "203.0.113.7:4431", nil, "203.0.113.7"},
+		{"ipv4 mapped", "[::ffff:203.0.113.7]:4431", nil, "203.0.113.7"},
+		{"spoofed header", "203.0.113.7:4431", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"trusted proxy", "10.0.0.2:4431", []string{"203.0.113.7"}, "203.0.113.7"},
+		{"proxy chain", "10.0.0.2:4431", []string{"198.51.100.1, 203.0.113.7", "10.0.0.3"}, "203.0.113.7"},
+		{"only proxies", "10.0.0.2:4431", []string{"10.0.0.3"}, "10.0.0.3"},
+	} {
+		request := httptest.NewRequest("POST", "/", nil)
+		request.RemoteAddr = tc.remoteAddr
+		for _, value := range tc.xForwardedFor {
+			request.Header.Add("X-Forwarded-For", value)
+		}
+
+		addr, err := SourceIP(request, trusted)
+		if err != nil || addr != netip.MustParseAddr(tc.expected) {
+			t.Errorf("%s: expected %s, got %s (%v)", tc.name, tc.expected, addr, err)
+		}
+	}
+
+	request := httptest.NewRequest("POST", "/", nil)
+	request.RemoteAddr = "10.0.0.2:4431"
+	request.Header.Set("X-Forwarded-For", "garbage")
+	if _, err := SourceIP(request, trusted); err == nil {
+		t.Fatal("expected an error with an invalid forwarded address")
+	}
+}
+
+func TestContainsIP(t *testing.T) {
+	allowlist, _ := ParseCIDRs("203.0.113.0/24,2001:db8::/32")
+
+	if !ContainsIP(allowlist, netip.MustParseAddr("203.0.113.7")) || !ContainsIP(allowlist, netip.MustParseAddr("::ffff:203.0.113.7")) {
+		t.Fatal("expected the address to be allowed")
+	}
+	if !ContainsIP(allowlist, netip.MustParseAddr("2001:db8::1")) {
+		t.Fatal("expected the ipv6 address to be allowed")
+	}
+	if ContainsIP(allowlist, netip.MustParseAddr("198.51.100.1")) {
+		t.Fatal("expected the address to be rejected")
+	}
+}
@@ -0,0 +1,125 @@
+package bank_integration_utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/rotisserie/eris"
+)
+
+var ErrInvalidAmount = eris.New("invalid amount")
+
+// ParseAmount converts an amount formatted with at most two decimals (e.g. 10000.00) into cents. An empty amount is
+// treated as 0.
+func ParseAmount(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+
+	whole, fraction, _ := strings.Cut(value, ".")
+	if len(fraction) > 2 {
+		return 0, eris.Errorf("amount %s has more than 2 decimals", value)
+	}
+	fraction += strings.Repeat("0", 2-len(fraction))
+
+	cents, err := strconv.ParseInt(whole+fraction, 10, 64)
+	if err != nil || cents < 0 {
+		return 0, eris.Errorf("invalid amount %s", value)
+	}
+
+	return cents, nil
+}
+
+// FormatAmount formats cents into the SNAP amount format (e.g. 10000.00)
+func FormatAmount(cents int64) string {
+	return fmt.Sprintf("%d.%02d", cents/100, cents%100)
+}
+
+// VAAmountRule holds the amounts of a VA Payment Request that decide which paid amounts are accepted
+type VAAmountRule struct {
+	TrxType    VATrxType
+	Total      string // Total billed amount
+	Min        string // Minimum amount of a single payment, 0 means no minimum
+	Max        string // Maximum amount of a single payment, 0 means no maximum
+	Cumulative string // Amount already paid through previous installments
+}
+
+// Apply checks the paid amount against the rule and returns the new cumulative paid amount and whether the VA is
+// settled. The cumulative amount reported by the bank (cumulativePaymentAmount), when given, must be the stored one
+// plus the paid amount. ErrInvalidAmount is returned when the paid amount is not accepted.
+func (r *VAAmountRule) Apply(paid string, reportedCumulative string) (string, bool, error) {
+	total, err := ParseAmount(r.Total)
+	if err != nil {
+		return "", false, eris.Wrap(err, "parsing total amount")
+	}
+	minimum, err := ParseAmount(r.Min)
+	if err != nil {
+		return "", false, eris.Wrap(err, "parsing minimum amount")
+	}
+	maximum, err := ParseAmount(r.Max)
+	if err != nil {
+		return "", false, eris.Wrap(err, "parsing maximum amount")
+	}
+	cumulative, err := ParseAmount(r.Cumulative)
+	if err != nil {
+		return "", false, eris.Wrap(err, "parsing cumulative amount")
+	}
+	amount, err := ParseAmount(paid)
+	if err != nil || amount <= 0 {
+		return "", false, ErrInvalidAmount
+	}
+
+	// Range of a single payment, applies to every type except the closed one
+	if r.TrxType != VATrxTypeClosed && r.TrxType != "" {
+		if (minimum > 0 && amount < minimum) || (maximum > 0 && amount > maximum) {
+			return "", false, ErrInvalidAmount
+		}
+	}
+
+	switch r.TrxType {
+	case VATrxTypeClosed, "":
+		if amount != total {
+			return "", false, ErrInvalidAmount
+		}
+		return FormatAmount(amount), true, nil
+
+	case VATrxTypeOpen, VATrxTypeMinimum, VATrxTypeMaximum:
+		return FormatAmount(amount), true, nil
+
+	case VATrxTypePartial:
+		next := cumulative + amount
+		if reportedCumulative != "" {
+			// The bank and us have to agree on the installments paid so far
+			if reported, err := ParseAmount(reportedCumulative); err != nil || reported != next {
+				return "", false, ErrInvalidAmount
+			}
+		}
+		if next > total {
+			return "", false, ErrInvalidAmount
+		}
+		return FormatAmount(next), next == total, nil
+	}
+
+	return "", false, eris.Errorf("unknown virtual account trx type %s", r.TrxType)
+}
+
+// AdvertisedAmount returns the totalAmount sent in bill presentment: the remaining amount of a partial VA, the
+// minimum / maximum of a minimum / maximum VA and 0 for an open VA.
+func (r *VAAmountRule) AdvertisedAmount() string {
+	switch r.TrxType {
+	case VATrxTypeOpen:
+		return FormatAmount(0)
+	case VATrxTypeMinimum:
+		return r.Min
+	case VATrxTypeMaximum:
+		return r.Max
+	case VATrxTypePartial:
+		total, _ := ParseAmount(r.Total)
+		cumulative, _ := ParseAmount(r.Cumulative)
+		return FormatAmount(total - cumulative)
+	}
+
+	return r.Total
+}
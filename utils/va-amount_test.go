@@ -0,0 +1,69 @@
+package bank_integration_utils
+
+import (
+	"testing"
+)
+
+func TestParseAmount(t *testing.T) {
+	for value, expected := range map[string]int64{"": 0, "10000": 1000000, "10000.5": 1000050, "10000.05": 1000005} {
+		if cents, err := ParseAmount(value); err != nil || cents != expected {
+			t.Fatalf("parsing %q: expected %d, got %d (%v)", value, expected, cents, err)
+		}
+	}
+	if amount := FormatAmount(1000005); amount != "10000.05" {
+		t.Fatalf("unexpected formatted amount %s", amount)
+	}
+
+	for _, value := range []string{"10.001", "-1.00", "abc"} {
+		if _, err := ParseAmount(value); err == nil {
+			t.Fatalf("expected %q to be rejected", value)
+		}
+	}
+}
+
+func TestVAAmountRule(t *testing.T) {
+	cases := []struct {
+		name       string
+		rule       VAAmountRule
+		paid       string
+		reported   string
+		cumulative string
+		settled    bool
+		invalid    bool
+	}{
+		{name: "closed exact", rule: VAAmountRule{TrxType: VATrxTypeClosed, Total: "10000.00"}, paid: "10000.00", cumulative: "10000.00", settled: true},
+		{name: "closed less", rule: VAAmountRule{TrxType: VATrxTypeClosed, Total: "10000.00"}, paid: "5000.00", invalid: true},
+		{name: "open any", rule: VAAmountRule{TrxType: VATrxTypeOpen}, paid: "123.00", cumulative: "123.00", settled: true},
+		{name: "open out of range", rule: VAAmountRule{TrxType: VATrxTypeOpen, Min: "100.00", Max: "200.00"}, paid: "250.00", invalid: true},
+		{name: "minimum below", rule: VAAmountRule{TrxType: VATrxTypeMinimum, Min: "5000.00"}, paid: "4999.00", invalid: true},
+		{name: "maximum", rule: VAAmountRule{TrxType: VATrxTypeMaximum, Max: "5000.00"}, paid: "5000.00", cumulative: "5000.00", settled: true},
+		{name: "first installment", rule: VAAmountRule{TrxType: VATrxTypePartial, Total: "10000.00"}, paid: "4000.00", cumulative: "4000.00"},
+		{name: "last installment", rule: VAAmountRule{TrxType: VATrxTypePartial, Total: "10000.00", Cumulative: "4000.00"}, paid: "6000.00", cumulative: "10000.00", settled: true},
+		{name: "reported cumulative", rule: VAAmountRule{TrxType: VATrxTypePartial, Total: "10000.00", Cumulative: "4000.00"}, paid: "6000.00", reported: "10000.00", cumulative: "10000.00", settled: true},
+		{name: "reported cumulative ahead", rule: VAAmountRule{TrxType: VATrxTypePartial, Total: "10000.00"}, paid: "6000.00", reported: "10000.00", invalid: true},
+		{name: "reported cumulative behind", rule: VAAmountRule{TrxType: VATrxTypePartial, Total: "10000.00", Cumulative: "4000.00"}, paid: "3000.00", reported: "3000.00", invalid: true},
+		{name: "reported cumulative invalid", rule: VAAmountRule{TrxType: VATrxTypePartial, Total: "10000.00"}, paid: "3000.00", reported: "abc", invalid: true},
+		{name: "overpaid installment", rule: VAAmountRule{TrxType: VATrxTypePartial, Total: "10000.00", Cumulative: "8000.00"}, paid: "3000.00", invalid: true},
+		{name: "zero", rule: VAAmountRule{TrxType: VATrxTypeOpen}, paid: "0.00", invalid: true},
+	}
+
+	for _, c := range cases {
+		cumulative, settled, err := c.rule.Apply(c.paid, c.reported)
+		if c.invalid {
+			if err != ErrInvalidAmount {
+				t.Fatalf("%s: expected invalid amount, got %v", c.name, err)
+			}
+			continue
+		}
+		if err != nil || cumulative != c.cumulative || settled != c.settled {
+			t.Fatalf("%s: expected %s settled=%v, got %s settled=%v (%v)", c.name, c.cumulative, c.settled, cumulative, settled, err)
+		}
+	}
+}
+
+func TestVAAmountRuleAdvertisedAmount(t *testing.T) {
+	rule := VAAmountRule{TrxType: VATrxTypePartial, Total: "10000.00", Cumulative: "2500.00"}
+	if amount := rule.AdvertisedAmount(); amount != "7500.00" {
+		t.Fatalf("expected the remaining amount to be advertised, got %s", amount)
+	}
+}
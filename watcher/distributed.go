@@ -0,0 +1,334 @@
+package watcher
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	biConfig "github.com/voxtmault/bank-integration/config"
+	biModel "github.com/voxtmault/bank-integration/models"
+	biConst "github.com/voxtmault/bank-integration/utils"
+)
+
+// claimBatchSize is the maximum number of due transactions claimed at once by a replica
+const claimBatchSize = 100
+
+// claimScript moves the due transactions into the future by the lease duration, the transactions are therefore
+// claimed by a single replica and claimed again by another one when the lease runs out (e.g. the replica died)
+var claimScript = redis.NewScript(`
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[3])
+for _, member in ipairs(due) do
+	redis.call('ZADD', KEYS[1], 'XX', ARGV[2], member)
+end
+return due
+`)
+
+// distributed is the redis backend of the TransactionWatcher, shared by every replica serving the same bank
+type distributed struct {
+	rdb      *redis.Client
+	cfg      *biConfig.TransactionWatcherConfig
+	idBank   uint
+	bankName string
+
+	key         string // Sorted set of id transaction scored by the expiration time
+	attemptsKey string // Hash of id transaction to attempts
+	channel     string // Payment status changes
+
+	// External channels can not be shared between replicas, they are kept by the replica that created the watcher
+	// and notified through the pub/sub channel
+	externalChannels map[uint]chan uint
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+type statusMessage struct {
+	IDTransaction uint                    `json:"id_transaction"`
+	Status        biConst.VAPaymentStatus `json:"status"`
+}
+
+// NewDistributedTransactionWatcher returns a watcher keeping the watched transactions of a bank in redis. Every
+// replica may add watchers and receive payments, the expiration of a transaction is done by a single replica.
+// Call Start to begin expiring transactions and receiving the payment status of the other replicas.
+func NewDistributedTransactionWatcher(db *sql.DB, rdb *redis.Client, cfg *biConfig.TransactionWatcherConfig, idBank uint, bankName string) *TransactionWatcher {
+	key := fmt.Sprintf("%s:%d", biConst.TransactionWatcherRedis, idBank)
+
+	return &TransactionWatcher{
+		con:         db,
+		WatchedList: make(map[uint]*biModel.TransactionWatcher),
+		distributed: &distributed{
+			rdb:              rdb,
+			cfg:              cfg,
+			idBank:           idBank,
+			bankName:         bankName,
+			key:              key,
+			attemptsKey:      key + ":attempts",
+			channel:          key + ":events",
+			externalChannels: make(map[uint]chan uint),
+		},
+	}
+}
+
+// Start runs the claim loop and the payment status subscription until Stop is called. It is a no-op for the in
+// memory watcher, its timers are started by AddWatcher.
+func (s *TransactionWatcher) Start() {
+	if s.distributed == nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.distributed.cancel = cancel
+
+	// Subscribe before returning so that no status published after Start is missed
+	pubsub := s.distributed.rdb.Subscribe(ctx, s.distributed.channel)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		slog.Error("error subscribing to transaction watcher events", "error", err)
+	}
+
+	s.distributed.wg.Add(2)
+	go func() {
+		defer s.distributed.wg.Done()
+		defer pubsub.Close()
+		s.receiveStatus(ctx, pubsub.Channel())
+	}()
+	go func() {
+		defer s.distributed.wg.Done()
+		s.claimLoop(ctx)
+	}()
+}
+
+// Stop stops the claim loop and the payment status subscription, the watched transactions stay in redis
+func (s *TransactionWatcher) Stop() {
+	if s == nil || s.distributed == nil || s.distributed.cancel == nil {
+		return
+	}
+
+	s.distributed.cancel()
+	s.distributed.wg.Wait()
+}
+
+func (s *TransactionWatcher) addDistributed(watcher *biModel.TransactionWatcher) {
+	d := s.distributed
+	ctx := context.Background()
+
+	expireAt := watcher.ExpireAt
+	if time.Until(expireAt) < 0 {
+		slog.Warn("remaining time is less than 0, setting to 10 seconds into the future", "remaining time", time.Until(expireAt).String())
+		expireAt = time.Now().Add(time.Second * 10)
+	}
+
+	// NX keeps the expiration and the lease of a transaction already watched, every replica reloads the pending
+	// transactions on startup
+	added, err := d.rdb.ZAddNX(ctx, d.key, redis.Z{Score: float64(expireAt.UnixMilli()), Member: watcher.IDTransaction}).Result()
+	if err != nil {
+		slog.Error("error adding watcher", "transaction id", watcher.IDTransaction, "error", err)
+		return
+	}
+	if added == 0 {
+		slog.Warn("skipping transaction since it already exists in watcher list", "transaction id", watcher.IDTransaction)
+	}
+
+	if watcher.ExternalChannel != nil {
+		s.Lock()
+		d.externalChannels[watcher.IDTransaction] = watcher.ExternalChannel
+		s.Unlock()
+	}
+}
+
+func (s *TransactionWatcher) removeDistributed(id uint) {
+	d := s.distributed
+	ctx := context.Background()
+
+	if err := d.rdb.ZRem(ctx, d.key, id).Err(); err != nil {
+		slog.Error("error removing watcher", "transaction id", id, "error", err)
+	}
+	d.rdb.HDel(ctx, d.attemptsKey, strconv.FormatUint(uint64(id), 10))
+}
+
+func (s *TransactionWatcher) getDistributed(id uint) *biModel.TransactionWatcherPublic {
+	d := s.distributed
+	ctx := context.Background()
+
+	score, err := d.rdb.ZScore(ctx, d.key, strconv.FormatUint(uint64(id), 10)).Result()
+	if err != nil {
+		if err != redis.Nil {
+			slog.Error("error getting watcher", "transaction id", id, "error", err)
+		}
+		return nil
+	}
+
+	attempts, _ := d.rdb.HGet(ctx, d.attemptsKey, strconv.FormatUint(uint64(id), 10)).Uint64()
+
+	return s.toPublic(id, score, uint(attempts))
+}
+
+func (s *TransactionWatcher) getAllDistributed() []*biModel.TransactionWatcherPublic {
+	d := s.distributed
+	ctx := context.Background()
+
+	members, err := d.rdb.ZRangeWithScores(ctx, d.key, 0, -1).Result()
+	if err != nil {
+		slog.Error("error getting watchers", "error", err)
+		return nil
+	}
+	attempts, _ := d.rdb.HGetAll(ctx, d.attemptsKey).Result()
+
+	var watchers []*biModel.TransactionWatcherPublic
+	for _, member := range members {
+		id, err := strconv.ParseUint(fmt.Sprint(member.Member), 10, 64)
+		if err != nil {
+			continue
+		}
+		attempt, _ := strconv.ParseUint(attempts[fmt.Sprint(member.Member)], 10, 64)
+		watchers = append(watchers, s.toPublic(uint(id), member.Score, uint(attempt)))
+	}
+
+	return watchers
+}
+
+func (s *TransactionWatcher) toPublic(id uint, score float64, attempts uint) *biModel.TransactionWatcherPublic {
+	return (&biModel.TransactionWatcher{
+		IDTransaction: id,
+		IDBank:        s.distributed.idBank,
+		BankName:      s.distributed.bankName,
+		ExpireAt:      time.UnixMilli(int64(score)),
+		MaxRetry:      s.distributed.cfg.MaxRetry,
+		Attempts:      attempts,
+	}).ToPublic()
+}
+
+// statusDistributed stops watching the transaction and notifies every replica, the watcher log is only written
+// by the replica that removed the transaction
+func (s *TransactionWatcher) statusDistributed(idTransaction uint, status biConst.VAPaymentStatus) {
+	d := s.distributed
+	ctx := context.Background()
+
+	removed, err := d.rdb.ZRem(ctx, d.key, idTransaction).Result()
+	if err != nil {
+		slog.Error("error removing watcher", "transaction id", idTransaction, "error", err)
+	}
+	attempts, _ := d.rdb.HGet(ctx, d.attemptsKey, strconv.FormatUint(uint64(idTransaction), 10)).Uint64()
+	d.rdb.HDel(ctx, d.attemptsKey, strconv.FormatUint(uint64(idTransaction), 10))
+
+	if removed > 0 {
+		message := "transaction has been cancelled"
+		if status == biConst.VAStatusPaid {
+			message = "transaction has been paid"
+		}
+
+		slog.Info(message, "transaction id", idTransaction)
+		s.logWatcher(&biModel.TransactionWatcher{IDTransaction: idTransaction, Attempts: uint(attempts), MaxRetry: d.cfg.MaxRetry},
+			biConst.WatcherCancelled, message)
+	}
+
+	message, _ := json.Marshal(statusMessage{IDTransaction: idTransaction, Status: status})
+	if err := d.rdb.Publish(ctx, d.channel, message).Err(); err != nil {
+		slog.Error("error publishing payment status", "transaction id", idTransaction, "error", err)
+	}
+}
+
+func (s *TransactionWatcher) receiveStatus(ctx context.Context, messages <-chan *redis.Message) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case message, ok := <-messages:
+			if !ok {
+				return
+			}
+
+			var status statusMessage
+			if err := json.Unmarshal([]byte(message.Payload), &status); err != nil {
+				slog.Error("error decoding payment status", "payload", message.Payload, "error", err)
+				continue
+			}
+
+			s.Lock()
+			externalChannel, exists := s.distributed.externalChannels[status.IDTransaction]
+			delete(s.distributed.externalChannels, status.IDTransaction)
+			s.Unlock()
+
+			if exists {
+				slog.Info("payment status received", "transaction id", status.IDTransaction, "status", status.Status)
+				// Same as the in memory watcher, the importer is expected to receive the status
+				go func() {
+					externalChannel <- uint(status.Status)
+				}()
+			}
+		}
+	}
+}
+
+func (s *TransactionWatcher) claimLoop(ctx context.Context) {
+	ticker := time.NewTicker(s.distributed.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		s.ExpireDue(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ExpireDue claims the transactions whose expiration time has passed and expires them, it is called periodically
+// once the watcher is started. Only available in distributed mode.
+func (s *TransactionWatcher) ExpireDue(ctx context.Context) {
+	d := s.distributed
+	if d == nil {
+		return
+	}
+
+	now := time.Now()
+	claimed, err := claimScript.Run(ctx, d.rdb, []string{d.key},
+		now.UnixMilli(), now.Add(d.cfg.LeaseDuration).UnixMilli(), claimBatchSize).StringSlice()
+	if err != nil {
+		slog.Error("error claiming due transactions", "error", err)
+		return
+	}
+
+	for _, member := range claimed {
+		id, err := strconv.ParseUint(member, 10, 64)
+		if err != nil {
+			slog.Error("skipping invalid watched transaction", "member", member)
+			d.rdb.ZRem(ctx, d.key, member)
+			continue
+		}
+
+		attempts, err := d.rdb.HIncrBy(ctx, d.attemptsKey, member, 1).Result()
+		if err != nil {
+			slog.Error("error incrementing watcher attempts", "transaction id", id, "error", err)
+		}
+
+		w := &biModel.TransactionWatcher{
+			IDTransaction: uint(id),
+			IDBank:        d.idBank,
+			BankName:      d.bankName,
+			MaxRetry:      d.cfg.MaxRetry,
+			Attempts:      uint(attempts),
+		}
+
+		if err := s.expireFunc(w); err != nil {
+			slog.Error("error while expiring transaction", "error", err)
+			s.logWatcher(w, biConst.WatcherFailed, err.Error())
+
+			// Retried after the retry interval, by any replica
+			retryAt := time.Now().Add(d.cfg.DefaultRetryInterval)
+			d.rdb.ZAddXX(ctx, d.key, redis.Z{Score: float64(retryAt.UnixMilli()), Member: member})
+			continue
+		}
+
+		slog.Debug("successfully expired transaction")
+		s.logWatcher(w, biConst.WatcherSuccess, "watcher successfully run")
+		s.removeDistributed(uint(id))
+	}
+}
@@ -0,0 +1,142 @@
+package watcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	biConfig "github.com/voxtmault/bank-integration/config"
+	biModel "github.com/voxtmault/bank-integration/models"
+	biConst "github.com/voxtmault/bank-integration/utils"
+)
+
+var vaRequestColumns = []string{"id_va_status", "id", "id_bank", "virtualAccountNo", "id_transaction", "paidAmountValue",
+	"paidAmountCurrency", "totalAmountValue", "totalAmountCurrency"}
+
+func newReplicas(t *testing.T) (*TransactionWatcher, *TransactionWatcher, sqlmock.Sqlmock, *miniredis.Miniredis) {
+	t.Helper()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("creating sql mock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	server := miniredis.RunT(t)
+	cfg := &biConfig.TransactionWatcherConfig{
+		MaxRetry:             10,
+		DefaultRetryInterval: time.Minute,
+		LeaseDuration:        time.Minute,
+		PollInterval:         time.Hour, // ExpireDue is called by the tests
+	}
+
+	newReplica := func() *TransactionWatcher {
+		rdb := redis.NewClient(&redis.Options{Addr: server.Addr()})
+		t.Cleanup(func() { rdb.Close() })
+		return NewDistributedTransactionWatcher(db, rdb, cfg, 1, "BCA")
+	}
+
+	return newReplica(), newReplica(), mock, server
+}
+
+func TestDistributedWatcherExpiresOnce(t *testing.T) {
+	replicaA, replicaB, mock, server := newReplicas(t)
+
+	replicaA.AddWatcher(&biModel.TransactionWatcher{IDTransaction: 42, ExpireAt: time.Now().Add(20 * time.Millisecond)})
+	// Reloading the pending transactions on another replica does not add a second watcher
+	replicaB.AddWatcher(&biModel.TransactionWatcher{IDTransaction: 42, ExpireAt: time.Now().Add(time.Hour)})
+
+	if watchers := replicaB.GetWatchers(); len(watchers) != 1 || watchers[0].IDTransaction != 42 || watchers[0].IDBank != 1 {
+		t.Fatalf("expected the watcher to be visible from every replica, got %+v", watchers)
+	}
+
+	mock.ExpectQuery("SELECT id_va_status").WithArgs(42).
+		WillReturnRows(sqlmock.NewRows(vaRequestColumns).AddRow(biConst.VAStatusPending, 42, 1, "1234500001", 7, "0.00", "IDR", "10000.00", "IDR"))
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE va_request SET id_va_status").WithArgs(biConst.VAStatusExpired, 42).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO payment_event").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO transaction_watcher_log").WithArgs(42, biConst.WatcherSuccess, sqlmock.AnyArg(), 1, 10).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	time.Sleep(30 * time.Millisecond)
+	replicaA.ExpireDue(context.Background())
+	replicaB.ExpireDue(context.Background())
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+	if members, _ := server.ZMembers(replicaA.distributed.key); len(members) != 0 {
+		t.Fatalf("expected the expired transaction to be removed, got %v", members)
+	}
+}
+
+func TestDistributedWatcherRetriesFailedExpiration(t *testing.T) {
+	replicaA, _, mock, server := newReplicas(t)
+
+	replicaA.AddWatcher(&biModel.TransactionWatcher{IDTransaction: 42, ExpireAt: time.Now().Add(10 * time.Millisecond)})
+
+	mock.ExpectQuery("SELECT id_va_status").WithArgs(42).WillReturnError(context.DeadlineExceeded)
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO transaction_watcher_log").WithArgs(42, biConst.WatcherFailed, sqlmock.AnyArg(), 1, 10).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	time.Sleep(20 * time.Millisecond)
+	replicaA.ExpireDue(context.Background())
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rescheduled after the retry interval with the attempt recorded
+	watcher := replicaA.GetWatcher(42)
+	if watcher == nil || watcher.Attempts != 1 {
+		t.Fatalf("expected the transaction to be retried, got %+v", watcher)
+	}
+	score, _ := server.ZScore(replicaA.distributed.key, "42")
+	if retryAt := time.UnixMilli(int64(score)); time.Until(retryAt) < 50*time.Second {
+		t.Fatalf("expected the retry to be scheduled after the retry interval, got %s", retryAt)
+	}
+}
+
+func TestDistributedWatcherBroadcastsPayment(t *testing.T) {
+	replicaA, replicaB, mock, _ := newReplicas(t)
+
+	replicaA.Start()
+	defer replicaA.Stop()
+	replicaB.Start()
+	defer replicaB.Stop()
+
+	externalChannel := make(chan uint, 1)
+	replicaA.AddWatcher(&biModel.TransactionWatcher{IDTransaction: 42, ExpireAt: time.Now().Add(time.Hour), ExternalChannel: externalChannel})
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO transaction_watcher_log").WithArgs(42, biConst.WatcherCancelled, "transaction has been paid", 0, 10).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	// The payment flag is received by the other replica
+	replicaB.TransactionPaid(42)
+
+	select {
+	case status := <-externalChannel:
+		if status != uint(biConst.VAStatusPaid) {
+			t.Fatalf("unexpected status %d", status)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the replica owning the external channel to be notified")
+	}
+
+	if watcher := replicaA.GetWatcher(42); watcher != nil {
+		t.Fatalf("expected the paid transaction to be removed, got %+v", watcher)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,6 +1,7 @@
 package watcher
 
 import (
+	"context"
 	"database/sql"
 	"log/slog"
 	"sync"
@@ -8,19 +9,28 @@ import (
 
 	biConfig "github.com/voxtmault/bank-integration/config"
 	biModel "github.com/voxtmault/bank-integration/models"
+	biOutbox "github.com/voxtmault/bank-integration/outbox"
 	biStorage "github.com/voxtmault/bank-integration/storage"
 	biConst "github.com/voxtmault/bank-integration/utils"
 )
 
 type TransactionWatcher struct {
 	con         *sql.DB
-	WatchedList map[uint]*biModel.TransactionWatcher
+	WatchedList map[uint]*biModel.TransactionWatcher // Only used by the in memory watcher
 	sync.RWMutex
+
+	// Set when the watcher is created by NewDistributedTransactionWatcher
+	distributed *distributed
 }
 
 func NewTransactionWatcher() *TransactionWatcher {
+	return NewTransactionWatcherWithDB(biStorage.GetDBConnection())
+}
+
+// NewTransactionWatcherWithDB is NewTransactionWatcher using con instead of the connection opened by InitMariaDB
+func NewTransactionWatcherWithDB(con *sql.DB) *TransactionWatcher {
 	return &TransactionWatcher{
-		con:         biStorage.GetDBConnection(),
+		con:         con,
 		WatchedList: make(map[uint]*biModel.TransactionWatcher),
 	}
 }
@@ -29,19 +39,29 @@ func NewWatcher() *biModel.TransactionWatcher {
 	return &biModel.TransactionWatcher{
 		MaxRetry:      biConfig.GetConfig().TransactionWatcherConfig.MaxRetry,
 		ExpireAt:      time.Now().Add(biConfig.GetConfig().TransactionWatcherConfig.DefaultExpireTime),
-		PaymentStatus: make(chan biConst.VAPaymentStatus),
+		PaymentStatus: make(chan biConst.VAPaymentStatus, 1),
 	}
 }
 
 func (s *TransactionWatcher) AddWatcher(watcher *biModel.TransactionWatcher) {
+	if s.distributed != nil {
+		s.addDistributed(watcher)
+		return
+	}
+
 	s.Lock()
 
 	// Check for existing transaction ID
 	if _, ok := s.WatchedList[watcher.IDTransaction]; ok {
+		s.Unlock()
 		// Transaction already exists, skipping
 		slog.Warn("skipping transaction since it already exists in watcher list", "transaction id", watcher.IDTransaction)
 		return
 	}
+	// The statuses are handed to the watcher without blocking, see notify
+	if cap(watcher.PaymentStatus) == 0 {
+		watcher.PaymentStatus = make(chan biConst.VAPaymentStatus, 1)
+	}
 	s.WatchedList[watcher.IDTransaction] = watcher
 	s.Unlock()
 
@@ -59,6 +79,10 @@ func (s *TransactionWatcher) AddWatcher(watcher *biModel.TransactionWatcher) {
 		select {
 		// Wait till the timer expires
 		case <-w.Timer.C:
+			// Increment the attempt and remove from the watcher list
+			w.Attempts++
+			s.RemoveWatcher(w.IDTransaction)
+
 			if err := s.expireFunc(w); err != nil {
 				slog.Error("error while expiring transaction", "error", err)
 				watcher.ExpireAt = watcher.ExpireAt.Add(biConfig.GetConfig().TransactionWatcherConfig.DefaultRetryInterval)
@@ -88,8 +112,10 @@ func (s *TransactionWatcher) AddWatcher(watcher *biModel.TransactionWatcher) {
 				<-w.Timer.C // If an error occurs, drain the channel
 			}
 
-			// Notify external channel
-			w.ExternalChannel <- uint(paymentStatus)
+			// Notify external channel, kept for importers that did not move to the payment event outbox yet
+			if w.ExternalChannel != nil {
+				w.ExternalChannel <- uint(paymentStatus)
+			}
 
 			if paymentStatus == biConst.VAStatusPaid {
 				s.logWatcher(w, biConst.WatcherCancelled, "transaction has been paid")
@@ -107,24 +133,43 @@ func (s *TransactionWatcher) AddWatcher(watcher *biModel.TransactionWatcher) {
 }
 
 func (s *TransactionWatcher) RemoveWatcher(id uint) {
+	if s.distributed != nil {
+		s.removeDistributed(id)
+		return
+	}
+
 	s.Lock()
 	defer s.Unlock()
 	delete(s.WatchedList, id)
 }
 
 func (s *TransactionWatcher) GetWatcher(id uint) *biModel.TransactionWatcherPublic {
+	if s.distributed != nil {
+		return s.getDistributed(id)
+	}
+
 	return s.WatchedList[id].ToPublic()
 }
 
+// Deprecated: the notification is lost on restart or when another replica receives the payment flag. Subscribe to
+// the payment event dispatcher of the outbox package instead.
 func (s *TransactionWatcher) AddExternalChannelToWatched(trxId uint, externalChan chan uint) {
 	s.Lock()
 	defer s.Unlock()
+	if s.distributed != nil {
+		s.distributed.externalChannels[trxId] = externalChan
+		return
+	}
 	if watcher, exists := s.WatchedList[trxId]; exists {
 		watcher.ExternalChannel = externalChan
 	}
 }
 
 func (s *TransactionWatcher) GetWatchers() []*biModel.TransactionWatcherPublic {
+	if s.distributed != nil {
+		return s.getAllDistributed()
+	}
+
 	s.RLock()
 	defer s.RUnlock()
 	var watchers []*biModel.TransactionWatcherPublic
@@ -134,33 +179,68 @@ func (s *TransactionWatcher) GetWatchers() []*biModel.TransactionWatcherPublic {
 	return watchers
 }
 
+// TransactionPaid stops watching the transaction. In distributed mode the external channel is notified by the
+// replica that added the watcher.
 func (s *TransactionWatcher) TransactionPaid(idTransaction uint) {
-	s.Lock()
-	defer s.Unlock()
-	if watcher, exists := s.WatchedList[idTransaction]; exists {
+	if s.distributed != nil {
+		s.statusDistributed(idTransaction, biConst.VAStatusPaid)
+		return
+	}
+
+	if s.notify(idTransaction, biConst.VAStatusPaid) {
 		slog.Info("transaction has been paid", "transaction id", idTransaction)
-		watcher.PaymentStatus <- biConst.VAStatusPaid
 	}
 }
 
+// TransactionCancelled stops watching the transaction, the external channel is notified with VAStatusCancelled
+func (s *TransactionWatcher) TransactionCancelled(idTransaction uint) {
+	if s.distributed != nil {
+		s.statusDistributed(idTransaction, biConst.VAStatusCancelled)
+		return
+	}
+
+	if s.notify(idTransaction, biConst.VAStatusCancelled) {
+		slog.Info("transaction has been cancelled", "transaction id", idTransaction)
+	}
+}
+
+// notify hands the status to the goroutine of the watcher. The send is done without holding the lock, which the
+// goroutine needs to remove the watcher, and is dropped when the goroutine is not waiting anymore: the watcher is
+// then already expiring or handling another status. false is returned when the transaction is not watched.
+func (s *TransactionWatcher) notify(idTransaction uint, status biConst.VAPaymentStatus) bool {
+	s.RLock()
+	watcher, exists := s.WatchedList[idTransaction]
+	s.RUnlock()
+	if !exists {
+		return false
+	}
+
+	select {
+	case watcher.PaymentStatus <- status:
+	default:
+		slog.Warn("watcher is not waiting for a payment status, dropping it", "transaction id", idTransaction, "status", status)
+	}
+
+	return true
+}
+
 // expireFunc is only called when the ticker / timer of the watcher has expired, updating the said transaction status from
 // waiting to expired, before updating watcher will also check if the transaction has been completed or not, if it is
 // then do nothing.
 func (s *TransactionWatcher) expireFunc(obj *biModel.TransactionWatcher) error {
-	// Increment the attempt
-	obj.Attempts++
-
-	// Remove from the watcher list
-	s.RemoveWatcher(obj.IDTransaction)
-
 	// Check if the transaction has been completed
 	var transactionStatus uint
+	var event biModel.PaymentEvent
 	statement := `
-	SELECT id_va_status
+	SELECT id_va_status, id, id_bank, TRIM(virtualAccountNo), COALESCE(id_transaction, 0), paidAmountValue,
+		   paidAmountCurrency, totalAmountValue, totalAmountCurrency
 	FROM va_request
 	WHERE id = ?
 	`
-	if err := s.con.QueryRow(statement, obj.IDTransaction).Scan(&transactionStatus); err != nil {
+	if err := s.con.QueryRow(statement, obj.IDTransaction).Scan(&transactionStatus, &event.IDVARequest, &event.IDBank,
+		&event.VirtualAccountNo, &event.IDTransaction, &event.PaidAmount.Value, &event.PaidAmount.Currency,
+		&event.TotalAmount.Value, &event.TotalAmount.Currency,
+	); err != nil {
 		if err == sql.ErrNoRows {
 			slog.Info("transaction not found, killing watcher")
 			return nil
@@ -190,6 +270,12 @@ func (s *TransactionWatcher) expireFunc(obj *biModel.TransactionWatcher) error {
 		return err
 	}
 
+	event.EventType = biConst.PaymentEventVAExpired
+	if err = biOutbox.Record(context.Background(), tx, &event); err != nil {
+		tx.Rollback()
+		return err
+	}
+
 	if err = tx.Commit(); err != nil {
 		tx.Rollback()
 		return err
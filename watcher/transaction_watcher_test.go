@@ -0,0 +1,63 @@
+package watcher
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	biModel "github.com/voxtmault/bank-integration/models"
+	biConst "github.com/voxtmault/bank-integration/utils"
+)
+
+func TestTransactionCancelledWhileNotifying(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("creating sql mock: %v", err)
+	}
+	defer db.Close()
+
+	s := NewTransactionWatcherWithDB(db)
+	externalChannel := make(chan uint)
+	s.AddWatcher(&biModel.TransactionWatcher{
+		IDTransaction:   42,
+		ExpireAt:        time.Now().Add(time.Hour),
+		PaymentStatus:   make(chan biConst.VAPaymentStatus),
+		ExternalChannel: externalChannel,
+	})
+
+	// The goroutine of the watcher is stuck notifying the importer of the payment
+	s.TransactionPaid(42)
+
+	done := make(chan struct{})
+	go func() {
+		s.TransactionCancelled(42)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected TransactionCancelled not to wait for the watcher")
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO transaction_watcher_log").
+		WithArgs(42, biConst.WatcherCancelled, "transaction has been paid", 0, 0).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	if status := <-externalChannel; status != uint(biConst.VAStatusPaid) {
+		t.Fatalf("expected the importer to be notified of the payment, got %d", status)
+	}
+
+	// The watcher is removed once the payment is logged
+	deadline := time.Now().Add(time.Second)
+	for len(s.GetWatchers()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the watcher to be removed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
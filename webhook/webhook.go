@@ -0,0 +1,536 @@
+package bank_integration_webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rotisserie/eris"
+	bcaSecurity "github.com/voxtmault/bank-integration/bca/security"
+	biConfig "github.com/voxtmault/bank-integration/config"
+	biKeys "github.com/voxtmault/bank-integration/keys"
+	biModels "github.com/voxtmault/bank-integration/models"
+	biOutbox "github.com/voxtmault/bank-integration/outbox"
+	biUtil "github.com/voxtmault/bank-integration/utils"
+)
+
+const (
+	DefaultPollInterval = 5 * time.Second
+	DefaultBatchSize    = 50
+
+	// SubscriberName is the checkpoint key of the webhook fan-out in the payment event dispatcher
+	SubscriberName = "webhook"
+
+	// TimestampFormat is the format of the X-TIMESTAMP header sent with every delivery
+	TimestampFormat = time.RFC3339
+
+	// DefaultTimestampSkew is the clock skew accepted by Verify, a captured webhook cannot be replayed past it
+	DefaultTimestampSkew = 5 * time.Minute
+)
+
+// Service delivers the payment events to the registered merchant webhook endpoints. The events are fanned out
+// into webhook_delivery by the payment event dispatcher, see Subscriber, then posted by Run.
+//
+// Every delivery is a POST of the JSON encoded biModels.PaymentEvent, signed the same way SNAP signs the
+// symmetric requests (HMAC-SHA512, see bcaSecurity.SymmetricSignature) with the endpoint secret and an empty
+// access token. Receivers can check the signature with Verify.
+//
+// webhook_delivery holds the state of the delivery along with its last response, every attempt is recorded in
+// webhook_delivery_attempt.
+type Service struct {
+	db     *sql.DB
+	client *http.Client
+	cfg    *biConfig.WebhookConfig
+
+	// Secrets encrypts the endpoint secrets at rest, they are stored in plaintext when nil
+	Secrets *biKeys.Envelope
+
+	PollInterval time.Duration
+	BatchSize    int
+}
+
+func NewService(db *sql.DB, cfg *biConfig.WebhookConfig) *Service {
+	return &Service{
+		db:           db,
+		client:       &http.Client{Timeout: cfg.Timeout},
+		cfg:          cfg,
+		PollInterval: DefaultPollInterval,
+		BatchSize:    DefaultBatchSize,
+	}
+}
+
+// RegisterEndpoint stores a new webhook endpoint. A secret is generated when none is given, the stored secret is
+// set back into endpoint and must be shared with the receiver.
+func (s *Service) RegisterEndpoint(ctx context.Context, endpoint *biModels.WebhookEndpoint) error {
+	if err := biUtil.GetValidator().Struct(endpoint); err != nil {
+		return eris.Wrap(err, "validating webhook endpoint")
+	}
+
+	parsed, err := url.Parse(endpoint.URL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return eris.Errorf("invalid webhook url %s", endpoint.URL)
+	}
+
+	if endpoint.Secret == "" {
+		if endpoint.Secret, err = generateSecret(); err != nil {
+			return eris.Wrap(err, "generating webhook secret")
+		}
+	}
+
+	// The secret is bound to the url it signs for
+	secret, err := s.Secrets.Encrypt(ctx, endpoint.Secret, endpoint.URL)
+	if err != nil {
+		return eris.Wrap(err, "encrypting webhook secret")
+	}
+
+	eventTypes := make([]string, 0, len(endpoint.EventTypes))
+	for _, eventType := range endpoint.EventTypes {
+		eventTypes = append(eventTypes, string(eventType))
+	}
+
+	statement := `
+	INSERT INTO webhook_endpoint (id_bank, id_transaction, url, secret, event_types, active)
+	VALUES (?,?,?,?,?,1)
+	`
+	result, err := s.db.ExecContext(ctx, statement, endpoint.IDBank, endpoint.IDTransaction, endpoint.URL,
+		secret, strings.Join(eventTypes, ","))
+	if err != nil {
+		return eris.Wrap(err, "inserting webhook_endpoint")
+	}
+
+	if id, err := result.LastInsertId(); err == nil {
+		endpoint.ID = uint(id)
+	}
+	endpoint.Active = true
+
+	return nil
+}
+
+// ReencryptSecrets encrypts the endpoint secrets stored in plaintext, or with a previous master key, with the
+// primary master key and returns how many were rewritten
+func (s *Service) ReencryptSecrets(ctx context.Context) (int, error) {
+	if s.Secrets == nil {
+		return 0, eris.New("no master key configured")
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, eris.Wrap(err, "beginning transaction")
+	}
+	defer tx.Rollback()
+
+	type endpoint struct {
+		id     uint
+		url    string
+		secret string
+	}
+
+	rows, err := tx.QueryContext(ctx, `SELECT id, url, secret FROM webhook_endpoint FOR UPDATE`)
+	if err != nil {
+		return 0, eris.Wrap(err, "querying webhook_endpoint")
+	}
+
+	var endpoints []endpoint
+	for rows.Next() {
+		var obj endpoint
+		if err := rows.Scan(&obj.id, &obj.url, &obj.secret); err != nil {
+			rows.Close()
+			return 0, eris.Wrap(err, "scanning webhook_endpoint")
+		}
+
+		if s.Secrets.NeedsReencryption(obj.secret) {
+			endpoints = append(endpoints, obj)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, eris.Wrap(err, "iterating webhook_endpoint")
+	}
+
+	for _, obj := range endpoints {
+		secret, err := s.Secrets.Decrypt(ctx, obj.secret, obj.url)
+		if err != nil {
+			return 0, eris.Wrapf(err, "decrypting secret of webhook endpoint %d", obj.id)
+		}
+
+		encrypted, err := s.Secrets.Encrypt(ctx, secret, obj.url)
+		if err != nil {
+			return 0, eris.Wrapf(err, "encrypting secret of webhook endpoint %d", obj.id)
+		}
+
+		if _, err := tx.ExecContext(ctx, `UPDATE webhook_endpoint SET secret = ? WHERE id = ?`, encrypted, obj.id); err != nil {
+			return 0, eris.Wrap(err, "updating webhook_endpoint")
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, eris.Wrap(err, "committing webhook_endpoint")
+	}
+
+	return len(endpoints), nil
+}
+
+// DeactivateEndpoint stops the fan-out of new events to the endpoint, pending deliveries are still attempted
+func (s *Service) DeactivateEndpoint(ctx context.Context, id uint) error {
+	result, err := s.db.ExecContext(ctx, `UPDATE webhook_endpoint SET active = 0 WHERE id = ?`, id)
+	if err != nil {
+		return eris.Wrap(err, "updating webhook_endpoint")
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return eris.Errorf("webhook endpoint %d not found", id)
+	}
+
+	return nil
+}
+
+// Requeue moves a dead delivery back to pending, it is attempted again from the first backoff step
+func (s *Service) Requeue(ctx context.Context, id uint64) error {
+	statement := `
+	UPDATE webhook_delivery SET id_delivery_status = ?, attempts = 0, next_attempt_at = NOW()
+	WHERE id = ? AND id_delivery_status = ?
+	`
+	result, err := s.db.ExecContext(ctx, statement, biUtil.WebhookDeliveryPending, id, biUtil.WebhookDeliveryDead)
+	if err != nil {
+		return eris.Wrap(err, "updating webhook_delivery")
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return eris.Errorf("dead webhook delivery %d not found", id)
+	}
+
+	return nil
+}
+
+// Subscriber returns the payment event subscriber creating one delivery per matching endpoint. It should be
+// registered under SubscriberName:
+//
+//	dispatcher.Subscribe(bank_integration_webhook.SubscriberName, webhooks.Subscriber())
+func (s *Service) Subscriber() biOutbox.Subscriber {
+	return func(ctx context.Context, event *biModels.PaymentEvent) error {
+		statement := `
+		SELECT id, event_types
+		FROM webhook_endpoint
+		WHERE active = 1 AND id_bank IN (0, ?) AND id_transaction IN (0, ?)
+		`
+		rows, err := s.db.QueryContext(ctx, statement, event.IDBank, event.IDTransaction)
+		if err != nil {
+			return eris.Wrap(err, "querying webhook_endpoint")
+		}
+		defer rows.Close()
+
+		var endpoints []uint
+		for rows.Next() {
+			var id uint
+			var eventTypes string
+			if err := rows.Scan(&id, &eventTypes); err != nil {
+				return eris.Wrap(err, "scanning webhook_endpoint")
+			}
+
+			if eventTypes != "" && !slices.Contains(strings.Split(eventTypes, ","), string(event.EventType)) {
+				continue
+			}
+			endpoints = append(endpoints, id)
+		}
+		if err := rows.Err(); err != nil {
+			return eris.Wrap(err, "iterating webhook_endpoint")
+		}
+
+		// The event may be delivered more than once by the dispatcher, the unique key keeps a single delivery
+		statement = `INSERT IGNORE INTO webhook_delivery (id_webhook_endpoint, id_payment_event, id_delivery_status) VALUES (?,?,?)`
+		for _, id := range endpoints {
+			if _, err := s.db.ExecContext(ctx, statement, id, event.ID, biUtil.WebhookDeliveryPending); err != nil {
+				return eris.Wrap(err, "inserting webhook_delivery")
+			}
+		}
+
+		return nil
+	}
+}
+
+// Run delivers the due deliveries every PollInterval until ctx is cancelled
+func (s *Service) Run(ctx context.Context) error {
+	ticker := time.NewTicker(s.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			attempted, err := s.DeliverPending(ctx)
+			if err != nil {
+				slog.Error("error delivering webhooks", "error", err)
+				break
+			}
+			if attempted < s.BatchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+type delivery struct {
+	id       uint64
+	attempts uint
+	url      string
+	secret   string
+	event    biModels.PaymentEvent
+}
+
+// DeliverPending attempts a single batch of due deliveries and returns the number of attempted deliveries. A
+// failed attempt is not an error, it is rescheduled with an exponential backoff and moved to the dead-letter
+// state after MaxAttempts.
+func (s *Service) DeliverPending(ctx context.Context) (int, error) {
+	deliveries, err := s.claim(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	// The deliveries are posted outside of any transaction, a delivery whose result is not recorded is attempted
+	// again once its lease expires
+	for _, obj := range deliveries {
+		obj.attempts++
+		code, err := s.post(ctx, obj)
+
+		var reason string
+		if err != nil {
+			reason = err.Error()
+		}
+		statement := `
+		INSERT INTO webhook_delivery_attempt (id_webhook_delivery, attempt, response_code, error)
+		VALUES (?,?,?,?)
+		`
+		if _, err := s.db.ExecContext(ctx, statement, obj.id, obj.attempts, code, reason); err != nil {
+			return 0, eris.Wrap(err, "inserting webhook_delivery_attempt")
+		}
+
+		if err == nil {
+			statement = `
+			UPDATE webhook_delivery SET id_delivery_status = ?, attempts = ?, last_response_code = ?, last_error = ''
+			WHERE id = ? AND attempts = ?
+			`
+			if _, err := s.db.ExecContext(ctx, statement, biUtil.WebhookDeliveryDelivered, obj.attempts, code, obj.id,
+				obj.attempts-1); err != nil {
+				return 0, eris.Wrap(err, "updating webhook_delivery")
+			}
+			continue
+		}
+
+		status := biUtil.WebhookDeliveryPending
+		if obj.attempts >= s.cfg.MaxAttempts {
+			status = biUtil.WebhookDeliveryDead
+			slog.Warn("webhook delivery moved to dead-letter", "delivery", obj.id, "url", obj.url, "error", err)
+		}
+
+		statement = `
+		UPDATE webhook_delivery SET id_delivery_status = ?, attempts = ?, last_response_code = ?, last_error = ?,
+									next_attempt_at = NOW() + INTERVAL ? SECOND
+		WHERE id = ? AND attempts = ?
+		`
+		if _, err := s.db.ExecContext(ctx, statement, status, obj.attempts, code, reason,
+			int64(Backoff(s.cfg, obj.attempts).Seconds()), obj.id, obj.attempts-1); err != nil {
+			return 0, eris.Wrap(err, "updating webhook_delivery")
+		}
+	}
+
+	return len(deliveries), nil
+}
+
+// claim leases a batch of due deliveries: their next attempt is pushed past the time needed to post them, so the
+// other replicas skip them once the claim is committed
+func (s *Service) claim(ctx context.Context) ([]*delivery, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, eris.Wrap(err, "beginning transaction")
+	}
+	defer tx.Rollback()
+
+	// The rows are only locked until the claim is committed, other replicas wait and skip the claimed rows
+	statement := `
+	SELECT d.id, d.attempts, e.url, e.secret, p.id, p.id_bank, p.event_type, p.id_va_request, p.id_transaction,
+		   p.virtual_account_no, p.payment_request_id, p.paid_amount_value, p.paid_amount_currency,
+		   p.total_amount_value, p.total_amount_currency, p.created_at
+	FROM webhook_delivery d
+	JOIN webhook_endpoint e ON e.id = d.id_webhook_endpoint
+	JOIN payment_event p ON p.id = d.id_payment_event
+	WHERE d.id_delivery_status = ? AND d.next_attempt_at <= NOW()
+	ORDER BY d.id
+	LIMIT ?
+	FOR UPDATE
+	`
+	rows, err := tx.QueryContext(ctx, statement, biUtil.WebhookDeliveryPending, s.BatchSize)
+	if err != nil {
+		return nil, eris.Wrap(err, "querying webhook_delivery")
+	}
+
+	var deliveries []*delivery
+	for rows.Next() {
+		var obj delivery
+		if err := rows.Scan(&obj.id, &obj.attempts, &obj.url, &obj.secret, &obj.event.ID, &obj.event.IDBank,
+			&obj.event.EventType, &obj.event.IDVARequest, &obj.event.IDTransaction, &obj.event.VirtualAccountNo,
+			&obj.event.PaymentRequestID, &obj.event.PaidAmount.Value, &obj.event.PaidAmount.Currency,
+			&obj.event.TotalAmount.Value, &obj.event.TotalAmount.Currency, &obj.event.CreatedAt,
+		); err != nil {
+			rows.Close()
+			return nil, eris.Wrap(err, "scanning webhook_delivery")
+		}
+		deliveries = append(deliveries, &obj)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, eris.Wrap(err, "iterating webhook_delivery")
+	}
+
+	if len(deliveries) == 0 {
+		return nil, nil
+	}
+
+	// Every post of the batch may take up to the client timeout
+	lease := time.Duration(len(deliveries))*s.cfg.Timeout + time.Minute
+
+	ids := make([]any, 0, len(deliveries)+1)
+	ids = append(ids, int64(lease.Seconds()))
+	for _, obj := range deliveries {
+		ids = append(ids, obj.id)
+	}
+
+	statement = fmt.Sprintf(`UPDATE webhook_delivery SET next_attempt_at = NOW() + INTERVAL ? SECOND WHERE id IN (?%s)`,
+		strings.Repeat(",?", len(deliveries)-1))
+	if _, err := tx.ExecContext(ctx, statement, ids...); err != nil {
+		return nil, eris.Wrap(err, "leasing webhook_delivery")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, eris.Wrap(err, "committing webhook_delivery lease")
+	}
+
+	return deliveries, nil
+}
+
+// post sends a single attempt, any non 2xx response is a failed attempt
+func (s *Service) post(ctx context.Context, obj *delivery) (int, error) {
+	body, err := json.Marshal(obj.event)
+	if err != nil {
+		return 0, eris.Wrap(err, "marshalling payment event")
+	}
+
+	parsed, err := url.Parse(obj.url)
+	if err != nil {
+		return 0, eris.Wrap(err, "parsing webhook url")
+	}
+
+	secret, err := s.Secrets.Decrypt(ctx, obj.secret, obj.url)
+	if err != nil {
+		return 0, eris.Wrap(err, "decrypting webhook secret")
+	}
+
+	timeStamp := time.Now().Format(TimestampFormat)
+	signature, err := bcaSecurity.SymmetricSignature(secret, &biModels.SymmetricSignatureRequirement{
+		HTTPMethod:  http.MethodPost,
+		Timestamp:   timeStamp,
+		RequestBody: body,
+		RelativeURL: parsed.RequestURI(),
+	})
+	if err != nil {
+		return 0, eris.Wrap(err, "signing webhook")
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, obj.url, bytes.NewBuffer(body))
+	if err != nil {
+		return 0, eris.Wrap(err, "creating webhook request")
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-TIMESTAMP", timeStamp)
+	request.Header.Set("X-SIGNATURE", signature)
+	request.Header.Set("X-EVENT-ID", strconv.FormatUint(obj.event.ID, 10))
+	request.Header.Set("X-EVENT-TYPE", string(obj.event.EventType))
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		return 0, eris.Wrap(err, "posting webhook")
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 1<<16))
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("unexpected response status %d", response.StatusCode)
+	}
+
+	return response.StatusCode, nil
+}
+
+// Backoff returns the delay before the next attempt, doubled after every attempt and capped at MaxBackoff
+func Backoff(cfg *biConfig.WebhookConfig, attempts uint) time.Duration {
+	delay := cfg.InitialBackoff
+	for i := uint(1); i < attempts && delay < cfg.MaxBackoff; i++ {
+		delay *= 2
+	}
+
+	return min(delay, cfg.MaxBackoff)
+}
+
+// Verify checks the X-SIGNATURE header of a received webhook and returns its body, a webhook whose X-TIMESTAMP is
+// more than DefaultTimestampSkew away from our clock is rejected. The relative URL is taken from request.URL,
+// receivers behind a proxy rewriting the path must restore it before calling Verify.
+func Verify(secret string, request *http.Request) ([]byte, error) {
+	return VerifyWithin(secret, request, DefaultTimestampSkew)
+}
+
+// VerifyWithin is Verify accepting an X-TIMESTAMP within skew of our clock
+func VerifyWithin(secret string, request *http.Request, skew time.Duration) ([]byte, error) {
+	timeStamp, err := time.Parse(TimestampFormat, request.Header.Get("X-TIMESTAMP"))
+	if err != nil {
+		return nil, eris.Wrap(err, "parsing webhook timestamp")
+	}
+	if age := time.Since(timeStamp); age > skew || age < -skew {
+		return nil, eris.Errorf("webhook timestamp %s is outside of the accepted skew", timeStamp.Format(TimestampFormat))
+	}
+
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		return nil, eris.Wrap(err, "reading webhook body")
+	}
+	request.Body = io.NopCloser(bytes.NewBuffer(body))
+
+	expected, err := bcaSecurity.SymmetricSignature(secret, &biModels.SymmetricSignatureRequirement{
+		HTTPMethod:  request.Method,
+		Timestamp:   request.Header.Get("X-TIMESTAMP"),
+		RequestBody: body,
+		RelativeURL: request.URL.RequestURI(),
+	})
+	if err != nil {
+		return nil, eris.Wrap(err, "signing webhook")
+	}
+
+	if !hmac.Equal([]byte(expected), []byte(request.Header.Get("X-SIGNATURE"))) {
+		return nil, eris.New("invalid webhook signature")
+	}
+
+	return body, nil
+}
+
+func generateSecret() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(raw), nil
+}
@@ -0,0 +1,302 @@
+package bank_integration_webhook
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	bcaSecurity "github.com/voxtmault/bank-integration/bca/security"
+	biConfig "github.com/voxtmault/bank-integration/config"
+	biKeys "github.com/voxtmault/bank-integration/keys"
+	biModels "github.com/voxtmault/bank-integration/models"
+	biUtil "github.com/voxtmault/bank-integration/utils"
+)
+
+var deliveryColumns = []string{"id", "attempts", "url", "secret", "id", "id_bank", "event_type", "id_va_request",
+	"id_transaction", "virtual_account_no", "payment_request_id", "paid_amount_value", "paid_amount_currency",
+	"total_amount_value", "total_amount_currency", "created_at"}
+
+var testConfig = &biConfig.WebhookConfig{
+	MaxAttempts:    3,
+	InitialBackoff: 30 * time.Second,
+	MaxBackoff:     time.Minute,
+	Timeout:        time.Second,
+}
+
+func TestRegisterEndpoint(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("creating sql mock: %v", err)
+	}
+	defer db.Close()
+
+	var stored storedSecret
+	mock.ExpectExec("INSERT INTO webhook_endpoint").
+		WithArgs(1, 0, "https://merchant.example/hooks", &stored, "va.paid,va.expired").
+		WillReturnResult(sqlmock.NewResult(5, 1))
+
+	s := NewService(db, testConfig)
+	s.Secrets = testEnvelope()
+	endpoint := &biModels.WebhookEndpoint{
+		IDBank:     1,
+		URL:        "https://merchant.example/hooks",
+		EventTypes: []biUtil.PaymentEventType{biUtil.PaymentEventVAPaid, biUtil.PaymentEventVAExpired},
+	}
+	if err := s.RegisterEndpoint(context.Background(), endpoint); err != nil {
+		t.Fatalf("registering endpoint: %v", err)
+	}
+	if endpoint.ID != 5 || len(endpoint.Secret) != 64 || !endpoint.Active {
+		t.Fatalf("unexpected endpoint: %+v", endpoint)
+	}
+
+	// Only the encrypted secret is stored, bound to the endpoint url
+	if !biKeys.IsEncrypted(string(stored)) {
+		t.Fatalf("expected the secret to be stored encrypted, got %s", stored)
+	}
+	if secret, err := s.Secrets.Decrypt(context.Background(), string(stored), endpoint.URL); err != nil || secret != endpoint.Secret {
+		t.Fatalf("expected the stored secret to decrypt to the endpoint secret, got %s (%v)", secret, err)
+	}
+
+	if err := s.RegisterEndpoint(context.Background(), &biModels.WebhookEndpoint{URL: "ftp://merchant.example"}); err == nil {
+		t.Fatal("expected a non http url to be rejected")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReencryptSecrets(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("creating sql mock: %v", err)
+	}
+	defer db.Close()
+
+	s := NewService(db, testConfig)
+	s.Secrets = testEnvelope()
+	encrypted, _ := s.Secrets.Encrypt(context.Background(), "already-encrypted", "https://merchant.example/b")
+
+	var stored storedSecret
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, url, secret FROM webhook_endpoint").WillReturnRows(sqlmock.NewRows([]string{"id", "url", "secret"}).
+		AddRow(1, "https://merchant.example/a", "plaintext-secret").
+		AddRow(2, "https://merchant.example/b", encrypted))
+	mock.ExpectExec("UPDATE webhook_endpoint SET secret").WithArgs(&stored, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	count, err := s.ReencryptSecrets(context.Background())
+	if err != nil || count != 1 {
+		t.Fatalf("expected a single secret to be encrypted, got %d (%v)", count, err)
+	}
+	if secret, err := s.Secrets.Decrypt(context.Background(), string(stored), "https://merchant.example/a"); err != nil || secret != "plaintext-secret" {
+		t.Fatalf("expected the secret to be encrypted, got %s (%v)", secret, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSubscriberFansOutMatchingEndpoints(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("creating sql mock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT id, event_types FROM webhook_endpoint").WithArgs(1, 42).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "event_types"}).
+			AddRow(1, "").
+			AddRow(2, "va.expired").
+			AddRow(3, "va.paid,va.cancelled"))
+	mock.ExpectExec("INSERT IGNORE INTO webhook_delivery").WithArgs(1, 7, biUtil.WebhookDeliveryPending).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT IGNORE INTO webhook_delivery").WithArgs(3, 7, biUtil.WebhookDeliveryPending).
+		WillReturnResult(sqlmock.NewResult(2, 1))
+
+	s := NewService(db, testConfig)
+	event := &biModels.PaymentEvent{ID: 7, IDBank: 1, IDTransaction: 42, EventType: biUtil.PaymentEventVAPaid}
+	if err := s.Subscriber()(context.Background(), event); err != nil {
+		t.Fatalf("fanning out event: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeliverPending(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("creating sql mock: %v", err)
+	}
+	defer db.Close()
+
+	secret := "merchant-secret"
+	var received biModels.PaymentEvent
+	merchant := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/down" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, err := Verify(secret, r)
+		if err != nil {
+			t.Errorf("verifying webhook: %v", err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get("X-EVENT-ID") != "7" || r.Header.Get("X-EVENT-TYPE") != "va.paid" {
+			t.Errorf("unexpected event headers %v", r.Header)
+		}
+		json.Unmarshal(body, &received)
+	}))
+	defer merchant.Close()
+
+	// The secrets are stored encrypted, the ones stored before a master key was configured are still in plaintext
+	s := NewService(db, testConfig)
+	s.Secrets = testEnvelope()
+	encrypted, err := s.Secrets.Encrypt(context.Background(), secret, merchant.URL+"/hooks?tenant=1")
+	if err != nil {
+		t.Fatalf("encrypting secret: %v", err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT d.id, d.attempts, e.url").WithArgs(biUtil.WebhookDeliveryPending, DefaultBatchSize).
+		WillReturnRows(sqlmock.NewRows(deliveryColumns).
+			AddRow(1, 0, merchant.URL+"/hooks?tenant=1", encrypted, 7, 1, "va.paid", 9, 42, "1234500001", "req-1", "10000.00", "IDR", "10000.00", "IDR", "2024-10-18 10:00:00").
+			AddRow(2, 0, merchant.URL+"/down", secret, 7, 1, "va.paid", 9, 42, "1234500001", "req-1", "10000.00", "IDR", "10000.00", "IDR", "2024-10-18 10:00:00").
+			AddRow(3, 2, merchant.URL+"/down", secret, 7, 1, "va.paid", 9, 42, "1234500001", "req-1", "10000.00", "IDR", "10000.00", "IDR", "2024-10-18 10:00:00"))
+	// The batch is leased for the time needed to post it, the transaction is committed before posting
+	mock.ExpectExec("UPDATE webhook_delivery SET next_attempt_at").WithArgs(63, 1, 2, 3).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectCommit()
+	// Every attempt is recorded along with the state of the delivery
+	mock.ExpectExec("INSERT INTO webhook_delivery_attempt").WithArgs(1, 1, http.StatusOK, "").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("UPDATE webhook_delivery SET id_delivery_status").
+		WithArgs(biUtil.WebhookDeliveryDelivered, 1, http.StatusOK, 1, 0).WillReturnResult(sqlmock.NewResult(0, 1))
+	// A failed attempt is retried after the initial backoff
+	mock.ExpectExec("INSERT INTO webhook_delivery_attempt").WithArgs(2, 1, http.StatusServiceUnavailable, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(2, 1))
+	mock.ExpectExec("UPDATE webhook_delivery SET id_delivery_status").
+		WithArgs(biUtil.WebhookDeliveryPending, 1, http.StatusServiceUnavailable, sqlmock.AnyArg(), 30, 2, 0).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	// The last attempt moves the delivery to the dead-letter state
+	mock.ExpectExec("INSERT INTO webhook_delivery_attempt").WithArgs(3, 3, http.StatusServiceUnavailable, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(3, 1))
+	mock.ExpectExec("UPDATE webhook_delivery SET id_delivery_status").
+		WithArgs(biUtil.WebhookDeliveryDead, 3, http.StatusServiceUnavailable, sqlmock.AnyArg(), 60, 3, 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	attempted, err := s.DeliverPending(context.Background())
+	if err != nil {
+		t.Fatalf("delivering webhooks: %v", err)
+	}
+	if attempted != 3 {
+		t.Fatalf("expected 3 attempted deliveries, got %d", attempted)
+	}
+	if received.ID != 7 || received.TotalAmount.Value != "10000.00" || received.IDTransaction != 42 {
+		t.Fatalf("unexpected received event: %+v", received)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyRejectsInvalidSignature(t *testing.T) {
+	timeStamp := time.Now().Format(TimestampFormat)
+	request := httptest.NewRequest(http.MethodPost, "/hooks", nil)
+	request.Header.Set("X-TIMESTAMP", timeStamp)
+	request.Header.Set("X-SIGNATURE", "invalid")
+
+	if _, err := Verify("merchant-secret", request); err == nil {
+		t.Fatal("expected an invalid signature to be rejected")
+	}
+}
+
+func TestDeliverPendingNothingDue(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("creating sql mock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT d.id, d.attempts, e.url").WillReturnRows(sqlmock.NewRows(deliveryColumns))
+	mock.ExpectRollback()
+
+	attempted, err := NewService(db, testConfig).DeliverPending(context.Background())
+	if err != nil || attempted != 0 {
+		t.Fatalf("expected no attempted delivery, got %d (%v)", attempted, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyRejectsStaleTimestamp(t *testing.T) {
+	secret := "merchant-secret"
+	body := []byte(`{"id":7}`)
+
+	for _, test := range []struct {
+		name     string
+		age      time.Duration
+		accepted bool
+	}{
+		{"fresh", 0, true},
+		{"within skew", 4 * time.Minute, true},
+		{"replayed", 10 * time.Minute, false},
+		{"in the future", -10 * time.Minute, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			timeStamp := time.Now().Add(-test.age).Format(TimestampFormat)
+			signature, err := bcaSecurity.SymmetricSignature(secret, &biModels.SymmetricSignatureRequirement{
+				HTTPMethod:  http.MethodPost,
+				Timestamp:   timeStamp,
+				RequestBody: body,
+				RelativeURL: "/hooks",
+			})
+			if err != nil {
+				t.Fatalf("signing webhook: %v", err)
+			}
+
+			request := httptest.NewRequest(http.MethodPost, "/hooks", bytes.NewReader(body))
+			request.Header.Set("X-TIMESTAMP", timeStamp)
+			request.Header.Set("X-SIGNATURE", signature)
+
+			if _, err := Verify(secret, request); (err == nil) != test.accepted {
+				t.Fatalf("expected accepted %v, got %v", test.accepted, err)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	cfg := &biConfig.WebhookConfig{InitialBackoff: time.Second, MaxBackoff: 10 * time.Second}
+
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, want := range expected {
+		if got := Backoff(cfg, uint(i+1)); got != want {
+			t.Fatalf("attempt %d: expected %s, got %s", i+1, want, got)
+		}
+	}
+}
+
+func testEnvelope() *biKeys.Envelope {
+	key, _ := biKeys.NewStaticMasterKey("v1", bytes.Repeat([]byte{1}, 32))
+	return biKeys.NewEnvelope(key)
+}
+
+// storedSecret captures the secret written to webhook_endpoint
+type storedSecret string
+
+func (s *storedSecret) Match(value driver.Value) bool {
+	secret, ok := value.(string)
+	*s = storedSecret(secret)
+	return ok
+}